@@ -0,0 +1,262 @@
+package adapter
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"twitter_oracle/common"
+	"twitter_oracle/db"
+	"twitter_oracle/log"
+	"twitter_oracle/query"
+
+	"github.com/ethereum/go-ethereum/metrics"
+)
+
+// the tasks a job selects with data.endpoint
+const (
+	TweetExistsEndpoint   = "tweet-exists"
+	TweetAuthorEndpoint   = "tweet-author"
+	PublicMetricsEndpoint = "public-metrics"
+	QuoteCountEndpoint    = "quote-count"
+	UserQuotedEndpoint    = "user-quoted"
+)
+
+var RequestTimeout = time.Second * 30
+
+// Tweets answers the twitter questions, implemented by query.Querier
+type Tweets interface {
+	GetTweet(ctx context.Context, tweetId string) (common.TweetInfo, error)
+	CountQuotesSince(ctx context.Context, tweetId string, since time.Time) (int, error)
+	FindQuoteBy(ctx context.Context, tweetId string, authorId string, username string) (string, error)
+}
+
+// AddressResolver maps a linked wallet to its twitter account, implemented by db.DBService
+type AddressResolver interface {
+	GetTwitterIdByAddress(address string) (string, error)
+}
+
+// Request is what a chainlink node posts to an external adapter
+type Request struct {
+	Id   string                 `json:"id"`
+	Data map[string]interface{} `json:"data"`
+}
+
+type Error struct {
+	Name    string `json:"name"`
+	Message string `json:"message"`
+}
+
+// Response is the external adapter answer, result is what the job's jsonparse task reads
+type Response struct {
+	JobRunId   string                 `json:"jobRunID"`
+	Data       map[string]interface{} `json:"data,omitempty"`
+	Result     interface{}            `json:"result"`
+	Status     string                 `json:"status,omitempty"`
+	StatusCode int                    `json:"statusCode"`
+	Error      *Error                 `json:"error,omitempty"`
+}
+
+// Adapter serves chainlink jobs the twitter facts the oracle knows, so a node operator only
+// adds a bridge to it instead of writing glue code
+type Adapter struct {
+	tweets Tweets
+	users  AddressResolver
+}
+
+func New(tweets Tweets, users AddressResolver) *Adapter {
+	return &Adapter{tweets: tweets, users: users}
+}
+
+// ServeHTTP takes a Request body, ids and counts should be strings or are decoded as exact numbers
+func (a *Adapter) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	req := Request{}
+	decoder := json.NewDecoder(io.LimitReader(request.Body, 1024*1024))
+	decoder.UseNumber()
+	var resp Response
+	if err := decoder.Decode(&req); err != nil {
+		resp = errorResponse("", fmt.Errorf("%w: body: %v", InvalidParamError, err))
+	} else {
+		ctx, cancel := context.WithTimeout(request.Context(), RequestTimeout)
+		resp = a.Handle(ctx, req)
+		cancel()
+	}
+	metrics.GetOrRegisterCounter(fmt.Sprintf("adapter/status/%d", resp.StatusCode), nil).Inc(1)
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(resp.StatusCode)
+	b, _ := json.Marshal(resp)
+	if _, err := writer.Write(b); err != nil {
+		log.Error("write adapter response", err)
+	}
+}
+
+// Handle runs the task of req.Data["endpoint"]
+func (a *Adapter) Handle(ctx context.Context, req Request) Response {
+	endpoint, _ := req.Data["endpoint"].(string)
+	data, err := a.handle(ctx, endpoint, req.Data)
+	if err != nil {
+		log.Warn("adapter request error", err, "jobRunID", req.Id, "endpoint", endpoint)
+		return errorResponse(req.Id, err)
+	}
+	return Response{
+		JobRunId:   req.Id,
+		Data:       data,
+		Result:     data["result"],
+		StatusCode: http.StatusOK,
+	}
+}
+
+func (a *Adapter) handle(ctx context.Context, endpoint string, params map[string]interface{}) (map[string]interface{}, error) {
+	tweetId, err := idParam(params, "tweetId")
+	if err != nil {
+		return nil, err
+	}
+	switch endpoint {
+	case TweetExistsEndpoint:
+		_, err := a.tweets.GetTweet(ctx, tweetId)
+		if errors.Is(err, query.TweetNotFoundError) {
+			return map[string]interface{}{"result": false}, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"result": true}, nil
+	case TweetAuthorEndpoint:
+		tweet, err := a.tweets.GetTweet(ctx, tweetId)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"result": tweet.AuthorId, "authorId": tweet.AuthorId, "username": tweet.AuthorUsername}, nil
+	case PublicMetricsEndpoint:
+		tweet, err := a.tweets.GetTweet(ctx, tweetId)
+		if err != nil {
+			return nil, err
+		}
+		m := tweet.PublicMetric
+		data := map[string]interface{}{
+			"likes":    m.LikeCount,
+			"retweets": m.RetweetCount,
+			"quotes":   m.QuoteCount,
+			"replies":  m.ReplyCount,
+		}
+		//result is the metric the job asks for, likes by default
+		metric, _ := params["metric"].(string)
+		if metric == "" {
+			metric = "likes"
+		}
+		result, ok := data[metric]
+		if !ok {
+			return nil, fmt.Errorf("%w: metric %q", InvalidParamError, metric)
+		}
+		data["result"] = result
+		return data, nil
+	case QuoteCountEndpoint:
+		since, err := timeParam(params, "since")
+		if err != nil {
+			return nil, err
+		}
+		count, err := a.tweets.CountQuotesSince(ctx, tweetId, since)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"result": count, "since": since.Unix()}, nil
+	case UserQuotedEndpoint:
+		authorId, username, err := a.user(params)
+		if err != nil {
+			return nil, err
+		}
+		quoteId, err := a.tweets.FindQuoteBy(ctx, tweetId, authorId, username)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"result": quoteId != "", "quoteId": quoteId}, nil
+	}
+	return nil, fmt.Errorf("%w: %q", UnknownEndpointError, endpoint)
+}
+
+// user takes the quoting account from userId, username or the address it linked
+func (a *Adapter) user(params map[string]interface{}) (string, string, error) {
+	if _, ok := params["userId"]; ok {
+		userId, err := idParam(params, "userId")
+		return userId, "", err
+	}
+	if username, ok := params["username"].(string); ok && username != "" {
+		return "", strings.TrimPrefix(username, "@"), nil
+	}
+	address, ok := params["address"].(string)
+	if !ok || address == "" {
+		return "", "", fmt.Errorf("%w: userId, username or address", MissingParamError)
+	}
+	if a.users == nil {
+		return "", "", fmt.Errorf("%w: address lookup not available", InvalidParamError)
+	}
+	userId, err := a.users.GetTwitterIdByAddress(address)
+	return userId, "", err
+}
+
+// idParam reads a twitter id given as a string or an exact json number
+func idParam(params map[string]interface{}, name string) (string, error) {
+	var id string
+	switch v := params[name].(type) {
+	case nil:
+		return "", fmt.Errorf("%w: %v", MissingParamError, name)
+	case string:
+		id = v
+	case json.Number:
+		id = v.String()
+	default:
+		return "", fmt.Errorf("%w: %v", InvalidParamError, name)
+	}
+	if n, ok := new(big.Int).SetString(id, 10); !ok || n.Sign() <= 0 {
+		return "", fmt.Errorf("%w: %v %q", InvalidParamError, name, id)
+	}
+	return id, nil
+}
+
+// timeParam reads unix seconds or an RFC3339 time
+func timeParam(params map[string]interface{}, name string) (time.Time, error) {
+	var value string
+	switch v := params[name].(type) {
+	case nil:
+		return time.Time{}, fmt.Errorf("%w: %v", MissingParamError, name)
+	case string:
+		value = v
+	case json.Number:
+		value = v.String()
+	default:
+		return time.Time{}, fmt.Errorf("%w: %v", InvalidParamError, name)
+	}
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(seconds, 0), nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%w: %v %q", InvalidParamError, name, value)
+	}
+	return t, nil
+}
+
+func errorResponse(jobRunId string, err error) Response {
+	resp := Response{
+		JobRunId:   jobRunId,
+		Status:     "errored",
+		StatusCode: http.StatusInternalServerError,
+		Error:      &Error{Name: "AdapterError", Message: err.Error()},
+	}
+	switch {
+	case errors.Is(err, UnknownEndpointError), errors.Is(err, MissingParamError), errors.Is(err, InvalidParamError),
+		errors.Is(err, db.AddressNotLinkedError):
+		resp.StatusCode = http.StatusBadRequest
+		resp.Error.Name = "AdapterInputError"
+	case errors.Is(err, query.TweetNotFoundError):
+		resp.StatusCode = http.StatusNotFound
+		resp.Error.Name = "AdapterDataProviderError"
+	}
+	return resp
+}
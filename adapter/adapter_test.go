@@ -0,0 +1,114 @@
+package adapter
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"twitter_oracle/db"
+	"twitter_oracle/query"
+	"twitter_oracle/twclient"
+
+	twitter "github.com/g8rswimmer/go-twitter/v2"
+)
+
+type memResolver map[string]string
+
+func (m memResolver) GetTwitterIdByAddress(address string) (string, error) {
+	if id, ok := m[strings.ToLower(address)]; ok {
+		return id, nil
+	}
+	return "", fmt.Errorf("%w: %v", db.AddressNotLinkedError, address)
+}
+
+func newTestAdapter() *Adapter {
+	fake := twclient.NewFake()
+	fake.AddUser(&twitter.UserObj{ID: "100", Name: "Ninox", UserName: "ninox2022"})
+	fake.AddUser(&twitter.UserObj{ID: "101", Name: "Hug", UserName: "HugFan"})
+	fake.AddTweet(&twitter.TweetObj{
+		ID:            "1593857112829136897",
+		AuthorID:      "100",
+		Text:          "#HugMe event",
+		CreatedAt:     "2022-11-15T08:00:00.000Z",
+		PublicMetrics: &twitter.TweetMetricsObj{Likes: 7, Retweets: 3, Quotes: 3, Replies: 1},
+	})
+	//quotes an hour apart, 1001 by @HugFan is the oldest
+	for i := 1; i <= 3; i++ {
+		id := fmt.Sprintf("100%d", i)
+		author := "100"
+		if i == 1 {
+			author = "101"
+		}
+		fake.AddTweet(&twitter.TweetObj{ID: id, AuthorID: author, Text: "quote", CreatedAt: fmt.Sprintf("2022-11-15T1%d:00:00.000Z", i)})
+		fake.AddQuote("1593857112829136897", id)
+	}
+	users := memResolver{"0x000000000000000000000000000000000000dead": "101"}
+	return New(query.Init(nil, 0, fake), users)
+}
+
+func post(t *testing.T, a *Adapter, body string) (int, Response) {
+	recorder := httptest.NewRecorder()
+	a.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/adapter", strings.NewReader(body)))
+	resp := Response{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("%v: %s", err, recorder.Body)
+	}
+	if resp.StatusCode != recorder.Code {
+		t.Fatalf("statusCode %d, http %d", resp.StatusCode, recorder.Code)
+	}
+	return recorder.Code, resp
+}
+
+func TestEndpoints(t *testing.T) {
+	a := newTestAdapter()
+	tests := []struct {
+		data   string
+		result interface{}
+	}{
+		//an id as a json number stays exact
+		{`{"endpoint":"tweet-exists","tweetId":1593857112829136897}`, true},
+		{`{"endpoint":"tweet-exists","tweetId":"42"}`, false},
+		{`{"endpoint":"tweet-author","tweetId":"1593857112829136897"}`, "100"},
+		{`{"endpoint":"public-metrics","tweetId":"1593857112829136897"}`, float64(7)},
+		{`{"endpoint":"public-metrics","tweetId":"1593857112829136897","metric":"replies"}`, float64(1)},
+		{`{"endpoint":"quote-count","tweetId":"1593857112829136897","since":"2022-11-15T11:30:00Z"}`, float64(2)},
+		{`{"endpoint":"quote-count","tweetId":"1593857112829136897","since":1668470400}`, float64(3)},
+		{`{"endpoint":"user-quoted","tweetId":"1593857112829136897","username":"@hugfan"}`, true},
+		{`{"endpoint":"user-quoted","tweetId":"1593857112829136897","userId":"102"}`, false},
+		{`{"endpoint":"user-quoted","tweetId":"1593857112829136897","address":"0x000000000000000000000000000000000000dEaD"}`, true},
+	}
+	for _, test := range tests {
+		code, resp := post(t, a, `{"id":"job-1","data":`+test.data+`}`)
+		if code != http.StatusOK || resp.JobRunId != "job-1" || resp.Result != test.result || resp.Data["result"] != test.result {
+			t.Fatalf("%v: %d %+v", test.data, code, resp)
+		}
+	}
+	_, resp := post(t, a, `{"id":"job-2","data":{"endpoint":"tweet-author","tweetId":"1593857112829136897"}}`)
+	if resp.Data["username"] != "ninox2022" {
+		t.Fatalf("data %+v", resp.Data)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	a := newTestAdapter()
+	tests := []struct {
+		body string
+		code int
+	}{
+		{`{"id":"job-1","data":{"endpoint":"tweet-exists"}}`, http.StatusBadRequest},
+		{`{"id":"job-1","data":{"endpoint":"retweeted","tweetId":"1"}}`, http.StatusBadRequest},
+		{`{"id":"job-1","data":{"endpoint":"public-metrics","tweetId":"1593857112829136897","metric":"views"}}`, http.StatusBadRequest},
+		{`{"id":"job-1","data":{"endpoint":"quote-count","tweetId":"1593857112829136897","since":"yesterday"}}`, http.StatusBadRequest},
+		{`{"id":"job-1","data":{"endpoint":"user-quoted","tweetId":"1593857112829136897","address":"0x1"}}`, http.StatusBadRequest},
+		{`{"id":"job-1","data":{"endpoint":"tweet-author","tweetId":"42"}}`, http.StatusNotFound},
+		{`not json`, http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		code, resp := post(t, a, test.body)
+		if code != test.code || resp.Status != "errored" || resp.Error == nil || resp.Result != nil {
+			t.Fatalf("%v: %d %+v", test.body, code, resp)
+		}
+	}
+}
@@ -0,0 +1,9 @@
+package adapter
+
+import "errors"
+
+var (
+	UnknownEndpointError = errors.New("unknown endpoint")
+	MissingParamError    = errors.New("missing parameter")
+	InvalidParamError    = errors.New("invalid parameter")
+)
@@ -0,0 +1,189 @@
+package attest
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"fmt"
+	"time"
+	"twitter_oracle/common"
+	"twitter_oracle/log"
+
+	ethcommon "github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/metrics"
+)
+
+var DefaultEpochInterval = time.Hour
+
+var (
+	recordedCounter = metrics.NewRegisteredCounter("attest/recorded", nil)
+	sealedCounter   = metrics.NewRegisteredCounter("attest/sealed", nil)
+)
+
+// Store keeps records until their epoch is sealed and the signed epochs with every leaf's proof,
+// implemented by db.DBService
+type Store interface {
+	PutAttestationRecord(record common.AttestationRecord) error
+	GetUnsealedAttestationRecords() ([]common.AttestationRecord, error)
+	GetLastAttestationEpoch() (int64, error)
+	// SealAttestationEpoch writes the epoch and places its records, in one transaction
+	SealAttestationEpoch(epoch common.AttestationEpochInfo, leaves []common.AttestationLeafInfo) error
+	GetAttestationProofs(tweetId string) ([]common.AttestationProofInfo, error)
+}
+
+// Attester batches the thoughts, quotes and metrics we record into epochs. Each epoch is a merkle
+// tree of the records' leaves whose root is signed into the epoch log instead of one transaction
+// per tweet, a proof then shows a record is part of a signed root
+type Attester struct {
+	//Interval between two epochs, an epoch without records is not sealed
+	Interval time.Duration
+	store    Store
+	key      *ecdsa.PrivateKey
+	signer   ethcommon.Address
+}
+
+func NewAttester(store Store, key *ecdsa.PrivateKey) *Attester {
+	return &Attester{
+		Interval: DefaultEpochInterval,
+		store:    store,
+		key:      key,
+		signer:   crypto.PubkeyToAddress(key.PublicKey),
+	}
+}
+
+// Record keeps record for the next epoch, records that can not become a leaf are refused here
+func (a *Attester) Record(record common.AttestationRecord) error {
+	if _, err := Leaf(record); err != nil {
+		return err
+	}
+	if err := a.store.PutAttestationRecord(record); err != nil {
+		return err
+	}
+	recordedCounter.Inc(1)
+	return nil
+}
+
+// Start seals an epoch every Interval until ctx is done
+func (a *Attester) Start(ctx context.Context) error {
+	ticker := time.NewTicker(a.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			if _, err := a.Seal(); err != nil {
+				log.Error("seal attestation epoch", err)
+			}
+		}
+	}
+}
+
+// Seal builds the tree of the unsealed records, signs its root and stores the epoch with the
+// proof of each record. It returns an epoch with Count 0 when there was nothing to seal
+func (a *Attester) Seal() (common.AttestationEpochInfo, error) {
+	records, err := a.store.GetUnsealedAttestationRecords()
+	if err != nil || len(records) == 0 {
+		return common.AttestationEpochInfo{}, err
+	}
+	hashes := make([]ethcommon.Hash, len(records))
+	for i, record := range records {
+		if hashes[i], err = Leaf(record); err != nil {
+			return common.AttestationEpochInfo{}, fmt.Errorf("record %v: %w", record.Id, err)
+		}
+	}
+	tree := NewTree(hashes)
+	last, err := a.store.GetLastAttestationEpoch()
+	if err != nil {
+		return common.AttestationEpochInfo{}, err
+	}
+	epoch := common.AttestationEpochInfo{
+		Epoch:     last + 1,
+		Root:      tree.Root().Hex(),
+		Count:     len(records),
+		Signer:    a.signer.Hex(),
+		CreatedAt: time.Now(),
+	}
+	hash, err := EpochHash(epoch.Epoch, tree.Root())
+	if err != nil {
+		return common.AttestationEpochInfo{}, err
+	}
+	signature, err := crypto.Sign(hash, a.key)
+	if err != nil {
+		return common.AttestationEpochInfo{}, err
+	}
+	//as ecrecover and wallets expect v
+	signature[crypto.RecoveryIDOffset] += 27
+	epoch.Signature = hexutil.Encode(signature)
+
+	leaves := make([]common.AttestationLeafInfo, len(records))
+	for i, record := range records {
+		proof := tree.Proof(i)
+		leaves[i] = common.AttestationLeafInfo{
+			RecordId: record.Id,
+			Index:    i,
+			Leaf:     hashes[i].Hex(),
+			Proof:    make([]string, len(proof)),
+		}
+		for j, sibling := range proof {
+			leaves[i].Proof[j] = sibling.Hex()
+		}
+	}
+	if err := a.store.SealAttestationEpoch(epoch, leaves); err != nil {
+		return common.AttestationEpochInfo{}, err
+	}
+	sealedCounter.Inc(1)
+	log.Info("attestation epoch sealed", epoch.Epoch, "root", epoch.Root, "records", epoch.Count)
+	return epoch, nil
+}
+
+// Proofs returns every sealed record of tweetId with its inclusion proof, a thought is sealed
+// once while the metrics of an event tweet are in each epoch they were polled in
+func (a *Attester) Proofs(tweetId string) ([]common.AttestationProofInfo, error) {
+	proofs, err := a.store.GetAttestationProofs(tweetId)
+	if err != nil {
+		return nil, err
+	}
+	if len(proofs) == 0 {
+		return nil, fmt.Errorf("%w: %v", NoAttestationError, tweetId)
+	}
+	return proofs, nil
+}
+
+// VerifyAttestation checks a proof the way a third party would: the record hashes to the leaf,
+// the leaf folds into the root and the root of the epoch is signed by signer
+func VerifyAttestation(proof common.AttestationProofInfo, signer ethcommon.Address) error {
+	leaf, err := Leaf(proof.Record)
+	if err != nil {
+		return err
+	}
+	if leaf.Hex() != proof.Leaf {
+		return fmt.Errorf("%w: record does not hash to the leaf", InvalidProofError)
+	}
+	siblings := make([]ethcommon.Hash, len(proof.Proof))
+	for i, sibling := range proof.Proof {
+		siblings[i] = ethcommon.HexToHash(sibling)
+	}
+	root := ethcommon.HexToHash(proof.Root)
+	if !VerifyProof(leaf, siblings, root) {
+		return fmt.Errorf("%w: leaf not in root", InvalidProofError)
+	}
+	hash, err := EpochHash(proof.Epoch, root)
+	if err != nil {
+		return err
+	}
+	signature, err := hexutil.Decode(proof.Signature)
+	if err != nil || len(signature) != crypto.SignatureLength {
+		return fmt.Errorf("%w: malformed signature", InvalidProofError)
+	}
+	signature[crypto.RecoveryIDOffset] -= 27
+	pub, err := crypto.SigToPub(hash, signature)
+	if err != nil {
+		return fmt.Errorf("%w: %v", InvalidProofError, err)
+	}
+	if crypto.PubkeyToAddress(*pub) != signer {
+		return fmt.Errorf("%w: root not signed by %v", InvalidProofError, signer)
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+package attest
+
+import (
+	"errors"
+	"testing"
+	"time"
+	"twitter_oracle/common"
+
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+type memStore struct {
+	records []common.AttestationRecord
+	epochs  []common.AttestationEpochInfo
+	leaves  map[int64]common.AttestationLeafInfo
+	sealed  map[int64]int64
+}
+
+func newMemStore() *memStore {
+	return &memStore{leaves: make(map[int64]common.AttestationLeafInfo), sealed: make(map[int64]int64)}
+}
+
+func (m *memStore) PutAttestationRecord(record common.AttestationRecord) error {
+	for _, r := range m.records {
+		if record.Kind != MetricsRecord && r.Kind == record.Kind && r.TweetId == record.TweetId {
+			return nil
+		}
+	}
+	record.Id = int64(len(m.records) + 1)
+	record.RecordedAt = time.Unix(record.RecordedAt.Unix(), 0)
+	m.records = append(m.records, record)
+	return nil
+}
+
+func (m *memStore) GetUnsealedAttestationRecords() ([]common.AttestationRecord, error) {
+	records := make([]common.AttestationRecord, 0)
+	for _, r := range m.records {
+		if _, ok := m.sealed[r.Id]; !ok {
+			records = append(records, r)
+		}
+	}
+	return records, nil
+}
+
+func (m *memStore) GetLastAttestationEpoch() (int64, error) {
+	return int64(len(m.epochs)), nil
+}
+
+func (m *memStore) SealAttestationEpoch(epoch common.AttestationEpochInfo, leaves []common.AttestationLeafInfo) error {
+	m.epochs = append(m.epochs, epoch)
+	for _, leaf := range leaves {
+		m.leaves[leaf.RecordId] = leaf
+		m.sealed[leaf.RecordId] = epoch.Epoch
+	}
+	return nil
+}
+
+func (m *memStore) GetAttestationProofs(tweetId string) ([]common.AttestationProofInfo, error) {
+	proofs := make([]common.AttestationProofInfo, 0)
+	for _, r := range m.records {
+		epoch, ok := m.sealed[r.Id]
+		if r.TweetId != tweetId || !ok {
+			continue
+		}
+		proofs = append(proofs, common.AttestationProofInfo{
+			AttestationEpochInfo: m.epochs[epoch-1],
+			AttestationLeafInfo:  m.leaves[r.Id],
+			Record:               r,
+		})
+	}
+	return proofs, nil
+}
+
+func TestSealAndProve(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	signer := crypto.PubkeyToAddress(key.PublicKey)
+	store := newMemStore()
+	attester := NewAttester(store, key)
+	created := time.Date(2022, 11, 15, 8, 0, 0, 0, time.UTC)
+
+	records := []common.AttestationRecord{
+		{Kind: ThoughtRecord, TweetId: "1593857112829136897", AuthorId: "100", AuthorName: "ninox2022", Text: "#HugMe gm", RecordedAt: created},
+		{Kind: QuoteRecord, TweetId: "1593857112829136898", AuthorId: "101", Text: "quoted", RecordedAt: created},
+		{Kind: MetricsRecord, TweetId: "1000", Metrics: common.TweetPublicMetricInfo{LikeCount: 7, QuoteCount: 1}, RecordedAt: created},
+		//a redelivered thought is recorded once
+		{Kind: ThoughtRecord, TweetId: "1593857112829136897", AuthorId: "100", AuthorName: "ninox2022", Text: "#HugMe gm", RecordedAt: created},
+	}
+	for _, record := range records {
+		if err := attester.Record(record); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := attester.Record(common.AttestationRecord{Kind: "like", TweetId: "1"}); !errors.Is(err, UnknownKindError) {
+		t.Fatalf("kind err %v", err)
+	}
+	if err := attester.Record(common.AttestationRecord{Kind: QuoteRecord, TweetId: "@ninox"}); !errors.Is(err, InvalidRecordError) {
+		t.Fatalf("id err %v", err)
+	}
+
+	epoch, err := attester.Seal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if epoch.Epoch != 1 || epoch.Count != 3 || epoch.Signer != signer.Hex() {
+		t.Fatalf("epoch %+v", epoch)
+	}
+	if epoch, err = attester.Seal(); err != nil || epoch.Count != 0 {
+		t.Fatalf("empty seal %+v %v", epoch, err)
+	}
+
+	//metrics polled again land in the next epoch
+	if err = attester.Record(records[2]); err != nil {
+		t.Fatal(err)
+	}
+	if epoch, err = attester.Seal(); err != nil || epoch.Epoch != 2 || epoch.Count != 1 {
+		t.Fatalf("second epoch %+v %v", epoch, err)
+	}
+
+	proofs, err := attester.Proofs("1593857112829136897")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(proofs) != 1 || proofs[0].Record.Text != "#HugMe gm" || proofs[0].Index != 0 {
+		t.Fatalf("proofs %+v", proofs)
+	}
+	if err = VerifyAttestation(proofs[0], signer); err != nil {
+		t.Fatal(err)
+	}
+	metrics, err := attester.Proofs("1000")
+	if err != nil || len(metrics) != 2 || metrics[1].Epoch != 2 {
+		t.Fatalf("metrics proofs %+v %v", metrics, err)
+	}
+	for _, proof := range metrics {
+		if err = VerifyAttestation(proof, signer); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tampered := proofs[0]
+	tampered.Record.Text = "#HugMe gn"
+	if err = VerifyAttestation(tampered, signer); !errors.Is(err, InvalidProofError) {
+		t.Fatalf("tampered err %v", err)
+	}
+	other, _ := crypto.GenerateKey()
+	if err = VerifyAttestation(proofs[0], crypto.PubkeyToAddress(other.PublicKey)); !errors.Is(err, InvalidProofError) {
+		t.Fatalf("signer err %v", err)
+	}
+	if _, err = attester.Proofs("42"); !errors.Is(err, NoAttestationError) {
+		t.Fatalf("missing err %v", err)
+	}
+}
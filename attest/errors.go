@@ -0,0 +1,10 @@
+package attest
+
+import "errors"
+
+var (
+	UnknownKindError   = errors.New("unknown attestation record kind")
+	InvalidRecordError = errors.New("attestation record field is not a number")
+	NoAttestationError = errors.New("tweet not in any sealed epoch")
+	InvalidProofError  = errors.New("attestation proof invalid")
+)
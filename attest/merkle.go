@@ -0,0 +1,71 @@
+package attest
+
+import (
+	"bytes"
+
+	ethcommon "github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// Tree is a merkle tree whose pairs are hashed in sorted order, the layout OpenZeppelin's
+// MerkleProof.verify checks, so a proof is only the sibling hashes bottom up. The last node of
+// an odd layer moves up unpaired
+type Tree struct {
+	layers [][]ethcommon.Hash
+}
+
+func NewTree(leaves []ethcommon.Hash) *Tree {
+	layer := append([]ethcommon.Hash(nil), leaves...)
+	t := &Tree{layers: [][]ethcommon.Hash{layer}}
+	for len(layer) > 1 {
+		next := make([]ethcommon.Hash, 0, (len(layer)+1)/2)
+		for i := 0; i < len(layer); i += 2 {
+			if i+1 == len(layer) {
+				next = append(next, layer[i])
+				continue
+			}
+			next = append(next, hashPair(layer[i], layer[i+1]))
+		}
+		t.layers = append(t.layers, next)
+		layer = next
+	}
+	return t
+}
+
+// Root is the zero hash for a tree without leaves
+func (t *Tree) Root() ethcommon.Hash {
+	top := t.layers[len(t.layers)-1]
+	if len(top) == 0 {
+		return ethcommon.Hash{}
+	}
+	return top[0]
+}
+
+// Proof returns the siblings from leaf index up to the root
+func (t *Tree) Proof(index int) []ethcommon.Hash {
+	proof := make([]ethcommon.Hash, 0, len(t.layers))
+	for _, layer := range t.layers[:len(t.layers)-1] {
+		sibling := index ^ 1
+		if sibling < len(layer) {
+			proof = append(proof, layer[sibling])
+		}
+		index /= 2
+	}
+	return proof
+}
+
+// VerifyProof folds proof into leaf and compares with root
+func VerifyProof(leaf ethcommon.Hash, proof []ethcommon.Hash, root ethcommon.Hash) bool {
+	hash := leaf
+	for _, sibling := range proof {
+		hash = hashPair(hash, sibling)
+	}
+	return hash == root
+}
+
+func hashPair(a, b ethcommon.Hash) ethcommon.Hash {
+	if bytes.Compare(a[:], b[:]) > 0 {
+		a, b = b, a
+	}
+	return crypto.Keccak256Hash(a[:], b[:])
+}
@@ -0,0 +1,55 @@
+package attest
+
+import (
+	"testing"
+
+	ethcommon "github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+func leaves(n int) []ethcommon.Hash {
+	hashes := make([]ethcommon.Hash, n)
+	for i := range hashes {
+		hashes[i] = crypto.Keccak256Hash([]byte{byte(i)})
+	}
+	return hashes
+}
+
+func TestTreeProofs(t *testing.T) {
+	for n := 1; n <= 9; n++ {
+		hashes := leaves(n)
+		tree := NewTree(hashes)
+		for i, leaf := range hashes {
+			proof := tree.Proof(i)
+			if !VerifyProof(leaf, proof, tree.Root()) {
+				t.Fatalf("%d leaves: proof of %d does not verify", n, i)
+			}
+			if n > 1 && VerifyProof(crypto.Keccak256Hash(leaf[:]), proof, tree.Root()) {
+				t.Fatalf("%d leaves: proof of %d verifies another leaf", n, i)
+			}
+		}
+	}
+	if NewTree(nil).Root() != (ethcommon.Hash{}) {
+		t.Fatal("empty tree root")
+	}
+	single := leaves(1)
+	if NewTree(single).Root() != single[0] || len(NewTree(single).Proof(0)) != 0 {
+		t.Fatal("single leaf is its own root")
+	}
+}
+
+func TestTreeLayout(t *testing.T) {
+	h := leaves(3)
+	//pairs are sorted before hashing and the odd leaf moves up unpaired
+	want := hashPair(hashPair(h[1], h[0]), h[2])
+	if got := NewTree(h).Root(); got != want {
+		t.Fatalf("root %v, want %v", got, want)
+	}
+	ab := crypto.Keccak256Hash(h[0][:], h[1][:])
+	if h[0].Big().Cmp(h[1].Big()) > 0 {
+		ab = crypto.Keccak256Hash(h[1][:], h[0][:])
+	}
+	if hashPair(h[0], h[1]) != ab {
+		t.Fatal("pair not hashed in sorted order")
+	}
+}
@@ -0,0 +1,92 @@
+package attest
+
+import (
+	"fmt"
+	"math/big"
+	"twitter_oracle/common"
+
+	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	ethcommon "github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+const (
+	ThoughtRecord = "thought"
+	QuoteRecord   = "quote"
+	MetricsRecord = "metrics"
+)
+
+var (
+	uint256Type, _ = abi.NewType("uint256", "", nil)
+	bytes32Type, _ = abi.NewType("bytes32", "", nil)
+	stringType, _  = abi.NewType("string", "", nil)
+
+	//abi.encode(string kind, uint256 tweetId, uint256 authorId, uint256 recordedAt, bytes32 content)
+	leafArguments = abi.Arguments{{Type: stringType}, {Type: uint256Type}, {Type: uint256Type}, {Type: uint256Type}, {Type: bytes32Type}}
+	//abi.encode(uint256 likes, uint256 retweets, uint256 quotes, uint256 replies)
+	metricsArguments = abi.Arguments{{Type: uint256Type}, {Type: uint256Type}, {Type: uint256Type}, {Type: uint256Type}}
+	//abi.encode(uint256 epoch, bytes32 root)
+	epochArguments = abi.Arguments{{Type: uint256Type}, {Type: bytes32Type}}
+)
+
+// ContentHash is keccak256 of the text of thoughts and quotes and of the abi encoded counts of metrics
+func ContentHash(record common.AttestationRecord) (ethcommon.Hash, error) {
+	switch record.Kind {
+	case ThoughtRecord, QuoteRecord:
+		return crypto.Keccak256Hash([]byte(record.Text)), nil
+	case MetricsRecord:
+		m := record.Metrics
+		packed, err := metricsArguments.Pack(big.NewInt(int64(m.LikeCount)), big.NewInt(int64(m.RetweetCount)),
+			big.NewInt(int64(m.QuoteCount)), big.NewInt(int64(m.ReplyCount)))
+		if err != nil {
+			return ethcommon.Hash{}, err
+		}
+		return crypto.Keccak256Hash(packed), nil
+	}
+	return ethcommon.Hash{}, fmt.Errorf("%w: %q", UnknownKindError, record.Kind)
+}
+
+// Leaf hashes the abi encoded record twice, so a leaf can not pass for an inner node. In solidity:
+// keccak256(bytes.concat(keccak256(abi.encode(kind, tweetId, authorId, recordedAt, content))))
+func Leaf(record common.AttestationRecord) (ethcommon.Hash, error) {
+	content, err := ContentHash(record)
+	if err != nil {
+		return ethcommon.Hash{}, err
+	}
+	tweetId, err := number(record.TweetId)
+	if err != nil {
+		return ethcommon.Hash{}, err
+	}
+	authorId, err := number(record.AuthorId)
+	if err != nil {
+		return ethcommon.Hash{}, err
+	}
+	packed, err := leafArguments.Pack(record.Kind, tweetId, authorId, big.NewInt(record.RecordedAt.Unix()), content)
+	if err != nil {
+		return ethcommon.Hash{}, err
+	}
+	return crypto.Keccak256Hash(crypto.Keccak256(packed)), nil
+}
+
+// number parses a twitter id, the author of an event tweet's metrics may be unknown and is 0
+func number(id string) (*big.Int, error) {
+	if id == "" {
+		return new(big.Int), nil
+	}
+	n, ok := new(big.Int).SetString(id, 10)
+	if !ok || n.Sign() < 0 {
+		return nil, fmt.Errorf("%w: %q", InvalidRecordError, id)
+	}
+	return n, nil
+}
+
+// EpochHash is what the attester signs for an epoch, the EIP-191 hash of abi.encode(epoch, root).
+// In solidity: keccak256(abi.encodePacked("\x19Ethereum Signed Message:\n64", epoch, root))
+func EpochHash(epoch int64, root ethcommon.Hash) ([]byte, error) {
+	packed, err := epochArguments.Pack(big.NewInt(epoch), root)
+	if err != nil {
+		return nil, err
+	}
+	return accounts.TextHash(packed), nil
+}
@@ -0,0 +1,29 @@
+// SPDX-License-Identifier: MIT
+pragma solidity ^0.8.0;
+
+// MetricsOracle keeps the latest public metrics of event tweets, only the oracle account may write them.
+// The deployed code is hand-assembled from MetricsOracle.evm, not compiled from this file, keep both in step
+contract MetricsOracle {
+    struct Metrics {
+        uint256 likes;
+        uint256 retweets;
+        uint256 quotes;
+        uint256 replies;
+        uint256 updatedAt;
+    }
+
+    address public owner;
+    mapping(uint256 => Metrics) public metrics;
+
+    event MetricsUpdated(uint256 indexed tweetId, uint256 likes, uint256 retweets, uint256 quotes, uint256 replies, uint256 updatedAt);
+
+    constructor() {
+        owner = msg.sender;
+    }
+
+    function updateMetrics(uint256 tweetId, uint256 likes, uint256 retweets, uint256 quotes, uint256 replies) external {
+        require(msg.sender == owner);
+        metrics[tweetId] = Metrics(likes, retweets, quotes, replies, block.timestamp);
+        emit MetricsUpdated(tweetId, likes, retweets, quotes, replies, block.timestamp);
+    }
+}
@@ -0,0 +1,228 @@
+package contract
+
+import (
+	"context"
+	"math/big"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind/backends"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/asm"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// TestBytecode keeps MetricsOracleBin in step with the assembly listing
+func TestBytecode(t *testing.T) {
+	src, err := os.ReadFile("MetricsOracle.evm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	compiler := asm.NewCompiler(false)
+	compiler.Feed(asm.Lex(src, false))
+	runtime, errs := compiler.Compile()
+	if len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	if "0x"+MetricsOracleConstructor+runtime != MetricsOracleBin {
+		t.Fatalf("MetricsOracleBin is stale, runtime is %v", runtime)
+	}
+	//the constructor copies len(runtime) bytes from its own end
+	if !strings.Contains(MetricsOracleConstructor, "60"+big.NewInt(int64(len(runtime)/2)).Text(16)) {
+		t.Fatalf("constructor does not copy %d bytes", len(runtime)/2)
+	}
+}
+
+func TestMetricsOracle(t *testing.T) {
+	ownerKey, _ := crypto.GenerateKey()
+	otherKey, _ := crypto.GenerateKey()
+	chainId := big.NewInt(1337)
+	owner, _ := bind.NewKeyedTransactorWithChainID(ownerKey, chainId)
+	other, _ := bind.NewKeyedTransactorWithChainID(otherKey, chainId)
+	balance := new(big.Int).Lsh(big.NewInt(1), 64)
+	backend := backends.NewSimulatedBackend(core.GenesisAlloc{owner.From: {Balance: balance}, other.From: {Balance: balance}}, 8000000)
+	defer backend.Close()
+
+	_, _, oracle, err := DeployMetricsOracle(owner, backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend.Commit()
+	got, err := oracle.Owner(nil)
+	if err != nil || got != owner.From {
+		t.Fatalf("owner %v %v", got, err)
+	}
+
+	tweetId, _ := new(big.Int).SetString("1593857112829136897", 10)
+	tx, err := oracle.UpdateMetrics(owner, tweetId, big.NewInt(7), big.NewInt(3), big.NewInt(5), big.NewInt(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend.Commit()
+	receipt, err := backend.TransactionReceipt(context.Background(), tx.Hash())
+	if err != nil || len(receipt.Logs) != 1 {
+		t.Fatalf("receipt %+v %v", receipt, err)
+	}
+	event, err := oracle.ParseMetricsUpdated(*receipt.Logs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event.TweetId.Cmp(tweetId) != 0 || event.Likes.Int64() != 7 || event.Replies.Int64() != 1 || event.UpdatedAt.Sign() == 0 {
+		t.Fatalf("event %+v", event)
+	}
+	metrics, err := oracle.Metrics(nil, tweetId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metrics.Likes.Int64() != 7 || metrics.Retweets.Int64() != 3 || metrics.Quotes.Int64() != 5 ||
+		metrics.Replies.Int64() != 1 || metrics.UpdatedAt.Cmp(event.UpdatedAt) != 0 {
+		t.Fatalf("metrics %+v", metrics)
+	}
+
+	//only the owner writes
+	if _, err = oracle.UpdateMetrics(other, tweetId, big.NewInt(0), big.NewInt(0), big.NewInt(0), big.NewInt(0)); err == nil {
+		t.Fatal("non owner update accepted")
+	}
+}
+
+var (
+	solFunction = regexp.MustCompile(`function (\w+)\(([^)]*)\)`)
+	solEvent    = regexp.MustCompile(`event (\w+)\(([^)]*)\)`)
+	solPublic   = regexp.MustCompile(`(address|uint256|mapping\((\w+) =>[^)]*\)) public (\w+);`)
+)
+
+// solSig turns "uint256 tweetId, uint256 indexed likes" into "name(uint256,uint256)"
+func solSig(name string, params string) string {
+	var types []string
+	for _, param := range strings.Split(params, ",") {
+		if fields := strings.Fields(param); len(fields) > 0 {
+			types = append(types, fields[0])
+		}
+	}
+	return name + "(" + strings.Join(types, ",") + ")"
+}
+
+// TestSourceMatchesABI keeps MetricsOracle.sol and MetricsOracleABI describing the same contract,
+// the bytecode is checked against the ABI by TestEveryMethodDeployed
+func TestSourceMatchesABI(t *testing.T) {
+	src, err := os.ReadFile("MetricsOracle.sol")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fromSource []string
+	for _, m := range solFunction.FindAllStringSubmatch(string(src), -1) {
+		fromSource = append(fromSource, solSig(m[1], m[2]))
+	}
+	for _, m := range solPublic.FindAllStringSubmatch(string(src), -1) {
+		//public state variables get a getter, a mapping takes its key
+		fromSource = append(fromSource, m[3]+"("+m[2]+")")
+	}
+	for _, m := range solEvent.FindAllStringSubmatch(string(src), -1) {
+		fromSource = append(fromSource, "event "+solSig(m[1], m[2]))
+	}
+	parsed, err := abi.JSON(strings.NewReader(MetricsOracleABI))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fromABI []string
+	for _, method := range parsed.Methods {
+		fromABI = append(fromABI, method.Sig)
+	}
+	for _, event := range parsed.Events {
+		fromABI = append(fromABI, "event "+event.Sig)
+	}
+	sort.Strings(fromSource)
+	sort.Strings(fromABI)
+	if strings.Join(fromSource, ";") != strings.Join(fromABI, ";") {
+		t.Fatalf("MetricsOracle.sol declares %v, the ABI %v", fromSource, fromABI)
+	}
+}
+
+// TestEveryMethodDeployed calls every method of the ABI on the assembled code, so a method or event
+// added to the ABI without being assembled fails here
+func TestEveryMethodDeployed(t *testing.T) {
+	ownerKey, _ := crypto.GenerateKey()
+	otherKey, _ := crypto.GenerateKey()
+	owner, _ := bind.NewKeyedTransactorWithChainID(ownerKey, big.NewInt(1337))
+	other := crypto.PubkeyToAddress(otherKey.PublicKey)
+	balance := new(big.Int).Lsh(big.NewInt(1), 64)
+	backend := backends.NewSimulatedBackend(core.GenesisAlloc{owner.From: {Balance: balance}, other: {Balance: balance}}, 8000000)
+	defer backend.Close()
+	address, _, _, err := DeployMetricsOracle(owner, backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend.Commit()
+	parsed, err := abi.JSON(strings.NewReader(MetricsOracleABI))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	call := func(from common.Address, data []byte, value *big.Int) ([]byte, error) {
+		return backend.CallContract(ctx, ethereum.CallMsg{From: from, To: &address, Data: data, Value: value}, nil)
+	}
+	var topics []common.Hash
+	for name, method := range parsed.Methods {
+		var args []interface{}
+		for i, input := range method.Inputs {
+			switch input.Type.T {
+			case abi.UintTy:
+				args = append(args, big.NewInt(int64(i+1)))
+			default:
+				t.Fatalf("%v: no test value for %v", name, input.Type)
+			}
+		}
+		data, err := parsed.Pack(name, args...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !method.IsConstant() {
+			if _, err = call(other, data, nil); err == nil {
+				t.Fatalf("%v: accepted from a non owner", name)
+			}
+			tx, err := bind.NewBoundContract(address, parsed, backend, backend, backend).RawTransact(owner, data)
+			if err != nil {
+				t.Fatalf("%v: %v", name, err)
+			}
+			backend.Commit()
+			receipt, err := backend.TransactionReceipt(ctx, tx.Hash())
+			if err != nil || receipt.Status != 1 {
+				t.Fatalf("%v: receipt %+v %v", name, receipt, err)
+			}
+			for _, l := range receipt.Logs {
+				topics = append(topics, l.Topics[0])
+			}
+		}
+		if _, err = call(owner.From, data, big.NewInt(1)); err == nil {
+			t.Fatalf("%v: accepted value", name)
+		}
+		out, err := call(owner.From, data, nil)
+		if err != nil {
+			t.Fatalf("%v: %v", name, err)
+		}
+		values, err := parsed.Unpack(name, out)
+		if err != nil || len(values) != len(method.Outputs) {
+			t.Fatalf("%v: unpacked %v %v", name, values, err)
+		}
+	}
+	for name, event := range parsed.Events {
+		found := false
+		for _, topic := range topics {
+			found = found || topic == event.ID
+		}
+		if !found {
+			t.Fatalf("event %v never emitted", name)
+		}
+	}
+	//a selector missing from the ABI reverts
+	if _, err = call(owner.From, crypto.Keccak256([]byte("unknown()"))[:4], nil); err == nil {
+		t.Fatal("unknown selector accepted")
+	}
+}
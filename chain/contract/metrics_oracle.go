@@ -0,0 +1,157 @@
+// Package contract binds MetricsOracle.sol. The binding is written by hand in abigen's layout and
+// the bytecode is not solc output: it is a hand-assembled constructor followed by MetricsOracle.evm
+// assembled with go-ethereum's core/asm. asm_test.go checks the listing against the bytecode, the
+// Solidity source against the ABI and every ABI method and event against the deployed code
+package contract
+
+import (
+	"math/big"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// MetricsOracleABI is the ABI of MetricsOracle.sol, the binding and MetricsOracle.evm follow it.
+const MetricsOracleABI = `[{"inputs":[],"stateMutability":"nonpayable","type":"constructor"},{"anonymous":false,"inputs":[{"indexed":true,"internalType":"uint256","name":"tweetId","type":"uint256"},{"indexed":false,"internalType":"uint256","name":"likes","type":"uint256"},{"indexed":false,"internalType":"uint256","name":"retweets","type":"uint256"},{"indexed":false,"internalType":"uint256","name":"quotes","type":"uint256"},{"indexed":false,"internalType":"uint256","name":"replies","type":"uint256"},{"indexed":false,"internalType":"uint256","name":"updatedAt","type":"uint256"}],"name":"MetricsUpdated","type":"event"},{"inputs":[{"internalType":"uint256","name":"","type":"uint256"}],"name":"metrics","outputs":[{"internalType":"uint256","name":"likes","type":"uint256"},{"internalType":"uint256","name":"retweets","type":"uint256"},{"internalType":"uint256","name":"quotes","type":"uint256"},{"internalType":"uint256","name":"replies","type":"uint256"},{"internalType":"uint256","name":"updatedAt","type":"uint256"}],"stateMutability":"view","type":"function"},{"inputs":[],"name":"owner","outputs":[{"internalType":"address","name":"","type":"address"}],"stateMutability":"view","type":"function"},{"inputs":[{"internalType":"uint256","name":"tweetId","type":"uint256"},{"internalType":"uint256","name":"likes","type":"uint256"},{"internalType":"uint256","name":"retweets","type":"uint256"},{"internalType":"uint256","name":"quotes","type":"uint256"},{"internalType":"uint256","name":"replies","type":"uint256"}],"name":"updateMetrics","outputs":[],"stateMutability":"nonpayable","type":"function"}]`
+
+// MetricsOracleConstructor is hand-assembled, it stores the deployer as owner and returns the
+// runtime appended to it.
+const MetricsOracleConstructor = "3360005560f580600f6000396000f3"
+
+// MetricsOracleBin is the assembled bytecode used for deploying new contracts.
+const MetricsOracleBin = "0x" + MetricsOracleConstructor + "3463000000345760003560e01c8063d1d536701463000000395780636d9aac621463000000ae5780638da5cb5b1463000000e9575b600080fd5b33600054141563000000345760043560005260016020526040600020602435815560443581600101556064358160020155608435816003015542816004015560806024600037426080526004357ff1f6a569ef8e9cc2386b304aa0f9f7b83a5cc6cc47f560734178685abb91613060a06000a2005b600435600052600160205260406000208054600052806001015460205280600201546040528060030154606052806004015460805260a06000f35b60005460005260206000f3"
+
+// MetricsOracle is a Go binding around the MetricsOracle contract.
+type MetricsOracle struct {
+	MetricsOracleCaller     // Read-only binding to the contract
+	MetricsOracleTransactor // Write-only binding to the contract
+	MetricsOracleFilterer   // Log filterer for contract events
+}
+
+// MetricsOracleCaller is a read-only Go binding around the MetricsOracle contract.
+type MetricsOracleCaller struct {
+	contract *bind.BoundContract // Generic contract wrapper for the low level calls
+}
+
+// MetricsOracleTransactor is a write-only Go binding around the MetricsOracle contract.
+type MetricsOracleTransactor struct {
+	contract *bind.BoundContract // Generic contract wrapper for the low level calls
+}
+
+// MetricsOracleFilterer is a log filtering Go binding around the MetricsOracle contract events.
+type MetricsOracleFilterer struct {
+	contract *bind.BoundContract // Generic contract wrapper for the low level calls
+}
+
+// DeployMetricsOracle deploys a new Ethereum contract, binding an instance of MetricsOracle to it.
+func DeployMetricsOracle(auth *bind.TransactOpts, backend bind.ContractBackend) (common.Address, *types.Transaction, *MetricsOracle, error) {
+	parsed, err := abi.JSON(strings.NewReader(MetricsOracleABI))
+	if err != nil {
+		return common.Address{}, nil, nil, err
+	}
+	address, tx, contract, err := bind.DeployContract(auth, parsed, common.FromHex(MetricsOracleBin), backend)
+	if err != nil {
+		return common.Address{}, nil, nil, err
+	}
+	return address, tx, &MetricsOracle{MetricsOracleCaller: MetricsOracleCaller{contract: contract}, MetricsOracleTransactor: MetricsOracleTransactor{contract: contract}, MetricsOracleFilterer: MetricsOracleFilterer{contract: contract}}, nil
+}
+
+// NewMetricsOracle creates a new instance of MetricsOracle, bound to a specific deployed contract.
+func NewMetricsOracle(address common.Address, backend bind.ContractBackend) (*MetricsOracle, error) {
+	contract, err := bindMetricsOracle(address, backend, backend, backend)
+	if err != nil {
+		return nil, err
+	}
+	return &MetricsOracle{MetricsOracleCaller: MetricsOracleCaller{contract: contract}, MetricsOracleTransactor: MetricsOracleTransactor{contract: contract}, MetricsOracleFilterer: MetricsOracleFilterer{contract: contract}}, nil
+}
+
+// bindMetricsOracle binds a generic wrapper to an already deployed contract.
+func bindMetricsOracle(address common.Address, caller bind.ContractCaller, transactor bind.ContractTransactor, filterer bind.ContractFilterer) (*bind.BoundContract, error) {
+	parsed, err := abi.JSON(strings.NewReader(MetricsOracleABI))
+	if err != nil {
+		return nil, err
+	}
+	return bind.NewBoundContract(address, parsed, caller, transactor, filterer), nil
+}
+
+// Metrics is a free data retrieval call binding the contract method 0x6d9aac62.
+//
+// Solidity: function metrics(uint256 ) view returns(uint256 likes, uint256 retweets, uint256 quotes, uint256 replies, uint256 updatedAt)
+func (_MetricsOracle *MetricsOracleCaller) Metrics(opts *bind.CallOpts, arg0 *big.Int) (struct {
+	Likes     *big.Int
+	Retweets  *big.Int
+	Quotes    *big.Int
+	Replies   *big.Int
+	UpdatedAt *big.Int
+}, error) {
+	var out []interface{}
+	err := _MetricsOracle.contract.Call(opts, &out, "metrics", arg0)
+
+	outstruct := new(struct {
+		Likes     *big.Int
+		Retweets  *big.Int
+		Quotes    *big.Int
+		Replies   *big.Int
+		UpdatedAt *big.Int
+	})
+	if err != nil {
+		return *outstruct, err
+	}
+
+	outstruct.Likes = *abi.ConvertType(out[0], new(*big.Int)).(**big.Int)
+	outstruct.Retweets = *abi.ConvertType(out[1], new(*big.Int)).(**big.Int)
+	outstruct.Quotes = *abi.ConvertType(out[2], new(*big.Int)).(**big.Int)
+	outstruct.Replies = *abi.ConvertType(out[3], new(*big.Int)).(**big.Int)
+	outstruct.UpdatedAt = *abi.ConvertType(out[4], new(*big.Int)).(**big.Int)
+
+	return *outstruct, err
+}
+
+// Owner is a free data retrieval call binding the contract method 0x8da5cb5b.
+//
+// Solidity: function owner() view returns(address)
+func (_MetricsOracle *MetricsOracleCaller) Owner(opts *bind.CallOpts) (common.Address, error) {
+	var out []interface{}
+	err := _MetricsOracle.contract.Call(opts, &out, "owner")
+
+	if err != nil {
+		return *new(common.Address), err
+	}
+
+	out0 := *abi.ConvertType(out[0], new(common.Address)).(*common.Address)
+
+	return out0, err
+}
+
+// UpdateMetrics is a paid mutator transaction binding the contract method 0xd1d53670.
+//
+// Solidity: function updateMetrics(uint256 tweetId, uint256 likes, uint256 retweets, uint256 quotes, uint256 replies) returns()
+func (_MetricsOracle *MetricsOracleTransactor) UpdateMetrics(opts *bind.TransactOpts, tweetId *big.Int, likes *big.Int, retweets *big.Int, quotes *big.Int, replies *big.Int) (*types.Transaction, error) {
+	return _MetricsOracle.contract.Transact(opts, "updateMetrics", tweetId, likes, retweets, quotes, replies)
+}
+
+// MetricsOracleMetricsUpdated represents a MetricsUpdated event raised by the MetricsOracle contract.
+type MetricsOracleMetricsUpdated struct {
+	TweetId   *big.Int
+	Likes     *big.Int
+	Retweets  *big.Int
+	Quotes    *big.Int
+	Replies   *big.Int
+	UpdatedAt *big.Int
+	Raw       types.Log // Blockchain specific contextual infos
+}
+
+// ParseMetricsUpdated is a log parse operation binding the contract event 0xf1f6a569ef8e9cc2386b304aa0f9f7b83a5cc6cc47f560734178685abb916130.
+//
+// Solidity: event MetricsUpdated(uint256 indexed tweetId, uint256 likes, uint256 retweets, uint256 quotes, uint256 replies, uint256 updatedAt)
+func (_MetricsOracle *MetricsOracleFilterer) ParseMetricsUpdated(log types.Log) (*MetricsOracleMetricsUpdated, error) {
+	event := new(MetricsOracleMetricsUpdated)
+	if err := _MetricsOracle.contract.UnpackLog(event, "MetricsUpdated", log); err != nil {
+		return nil, err
+	}
+	event.Raw = log
+	return event, nil
+}
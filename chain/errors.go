@@ -0,0 +1,13 @@
+package chain
+
+import "errors"
+
+var (
+	InvalidTweetIdError    = errors.New("tweet id is not a number")
+	ConfirmTimeoutError    = errors.New("transaction not confirmed in time")
+	TransactionFailedError = errors.New("transaction reverted")
+	PublishFailedError     = errors.New("metrics not published")
+	GasPriceCapError       = errors.New("gas price above the configured cap")
+	NoContractError        = errors.New("no oracle contract at the address")
+	NotOwnerError          = errors.New("oracle contract owned by another account")
+)
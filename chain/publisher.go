@@ -0,0 +1,415 @@
+package chain
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+	"twitter_oracle/chain/contract"
+	"twitter_oracle/common"
+	"twitter_oracle/log"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	ethcommon "github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/metrics"
+)
+
+var (
+	submittedCounter = metrics.NewRegisteredCounter("chain/publish/submitted", nil)
+	confirmedCounter = metrics.NewRegisteredCounter("chain/publish/confirmed", nil)
+	failedCounter    = metrics.NewRegisteredCounter("chain/publish/failed", nil)
+	revertedCounter  = metrics.NewRegisteredCounter("chain/publish/reverted", nil)
+)
+
+// Backend is the node the publisher talks to, an ethclient.Client or a simulated backend
+type Backend interface {
+	bind.ContractBackend
+	bind.DeployBackend
+}
+
+// PublisherConfig tunes how metrics reach the oracle contract
+type PublisherConfig struct {
+	//Interval between two rounds of submitting queued metrics
+	Interval time.Duration
+	//Confirmations is the number of blocks, the one including it counts, a transaction waits for
+	Confirmations uint64
+	//ConfirmTimeout is how long a transaction may stay unmined before it is resent with a higher fee
+	ConfirmTimeout time.Duration
+	//ReceiptPoll is how often receipts are checked while confirming
+	ReceiptPoll time.Duration
+	//MaxAttempts bounds the sends of one update, resends keep the nonce and replace the pending one
+	MaxAttempts int
+	//GasBumpPercent raises the fee of each resend, nodes want at least 10 to replace a transaction
+	GasBumpPercent int64
+	//MaxFeeCap stops bumping above this fee per gas, nil for no cap
+	MaxFeeCap *big.Int
+}
+
+var DefaultPublisherConfig = PublisherConfig{
+	Interval:       time.Minute * 10,
+	Confirmations:  2,
+	ConfirmTimeout: time.Minute * 3,
+	ReceiptPoll:    time.Second * 3,
+	MaxAttempts:    4,
+	GasBumpPercent: 20,
+}
+
+// Publisher submits event tweet metrics to the oracle contract. Metrics are queued by the querier
+// and the latest of every tweet is sent each Interval if it changed since it was last confirmed.
+// Updates are sent one at a time from a single account so the publisher owns the nonce sequence
+type Publisher struct {
+	PublisherConfig
+	backend Backend
+	key     *ecdsa.PrivateKey
+	from    ethcommon.Address
+	chainId *big.Int
+	address ethcommon.Address
+	oracle  *contract.MetricsOracle
+
+	mutex     sync.Mutex
+	queued    map[string]common.TweetPublicMetricInfo
+	published map[string]common.TweetPublicMetricInfo
+	//reverted are metrics the contract rejected, parked so they are not paid for every round
+	reverted map[string]common.TweetPublicMetricInfo
+	//nonce is the next nonce of from, nil refetches the pending nonce from the node
+	nonce *uint64
+}
+
+func NewPublisher(backend Backend, contractAddress ethcommon.Address, key *ecdsa.PrivateKey, chainId *big.Int) (*Publisher, error) {
+	oracle, err := contract.NewMetricsOracle(contractAddress, backend)
+	if err != nil {
+		return nil, err
+	}
+	return &Publisher{
+		PublisherConfig: DefaultPublisherConfig,
+		backend:         backend,
+		key:             key,
+		from:            crypto.PubkeyToAddress(key.PublicKey),
+		chainId:         chainId,
+		address:         contractAddress,
+		oracle:          oracle,
+		queued:          make(map[string]common.TweetPublicMetricInfo),
+		published:       make(map[string]common.TweetPublicMetricInfo),
+		reverted:        make(map[string]common.TweetPublicMetricInfo),
+	}, nil
+}
+
+// Queue keeps metric as the latest of tweetId, it is submitted with the next round. Metrics
+// equal to the published or reverted ones of the tweet are not sent again
+func (p *Publisher) Queue(tweetId string, metric common.TweetPublicMetricInfo) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if published, ok := p.published[tweetId]; ok && published == metric {
+		delete(p.queued, tweetId)
+		return
+	}
+	if reverted, ok := p.reverted[tweetId]; ok && reverted == metric {
+		delete(p.queued, tweetId)
+		return
+	}
+	p.queued[tweetId] = metric
+}
+
+// Start submits queued metrics every Interval until ctx is done, the contract must be deployed
+// and owned by the publishing account
+func (p *Publisher) Start(ctx context.Context) error {
+	code, err := p.backend.CodeAt(ctx, p.address, nil)
+	if err != nil {
+		return err
+	}
+	if len(code) == 0 {
+		return fmt.Errorf("%w: %v", NoContractError, p.address)
+	}
+	owner, err := p.oracle.Owner(&bind.CallOpts{Context: ctx})
+	if err != nil {
+		return err
+	}
+	if owner != p.from {
+		return fmt.Errorf("%w: owner %v, publishing from %v", NotOwnerError, owner, p.from)
+	}
+	ticker := time.NewTicker(p.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			p.PublishQueued(ctx)
+		}
+	}
+}
+
+// PublishQueued submits the queued metrics and returns how many were confirmed, failed ones
+// stay queued for the next round unless newer metrics replaced them. Reverted ones are parked
+// until the metrics of the tweet change, the contract would reject them again
+func (p *Publisher) PublishQueued(ctx context.Context) int {
+	p.mutex.Lock()
+	queued := p.queued
+	p.queued = make(map[string]common.TweetPublicMetricInfo)
+	p.mutex.Unlock()
+
+	confirmed := 0
+	for tweetId, metric := range queued {
+		if ctx.Err() != nil {
+			p.requeue(tweetId, metric)
+			continue
+		}
+		err := p.Publish(ctx, tweetId, metric)
+		if errors.Is(err, InvalidTweetIdError) {
+			log.Warn("drop metrics", err, "tweetId", tweetId)
+			continue
+		}
+		if errors.Is(err, TransactionFailedError) {
+			revertedCounter.Inc(1)
+			log.Error("metrics reverted, parked until they change", err, "tweetId", tweetId)
+			p.mutex.Lock()
+			p.reverted[tweetId] = metric
+			p.mutex.Unlock()
+			continue
+		}
+		if err != nil {
+			failedCounter.Inc(1)
+			log.Warn("publish metrics error", err, "tweetId", tweetId)
+			p.requeue(tweetId, metric)
+			continue
+		}
+		confirmed++
+	}
+	return confirmed
+}
+
+func (p *Publisher) requeue(tweetId string, metric common.TweetPublicMetricInfo) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if _, ok := p.queued[tweetId]; !ok {
+		p.queued[tweetId] = metric
+	}
+}
+
+// Publish sends one update and waits until it is confirmed. An unmined transaction is resent
+// with the same nonce and a bumped fee, whichever of the sends is mined confirms the update
+func (p *Publisher) Publish(ctx context.Context, tweetId string, metric common.TweetPublicMetricInfo) error {
+	id, ok := new(big.Int).SetString(tweetId, 10)
+	if !ok {
+		return fmt.Errorf("%w: %q", InvalidTweetIdError, tweetId)
+	}
+	nonce, err := p.nextNonce(ctx)
+	if err != nil {
+		return err
+	}
+	price, err := p.suggestFee(ctx)
+	if err != nil {
+		return err
+	}
+	sent := make([]ethcommon.Hash, 0, p.MaxAttempts)
+	for attempt := 1; attempt <= p.MaxAttempts; attempt++ {
+		tx, err := p.oracle.UpdateMetrics(p.transactOpts(ctx, nonce, price), id,
+			big.NewInt(int64(metric.LikeCount)), big.NewInt(int64(metric.RetweetCount)),
+			big.NewInt(int64(metric.QuoteCount)), big.NewInt(int64(metric.ReplyCount)))
+		if err != nil {
+			log.Warn("send metrics transaction error", err, "tweetId", tweetId, "nonce", nonce, "attempt", attempt)
+			//nothing of ours is pending, another sender used the nonce
+			if len(sent) == 0 && isNonceError(err) {
+				p.resetNonce()
+				if nonce, err = p.nextNonce(ctx); err != nil {
+					return err
+				}
+			}
+		} else {
+			submittedCounter.Inc(1)
+			sent = append(sent, tx.Hash())
+		}
+		if len(sent) > 0 {
+			receipt, err := p.waitConfirmed(ctx, sent)
+			if err == nil {
+				p.useNonce(nonce)
+				if receipt.Status != types.ReceiptStatusSuccessful {
+					return fmt.Errorf("%w: %v", TransactionFailedError, receipt.TxHash)
+				}
+				confirmedCounter.Inc(1)
+				p.mutex.Lock()
+				p.published[tweetId] = metric
+				delete(p.reverted, tweetId)
+				p.mutex.Unlock()
+				log.Info("metrics published", tweetId, "tx", receipt.TxHash, "block", receipt.BlockNumber)
+				return nil
+			}
+			if !errors.Is(err, ConfirmTimeoutError) {
+				p.resetNonce()
+				return err
+			}
+		} else if err := sleep(ctx, p.ReceiptPoll); err != nil {
+			return err
+		}
+		if price, err = p.bumpFee(price); err != nil {
+			p.resetNonce()
+			return fmt.Errorf("%w: tweet %v: %v", PublishFailedError, tweetId, err)
+		}
+	}
+	//a send may still be mined, the node knows the nonce to continue from
+	p.resetNonce()
+	return fmt.Errorf("%w: tweet %v after %d attempts, sent %v", PublishFailedError, tweetId, p.MaxAttempts, sent)
+}
+
+func (p *Publisher) nextNonce(ctx context.Context) (uint64, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.nonce != nil {
+		return *p.nonce, nil
+	}
+	nonce, err := p.backend.PendingNonceAt(ctx, p.from)
+	if err != nil {
+		return 0, err
+	}
+	p.nonce = &nonce
+	return nonce, nil
+}
+
+func (p *Publisher) useNonce(nonce uint64) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	next := nonce + 1
+	p.nonce = &next
+}
+
+func (p *Publisher) resetNonce() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.nonce = nil
+}
+
+func isNonceError(err error) bool {
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, "nonce too low") || strings.Contains(msg, "invalid transaction nonce")
+}
+
+// fee is a dynamic fee when the chain has a base fee, a legacy gas price otherwise
+type fee struct {
+	gasPrice *big.Int
+	tipCap   *big.Int
+	feeCap   *big.Int
+}
+
+func (p *Publisher) suggestFee(ctx context.Context) (fee, error) {
+	head, err := p.backend.HeaderByNumber(ctx, nil)
+	if err != nil {
+		return fee{}, err
+	}
+	if head.BaseFee == nil {
+		gasPrice, err := p.backend.SuggestGasPrice(ctx)
+		if err != nil {
+			return fee{}, err
+		}
+		return fee{gasPrice: gasPrice}, nil
+	}
+	tipCap, err := p.backend.SuggestGasTipCap(ctx)
+	if err != nil {
+		return fee{}, err
+	}
+	//room for the base fee to double before the transaction is priced out
+	feeCap := new(big.Int).Add(tipCap, new(big.Int).Mul(head.BaseFee, big.NewInt(2)))
+	return fee{tipCap: tipCap, feeCap: feeCap}, nil
+}
+
+func (p *Publisher) bumpFee(f fee) (fee, error) {
+	bump := func(v *big.Int) *big.Int {
+		bumped := new(big.Int).Mul(v, big.NewInt(100+p.GasBumpPercent))
+		bumped.Div(bumped, big.NewInt(100))
+		//small values would not move at all
+		if bumped.Cmp(v) <= 0 {
+			bumped.Add(v, big.NewInt(1))
+		}
+		return bumped
+	}
+	bumped := fee{}
+	max := new(big.Int)
+	if f.gasPrice != nil {
+		bumped.gasPrice = bump(f.gasPrice)
+		max = bumped.gasPrice
+	} else {
+		bumped.tipCap, bumped.feeCap = bump(f.tipCap), bump(f.feeCap)
+		max = bumped.feeCap
+	}
+	if p.MaxFeeCap != nil && max.Cmp(p.MaxFeeCap) > 0 {
+		return f, fmt.Errorf("%w: %v", GasPriceCapError, max)
+	}
+	return bumped, nil
+}
+
+func (p *Publisher) transactOpts(ctx context.Context, nonce uint64, f fee) *bind.TransactOpts {
+	signer := types.LatestSignerForChainID(p.chainId)
+	return &bind.TransactOpts{
+		From:  p.from,
+		Nonce: new(big.Int).SetUint64(nonce),
+		Signer: func(address ethcommon.Address, tx *types.Transaction) (*types.Transaction, error) {
+			if address != p.from {
+				return nil, bind.ErrNotAuthorized
+			}
+			return types.SignTx(tx, signer, p.key)
+		},
+		GasPrice:  f.gasPrice,
+		GasTipCap: f.tipCap,
+		GasFeeCap: f.feeCap,
+		Context:   ctx,
+	}
+}
+
+// waitConfirmed polls the receipts of the sends of one nonce until one of them is mined and has
+// Confirmations blocks, or ConfirmTimeout passes without any being mined
+func (p *Publisher) waitConfirmed(ctx context.Context, sent []ethcommon.Hash) (*types.Receipt, error) {
+	timeout := time.NewTimer(p.ConfirmTimeout)
+	defer timeout.Stop()
+	ticker := time.NewTicker(p.ReceiptPoll)
+	defer ticker.Stop()
+	var mined *types.Receipt
+	for {
+		if mined == nil {
+			for _, hash := range sent {
+				receipt, err := p.backend.TransactionReceipt(ctx, hash)
+				if err == nil {
+					mined = receipt
+					break
+				}
+				if !errors.Is(err, ethereum.NotFound) {
+					log.Warn("transaction receipt error", err, "tx", hash)
+				}
+			}
+		}
+		if mined != nil {
+			head, err := p.backend.HeaderByNumber(ctx, nil)
+			if err != nil {
+				log.Warn("head error", err)
+			} else if head.Number.Uint64()+1 >= mined.BlockNumber.Uint64()+p.Confirmations {
+				return mined, nil
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-timeout.C:
+			//mined transactions only wait for more blocks
+			if mined == nil {
+				return nil, fmt.Errorf("%w: %v", ConfirmTimeoutError, sent)
+			}
+		case <-ticker.C:
+		}
+	}
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
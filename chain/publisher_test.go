@@ -0,0 +1,242 @@
+package chain
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"sync"
+	"testing"
+	"time"
+	"twitter_oracle/chain/contract"
+	"twitter_oracle/common"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind/backends"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// minedBackend mines a block after every send like an instant sealing node. Failing sends fail
+// without reaching the chain and held sends stay pending until the next send
+type minedBackend struct {
+	*backends.SimulatedBackend
+	mutex sync.Mutex
+	fail  int
+	hold  int
+	sends int
+	//gas is the estimate of every transaction when set, a stale node that lets reverts through
+	gas uint64
+}
+
+func (b *minedBackend) EstimateGas(ctx context.Context, call ethereum.CallMsg) (uint64, error) {
+	if b.gas > 0 {
+		return b.gas, nil
+	}
+	return b.SimulatedBackend.EstimateGas(ctx, call)
+}
+
+func (b *minedBackend) SendTransaction(ctx context.Context, tx *types.Transaction) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.sends++
+	if b.fail > 0 {
+		b.fail--
+		return errors.New("connection reset")
+	}
+	err := b.SimulatedBackend.SendTransaction(ctx, tx)
+	if b.hold > 0 {
+		b.hold--
+		return err
+	}
+	b.Commit()
+	//a second block confirms it
+	b.Commit()
+	return err
+}
+
+func newTestPublisher(t *testing.T) (*Publisher, *minedBackend, *contract.MetricsOracle) {
+	key, _ := crypto.GenerateKey()
+	chainId := big.NewInt(1337)
+	auth, _ := bind.NewKeyedTransactorWithChainID(key, chainId)
+	sim := backends.NewSimulatedBackend(core.GenesisAlloc{auth.From: {Balance: new(big.Int).Lsh(big.NewInt(1), 64)}}, 8000000)
+	t.Cleanup(func() { sim.Close() })
+	address, _, oracle, err := contract.DeployMetricsOracle(auth, sim)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sim.Commit()
+	backend := &minedBackend{SimulatedBackend: sim}
+	publisher, err := NewPublisher(backend, address, key, chainId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publisher.ConfirmTimeout = 100 * time.Millisecond
+	publisher.ReceiptPoll = 10 * time.Millisecond
+	return publisher, backend, oracle
+}
+
+func onChain(t *testing.T, oracle *contract.MetricsOracle, tweetId string) common.TweetPublicMetricInfo {
+	id, _ := new(big.Int).SetString(tweetId, 10)
+	metrics, err := oracle.Metrics(nil, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return common.TweetPublicMetricInfo{
+		LikeCount:    int(metrics.Likes.Int64()),
+		RetweetCount: int(metrics.Retweets.Int64()),
+		QuoteCount:   int(metrics.Quotes.Int64()),
+		ReplyCount:   int(metrics.Replies.Int64()),
+	}
+}
+
+func TestPublishQueued(t *testing.T) {
+	publisher, backend, oracle := newTestPublisher(t)
+	ctx := context.Background()
+	first := common.TweetPublicMetricInfo{LikeCount: 7, RetweetCount: 3, QuoteCount: 5, ReplyCount: 1}
+	second := common.TweetPublicMetricInfo{LikeCount: 1}
+	publisher.Queue("1593857112829136897", common.TweetPublicMetricInfo{})
+	//the latest metrics of a tweet win
+	publisher.Queue("1593857112829136897", first)
+	publisher.Queue("1593857112829136898", second)
+	publisher.Queue("not a tweet", first)
+
+	if confirmed := publisher.PublishQueued(ctx); confirmed != 2 {
+		t.Fatalf("confirmed %d", confirmed)
+	}
+	if got := onChain(t, oracle, "1593857112829136897"); got != first {
+		t.Fatalf("on chain %+v", got)
+	}
+	if got := onChain(t, oracle, "1593857112829136898"); got != second {
+		t.Fatalf("on chain %+v", got)
+	}
+
+	//unchanged metrics are not sent again
+	publisher.Queue("1593857112829136897", first)
+	if confirmed := publisher.PublishQueued(ctx); confirmed != 0 || backend.sends != 2 {
+		t.Fatalf("confirmed %d sends %d", confirmed, backend.sends)
+	}
+	first.LikeCount++
+	publisher.Queue("1593857112829136897", first)
+	if confirmed := publisher.PublishQueued(ctx); confirmed != 1 {
+		t.Fatalf("confirmed %d", confirmed)
+	}
+	if got := onChain(t, oracle, "1593857112829136897"); got != first {
+		t.Fatalf("on chain %+v", got)
+	}
+}
+
+func TestPublishRetries(t *testing.T) {
+	publisher, backend, oracle := newTestPublisher(t)
+	ctx := context.Background()
+	metric := common.TweetPublicMetricInfo{LikeCount: 7}
+
+	//a failed send is retried with the same nonce, the deployment used nonce 0
+	backend.fail = 1
+	if err := publisher.Publish(ctx, "1000", metric); err != nil {
+		t.Fatal(err)
+	}
+	if backend.sends != 2 || *publisher.nonce != 2 {
+		t.Fatalf("sends %d nonce %d", backend.sends, *publisher.nonce)
+	}
+
+	//an unmined send times out and is replaced, the first is mined meanwhile and confirms it
+	backend.hold = 1
+	metric.LikeCount++
+	if err := publisher.Publish(ctx, "1000", metric); err != nil {
+		t.Fatal(err)
+	}
+	if backend.sends != 4 || *publisher.nonce != 3 {
+		t.Fatalf("sends %d nonce %d", backend.sends, *publisher.nonce)
+	}
+	if got := onChain(t, oracle, "1000"); got != metric {
+		t.Fatalf("on chain %+v", got)
+	}
+
+	//another sender took the nonce
+	*publisher.nonce = 2
+	metric.LikeCount++
+	if err := publisher.Publish(ctx, "1000", metric); err != nil {
+		t.Fatal(err)
+	}
+	if got := onChain(t, oracle, "1000"); got != metric {
+		t.Fatalf("on chain %+v", got)
+	}
+
+	//sends that keep failing give up and leave the metrics queued
+	backend.fail = publisher.MaxAttempts
+	metric.LikeCount++
+	publisher.Queue("1000", metric)
+	if confirmed := publisher.PublishQueued(ctx); confirmed != 0 {
+		t.Fatalf("confirmed %d", confirmed)
+	}
+	if _, ok := publisher.queued["1000"]; !ok || publisher.nonce != nil {
+		t.Fatalf("queued %v nonce %v", publisher.queued, publisher.nonce)
+	}
+	if confirmed := publisher.PublishQueued(ctx); confirmed != 1 {
+		t.Fatalf("confirmed %d", confirmed)
+	}
+}
+
+func TestStartWithoutContract(t *testing.T) {
+	publisher, _, _ := newTestPublisher(t)
+	publisher.address[0] ^= 0xff
+	if err := publisher.Start(context.Background()); !errors.Is(err, NoContractError) {
+		t.Fatalf("err %v", err)
+	}
+}
+
+// strangerPublisher publishes to the contract of owner from another funded account
+func strangerPublisher(t *testing.T, owner *Publisher, backend *minedBackend) *Publisher {
+	ctx := context.Background()
+	key, _ := crypto.GenerateKey()
+	to := crypto.PubkeyToAddress(key.PublicKey)
+	nonce, _ := backend.PendingNonceAt(ctx, owner.from)
+	price, _ := backend.SuggestGasPrice(ctx)
+	tx, err := types.SignTx(types.NewTransaction(nonce, to, big.NewInt(1e18), 21000, price, nil),
+		types.LatestSignerForChainID(owner.chainId), owner.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = backend.SendTransaction(ctx, tx); err != nil {
+		t.Fatal(err)
+	}
+	stranger, err := NewPublisher(backend, owner.address, key, owner.chainId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stranger.ConfirmTimeout, stranger.ReceiptPoll = owner.ConfirmTimeout, owner.ReceiptPoll
+	return stranger
+}
+
+func TestStartNotOwner(t *testing.T) {
+	publisher, backend, _ := newTestPublisher(t)
+	stranger := strangerPublisher(t, publisher, backend)
+	if err := stranger.Start(context.Background()); !errors.Is(err, NotOwnerError) {
+		t.Fatalf("err %v", err)
+	}
+}
+
+func TestRevertedParked(t *testing.T) {
+	publisher, backend, _ := newTestPublisher(t)
+	stranger := strangerPublisher(t, publisher, backend)
+	backend.gas = 100000
+	ctx := context.Background()
+	metric := common.TweetPublicMetricInfo{LikeCount: 7}
+	stranger.Queue("1000", metric)
+	if confirmed := stranger.PublishQueued(ctx); confirmed != 0 {
+		t.Fatalf("confirmed %d", confirmed)
+	}
+	sends := backend.sends
+	//the same metrics are not paid for again, later rounds send nothing
+	stranger.Queue("1000", metric)
+	if confirmed := stranger.PublishQueued(ctx); confirmed != 0 || backend.sends != sends {
+		t.Fatalf("confirmed %d sends %d, want %d", confirmed, backend.sends, sends)
+	}
+	metric.LikeCount++
+	stranger.Queue("1000", metric)
+	if _, ok := stranger.queued["1000"]; !ok {
+		t.Fatal("changed metrics not queued")
+	}
+}
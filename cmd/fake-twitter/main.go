@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"gopkg.in/urfave/cli.v1"
+	"net/http"
+	"os"
+	"time"
+	"twitter_oracle/faketwitter"
+	"twitter_oracle/log"
+)
+
+var (
+	portFlag = cli.StringFlag{
+		Name:  "port",
+		Usage: "fake twitter api port",
+		Value: "8547",
+	}
+	fixtureFlag = cli.StringFlag{
+		Name:  "fixture",
+		Usage: "json fixture with users, tweets, rules, search, quotes, stream script and faults",
+	}
+	heartbeatFlag = cli.DurationFlag{
+		Name:  "heartbeat",
+		Usage: "keep-alive interval of the filtered stream",
+		Value: faketwitter.DefaultHeartbeat,
+	}
+)
+
+func main() {
+	app := cli.NewApp()
+	app.Name = "fake-twitter"
+	app.Usage = "local twitter v2 api for oracle end to end tests, point --twitter-host of the oracle at it"
+	app.Flags = []cli.Flag{portFlag, fixtureFlag, heartbeatFlag}
+	app.Action = run
+	if err := app.Run(os.Args); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func run(ctx *cli.Context) error {
+	fixture := &faketwitter.Fixture{}
+	if path := ctx.String(fixtureFlag.Name); path != "" {
+		var err error
+		fixture, err = faketwitter.LoadFixture(path)
+		if err != nil {
+			return err
+		}
+	}
+	s := faketwitter.NewServer(fixture)
+	if heartbeat := ctx.Duration(heartbeatFlag.Name); heartbeat > 0 {
+		s.Heartbeat = heartbeat
+	}
+	address := "127.0.0.1:" + ctx.String(portFlag.Name)
+	log.Info("fake twitter api listening on http://" + address)
+	server := &http.Server{
+		Addr:              address,
+		Handler:           s,
+		ReadHeaderTimeout: time.Second * 10,
+	}
+	return server.ListenAndServe()
+}
@@ -1,6 +1,9 @@
 package common
 
-import "time"
+import (
+	"encoding/json"
+	"time"
+)
 
 type EventTweetInfo struct {
 	TweetId    string    `json:"tweet_id"`
@@ -33,3 +36,124 @@ type ReplyInfo struct {
 	Text       string    `json:"text"`
 	CreatedAt  time.Time `json:"created_at"`
 }
+
+type ConversationInfo struct {
+	ConversationId string    `json:"conversation_id"`
+	HandlerName    string    `json:"handler_name"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+type DeadLetterInfo struct {
+	Id          int64           `json:"id"`
+	TweetId     string          `json:"tweet_id"`
+	HandlerName string          `json:"handler_name"`
+	Payload     json.RawMessage `json:"payload"`
+	Error       string          `json:"error"`
+	Attempts    int             `json:"attempts"`
+	NextRetryAt time.Time       `json:"next_retry_at"`
+	CreatedAt   time.Time       `json:"created_at"`
+	UpdatedAt   time.Time       `json:"updated_at"`
+}
+
+type PendingThoughtInfo struct {
+	TweetId    string    `json:"tweet_id"`
+	AuthorId   string    `json:"author_id"`
+	AuthorName string    `json:"author_name"`
+	Content    string    `json:"content"`
+	SourceUrl  string    `json:"source_url"`
+	Tips       string    `json:"tips"`
+	CreatedAt  time.Time `json:"created_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+type TwitterUsernameInfo struct {
+	AuthorId  string    `json:"author_id"`
+	Username  string    `json:"username"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+}
+
+type WalletLinkInfo struct {
+	Nonce     string    `json:"nonce"`
+	Twitter   string    `json:"twitter"`
+	TwitterId string    `json:"twitter_id"`
+	Address   string    `json:"address"`
+	TweetId   string    `json:"tweet_id"`
+	Status    string    `json:"status"`
+	Error     string    `json:"error"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type OAuthSessionInfo struct {
+	State     string    `json:"state"`
+	Verifier  string    `json:"-"`
+	Address   string    `json:"address"`
+	Verified  bool      `json:"verified"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// AttestationRecord is the canonical form of a tweet fact we recorded, hashed into an epoch's merkle tree
+type AttestationRecord struct {
+	Id         int64                 `json:"-"`
+	Kind       string                `json:"kind"`
+	TweetId    string                `json:"tweet_id"`
+	AuthorId   string                `json:"author_id"`
+	AuthorName string                `json:"author_name"`
+	Text       string                `json:"text"`
+	Metrics    TweetPublicMetricInfo `json:"metrics"`
+	//RecordedAt is the creation time of thoughts and quotes and the poll time of metrics
+	RecordedAt time.Time `json:"recorded_at"`
+}
+
+type AttestationEpochInfo struct {
+	Epoch     int64     `json:"epoch"`
+	Root      string    `json:"root"`
+	Count     int       `json:"count"`
+	Signer    string    `json:"signer"`
+	Signature string    `json:"signature"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// AttestationLeafInfo places a record in its sealed epoch
+type AttestationLeafInfo struct {
+	RecordId int64    `json:"-"`
+	Index    int      `json:"index"`
+	Leaf     string   `json:"leaf"`
+	Proof    []string `json:"proof"`
+}
+
+type AttestationProofInfo struct {
+	AttestationEpochInfo
+	AttestationLeafInfo
+	Record AttestationRecord `json:"record"`
+}
+
+type TweetInfo struct {
+	TweetId        string                `json:"tweet_id"`
+	AuthorId       string                `json:"author_id"`
+	AuthorUsername string                `json:"author_username"`
+	Text           string                `json:"text"`
+	CreatedAt      time.Time             `json:"created_at"`
+	PublicMetric   TweetPublicMetricInfo `json:"public_metric"`
+}
+
+// EventInfo is a registration tweet with the outcome of registering its event, a registered
+// event carries its latest polled metrics
+type EventInfo struct {
+	EventTweetInfo
+	Status           string                `json:"status"`
+	Error            string                `json:"error"`
+	PublicMetric     TweetPublicMetricInfo `json:"public_metric"`
+	MetricsUpdatedAt *time.Time            `json:"metrics_updated_at"`
+	UpdatedAt        time.Time             `json:"updated_at"`
+}
+
+// OracleKeyInfo is a signer address and when it signed for the oracle, RetiredAt is nil for the current key
+type OracleKeyInfo struct {
+	Address    string     `json:"address"`
+	ActiveFrom time.Time  `json:"active_from"`
+	RetiredAt  *time.Time `json:"retired_at,omitempty"`
+}
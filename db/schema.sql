@@ -0,0 +1,176 @@
+-- tables owned by the oracle, users and thoughts are shared with the main service
+create table if not exists conversations
+(
+    conversation_id varchar(32) primary key,
+    handler_name    varchar(64) not null,
+    created_at      timestamptz not null default now()
+);
+
+create table if not exists stream_checkpoints
+(
+    rule_id       varchar(32) primary key,
+    last_tweet_id bigint      not null,
+    updated_at    timestamptz not null default now()
+);
+
+create table if not exists dead_letters
+(
+    id            bigserial primary key,
+    tweet_id      varchar(32) not null,
+    handler_name  varchar(64) not null,
+    payload       jsonb       not null,
+    error         text        not null,
+    attempts      int         not null default 1,
+    next_retry_at timestamptz not null,
+    created_at    timestamptz not null default now(),
+    updated_at    timestamptz not null default now(),
+    unique (tweet_id, handler_name)
+);
+
+-- thoughts of authors without a linked address, promoted once the address is linked
+create table if not exists pending_thoughts
+(
+    tweet_id    varchar(32) primary key,
+    author_id   varchar(32) not null,
+    author_name varchar(64) not null,
+    content     text        not null,
+    source_url  text        not null,
+    tips        text        not null,
+    created_at  timestamptz not null default now(),
+    expires_at  timestamptz not null
+);
+create index if not exists pending_thoughts_author_id_idx on pending_thoughts (author_id);
+
+-- every username a twitter user was seen under, users are identified by author_id
+create table if not exists twitter_usernames
+(
+    author_id  varchar(32) not null,
+    username   varchar(64) not null,
+    first_seen timestamptz not null default now(),
+    last_seen  timestamptz not null default now(),
+    primary key (author_id, username)
+);
+
+-- nonces issued to link a twitter account to the address signing them, each links once.
+-- A linked row is the link of addresses the main service has no users row for
+create table if not exists wallet_links
+(
+    nonce      varchar(64) primary key,
+    twitter    varchar(64) not null,
+    twitter_id varchar(32) not null default '',
+    address    varchar(42) not null default '',
+    tweet_id   varchar(32) not null default '',
+    status     varchar(16) not null,
+    error      text        not null default '',
+    created_at timestamptz not null default now(),
+    expires_at timestamptz not null,
+    updated_at timestamptz not null default now()
+);
+create index if not exists wallet_links_twitter_idx on wallet_links (twitter);
+create index if not exists wallet_links_linked_idx on wallet_links (twitter_id) where status = 'linked';
+
+-- oauth2 logins in progress, the pkce verifier stays here until the callback
+create table if not exists oauth_sessions
+(
+    state      varchar(64) primary key,
+    verifier   varchar(128) not null,
+    address    varchar(42)  not null,
+    verified   boolean      not null default false,
+    created_at timestamptz  not null default now(),
+    expires_at timestamptz  not null
+);
+
+-- signed merkle roots of recorded tweets, one row per sealed epoch
+create table if not exists attestation_epochs
+(
+    epoch      bigint primary key,
+    root       varchar(66)  not null,
+    count      int          not null,
+    signer     varchar(42)  not null,
+    signature  varchar(132) not null,
+    created_at timestamptz  not null default now()
+);
+
+-- records wait with a null epoch until they are sealed with their leaf and proof
+create table if not exists attestation_records
+(
+    id          bigserial primary key,
+    kind        varchar(16) not null,
+    tweet_id    varchar(32) not null,
+    author_id   varchar(32) not null default '',
+    author_name varchar(64) not null default '',
+    text        text        not null default '',
+    likes       int         not null default 0,
+    retweets    int         not null default 0,
+    quotes      int         not null default 0,
+    replies     int         not null default 0,
+    recorded_at timestamptz not null,
+    epoch       bigint references attestation_epochs (epoch),
+    leaf_index  int,
+    leaf        varchar(66),
+    proof       text[]
+);
+create index if not exists attestation_records_tweet_id_idx on attestation_records (tweet_id);
+create index if not exists attestation_records_unsealed_idx on attestation_records (id) where epoch is null;
+-- a thought or quote is recorded once however often it is delivered, metrics every poll
+create unique index if not exists attestation_records_content_key on attestation_records (kind, tweet_id) where kind <> 'metrics';
+
+-- every key that signed oracle facts, the one without retired_at is current
+create table if not exists oracle_keys
+(
+    address     varchar(42) not null,
+    active_from timestamptz primary key,
+    retired_at  timestamptz
+);
+
+-- #HugMe registration tweets, one registered event per name, rejected tweets keep the reason
+create table if not exists events
+(
+    tweet_id           varchar(32) primary key,
+    event_name         varchar(64) not null,
+    author_id          varchar(32) not null,
+    author_name        varchar(64) not null,
+    text               text        not null,
+    status             varchar(16) not null,
+    error              text        not null default '',
+    created_at         timestamptz not null,
+    likes              int         not null default 0,
+    retweets           int         not null default 0,
+    quotes             int         not null default 0,
+    replies            int         not null default 0,
+    metrics_updated_at timestamptz,
+    updated_at         timestamptz not null default now()
+);
+create unique index if not exists events_name_key on events (lower(event_name)) where status = 'registered';
+
+-- quotes of registered event tweets
+create table if not exists event_quotes
+(
+    tweet_id       varchar(32) primary key,
+    event_tweet_id varchar(32) not null references events (tweet_id),
+    author_id      varchar(32) not null,
+    author_name    varchar(64) not null,
+    text           text        not null,
+    likes          int         not null default 0,
+    retweets       int         not null default 0,
+    quotes         int         not null default 0,
+    replies        int         not null default 0,
+    created_at     timestamptz not null
+);
+create index if not exists event_quotes_event_tweet_id_idx on event_quotes (event_tweet_id);
+
+-- thoughts is created by the main service, tweet_id makes stream deliveries idempotent
+do
+$$
+    begin
+        if to_regclass('thoughts') is not null then
+            alter table thoughts add column if not exists tweet_id varchar(32);
+            create unique index if not exists thoughts_tweet_id_key on thoughts (tweet_id);
+        end if;
+        -- users is created by the main service too, twitter_id keeps a wallet linked across renames
+        if to_regclass('users') is not null then
+            alter table users add column if not exists twitter_id varchar(32);
+            create unique index if not exists users_twitter_id_key on users (twitter_id);
+        end if;
+    end
+$$;
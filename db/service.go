@@ -2,13 +2,27 @@ package db
 
 import (
 	"context"
+	_ "embed"
+	"errors"
 	"fmt"
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"os"
 	"time"
 	"twitter_oracle/common"
 )
 
+var (
+	UserNotRegisteredError = errors.New("twitter user has no linked address")
+	LinkNonceUsedError     = errors.New("link nonce already used or expired")
+	LinkNonceNotFoundError = errors.New("link nonce not issued")
+	AddressNotLinkedError  = errors.New("address has no linked twitter account")
+	EventNameTakenError    = errors.New("event name already registered")
+)
+
+//go:embed schema.sql
+var schema string
+
 type DBService struct {
 	pool *pgxpool.Pool
 }
@@ -25,40 +39,720 @@ func Init() (*DBService, error) {
 	}, nil
 }
 
-func (db *DBService) PutThought(author, content, sourceUrl, tips string) error {
-	//get user
-	getUserSql := "select address from users where twitter=$1"
-	address := ""
+func (db *DBService) Close() {
+	db.pool.Close()
+}
+
+// Migrate creates the tables owned by the oracle if they do not exist
+func (db *DBService) Migrate() error {
 	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
 	defer cancel()
-	err := db.pool.QueryRow(ctx, getUserSql, author).Scan(&address)
+	_, err := db.pool.Exec(ctx, schema)
+	return err
+}
+
+// PutThought saves the thought of tweetId, a tweet delivered again updates its thought in place.
+// The author is found by twitter id, a user linked by handle only gets the id on the first match
+func (db *DBService) PutThought(tweetId, authorId, authorName, content, sourceUrl, tips string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	address, err := db.getUserAddress(ctx, authorId, authorName)
 	if err != nil {
 		return err
 	}
 	//insert thought
-	putThoughtSql := "insert into thoughts(content, address, source_url, submit_state, tips, thought_type, viewed) values ($1, $2, $3, $4, $5, $6, $7)"
-	//sourceUrl example: https://twitter.com/ninox2022/status/1587630498012332032
-	_, err = db.pool.Exec(ctx, putThoughtSql, content, address, sourceUrl, "save", tips, "twitter", "all")
+	putThoughtSql := "insert into thoughts(tweet_id, content, address, source_url, submit_state, tips, thought_type, viewed) values ($1, $2, $3, $4, $5, $6, $7, $8) " +
+		"on conflict (tweet_id) do update set content=excluded.content, source_url=excluded.source_url, tips=excluded.tips"
+	//sourceUrl example: https://twitter.com/i/web/status/1587630498012332032
+	_, err = db.pool.Exec(ctx, putThoughtSql, tweetId, content, address, sourceUrl, "save", tips, "twitter", "all")
 	return err
 }
 
-func (db *DBService) GetConversationList() ([]string, error) {
-	//todo:impl
-	return nil, nil
+func (db *DBService) getUserAddress(ctx context.Context, authorId, authorName string) (string, error) {
+	getUserSql := "select address from users where twitter_id=$1"
+	address := ""
+	err := db.pool.QueryRow(ctx, getUserSql, authorId).Scan(&address)
+	if errors.Is(err, pgx.ErrNoRows) {
+		//wallets linked by tweet without a users row of the main service, looked up before the
+		//handle so a row unlinked by a relink keeps its handle without taking the account back
+		getLinkSql := "select address from wallet_links where twitter_id=$1 and status='linked' order by updated_at desc limit 1"
+		err = db.pool.QueryRow(ctx, getLinkSql, authorId).Scan(&address)
+	}
+	if errors.Is(err, pgx.ErrNoRows) {
+		//users registered by handle before twitter_id existed
+		linkUserSql := "update users set twitter_id=$1 where lower(twitter)=lower($2) and twitter_id is null returning address"
+		err = db.pool.QueryRow(ctx, linkUserSql, authorId, authorName).Scan(&address)
+	}
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", fmt.Errorf("%w: %v (%v)", UserNotRegisteredError, authorName, authorId)
+	}
+	return address, err
 }
 
+// PutTwitterUsername records that authorId goes by username now and renames the linked user
+func (db *DBService) PutTwitterUsername(authorId string, username string) error {
+	putUsernameSql := `insert into twitter_usernames(author_id, username) values ($1, $2)
+		on conflict (author_id, username) do update set last_seen = now()`
+	renameUserSql := "update users set twitter=$2 where twitter_id=$1 and twitter is distinct from $2"
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	tx, err := db.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	if _, err = tx.Exec(ctx, putUsernameSql, authorId, username); err != nil {
+		return err
+	}
+	if _, err = tx.Exec(ctx, renameUserSql, authorId, username); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// GetTwitterUsernameHistory returns the usernames authorId was seen under, the current one first
+func (db *DBService) GetTwitterUsernameHistory(authorId string) ([]common.TwitterUsernameInfo, error) {
+	getUsernameSql := "select author_id, username, first_seen, last_seen from twitter_usernames where author_id=$1 order by last_seen desc"
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	rows, err := db.pool.Query(ctx, getUsernameSql, authorId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	names := make([]common.TwitterUsernameInfo, 0)
+	for rows.Next() {
+		name := common.TwitterUsernameInfo{}
+		err = rows.Scan(&name.AuthorId, &name.Username, &name.FirstSeen, &name.LastSeen)
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
+
+// GetTwitterIdByAddress returns the twitter account linked to address, by the users row or else
+// the wallet link
+func (db *DBService) GetTwitterIdByAddress(address string) (string, error) {
+	getTwitterIdSql := "select twitter_id from users where lower(address)=lower($1) and twitter_id is not null"
+	getLinkSql := "select twitter_id from wallet_links where lower(address)=lower($1) and status='linked' order by updated_at desc limit 1"
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	var twitterId string
+	err := db.pool.QueryRow(ctx, getTwitterIdSql, address).Scan(&twitterId)
+	if errors.Is(err, pgx.ErrNoRows) {
+		err = db.pool.QueryRow(ctx, getLinkSql, address).Scan(&twitterId)
+	}
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", fmt.Errorf("%w: %v", AddressNotLinkedError, address)
+	}
+	return twitterId, err
+}
+
+func (db *DBService) GetConversationList() ([]common.ConversationInfo, error) {
+	getConversationSql := "select conversation_id, handler_name, created_at from conversations"
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	rows, err := db.pool.Query(ctx, getConversationSql)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	convList := make([]common.ConversationInfo, 0)
+	for rows.Next() {
+		conv := common.ConversationInfo{}
+		err = rows.Scan(&conv.ConversationId, &conv.HandlerName, &conv.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		convList = append(convList, conv)
+	}
+	return convList, rows.Err()
+}
+
+func (db *DBService) PutConversation(conversationId string, handlerName string) error {
+	putConversationSql := "insert into conversations(conversation_id, handler_name) values ($1, $2) on conflict (conversation_id) do update set handler_name = excluded.handler_name"
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	_, err := db.pool.Exec(ctx, putConversationSql, conversationId, handlerName)
+	return err
+}
+
+func (db *DBService) DeleteConversation(conversationId string) error {
+	deleteConversationSql := "delete from conversations where conversation_id=$1"
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	_, err := db.pool.Exec(ctx, deleteConversationSql, conversationId)
+	return err
+}
+
+// GetOracleKeys returns the oracle signing keys, oldest first
+func (db *DBService) GetOracleKeys() ([]common.OracleKeyInfo, error) {
+	getKeysSql := "select address, active_from, retired_at from oracle_keys order by active_from"
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	rows, err := db.pool.Query(ctx, getKeysSql)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	keys := make([]common.OracleKeyInfo, 0)
+	for rows.Next() {
+		key := common.OracleKeyInfo{}
+		if err = rows.Scan(&key.Address, &key.ActiveFrom, &key.RetiredAt); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+// PutOracleKey retires the current key when key becomes active, in one transaction
+func (db *DBService) PutOracleKey(key common.OracleKeyInfo) error {
+	retireSql := "update oracle_keys set retired_at=$1 where retired_at is null"
+	putKeySql := "insert into oracle_keys(address, active_from) values ($1, $2)"
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	tx, err := db.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	if _, err = tx.Exec(ctx, retireSql, key.ActiveFrom); err != nil {
+		return err
+	}
+	if _, err = tx.Exec(ctx, putKeySql, key.Address, key.ActiveFrom); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// GetEventTweetIdList returns the tweets of registered events, their metrics and quotes are polled
 func (db *DBService) GetEventTweetIdList() ([]string, error) {
-	return nil, nil
+	getEventTweetIdSql := "select tweet_id from events where status='registered' order by created_at"
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	rows, err := db.pool.Query(ctx, getEventTweetIdSql)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	tweetIdList := make([]string, 0)
+	for rows.Next() {
+		var tweetId string
+		if err = rows.Scan(&tweetId); err != nil {
+			return nil, err
+		}
+		tweetIdList = append(tweetIdList, tweetId)
+	}
+	return tweetIdList, rows.Err()
 }
 
 func (db *DBService) PutEventPublicMetric(tweetId string, metric common.TweetPublicMetricInfo) error {
-	return nil
+	putMetricSql := "update events set likes=$2, retweets=$3, quotes=$4, replies=$5, metrics_updated_at=now() where tweet_id=$1"
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	_, err := db.pool.Exec(ctx, putMetricSql, tweetId, metric.LikeCount, metric.RetweetCount, metric.QuoteCount, metric.ReplyCount)
+	return err
 }
 
+// PutQuotes saves the quotes of an event tweet, a quote polled again keeps its first row
 func (db *DBService) PutQuotes(tweetId string, quoteList []common.QuoteInfo) error {
-	return nil
+	putQuoteSql := `insert into event_quotes(tweet_id, event_tweet_id, author_id, author_name, text, likes, retweets, quotes, replies, created_at)
+		values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10) on conflict (tweet_id) do nothing`
+	if len(quoteList) == 0 {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	batch := &pgx.Batch{}
+	for _, quote := range quoteList {
+		metric := quote.PublicMetic
+		batch.Queue(putQuoteSql, quote.TweetId, tweetId, quote.AuthorId, quote.AuthorName, quote.Text,
+			metric.LikeCount, metric.RetweetCount, metric.QuoteCount, metric.ReplyCount, quote.CreatedAt)
+	}
+	return db.pool.SendBatch(ctx, batch).Close()
 }
 
+// GetLastQuoteId returns the newest saved quote of an event tweet, empty if there is none
 func (db *DBService) GetLastQuoteId(tweetId string) (string, error) {
-	return "", nil
+	getLastQuoteSql := "select coalesce(max(tweet_id::bigint)::text, '') from event_quotes where event_tweet_id=$1"
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	var lastQuoteId string
+	err := db.pool.QueryRow(ctx, getLastQuoteSql, tweetId).Scan(&lastQuoteId)
+	return lastQuoteId, err
+}
+
+// RegisterEvent stores the event of a registration tweet, EventNameTakenError if another tweet
+// registered the name. A tweet delivered again is left as it is, a rejected one may register later
+func (db *DBService) RegisterEvent(event common.EventTweetInfo) error {
+	getOwnerSql := "select tweet_id from events where lower(event_name)=lower($1) and status='registered'"
+	registerSql := `insert into events(tweet_id, event_name, author_id, author_name, text, status, created_at)
+		values ($1, $2, $3, $4, $5, 'registered', $6)
+		on conflict (tweet_id) do update set event_name=excluded.event_name, status='registered', error='', updated_at=now()
+		where events.status<>'registered'`
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	var owner string
+	err := db.pool.QueryRow(ctx, getOwnerSql, event.EventName).Scan(&owner)
+	if err == nil && owner != event.TweetId {
+		return fmt.Errorf("%w: #%v by tweet %v", EventNameTakenError, event.EventName, owner)
+	}
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return err
+	}
+	_, err = db.pool.Exec(ctx, registerSql, event.TweetId, event.EventName, event.AuthorId, event.AuthorName, event.Text, event.CreatedAt)
+	return err
+}
+
+// RejectEvent records why a registration tweet was refused, a registered tweet is never rejected
+func (db *DBService) RejectEvent(event common.EventTweetInfo, errMsg string) error {
+	rejectSql := `insert into events(tweet_id, event_name, author_id, author_name, text, status, error, created_at)
+		values ($1, $2, $3, $4, $5, 'rejected', $6, $7)
+		on conflict (tweet_id) do update set error=excluded.error, updated_at=now() where events.status<>'registered'`
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	_, err := db.pool.Exec(ctx, rejectSql, event.TweetId, event.EventName, event.AuthorId, event.AuthorName, event.Text, errMsg, event.CreatedAt)
+	return err
+}
+
+const eventColumns = "tweet_id, event_name, author_id, author_name, text, status, error, created_at, likes, retweets, quotes, replies, metrics_updated_at, updated_at"
+
+func scanEvent(row pgx.Row, event *common.EventInfo) error {
+	return row.Scan(&event.TweetId, &event.EventName, &event.AuthorId, &event.AuthorName, &event.Text, &event.Status, &event.Error,
+		&event.CreatedAt, &event.PublicMetric.LikeCount, &event.PublicMetric.RetweetCount, &event.PublicMetric.QuoteCount,
+		&event.PublicMetric.ReplyCount, &event.MetricsUpdatedAt, &event.UpdatedAt)
+}
+
+// GetEvent returns the registration of a tweet, registered or rejected
+func (db *DBService) GetEvent(tweetId string) (common.EventInfo, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	event := common.EventInfo{}
+	err := scanEvent(db.pool.QueryRow(ctx, "select "+eventColumns+" from events where tweet_id=$1", tweetId), &event)
+	return event, err
+}
+
+// GetEventList returns the registered events, oldest first
+func (db *DBService) GetEventList() ([]common.EventInfo, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	rows, err := db.pool.Query(ctx, "select "+eventColumns+" from events where status='registered' order by created_at")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	eventList := make([]common.EventInfo, 0)
+	for rows.Next() {
+		event := common.EventInfo{}
+		if err = scanEvent(rows, &event); err != nil {
+			return nil, err
+		}
+		eventList = append(eventList, event)
+	}
+	return eventList, rows.Err()
+}
+
+func (db *DBService) GetStreamCheckpoints() (map[string]string, error) {
+	getCheckpointSql := "select rule_id, last_tweet_id::text from stream_checkpoints"
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	rows, err := db.pool.Query(ctx, getCheckpointSql)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	checkpoints := make(map[string]string)
+	for rows.Next() {
+		var ruleId, tweetId string
+		err = rows.Scan(&ruleId, &tweetId)
+		if err != nil {
+			return nil, err
+		}
+		checkpoints[ruleId] = tweetId
+	}
+	return checkpoints, rows.Err()
+}
+
+// PutStreamCheckpoint only ever moves a rule checkpoint forward
+func (db *DBService) PutStreamCheckpoint(ruleId string, tweetId string) error {
+	putCheckpointSql := `insert into stream_checkpoints(rule_id, last_tweet_id) values ($1, $2::bigint)
+		on conflict (rule_id) do update set last_tweet_id = greatest(stream_checkpoints.last_tweet_id, excluded.last_tweet_id), updated_at = now()`
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	_, err := db.pool.Exec(ctx, putCheckpointSql, ruleId, tweetId)
+	return err
+}
+
+const deadLetterColumns = "id, tweet_id, handler_name, payload, error, attempts, next_retry_at, created_at, updated_at"
+
+// PutDeadLetter stores a failed tweet, failing again for the same handler bumps attempts
+func (db *DBService) PutDeadLetter(letter common.DeadLetterInfo) error {
+	putDeadLetterSql := `insert into dead_letters(tweet_id, handler_name, payload, error, next_retry_at) values ($1, $2, $3, $4, $5)
+		on conflict (tweet_id, handler_name) do update set error = excluded.error, attempts = dead_letters.attempts + 1,
+		next_retry_at = excluded.next_retry_at, updated_at = now()`
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	_, err := db.pool.Exec(ctx, putDeadLetterSql, letter.TweetId, letter.HandlerName, letter.Payload, letter.Error, letter.NextRetryAt)
+	return err
+}
+
+func (db *DBService) GetDeadLetterList() ([]common.DeadLetterInfo, error) {
+	return db.queryDeadLetters("select " + deadLetterColumns + " from dead_letters order by id")
+}
+
+// GetDueDeadLetters returns letters whose retry time has passed and that have attempts left
+func (db *DBService) GetDueDeadLetters(now time.Time, maxAttempts int) ([]common.DeadLetterInfo, error) {
+	return db.queryDeadLetters("select "+deadLetterColumns+" from dead_letters where next_retry_at <= $1 and attempts < $2 order by next_retry_at", now, maxAttempts)
+}
+
+func (db *DBService) queryDeadLetters(sql string, args ...interface{}) ([]common.DeadLetterInfo, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	rows, err := db.pool.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	letters := make([]common.DeadLetterInfo, 0)
+	for rows.Next() {
+		letter := common.DeadLetterInfo{}
+		err = rows.Scan(&letter.Id, &letter.TweetId, &letter.HandlerName, &letter.Payload, &letter.Error,
+			&letter.Attempts, &letter.NextRetryAt, &letter.CreatedAt, &letter.UpdatedAt)
+		if err != nil {
+			return nil, err
+		}
+		letters = append(letters, letter)
+	}
+	return letters, rows.Err()
+}
+
+func (db *DBService) GetDeadLetter(id int64) (common.DeadLetterInfo, error) {
+	getDeadLetterSql := "select " + deadLetterColumns + " from dead_letters where id=$1"
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	letter := common.DeadLetterInfo{}
+	err := db.pool.QueryRow(ctx, getDeadLetterSql, id).Scan(&letter.Id, &letter.TweetId, &letter.HandlerName, &letter.Payload,
+		&letter.Error, &letter.Attempts, &letter.NextRetryAt, &letter.CreatedAt, &letter.UpdatedAt)
+	return letter, err
+}
+
+func (db *DBService) UpdateDeadLetterAttempt(id int64, attempts int, errMsg string, nextRetryAt time.Time) error {
+	updateDeadLetterSql := "update dead_letters set attempts=$2, error=$3, next_retry_at=$4, updated_at=now() where id=$1"
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	_, err := db.pool.Exec(ctx, updateDeadLetterSql, id, attempts, errMsg, nextRetryAt)
+	return err
+}
+
+func (db *DBService) DeleteDeadLetter(id int64) error {
+	deleteDeadLetterSql := "delete from dead_letters where id=$1"
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	_, err := db.pool.Exec(ctx, deleteDeadLetterSql, id)
+	return err
+}
+
+const pendingThoughtColumns = "tweet_id, author_id, author_name, content, source_url, tips, created_at, expires_at"
+
+// PutPendingThought keeps a thought until its author links an address, a tweet delivered again
+// updates it in place
+func (db *DBService) PutPendingThought(thought common.PendingThoughtInfo) error {
+	putPendingThoughtSql := `insert into pending_thoughts(tweet_id, author_id, author_name, content, source_url, tips, expires_at)
+		values ($1, $2, $3, $4, $5, $6, $7) on conflict (tweet_id) do update set author_name = excluded.author_name,
+		content = excluded.content, source_url = excluded.source_url, tips = excluded.tips`
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	_, err := db.pool.Exec(ctx, putPendingThoughtSql, thought.TweetId, thought.AuthorId, thought.AuthorName, thought.Content,
+		thought.SourceUrl, thought.Tips, thought.ExpiresAt)
+	return err
+}
+
+// GetPendingThoughtList returns the unexpired pending thoughts, of one author if authorName is set
+func (db *DBService) GetPendingThoughtList(authorName string) ([]common.PendingThoughtInfo, error) {
+	getPendingThoughtSql := "select " + pendingThoughtColumns + " from pending_thoughts where expires_at > now() and ($1 = '' or lower(author_name) = lower($1)) order by author_name, created_at"
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	rows, err := db.pool.Query(ctx, getPendingThoughtSql, authorName)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	thoughts := make([]common.PendingThoughtInfo, 0)
+	for rows.Next() {
+		thought := common.PendingThoughtInfo{}
+		err = rows.Scan(&thought.TweetId, &thought.AuthorId, &thought.AuthorName, &thought.Content, &thought.SourceUrl,
+			&thought.Tips, &thought.CreatedAt, &thought.ExpiresAt)
+		if err != nil {
+			return nil, err
+		}
+		thoughts = append(thoughts, thought)
+	}
+	return thoughts, rows.Err()
+}
+
+// PromotePendingThoughts moves the pending thoughts of authors who linked an address into thoughts,
+// it returns how many were promoted
+func (db *DBService) PromotePendingThoughts() (int64, error) {
+	//addresses resolve as in getUserAddress: the users row of the account, its wallet link, the handle
+	promoteSql := `with resolved as (
+			select p.tweet_id, coalesce(
+				(select u.address from users u where u.twitter_id = p.author_id limit 1),
+				(select w.address from wallet_links w where w.twitter_id = p.author_id and w.status = 'linked'
+					order by w.updated_at desc limit 1),
+				(select u.address from users u where u.twitter_id is null and lower(u.twitter) = lower(p.author_name) limit 1)
+			) as address
+			from pending_thoughts p where p.expires_at > now()),
+		promoted as (
+			delete from pending_thoughts p using resolved r
+			where p.tweet_id = r.tweet_id and r.address is not null
+			returning p.tweet_id, p.content, r.address, p.source_url, p.tips)
+		insert into thoughts(tweet_id, content, address, source_url, submit_state, tips, thought_type, viewed)
+		select tweet_id, content, address, source_url, 'save', tips, 'twitter', 'all' from promoted
+		on conflict (tweet_id) do nothing`
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	tag, err := db.pool.Exec(ctx, promoteSql)
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
+
+// DeleteExpiredPendingThoughts drops pending thoughts whose author never linked an address in time
+func (db *DBService) DeleteExpiredPendingThoughts(now time.Time) (int64, error) {
+	deletePendingThoughtSql := "delete from pending_thoughts where expires_at <= $1"
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	tag, err := db.pool.Exec(ctx, deletePendingThoughtSql, now)
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
+
+const walletLinkColumns = "nonce, twitter, twitter_id, address, tweet_id, status, error, created_at, expires_at, updated_at"
+
+func (db *DBService) PutLinkNonce(link common.WalletLinkInfo) error {
+	putLinkNonceSql := "insert into wallet_links(nonce, twitter, status, expires_at) values ($1, $2, $3, $4)"
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	_, err := db.pool.Exec(ctx, putLinkNonceSql, link.Nonce, link.Twitter, link.Status, link.ExpiresAt)
+	return err
+}
+
+// GetLinkNonce returns the issued nonce, LinkNonceNotFoundError if it never was
+func (db *DBService) GetLinkNonce(nonce string) (common.WalletLinkInfo, error) {
+	link, err := db.queryWalletLink("select "+walletLinkColumns+" from wallet_links where nonce=$1", nonce)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return link, fmt.Errorf("%w: %v", LinkNonceNotFoundError, nonce)
+	}
+	return link, err
+}
+
+// GetWalletLinkStatus returns the latest link attempt of a twitter handle
+func (db *DBService) GetWalletLinkStatus(twitter string) (common.WalletLinkInfo, error) {
+	return db.queryWalletLink("select "+walletLinkColumns+" from wallet_links where twitter=$1 order by updated_at desc limit 1", twitter)
+}
+
+func (db *DBService) queryWalletLink(sql string, args ...interface{}) (common.WalletLinkInfo, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	link := common.WalletLinkInfo{}
+	err := db.pool.QueryRow(ctx, sql, args...).Scan(&link.Nonce, &link.Twitter, &link.TwitterId, &link.Address, &link.TweetId,
+		&link.Status, &link.Error, &link.CreatedAt, &link.ExpiresAt, &link.UpdatedAt)
+	return link, err
+}
+
+// LinkWallet consumes the nonce and binds the twitter account to the address in one transaction.
+// The nonce must be unused and unexpired, the tweet that already used it may link again. The
+// users row of the address is updated when the main service has one, the users table is not
+// ours to add rows to so otherwise the linked wallet_links row is the link
+func (db *DBService) LinkWallet(link common.WalletLinkInfo) error {
+	useNonceSql := `update wallet_links set status='linked', twitter_id=$2, address=$3, tweet_id=$4, error='', updated_at=now()
+		where nonce=$1 and ((status<>'linked' and expires_at > now()) or (status='linked' and tweet_id=$4))`
+	//the twitter id moves to the new address, an address keeps one account
+	replaceSql := `update wallet_links set status='replaced', updated_at=now()
+		where status='linked' and nonce<>$1 and (twitter_id=$2 or lower(address)=lower($3))`
+	unlinkSql := "update users set twitter_id=null where twitter_id=$1 and lower(address)<>lower($2)"
+	linkSql := "update users set twitter=$1, twitter_id=$2 where lower(address)=lower($3)"
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	tx, err := db.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	tag, err := tx.Exec(ctx, useNonceSql, link.Nonce, link.TwitterId, link.Address, link.TweetId)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("%w: %v", LinkNonceUsedError, link.Nonce)
+	}
+	if _, err = tx.Exec(ctx, replaceSql, link.Nonce, link.TwitterId, link.Address); err != nil {
+		return err
+	}
+	if _, err = tx.Exec(ctx, unlinkSql, link.TwitterId, link.Address); err != nil {
+		return err
+	}
+	if _, err = tx.Exec(ctx, linkSql, link.Twitter, link.TwitterId, link.Address); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// RejectWalletLink records why a link tweet failed, the nonce stays usable until it expires
+func (db *DBService) RejectWalletLink(nonce string, tweetId string, errMsg string) error {
+	rejectSql := "update wallet_links set status='rejected', tweet_id=$2, error=$3, updated_at=now() where nonce=$1 and status<>'linked'"
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	_, err := db.pool.Exec(ctx, rejectSql, nonce, tweetId, errMsg)
+	return err
+}
+
+// PutOAuthSession starts an oauth2 login, sessions that expired unused are dropped on the way
+func (db *DBService) PutOAuthSession(session common.OAuthSessionInfo) error {
+	deleteExpiredSql := "delete from oauth_sessions where expires_at <= now()"
+	putSessionSql := "insert into oauth_sessions(state, verifier, address, expires_at) values ($1, $2, $3, $4)"
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if _, err := db.pool.Exec(ctx, deleteExpiredSql); err != nil {
+		return err
+	}
+	_, err := db.pool.Exec(ctx, putSessionSql, session.State, session.Verifier, session.Address, session.ExpiresAt)
+	return err
+}
+
+func (db *DBService) GetOAuthSession(state string) (common.OAuthSessionInfo, error) {
+	getSessionSql := "select state, verifier, address, verified, created_at, expires_at from oauth_sessions where state=$1"
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	session := common.OAuthSessionInfo{}
+	err := db.pool.QueryRow(ctx, getSessionSql, state).Scan(&session.State, &session.Verifier, &session.Address,
+		&session.Verified, &session.CreatedAt, &session.ExpiresAt)
+	return session, err
+}
+
+// VerifyOAuthSession marks that the session's address signed its state
+func (db *DBService) VerifyOAuthSession(state string) error {
+	verifySessionSql := "update oauth_sessions set verified=true where state=$1"
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	_, err := db.pool.Exec(ctx, verifySessionSql, state)
+	return err
+}
+
+// TakeOAuthSession removes and returns a session so its code exchange runs only once
+func (db *DBService) TakeOAuthSession(state string) (common.OAuthSessionInfo, error) {
+	takeSessionSql := "delete from oauth_sessions where state=$1 returning state, verifier, address, verified, created_at, expires_at"
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	session := common.OAuthSessionInfo{}
+	err := db.pool.QueryRow(ctx, takeSessionSql, state).Scan(&session.State, &session.Verifier, &session.Address,
+		&session.Verified, &session.CreatedAt, &session.ExpiresAt)
+	return session, err
+}
+
+func (db *DBService) PutAttestationRecord(record common.AttestationRecord) error {
+	putRecordSql := `insert into attestation_records(kind, tweet_id, author_id, author_name, text, likes, retweets, quotes, replies, recorded_at)
+		values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10) on conflict (kind, tweet_id) where kind <> 'metrics' do nothing`
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	m := record.Metrics
+	_, err := db.pool.Exec(ctx, putRecordSql, record.Kind, record.TweetId, record.AuthorId, record.AuthorName, record.Text,
+		m.LikeCount, m.RetweetCount, m.QuoteCount, m.ReplyCount, record.RecordedAt)
+	return err
+}
+
+const attestationRecordColumns = "r.id, r.kind, r.tweet_id, r.author_id, r.author_name, r.text, r.likes, r.retweets, r.quotes, r.replies, r.recorded_at"
+
+func scanAttestationRecord(row pgx.Row, record *common.AttestationRecord, more ...interface{}) error {
+	m := &record.Metrics
+	dest := []interface{}{&record.Id, &record.Kind, &record.TweetId, &record.AuthorId, &record.AuthorName, &record.Text,
+		&m.LikeCount, &m.RetweetCount, &m.QuoteCount, &m.ReplyCount, &record.RecordedAt}
+	return row.Scan(append(dest, more...)...)
+}
+
+// GetUnsealedAttestationRecords returns the records of the next epoch in the order they were recorded
+func (db *DBService) GetUnsealedAttestationRecords() ([]common.AttestationRecord, error) {
+	getRecordSql := "select " + attestationRecordColumns + " from attestation_records r where r.epoch is null order by r.id"
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	rows, err := db.pool.Query(ctx, getRecordSql)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	records := make([]common.AttestationRecord, 0)
+	for rows.Next() {
+		record := common.AttestationRecord{}
+		if err = scanAttestationRecord(rows, &record); err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	return records, rows.Err()
+}
+
+// GetLastAttestationEpoch returns 0 before the first epoch
+func (db *DBService) GetLastAttestationEpoch() (int64, error) {
+	getEpochSql := "select coalesce(max(epoch), 0) from attestation_epochs"
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	var epoch int64
+	err := db.pool.QueryRow(ctx, getEpochSql).Scan(&epoch)
+	return epoch, err
+}
+
+func (db *DBService) SealAttestationEpoch(epoch common.AttestationEpochInfo, leaves []common.AttestationLeafInfo) error {
+	putEpochSql := "insert into attestation_epochs(epoch, root, count, signer, signature, created_at) values ($1, $2, $3, $4, $5, $6)"
+	placeRecordSql := "update attestation_records set epoch=$1, leaf_index=$2, leaf=$3, proof=$4 where id=$5 and epoch is null"
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	tx, err := db.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	_, err = tx.Exec(ctx, putEpochSql, epoch.Epoch, epoch.Root, epoch.Count, epoch.Signer, epoch.Signature, epoch.CreatedAt)
+	if err != nil {
+		return err
+	}
+	batch := &pgx.Batch{}
+	for _, leaf := range leaves {
+		batch.Queue(placeRecordSql, epoch.Epoch, leaf.Index, leaf.Leaf, leaf.Proof, leaf.RecordId)
+	}
+	if err = tx.SendBatch(ctx, batch).Close(); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// GetAttestationProofs returns the sealed records of a tweet, oldest epoch first
+func (db *DBService) GetAttestationProofs(tweetId string) ([]common.AttestationProofInfo, error) {
+	getProofSql := "select " + attestationRecordColumns + `, e.epoch, e.root, e.count, e.signer, e.signature, e.created_at,
+		r.leaf_index, r.leaf, r.proof from attestation_records r join attestation_epochs e on e.epoch = r.epoch
+		where r.tweet_id=$1 order by e.epoch, r.leaf_index`
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	rows, err := db.pool.Query(ctx, getProofSql, tweetId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	proofs := make([]common.AttestationProofInfo, 0)
+	for rows.Next() {
+		p := common.AttestationProofInfo{}
+		err = scanAttestationRecord(rows, &p.Record, &p.Epoch, &p.Root, &p.Count, &p.Signer, &p.Signature, &p.CreatedAt,
+			&p.Index, &p.Leaf, &p.Proof)
+		if err != nil {
+			return nil, err
+		}
+		p.RecordId = p.Record.Id
+		proofs = append(proofs, p)
+	}
+	return proofs, rows.Err()
 }
@@ -1,23 +1,338 @@
 package db
 
 import (
+	"context"
+	"errors"
 	"os"
 	"testing"
+	"time"
 	"twitter_oracle/common"
 )
 
 func TestPutThought(t *testing.T) {
+	if os.Getenv("DATABASE_URL") == "" {
+		t.Skip("DATABASE_URL not set")
+	}
 	common.BeaverToken = os.Getenv("TW_BEAVER")
 	db, err := Init()
 	if err != nil {
 		t.Fatal(err)
 	}
+	authorId := "1551129939281297408"
 	author := "ninox2022"
 	text := "this is a good day @ninox2022 #thought"
 	conversationId := "1587629551169204224"
 	tips := "test tips"
-	err = db.PutThought(author, text, conversationId, tips)
+	tweetId := "1587630498012332032"
+	err = db.Migrate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	//a redelivered tweet updates its thought instead of adding another
+	for i := 0; i < 2; i++ {
+		err = db.PutThought(tweetId, authorId, author, text, conversationId, tips)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	count := 0
+	err = db.pool.QueryRow(context.Background(), "select count(*) from thoughts where tweet_id=$1", tweetId).Scan(&count)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Fatalf("got %v thoughts for tweet %v, want 1", count, tweetId)
+	}
+}
+
+func TestPendingThoughts(t *testing.T) {
+	if os.Getenv("DATABASE_URL") == "" {
+		t.Skip("DATABASE_URL not set")
+	}
+	db, err := Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Migrate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	thought := common.PendingThoughtInfo{
+		TweetId:    "1587630498012332099",
+		AuthorId:   "1587630498012332000",
+		AuthorName: "not_registered_yet",
+		Content:    "this is a good day @ninox2022 #thought",
+		SourceUrl:  "https://twitter.com/not_registered_yet/status/1587630498012332099",
+		Tips:       "this is a good day",
+		ExpiresAt:  time.Now().Add(time.Hour),
+	}
+	err = db.PutPendingThought(thought)
+	if err != nil {
+		t.Fatal(err)
+	}
+	thoughts, err := db.GetPendingThoughtList(thought.AuthorName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(thoughts) != 1 || thoughts[0].TweetId != thought.TweetId {
+		t.Fatalf("unexpected pending thoughts %+v", thoughts)
+	}
+	expired, err := db.DeleteExpiredPendingThoughts(thought.ExpiresAt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expired < 1 {
+		t.Fatal("pending thought not expired")
+	}
+}
+
+func TestLinkWalletWithoutUser(t *testing.T) {
+	if os.Getenv("DATABASE_URL") == "" {
+		t.Skip("DATABASE_URL not set")
+	}
+	db, err := Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Migrate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	suffix := time.Now().Format("150405.000000")
+	twitterId := "1587630498012332002"
+	addresses := []string{"0x00000000000000000000000000000000000000a1", "0x00000000000000000000000000000000000000a2"}
+	for i, address := range addresses {
+		link := common.WalletLinkInfo{Nonce: suffix + address, Twitter: "linker", TwitterId: twitterId, Address: address, TweetId: suffix}
+		err = db.PutLinkNonce(common.WalletLinkInfo{Nonce: link.Nonce, Twitter: link.Twitter, Status: "issued", ExpiresAt: time.Now().Add(time.Hour)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = db.LinkWallet(link); err != nil {
+			t.Fatal(err)
+		}
+		got, err := db.GetTwitterIdByAddress(address)
+		if err != nil || got != twitterId {
+			t.Fatalf("link %v: got %v %v", i, got, err)
+		}
+	}
+	//the account moved on from the first address
+	if _, err = db.GetTwitterIdByAddress(addresses[0]); !errors.Is(err, AddressNotLinkedError) {
+		t.Fatalf("expected AddressNotLinkedError, got %v", err)
+	}
+	address, err := db.getUserAddress(context.Background(), twitterId, "linker")
+	if err != nil || address != addresses[1] {
+		t.Fatalf("got %v %v, want %v", address, err, addresses[1])
+	}
+	count := 0
+	err = db.pool.QueryRow(context.Background(), "select count(*) from users where twitter_id=$1", twitterId).Scan(&count)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Fatalf("linking added %v users rows", count)
+	}
+}
+
+func TestPromoteLinkedByTweet(t *testing.T) {
+	if os.Getenv("DATABASE_URL") == "" {
+		t.Skip("DATABASE_URL not set")
+	}
+	db, err := Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Migrate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	suffix := time.Now().Format("150405.000000")
+	address := "0x00000000000000000000000000000000000000c1"
+	thought := common.PendingThoughtInfo{
+		TweetId:    "15876304980123" + time.Now().Format("150405"),
+		AuthorId:   "1587630498012332004",
+		AuthorName: "linked_by_tweet",
+		Content:    "this is a good day @ninox2022 #thought",
+		SourceUrl:  "https://twitter.com/linked_by_tweet/status/1587630498012332098",
+		Tips:       "this is a good day",
+		ExpiresAt:  time.Now().Add(time.Hour),
+	}
+	if err = db.PutPendingThought(thought); err != nil {
+		t.Fatal(err)
+	}
+	link := common.WalletLinkInfo{Nonce: suffix + address, Twitter: thought.AuthorName, TwitterId: thought.AuthorId, Address: address, TweetId: suffix}
+	err = db.PutLinkNonce(common.WalletLinkInfo{Nonce: link.Nonce, Twitter: link.Twitter, Status: "issued", ExpiresAt: time.Now().Add(time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.LinkWallet(link); err != nil {
+		t.Fatal(err)
+	}
+	promoted, err := db.PromotePendingThoughts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if promoted < 1 {
+		t.Fatal("pending thought of a wallet linked by tweet not promoted")
+	}
+	var got string
+	err = db.pool.QueryRow(context.Background(), "select address from thoughts where tweet_id=$1", thought.TweetId).Scan(&got)
+	if err != nil || got != address {
+		t.Fatalf("promoted thought address %v %v, want %v", got, err, address)
+	}
+}
+
+func TestRelinkKeepsOldHandle(t *testing.T) {
+	if os.Getenv("DATABASE_URL") == "" {
+		t.Skip("DATABASE_URL not set")
+	}
+	db, err := Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Migrate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	suffix := time.Now().Format("150405.000000")
+	twitterId := "1587630498012332003"
+	oldAddress := "0x00000000000000000000000000000000000000b1"
+	newAddress := "0x00000000000000000000000000000000000000b2"
+	_, err = db.pool.Exec(ctx, "delete from users where lower(address)=lower($1)", oldAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.pool.Exec(ctx, "insert into users(address, twitter, twitter_id) values ($1, $2, $3)", oldAddress, "relinker", twitterId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	link := common.WalletLinkInfo{Nonce: suffix + newAddress, Twitter: "relinker", TwitterId: twitterId, Address: newAddress, TweetId: suffix}
+	err = db.PutLinkNonce(common.WalletLinkInfo{Nonce: link.Nonce, Twitter: link.Twitter, Status: "issued", ExpiresAt: time.Now().Add(time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.LinkWallet(link); err != nil {
+		t.Fatal(err)
+	}
+	//the old row still carries the handle, the next thought must not take the account back
+	for i := 0; i < 2; i++ {
+		address, err := db.getUserAddress(ctx, twitterId, "relinker")
+		if err != nil || address != newAddress {
+			t.Fatalf("got %v %v, want %v", address, err, newAddress)
+		}
+	}
+	if _, err = db.GetTwitterIdByAddress(oldAddress); !errors.Is(err, AddressNotLinkedError) {
+		t.Fatalf("expected AddressNotLinkedError, got %v", err)
+	}
+}
+
+func TestTwitterUsernameHistory(t *testing.T) {
+	if os.Getenv("DATABASE_URL") == "" {
+		t.Skip("DATABASE_URL not set")
+	}
+	db, err := Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Migrate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	authorId := "1587630498012332001"
+	for _, username := range []string{"before_rename", "after_rename"} {
+		err = db.PutTwitterUsername(authorId, username)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	names, err := db.GetTwitterUsernameHistory(authorId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 2 || names[0].Username != "after_rename" {
+		t.Fatalf("unexpected username history %+v", names)
+	}
+}
+
+func TestEvents(t *testing.T) {
+	if os.Getenv("DATABASE_URL") == "" {
+		t.Skip("DATABASE_URL not set")
+	}
+	db, err := Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Migrate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	event := common.EventTweetInfo{
+		TweetId:    "1593857112829136001",
+		AuthorId:   "1551129939281297408",
+		AuthorName: "ninox2022",
+		Text:       "#DbTestCon #HugMe @HUGGLE",
+		CreatedAt:  time.Now(),
+		EventName:  "DbTestCon",
+	}
+	//registered again by the same tweet it stays as it is
+	for i := 0; i < 2; i++ {
+		if err = db.RegisterEvent(event); err != nil {
+			t.Fatal(err)
+		}
+	}
+	duplicate := event
+	duplicate.TweetId, duplicate.EventName = "1593857112829136002", "dbtestcon"
+	if err = db.RegisterEvent(duplicate); !errors.Is(err, EventNameTakenError) {
+		t.Fatalf("expected EventNameTakenError, got %v", err)
+	}
+	if err = db.RejectEvent(duplicate, err.Error()); err != nil {
+		t.Fatal(err)
+	}
+	rejected, err := db.GetEvent(duplicate.TweetId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rejected.Status != "rejected" || rejected.Error == "" {
+		t.Fatalf("unexpected rejected event %+v", rejected)
+	}
+	tweetIdList, err := db.GetEventTweetIdList()
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, tweetId := range tweetIdList {
+		found = found || tweetId == event.TweetId
+		if tweetId == duplicate.TweetId {
+			t.Fatal("rejected event is polled")
+		}
+	}
+	if !found {
+		t.Fatalf("registered event not in %v", tweetIdList)
+	}
+
+	metric := common.TweetPublicMetricInfo{RetweetCount: 3, ReplyCount: 1, LikeCount: 7, QuoteCount: 2}
+	if err = db.PutEventPublicMetric(event.TweetId, metric); err != nil {
+		t.Fatal(err)
+	}
+	quotes := []common.QuoteInfo{
+		{TweetId: "1593857112829136012", AuthorId: "1", AuthorName: "a", Text: "quote", CreatedAt: time.Now()},
+		{TweetId: "1593857112829136011", AuthorId: "2", AuthorName: "b", Text: "quote", CreatedAt: time.Now()},
+	}
+	if err = db.PutQuotes(event.TweetId, quotes); err != nil {
+		t.Fatal(err)
+	}
+	lastQuoteId, err := db.GetLastQuoteId(event.TweetId)
 	if err != nil {
 		t.Fatal(err)
 	}
+	if lastQuoteId != quotes[0].TweetId {
+		t.Fatalf("last quote id %v, want %v", lastQuoteId, quotes[0].TweetId)
+	}
+	registered, err := db.GetEvent(event.TweetId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if registered.Status != "registered" || registered.PublicMetric != metric || registered.MetricsUpdatedAt == nil {
+		t.Fatalf("unexpected registered event %+v", registered)
+	}
 }
@@ -0,0 +1,77 @@
+package faketwitter
+
+import (
+	"encoding/json"
+	twitter "github.com/g8rswimmer/go-twitter/v2"
+	"os"
+	"twitter_oracle/twclient"
+)
+
+// Fixture is the scripted data the fake server answers from
+type Fixture struct {
+	Users  []*twitter.UserObj              `json:"users"`
+	Tweets []*twitter.TweetObj             `json:"tweets"`
+	Rules  []twitter.TweetSearchStreamRule `json:"rules"`
+	Search map[string][]string             `json:"search"`
+	Quotes map[string][]string             `json:"quotes"`
+	Stream []StreamEvent                   `json:"stream"`
+	Faults []Fault                         `json:"faults"`
+	//OAuthUser is the id of the user the oauth2 authorize endpoint logs in, the first user if empty
+	OAuthUser string `json:"oauth_user"`
+}
+
+// StreamEvent is one step of the filtered stream script, exactly one action field should be set
+type StreamEvent struct {
+	//DelayMs waits before the action is taken
+	DelayMs int `json:"delay_ms"`
+	//TweetId sends the fixture tweet with its author and matching rules
+	TweetId string `json:"tweet_id"`
+	//Tags limits matching_rules to rules with these tags, empty matches every rule
+	Tags []string `json:"tags"`
+	//System sends a system message such as {"error": {"message": "..."}}
+	System map[twitter.SystemMessageType]twitter.SystemMessage `json:"system"`
+	//Raw is written to the stream verbatim, used for malformed payloads
+	Raw string `json:"raw"`
+	//Disconnect ends the current connection, the script resumes on the next one
+	Disconnect bool `json:"disconnect"`
+}
+
+// Fault makes the next Count requests to Path fail, Status 200 with Malformed answers an undecodable body
+type Fault struct {
+	Path       string `json:"path"`
+	Status     int    `json:"status"`
+	Malformed  bool   `json:"malformed"`
+	Count      int    `json:"count"`
+	RetryAfter int    `json:"retry_after"`
+}
+
+func LoadFixture(path string) (*Fixture, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	fixture := &Fixture{}
+	if err := json.Unmarshal(b, fixture); err != nil {
+		return nil, err
+	}
+	return fixture, nil
+}
+
+func (f *Fixture) load(fake *twclient.Fake) {
+	for _, user := range f.Users {
+		fake.AddUser(user)
+	}
+	for _, tweet := range f.Tweets {
+		fake.AddTweet(tweet)
+	}
+	for query, ids := range f.Search {
+		for _, id := range ids {
+			fake.AddSearchResult(query, id)
+		}
+	}
+	for tweetId, ids := range f.Quotes {
+		for _, id := range ids {
+			fake.AddQuote(tweetId, id)
+		}
+	}
+}
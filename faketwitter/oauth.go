@@ -0,0 +1,135 @@
+package faketwitter
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+type oauthGrant struct {
+	userId      string
+	clientId    string
+	redirectUri string
+	challenge   string
+}
+
+// oauthState is the authorization code with PKCE flow of twitter, every authorize request is
+// approved by the logged in user
+type oauthState struct {
+	mutex  sync.Mutex
+	userId string
+	codes  map[string]oauthGrant
+	tokens map[string]string
+}
+
+func newOAuthState(fixture *Fixture) *oauthState {
+	userId := fixture.OAuthUser
+	if userId == "" && len(fixture.Users) > 0 {
+		userId = fixture.Users[0].ID
+	}
+	return &oauthState{
+		userId: userId,
+		codes:  make(map[string]oauthGrant),
+		tokens: make(map[string]string),
+	}
+}
+
+// SetOAuthUser logs userId in, the next authorize request is approved as them
+func (s *Server) SetOAuthUser(userId string) {
+	s.oauth.mutex.Lock()
+	defer s.oauth.mutex.Unlock()
+	s.oauth.userId = userId
+}
+
+func randomToken() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func (s *Server) oauthAuthorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	redirect, err := url.Parse(q.Get("redirect_uri"))
+	if err != nil || q.Get("redirect_uri") == "" {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid redirect_uri"))
+		return
+	}
+	if q.Get("response_type") != "code" || q.Get("client_id") == "" || q.Get("state") == "" ||
+		q.Get("code_challenge") == "" || q.Get("code_challenge_method") != "S256" {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid authorize request"))
+		return
+	}
+	code := randomToken()
+	s.oauth.mutex.Lock()
+	s.oauth.codes[code] = oauthGrant{
+		userId:      s.oauth.userId,
+		clientId:    q.Get("client_id"),
+		redirectUri: q.Get("redirect_uri"),
+		challenge:   q.Get("code_challenge"),
+	}
+	s.oauth.mutex.Unlock()
+	back := redirect.Query()
+	back.Set("state", q.Get("state"))
+	back.Set("code", code)
+	redirect.RawQuery = back.Encode()
+	http.Redirect(w, r, redirect.String(), http.StatusFound)
+}
+
+func (s *Server) oauthToken(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	clientId := r.PostForm.Get("client_id")
+	if user, _, ok := r.BasicAuth(); ok {
+		clientId = user
+	}
+	s.oauth.mutex.Lock()
+	defer s.oauth.mutex.Unlock()
+	grant, ok := s.oauth.codes[r.PostForm.Get("code")]
+	//a code is single use whether the exchange succeeds or not
+	delete(s.oauth.codes, r.PostForm.Get("code"))
+	sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	switch {
+	case r.PostForm.Get("grant_type") != "authorization_code", !ok:
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid_grant"))
+		return
+	case grant.clientId != clientId, grant.redirectUri != r.PostForm.Get("redirect_uri"):
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid_client"))
+		return
+	case base64.RawURLEncoding.EncodeToString(sum[:]) != grant.challenge:
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid_grant: code_verifier does not match"))
+		return
+	}
+	token := randomToken()
+	s.oauth.tokens[token] = grant.userId
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"token_type":   "bearer",
+		"access_token": token,
+		"expires_in":   7200,
+		"scope":        "users.read tweet.read",
+	})
+}
+
+func (s *Server) usersMe(w http.ResponseWriter, r *http.Request) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	s.oauth.mutex.Lock()
+	userId, ok := s.oauth.tokens[token]
+	s.oauth.mutex.Unlock()
+	if !ok {
+		writeError(w, http.StatusUnauthorized, fmt.Errorf("unauthorized"))
+		return
+	}
+	user, ok := s.fake.User(userId)
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("user %v not found", userId))
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"data": user})
+}
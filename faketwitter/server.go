@@ -0,0 +1,370 @@
+package faketwitter
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	twitter "github.com/g8rswimmer/go-twitter/v2"
+	"github.com/gorilla/mux"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"twitter_oracle/twclient"
+)
+
+var DefaultHeartbeat = time.Second * 20
+
+const rateLimitPerWindow = 450
+
+type matchingRule struct {
+	ID  twitter.TweetSearchStreamRuleID `json:"id"`
+	Tag string                          `json:"tag"`
+}
+
+type streamMessage struct {
+	Data          *twitter.TweetObj         `json:"data"`
+	Includes      *twitter.TweetRawIncludes `json:"includes,omitempty"`
+	MatchingRules []matchingRule            `json:"matching_rules"`
+}
+
+// Server serves the twitter v2 endpoints the oracle calls from a Fixture
+type Server struct {
+	Heartbeat time.Duration
+	fake      *twclient.Fake
+	router    *mux.Router
+	mutex     sync.Mutex
+	script    []StreamEvent
+	faults    []Fault
+	live      chan StreamEvent
+	oauth     *oauthState
+}
+
+func NewServer(fixture *Fixture) *Server {
+	if fixture == nil {
+		fixture = &Fixture{}
+	}
+	s := &Server{
+		Heartbeat: DefaultHeartbeat,
+		fake:      twclient.NewFake(),
+		script:    append([]StreamEvent(nil), fixture.Stream...),
+		faults:    append([]Fault(nil), fixture.Faults...),
+		live:      make(chan StreamEvent, 64),
+		oauth:     newOAuthState(fixture),
+	}
+	fixture.load(s.fake)
+	if len(fixture.Rules) > 0 {
+		s.fake.TweetSearchStreamAddRule(context.Background(), fixture.Rules, false)
+	}
+	r := mux.NewRouter()
+	r.HandleFunc("/2/tweets/search/stream/rules", s.getRules).Methods(http.MethodGet)
+	r.HandleFunc("/2/tweets/search/stream/rules", s.postRules).Methods(http.MethodPost)
+	r.HandleFunc("/2/tweets/search/stream", s.searchStream).Methods(http.MethodGet)
+	r.HandleFunc("/2/tweets/search/recent", s.recentSearch).Methods(http.MethodGet)
+	r.HandleFunc("/2/tweets/{id}/quote_tweets", s.quoteTweets).Methods(http.MethodGet)
+	r.HandleFunc("/2/tweets/{id}", s.tweetLookup).Methods(http.MethodGet)
+	r.HandleFunc("/2/tweets", s.tweetLookup).Methods(http.MethodGet)
+	r.HandleFunc("/i/oauth2/authorize", s.oauthAuthorize).Methods(http.MethodGet)
+	r.HandleFunc("/2/oauth2/token", s.oauthToken).Methods(http.MethodPost)
+	r.HandleFunc("/2/users/me", s.usersMe).Methods(http.MethodGet)
+	s.router = r
+	return s
+}
+
+// Fake exposes the backing state so tests can add tweets and inspect recorded calls
+func (s *Server) Fake() *twclient.Fake {
+	return s.fake
+}
+
+// Send pushes an event to the currently connected stream after the script is exhausted
+func (s *Server) Send(event StreamEvent) {
+	s.live <- event
+}
+
+// InjectFault queues a fault for the next requests to fault.Path
+func (s *Server) InjectFault(fault Fault) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.faults = append(s.faults, fault)
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if fault, ok := s.takeFault(r.URL.Path); ok {
+		writeFault(w, fault)
+		return
+	}
+	s.router.ServeHTTP(w, r)
+}
+
+func (s *Server) takeFault(path string) (Fault, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for i, fault := range s.faults {
+		if fault.Path != path {
+			continue
+		}
+		if fault.Count <= 1 {
+			s.faults = append(s.faults[:i], s.faults[i+1:]...)
+		} else {
+			s.faults[i].Count--
+		}
+		return fault, true
+	}
+	return Fault{}, false
+}
+
+func writeFault(w http.ResponseWriter, fault Fault) {
+	status := fault.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if status == http.StatusTooManyRequests {
+		retryAfter := fault.RetryAfter
+		if retryAfter == 0 {
+			retryAfter = 15 * 60
+		}
+		w.Header().Set("x-rate-limit-limit", strconv.Itoa(rateLimitPerWindow))
+		w.Header().Set("x-rate-limit-remaining", "0")
+		w.Header().Set("x-rate-limit-reset", strconv.FormatInt(time.Now().Add(time.Duration(retryAfter)*time.Second).Unix(), 10))
+	}
+	w.WriteHeader(status)
+	if fault.Malformed {
+		io.WriteString(w, `{"data": [{"id": `)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"title":  http.StatusText(status),
+		"detail": http.StatusText(status),
+		"type":   "about:blank",
+		"status": status,
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]interface{}{
+		"title":  http.StatusText(status),
+		"detail": err.Error(),
+		"type":   "about:blank",
+		"status": status,
+	})
+}
+
+func ruleIds(param string) []twitter.TweetSearchStreamRuleID {
+	ids := make([]twitter.TweetSearchStreamRuleID, 0)
+	for _, id := range strings.Split(param, ",") {
+		if id != "" {
+			ids = append(ids, twitter.TweetSearchStreamRuleID(id))
+		}
+	}
+	return ids
+}
+
+func (s *Server) getRules(w http.ResponseWriter, r *http.Request) {
+	resp, err := s.fake.TweetSearchStreamRules(r.Context(), ruleIds(r.URL.Query().Get("ids")))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (s *Server) postRules(w http.ResponseWriter, r *http.Request) {
+	body := struct {
+		Add    []twitter.TweetSearchStreamRule `json:"add"`
+		Delete *struct {
+			IDs []twitter.TweetSearchStreamRuleID `json:"ids"`
+		} `json:"delete"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	dryRun := r.URL.Query().Get("dry_run") == "true"
+	switch {
+	case len(body.Add) > 0:
+		resp, err := s.fake.TweetSearchStreamAddRule(r.Context(), body.Add, dryRun)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, resp)
+	case body.Delete != nil && len(body.Delete.IDs) > 0:
+		resp, err := s.fake.TweetSearchStreamDeleteRuleByID(r.Context(), body.Delete.IDs, dryRun)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, resp)
+	default:
+		writeError(w, http.StatusBadRequest, fmt.Errorf("one of add or delete is required"))
+	}
+}
+
+func (s *Server) tweetLookup(w http.ResponseWriter, r *http.Request) {
+	id, single := mux.Vars(r)["id"]
+	ids := []string{id}
+	if !single {
+		ids = strings.Split(r.URL.Query().Get("ids"), ",")
+	}
+	resp, err := s.fake.TweetLookup(r.Context(), ids, twitter.TweetLookupOpts{})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if !single {
+		writeJSON(w, http.StatusOK, resp.Raw)
+		return
+	}
+	body := struct {
+		Data     *twitter.TweetObj         `json:"data,omitempty"`
+		Includes *twitter.TweetRawIncludes `json:"includes,omitempty"`
+		Errors   []*twitter.ErrorObj       `json:"errors,omitempty"`
+	}{Includes: resp.Raw.Includes, Errors: resp.Raw.Errors}
+	if len(resp.Raw.Tweets) > 0 {
+		body.Data = resp.Raw.Tweets[0]
+	}
+	writeJSON(w, http.StatusOK, body)
+}
+
+func (s *Server) recentSearch(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	maxResults, _ := strconv.Atoi(q.Get("max_results"))
+	opts := twitter.TweetRecentSearchOpts{
+		MaxResults: maxResults,
+		NextToken:  q.Get("next_token"),
+		SinceID:    q.Get("since_id"),
+		UntilID:    q.Get("until_id"),
+	}
+	resp, err := s.fake.TweetRecentSearch(r.Context(), q.Get("query"), opts)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, struct {
+		*twitter.TweetRaw
+		Meta *twitter.TweetRecentSearchMeta `json:"meta"`
+	}{resp.Raw, resp.Meta})
+}
+
+func (s *Server) quoteTweets(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	maxResults, _ := strconv.Atoi(q.Get("max_results"))
+	opts := twitter.QuoteTweetsLookupOpts{
+		MaxResults:      maxResults,
+		PaginationToken: q.Get("pagination_token"),
+	}
+	resp, err := s.fake.QuoteTweetsLookup(r.Context(), mux.Vars(r)["id"], opts)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, struct {
+		*twitter.TweetRaw
+		Meta *twitter.QuoteTweetsLookupMeta `json:"meta"`
+	}{resp.Raw, resp.Meta})
+}
+
+// nextScripted pops the next scripted event, ok is false once the script is exhausted
+func (s *Server) nextScripted() (StreamEvent, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if len(s.script) == 0 {
+		return StreamEvent{}, false
+	}
+	event := s.script[0]
+	s.script = s.script[1:]
+	return event, true
+}
+
+func (s *Server) searchStream(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("streaming unsupported"))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(s.Heartbeat)
+	defer heartbeat.Stop()
+	for {
+		event, scripted := s.nextScripted()
+		if !scripted {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-heartbeat.C:
+				io.WriteString(w, "\r\n")
+				flusher.Flush()
+				continue
+			case event = <-s.live:
+			}
+		}
+		if event.DelayMs > 0 {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-time.After(time.Duration(event.DelayMs) * time.Millisecond):
+			}
+		}
+		if event.Disconnect {
+			return
+		}
+		payload, err := s.streamPayload(r.Context(), event)
+		if err != nil {
+			continue
+		}
+		if _, err := w.Write(append(payload, '\r', '\n')); err != nil {
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+func (s *Server) streamPayload(ctx context.Context, event StreamEvent) ([]byte, error) {
+	switch {
+	case event.Raw != "":
+		return []byte(event.Raw), nil
+	case event.System != nil:
+		return json.Marshal(event.System)
+	case event.TweetId != "":
+		resp, err := s.fake.TweetLookup(ctx, []string{event.TweetId}, twitter.TweetLookupOpts{})
+		if err != nil {
+			return nil, err
+		}
+		if len(resp.Raw.Tweets) == 0 {
+			return nil, fmt.Errorf("fixture tweet %v not found", event.TweetId)
+		}
+		return json.Marshal(streamMessage{
+			Data:          resp.Raw.Tweets[0],
+			Includes:      resp.Raw.Includes,
+			MatchingRules: s.matchingRules(event.Tags),
+		})
+	default:
+		return nil, fmt.Errorf("empty stream event")
+	}
+}
+
+func (s *Server) matchingRules(tags []string) []matchingRule {
+	want := make(map[string]bool)
+	for _, tag := range tags {
+		want[tag] = true
+	}
+	rules := make([]matchingRule, 0)
+	for _, rule := range s.fake.Rules() {
+		if len(want) == 0 || want[rule.Tag] {
+			rules = append(rules, matchingRule{ID: rule.ID, Tag: rule.Tag})
+		}
+	}
+	return rules
+}
@@ -0,0 +1,244 @@
+package faketwitter
+
+import (
+	"context"
+	"errors"
+	twitter "github.com/g8rswimmer/go-twitter/v2"
+	"net/http"
+	"testing"
+	"time"
+	"twitter_oracle/twclient"
+)
+
+func newFixtureServer(t *testing.T) *TestServer {
+	fixture, err := LoadFixture("testdata/fixture.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := NewTestServer(fixture)
+	//a short heartbeat lets a blocked stream reader notice Close quickly
+	ts.Heartbeat = 50 * time.Millisecond
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func TestRules(t *testing.T) {
+	ts := newFixtureServer(t)
+	client := ts.Client()
+	ctx := context.Background()
+
+	rules, err := client.TweetSearchStreamRules(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules.Rules) != 2 {
+		t.Fatalf("got %v rules, want 2", len(rules.Rules))
+	}
+	added, err := client.TweetSearchStreamAddRule(ctx, []twitter.TweetSearchStreamRule{{Value: "#HugReply", Tag: "replies"}}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if added.Meta.Summary.Created != 1 || len(ts.Fake().Rules()) != 2 {
+		t.Fatal("dry run must validate without adding")
+	}
+	_, err = client.TweetSearchStreamDeleteRuleByID(ctx, []twitter.TweetSearchStreamRuleID{rules.Rules[0].ID}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ts.Fake().Rules()) != 1 {
+		t.Fatal("rule not deleted")
+	}
+}
+
+func TestLookupSearchAndQuotes(t *testing.T) {
+	ts := newFixtureServer(t)
+	client := ts.Client()
+	ctx := context.Background()
+
+	single, err := client.TweetLookup(ctx, []string{"1000"}, twitter.TweetLookupOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if single.Raw.Tweets[0].PublicMetrics.Likes != 7 || single.Raw.Includes.Users[0].UserName != "HUGGLE" {
+		t.Fatalf("unexpected lookup %+v", single.Raw.Tweets[0])
+	}
+	multi, err := client.TweetLookup(ctx, []string{"1001", "1002", "404"}, twitter.TweetLookupOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(multi.Raw.Tweets) != 2 || len(multi.Raw.Errors) != 1 {
+		t.Fatalf("got %v tweets and %v errors", len(multi.Raw.Tweets), len(multi.Raw.Errors))
+	}
+
+	search, err := client.TweetRecentSearch(ctx, "@ninox2022 #thought", twitter.TweetRecentSearchOpts{SinceID: "1000"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if search.Meta.ResultCount != 1 || search.Raw.Tweets[0].ID != "1003" {
+		t.Fatalf("unexpected search result %+v", search.Meta)
+	}
+
+	quotes, err := client.QuoteTweetsLookup(ctx, "1000", twitter.QuoteTweetsLookupOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if quotes.Meta.ResultCount != 2 || quotes.Raw.Tweets[0].ID != "1002" {
+		t.Fatalf("quotes must come newest first, got %+v", quotes.Raw.Tweets)
+	}
+}
+
+func TestFaults(t *testing.T) {
+	ts := newFixtureServer(t)
+	client := ts.Client()
+	ctx := context.Background()
+
+	ts.InjectFault(Fault{Path: "/2/tweets/search/stream", Status: http.StatusTooManyRequests, RetryAfter: 60})
+	_, err := client.TweetSearchStream(ctx, twitter.TweetSearchStreamOpts{})
+	errResp := &twitter.ErrorResponse{}
+	if !errors.As(err, &errResp) || errResp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("expected 429, got %v", err)
+	}
+	if errResp.RateLimit == nil || errResp.RateLimit.Remaining != 0 {
+		t.Fatalf("expected rate limit headers, got %+v", errResp.RateLimit)
+	}
+
+	ts.InjectFault(Fault{Path: "/2/tweets/1000", Malformed: true})
+	_, err = client.TweetLookup(ctx, []string{"1000"}, twitter.TweetLookupOpts{})
+	decodeErr := &twitter.ResponseDecodeError{}
+	if !errors.As(err, &decodeErr) {
+		t.Fatalf("expected decode error, got %v", err)
+	}
+	if _, err = client.TweetLookup(ctx, []string{"1000"}, twitter.TweetLookupOpts{}); err != nil {
+		t.Fatalf("fault must only apply once, got %v", err)
+	}
+}
+
+func nextTweet(t *testing.T, ch <-chan *twclient.TweetMessage) *twclient.TweetMessage {
+	select {
+	case msg := <-ch:
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatal("no tweet received")
+	}
+	return nil
+}
+
+func waitDisconnected(t *testing.T, stream twclient.TweetStream) {
+	deadline := time.Now().Add(5 * time.Second)
+	for stream.Connection() {
+		if time.Now().After(deadline) {
+			t.Fatal("disconnect not detected")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestStreamScript(t *testing.T) {
+	ts := newFixtureServer(t)
+	client := ts.Client()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stream, err := client.TweetSearchStream(ctx, twitter.TweetSearchStreamOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := nextTweet(t, stream.Tweets())
+	if msg.Raw.Tweets[0].ID != "1003" {
+		t.Fatalf("got tweet %v, want 1003", msg.Raw.Tweets[0].ID)
+	}
+	if len(msg.MatchingRules) != 1 || msg.MatchingRules[0].Tag != "thought" {
+		t.Fatalf("unexpected matching rules %+v", msg.MatchingRules)
+	}
+	select {
+	case sys := <-stream.SystemMessages():
+		if sys[twitter.InfoMessageType].Message != "fixture info message" {
+			t.Fatalf("unexpected system message %+v", sys)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no system message received")
+	}
+	select {
+	case <-stream.Err():
+	case <-time.After(5 * time.Second):
+		t.Fatal("malformed payload not reported")
+	}
+	waitDisconnected(t, stream)
+	stream.Close()
+
+	//the script resumes after the disconnect on the next connection
+	stream, err = client.TweetSearchStream(ctx, twitter.TweetSearchStreamOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	if msg = nextTweet(t, stream.Tweets()); msg.Raw.Tweets[0].ID != "1000" {
+		t.Fatalf("got tweet %v, want 1000", msg.Raw.Tweets[0].ID)
+	}
+	ts.Send(StreamEvent{TweetId: "1001"})
+	if msg = nextTweet(t, stream.Tweets()); msg.Raw.Tweets[0].ID != "1001" {
+		t.Fatalf("got tweet %v, want 1001", msg.Raw.Tweets[0].ID)
+	}
+}
+
+func TestStreamProblemsAndHeartbeat(t *testing.T) {
+	ts := NewTestServer(&Fixture{})
+	ts.Heartbeat = 50 * time.Millisecond
+	t.Cleanup(ts.Close)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stream, err := ts.Client().TweetSearchStream(ctx, twitter.TweetSearchStreamOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	connected := stream.LastActivity()
+	time.Sleep(120 * time.Millisecond)
+	if !stream.LastActivity().After(connected) {
+		t.Fatal("heartbeat did not count as activity")
+	}
+	ts.Send(StreamEvent{Raw: `{"errors":[{"title":"operational-disconnect","disconnect_type":"UpstreamOperationalDisconnect","detail":"This stream has been disconnected upstream for operational reasons.","type":"https://api.twitter.com/2/problems/operational-disconnect"}]}`})
+	select {
+	case sys := <-stream.SystemMessages():
+		want := "operational-disconnect (UpstreamOperationalDisconnect): This stream has been disconnected upstream for operational reasons."
+		if sys[twitter.ErrorMessageType].Message != want {
+			t.Fatalf("unexpected system message %+v", sys)
+		}
+	case err := <-stream.Err():
+		t.Fatal(err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no system message received")
+	}
+}
+
+func TestStreamBackpressureIsNotStall(t *testing.T) {
+	ts := NewTestServer(&Fixture{})
+	//no heartbeats, only the blocked delivery keeps the stream active
+	ts.Heartbeat = time.Hour
+	t.Cleanup(ts.Close)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stream, err := ts.Client().TweetSearchStream(ctx, twitter.TweetSearchStreamOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	//fill the tweet channel and one more the reader blocks on
+	for i := 0; i < 65; i++ {
+		ts.Send(StreamEvent{Raw: `{"data":{"id":"1000","text":"slow"}}`})
+	}
+	time.Sleep(200 * time.Millisecond)
+	if silent := time.Since(stream.LastActivity()); silent > 50*time.Millisecond {
+		t.Fatalf("stream blocked on a slow consumer reported silent for %v", silent)
+	}
+	//once the consumer catches up the stall timer starts over
+	for i := 0; i < 65; i++ {
+		nextTweet(t, stream.Tweets())
+	}
+	time.Sleep(100 * time.Millisecond)
+	if silent := time.Since(stream.LastActivity()); silent < 50*time.Millisecond {
+		t.Fatalf("idle stream reported active %v ago", silent)
+	}
+}
@@ -0,0 +1,34 @@
+package faketwitter
+
+import (
+	"net/http/httptest"
+	"twitter_oracle/twclient"
+)
+
+// TestServer runs a Server on a local httptest listener
+type TestServer struct {
+	*Server
+	HTTP *httptest.Server
+}
+
+func NewTestServer(fixture *Fixture) *TestServer {
+	s := NewServer(fixture)
+	return &TestServer{
+		Server: s,
+		HTTP:   httptest.NewServer(s),
+	}
+}
+
+func (ts *TestServer) URL() string {
+	return ts.HTTP.URL
+}
+
+// Client returns a real api client pointed at the test server
+func (ts *TestServer) Client() twclient.Client {
+	return twclient.NewWithHTTPClient("fake-token", ts.HTTP.URL, ts.HTTP.Client())
+}
+
+func (ts *TestServer) Close() {
+	ts.HTTP.CloseClientConnections()
+	ts.HTTP.Close()
+}
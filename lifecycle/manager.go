@@ -0,0 +1,187 @@
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+	"twitter_oracle/log"
+)
+
+var (
+	ShutdownTimeoutError = errors.New("components still running after shutdown timeout")
+)
+
+var (
+	//DefaultShutdownTimeout bounds how long components get to drain after a signal
+	DefaultShutdownTimeout = time.Second * 30
+	RestartInitial         = time.Second
+	RestartMax             = time.Minute
+)
+
+type component struct {
+	name string
+	run  func(ctx context.Context) error
+}
+
+type hook struct {
+	name string
+	fn   func() error
+	//users are the components that must have stopped before fn runs, nil means all of them
+	users []string
+	//always runs fn even while components are still running
+	always bool
+}
+
+// Manager runs components until its context is cancelled. A component that fails or panics is
+// restarted with exponential backoff, on shutdown every component context is cancelled and the
+// shutdown hooks run once they returned. A hook whose components are still running when the
+// timeout passes is skipped, closing what they use under them would only turn a slow shutdown
+// into use-after-close errors.
+type Manager struct {
+	ShutdownTimeout time.Duration
+	components      []component
+	hooks           []hook
+}
+
+func New(shutdownTimeout time.Duration) *Manager {
+	return &Manager{
+		ShutdownTimeout: shutdownTimeout,
+	}
+}
+
+// Add registers a component, run must return once ctx is done. Returning nil before that ends
+// the component without a restart.
+func (m *Manager) Add(name string, run func(ctx context.Context) error) {
+	m.components = append(m.components, component{name: name, run: run})
+}
+
+// OnShutdown registers fn to run after the named components stopped, or all of them when none
+// is named. Hooks run in registration order
+func (m *Manager) OnShutdown(name string, fn func() error, users ...string) {
+	m.hooks = append(m.hooks, hook{name: name, fn: fn, users: users})
+}
+
+// Finally registers fn to run on shutdown even if components are still running, for hooks that
+// are safe under them such as flushing the log
+func (m *Manager) Finally(name string, fn func() error) {
+	m.hooks = append(m.hooks, hook{name: name, fn: fn, always: true})
+}
+
+// Run blocks until ctx is done and everything is shut down
+func (m *Manager) Run(ctx context.Context) error {
+	componentCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	running := make(map[string]bool)
+	for _, c := range m.components {
+		wg.Add(1)
+		running[c.name] = true
+		go func(c component) {
+			defer wg.Done()
+			m.supervise(componentCtx, c)
+			mutex.Lock()
+			delete(running, c.name)
+			mutex.Unlock()
+		}(c)
+	}
+	<-ctx.Done()
+	log.Info("shutting down, waiting up to", m.ShutdownTimeout, "for components")
+	cancel()
+
+	stopped := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(stopped)
+	}()
+	var err error
+	timer := time.NewTimer(m.ShutdownTimeout)
+	defer timer.Stop()
+	select {
+	case <-stopped:
+		log.Info("all components stopped")
+	case <-timer.C:
+		err = ShutdownTimeoutError
+		mutex.Lock()
+		log.Error(err, "running", len(running))
+		mutex.Unlock()
+	}
+	for _, h := range m.hooks {
+		mutex.Lock()
+		busy := h.busy(running)
+		mutex.Unlock()
+		if busy != "" {
+			log.Warn("shutdown hook skipped", h.name, "component still running", busy)
+			continue
+		}
+		if hookErr := h.fn(); hookErr != nil {
+			log.Error("shutdown hook error", h.name, hookErr)
+			if err == nil {
+				err = hookErr
+			}
+		}
+	}
+	return err
+}
+
+// busy returns a running component the hook waits for, empty when it can run
+func (h hook) busy(running map[string]bool) string {
+	if h.always {
+		return ""
+	}
+	if h.users == nil {
+		for name := range running {
+			return name
+		}
+		return ""
+	}
+	for _, name := range h.users {
+		if running[name] {
+			return name
+		}
+	}
+	return ""
+}
+
+func (m *Manager) supervise(ctx context.Context, c component) {
+	delay := RestartInitial
+	for {
+		started := time.Now()
+		err := runSafe(ctx, c)
+		if ctx.Err() != nil {
+			log.Info("component stopped", c.name)
+			return
+		}
+		if err == nil {
+			log.Info("component finished", c.name)
+			return
+		}
+		//a component that ran for a while starts over from the initial delay
+		if time.Since(started) > RestartMax {
+			delay = RestartInitial
+		}
+		log.Error("component failed", c.name, err, "restart in", delay)
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		delay *= 2
+		if delay > RestartMax {
+			delay = RestartMax
+		}
+	}
+}
+
+func runSafe(ctx context.Context, c component) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return c.run(ctx)
+}
@@ -0,0 +1,93 @@
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestManagerShutdown(t *testing.T) {
+	RestartInitial = time.Millisecond
+	m := New(time.Second)
+	var stopped, runs int32
+	m.Add("blocking", func(ctx context.Context) error {
+		<-ctx.Done()
+		//drains after cancel
+		time.Sleep(time.Millisecond * 20)
+		atomic.AddInt32(&stopped, 1)
+		return ctx.Err()
+	})
+	m.Add("flaky", func(ctx context.Context) error {
+		if atomic.AddInt32(&runs, 1) < 3 {
+			panic("boom")
+		}
+		<-ctx.Done()
+		return nil
+	})
+	var hooks []string
+	m.OnShutdown("db", func() error {
+		if atomic.LoadInt32(&stopped) != 1 {
+			t.Error("hook ran before components stopped")
+		}
+		hooks = append(hooks, "db")
+		return nil
+	})
+	m.OnShutdown("log", func() error {
+		hooks = append(hooks, "log")
+		return nil
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(time.Millisecond * 50)
+		cancel()
+	}()
+	if err := m.Run(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadInt32(&runs) != 3 {
+		t.Fatalf("flaky component ran %v times, want 3", runs)
+	}
+	if len(hooks) != 2 || hooks[0] != "db" || hooks[1] != "log" {
+		t.Fatalf("hooks ran %v", hooks)
+	}
+}
+
+func TestManagerShutdownTimeout(t *testing.T) {
+	m := New(time.Millisecond * 20)
+	release := make(chan struct{})
+	defer close(release)
+	m.Add("stuck", func(ctx context.Context) error {
+		<-release
+		return nil
+	})
+	m.Add("recorder user", func(ctx context.Context) error {
+		<-ctx.Done()
+		return nil
+	})
+	var ran []string
+	m.OnShutdown("db", func() error {
+		ran = append(ran, "db")
+		return nil
+	})
+	m.OnShutdown("recorder", func() error {
+		ran = append(ran, "recorder")
+		return nil
+	}, "recorder user")
+	m.Finally("log", func() error {
+		ran = append(ran, "log")
+		return nil
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := m.Run(ctx); !errors.Is(err, ShutdownTimeoutError) {
+		t.Fatalf("got %v, want ShutdownTimeoutError", err)
+	}
+	//the db may still be in use by the stuck component
+	if fmt.Sprint(ran) != "[recorder log]" {
+		t.Fatalf("hooks ran %v, want [recorder log]", ran)
+	}
+}
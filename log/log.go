@@ -510,6 +510,14 @@ func CheckIfNeedNewFile() bool {
 	}
 }
 
+// Flush commits the log file to disk
+func Flush() error {
+	if Log.logFile != nil {
+		return Log.logFile.Sync()
+	}
+	return nil
+}
+
 func ClosePrintLog() error {
 	var err error
 	if Log.logFile != nil {
@@ -2,15 +2,33 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	ethcommon "github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethclient"
 	"gopkg.in/urfave/cli.v1"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
+	"time"
+	"twitter_oracle/adapter"
+	"twitter_oracle/attest"
+	"twitter_oracle/chain"
 	"twitter_oracle/common"
 	"twitter_oracle/db"
+	"twitter_oracle/lifecycle"
 	"twitter_oracle/log"
+	"twitter_oracle/oauth"
+	"twitter_oracle/oracle"
+	"twitter_oracle/query"
+	"twitter_oracle/restful"
+	"twitter_oracle/signer"
 	"twitter_oracle/stream"
+	"twitter_oracle/twclient"
 )
 
 var (
@@ -37,6 +55,109 @@ var (
 		Name:  "beaver",
 		Usage: "auth beaver token",
 	}
+	//read by go-ethereum/metrics from os.Args at init, declared so the cli accepts it
+	metricsFlag = cli.BoolFlag{
+		Name:  "metrics",
+		Usage: "enable metrics collection, served by the rest service at /debug/metrics/prometheus",
+	}
+	twitterHostFlag = cli.StringFlag{
+		Name:  "twitter-host",
+		Usage: "twitter api host, point at cmd/fake-twitter for local testing",
+		Value: twclient.DefaultHost,
+	}
+	rulesFlag = cli.StringFlag{
+		Name:  "rules",
+		Usage: "stream rules manifest, reconciled with the live rules at startup",
+	}
+	workersFlag = cli.IntFlag{
+		Name:  "workers",
+		Usage: "number of workers handling tweets, tweets of one conversation stay in order",
+		Value: stream.DefaultWorkerPoolConfig.Workers,
+	}
+	recordFlag = cli.StringFlag{
+		Name:  "record",
+		Usage: "directory to record the stream to as rotating NDJSON files",
+	}
+	speedFlag = cli.Float64Flag{
+		Name:  "speed",
+		Usage: "replay speed, 1 keeps the recorded pace, 0 replays as fast as possible",
+		Value: 1,
+	}
+	pollIntervalFlag = cli.DurationFlag{
+		Name:  "poll-interval",
+		Usage: "how often the querier polls event tweet metrics and quotes",
+		Value: time.Minute * 10,
+	}
+	shutdownTimeoutFlag = cli.DurationFlag{
+		Name:  "shutdown-timeout",
+		Usage: "how long in-flight work may drain after an exit signal",
+		Value: lifecycle.DefaultShutdownTimeout,
+	}
+	tipsLenFlag = cli.IntFlag{
+		Name:  "tips-len",
+		Usage: "how many characters the tips of a thought keep",
+		Value: stream.MAX_TIPS_LEN,
+	}
+	pendingTTLFlag = cli.DurationFlag{
+		Name:  "pending-ttl",
+		Usage: "how long thoughts of authors without a linked address wait before they are dropped",
+		Value: stream.DefaultPendingPolicy.TTL,
+	}
+	oauthClientIdFlag = cli.StringFlag{
+		Name:  "oauth-client-id",
+		Usage: "twitter oauth2 client id, enables linking wallets by twitter login, the secret is read from TW_OAUTH_SECRET",
+	}
+	oauthRedirectFlag = cli.StringFlag{
+		Name:  "oauth-redirect-url",
+		Usage: "oauth2 redirect url registered for the twitter app, served by the rest service at /oauth/callback",
+	}
+	oracleRPCFlag = cli.StringFlag{
+		Name:  "oracle-rpc",
+		Usage: "ethereum node rpc url, enables publishing event metrics to --oracle-contract with the key in TW_ORACLE_KEY",
+	}
+	oracleContractFlag = cli.StringFlag{
+		Name:  "oracle-contract",
+		Usage: "address of the MetricsOracle contract owned by the TW_ORACLE_KEY account",
+	}
+	oracleIntervalFlag = cli.DurationFlag{
+		Name:  "oracle-interval",
+		Usage: "how often changed event metrics are submitted on chain",
+		Value: chain.DefaultPublisherConfig.Interval,
+	}
+	attestFlag = cli.BoolFlag{
+		Name:  "attest",
+		Usage: "seal recorded thoughts, quotes and metrics into merkle roots signed with the key in TW_ATTEST_KEY",
+	}
+	attestIntervalFlag = cli.DurationFlag{
+		Name:  "attest-interval",
+		Usage: "length of an attestation epoch",
+		Value: attest.DefaultEpochInterval,
+	}
+	signerKeyFileFlag = cli.StringFlag{
+		Name:  "signer-keyfile",
+		Usage: "oracle signer key, a geth keystore file unlocked with TW_SIGNER_PASSWORD or a hex key file, replace it and call /oracle_keys/rotate to rotate",
+	}
+	signerExternalFlag = cli.StringFlag{
+		Name:  "signer-external",
+		Usage: "clef compatible signer endpoint used instead of --signer-keyfile",
+	}
+	signerAddressFlag = cli.StringFlag{
+		Name:  "signer-address",
+		Usage: "account of --signer-external that signs oracle facts",
+	}
+	signerChainIdFlag = cli.Int64Flag{
+		Name:  "signer-chain-id",
+		Usage: "chain id of the EIP-712 domain of signed facts",
+		Value: 1,
+	}
+	signerContractFlag = cli.StringFlag{
+		Name:  "signer-contract",
+		Usage: "verifying contract of the EIP-712 domain of signed facts",
+	}
+	dryRunFlag = cli.BoolFlag{
+		Name:  "dry-run",
+		Usage: "only validate the manifest and report the changes",
+	}
 )
 
 var commandStart = cli.Command{
@@ -44,15 +165,94 @@ var commandStart = cli.Command{
 	Usage: "start twitter oracle",
 	Flags: []cli.Flag{
 		//beaverFlag,
+		portFlag,
+		twitterHostFlag,
+		metricsFlag,
+		rulesFlag,
+		workersFlag,
+		recordFlag,
+		pollIntervalFlag,
+		shutdownTimeoutFlag,
+		tipsLenFlag,
+		pendingTTLFlag,
+		oauthClientIdFlag,
+		oauthRedirectFlag,
+		oracleRPCFlag,
+		oracleContractFlag,
+		oracleIntervalFlag,
+		attestFlag,
+		attestIntervalFlag,
+		signerKeyFileFlag,
+		signerExternalFlag,
+		signerAddressFlag,
+		signerChainIdFlag,
+		signerContractFlag,
 	},
 	Action: Start,
 }
 
+var commandReplay = cli.Command{
+	Name:      "replay",
+	Usage:     "feed recorded stream files through the handlers",
+	ArgsUsage: "<file or directory>...",
+	Flags: []cli.Flag{
+		twitterHostFlag,
+		speedFlag,
+		tipsLenFlag,
+	},
+	Action: Replay,
+}
+
+var commandDeadLetters = cli.Command{
+	Name:  "dead-letters",
+	Usage: "manage tweets whose handler failed",
+	Subcommands: []cli.Command{
+		{
+			Name:   "list",
+			Usage:  "list dead-lettered tweets",
+			Action: ListDeadLetters,
+		},
+		{
+			Name:      "show",
+			Usage:     "show one dead-lettered tweet with its payload",
+			ArgsUsage: "<id>",
+			Action:    DeadLetterAction,
+		},
+		{
+			Name:      "replay",
+			Usage:     "run the handler of a dead-lettered tweet again",
+			ArgsUsage: "<id>",
+			Flags:     []cli.Flag{twitterHostFlag, tipsLenFlag},
+			Action:    DeadLetterAction,
+		},
+		{
+			Name:      "discard",
+			Usage:     "drop a dead-lettered tweet",
+			ArgsUsage: "<id>",
+			Action:    DeadLetterAction,
+		},
+	},
+}
+
+var commandSyncRules = cli.Command{
+	Name:  "sync-rules",
+	Usage: "reconcile the stream rules with a manifest",
+	Flags: []cli.Flag{
+		twitterHostFlag,
+		rulesFlag,
+		dryRunFlag,
+	},
+	Action: SyncRules,
+}
+
 func init() {
 	app = cli.NewApp()
 	app.Version = "v1.0.0"
 	app.Commands = []cli.Command{
 		commandStart,
+		commandSyncRules,
+		commandDeadLetters,
+		commandReplay,
 	}
 	cli.CommandHelpTemplate = OriginCommandHelpTemplate
 }
@@ -66,46 +266,266 @@ func main() {
 
 func Start(ctx *cli.Context) {
 	common.BeaverToken = os.Getenv("TW_BEAVER")
+	setTipsLen(ctx)
+	exitCtx := exitContext()
+	manager := lifecycle.New(ctx.Duration(shutdownTimeoutFlag.Name))
 	//init and start services
 	dbt, err := db.Init()
 	if err != nil {
 		panic(err)
 	}
 	log.Info("db connected")
+	err = dbt.Migrate()
+	if err != nil {
+		panic(err)
+	}
 
-	sub, err := stream.Init(dbt)
+	client := twclient.New(common.BeaverToken, ctx.String(twitterHostFlag.Name))
+	sub, err := stream.Init(dbt, client)
 	if err != nil {
 		panic(err)
 	}
 	sub.AddDefaultHanler(sub.LoadThoughtHandler)
-	err = sub.Start(context.Background())
+	sub.Workers.Workers = ctx.Int(workersFlag.Name)
+	sub.DrainTimeout = ctx.Duration(shutdownTimeoutFlag.Name) * 2 / 3
+	sub.Pending.TTL = ctx.Duration(pendingTTLFlag.Name)
+	if recordDir := ctx.String(recordFlag.Name); recordDir != "" {
+		recorder, err := stream.NewRecorder(recordDir, stream.DefaultRecordInterval, stream.DefaultRecordMaxBytes)
+		if err != nil {
+			panic(err)
+		}
+		manager.OnShutdown("recorder", recorder.Close, "stream subscriber")
+		sub.SetRecorder(recorder)
+	}
+	if rulesFile := ctx.String(rulesFlag.Name); rulesFile != "" {
+		sub.RulesFile = rulesFile
+		_, err = sub.SyncRulesFile(exitCtx, rulesFile, false)
+		if err != nil {
+			panic(err)
+		}
+	}
+	querier := query.Init(dbt, ctx.Duration(pollIntervalFlag.Name), client)
+	sub.Enroller = querier
+	if rpcUrl := ctx.String(oracleRPCFlag.Name); rpcUrl != "" {
+		publisher, err := newPublisher(exitCtx, rpcUrl, ctx.String(oracleContractFlag.Name))
+		if err != nil {
+			panic(err)
+		}
+		publisher.Interval = ctx.Duration(oracleIntervalFlag.Name)
+		querier.Publisher = publisher
+		manager.Add("metrics publisher", publisher.Start)
+	}
+	restS := restful.InitRestService(ctx.String(portFlag.Name), dbt)
+	restS.Subscriber = sub
+	restS.RulesFile = ctx.String(rulesFlag.Name)
+	restS.AdminToken = os.Getenv("TW_ADMIN_TOKEN")
+	restS.Adapter = adapter.New(querier, dbt)
+	restS.Querier = querier
+	if load := signerLoader(ctx); load != nil {
+		keys := signer.NewKeyRing(load, dbt)
+		if _, err := keys.Reload(exitCtx); err != nil {
+			panic(err)
+		}
+		contract := ctx.String(signerContractFlag.Name)
+		if contract != "" && !ethcommon.IsHexAddress(contract) {
+			panic(fmt.Errorf("invalid signer contract %q", contract))
+		}
+		restS.Oracle = oracle.NewOracle(client, keys, ctx.Int64(signerChainIdFlag.Name), contract)
+	}
+	if ctx.Bool(attestFlag.Name) {
+		key, err := crypto.HexToECDSA(strings.TrimPrefix(os.Getenv("TW_ATTEST_KEY"), "0x"))
+		if err != nil {
+			panic(fmt.Errorf("TW_ATTEST_KEY: %v", err))
+		}
+		attester := attest.NewAttester(dbt, key)
+		attester.Interval = ctx.Duration(attestIntervalFlag.Name)
+		sub.Attester = attester
+		querier.Attester = attester
+		restS.Attester = attester
+		manager.Add("attester", attester.Start)
+	}
+	if clientId := ctx.String(oauthClientIdFlag.Name); clientId != "" {
+		config := oauth.NewConfig(clientId, os.Getenv("TW_OAUTH_SECRET"), ctx.String(oauthRedirectFlag.Name), ctx.String(twitterHostFlag.Name))
+		restS.OAuth = oauth.NewFlow(config, dbt, dbt, nil)
+	}
+
+	manager.Add("stream subscriber", sub.Start)
+	manager.Add("dead letter retry", func(ctx context.Context) error {
+		sub.RetryDeadLetters(ctx)
+		return nil
+	})
+	manager.Add("pending thoughts", func(ctx context.Context) error {
+		sub.PromotePendingThoughts(ctx)
+		return nil
+	})
+	manager.Add("querier", querier.Start)
+	manager.Add("rest api", restS.Start)
+	manager.OnShutdown("db", func() error {
+		dbt.Close()
+		return nil
+	})
+	manager.Finally("log", log.Flush)
+	log.Info("oracle started")
+	err = manager.Run(exitCtx)
 	if err != nil {
-		panic(err)
+		log.Error("shutdown", err)
+	}
+	log.ClosePrintLog()
+}
+
+func SyncRules(ctx *cli.Context) error {
+	rulesFile := ctx.String(rulesFlag.Name)
+	if rulesFile == "" {
+		return errors.New("missing --rules manifest")
 	}
-	log.Info("stream subscriber started")
+	client := twclient.New(os.Getenv("TW_BEAVER"), ctx.String(twitterHostFlag.Name))
+	sub, err := stream.Init(nil, client)
+	if err != nil {
+		return err
+	}
+	report, err := sub.SyncRulesFile(context.Background(), rulesFile, ctx.Bool(dryRunFlag.Name))
+	if report != nil {
+		enc, _ := json.MarshalIndent(report, "", "    ")
+		fmt.Println(string(enc))
+	}
+	return err
+}
+
+// initSubscriber connects the db and a subscriber that handles tweets like the start command
+func initSubscriber(ctx *cli.Context) (*stream.Subscriber, error) {
+	setTipsLen(ctx)
+	dbt, err := db.Init()
+	if err != nil {
+		return nil, err
+	}
+	err = dbt.Migrate()
+	if err != nil {
+		return nil, err
+	}
+	client := twclient.New(os.Getenv("TW_BEAVER"), ctx.String(twitterHostFlag.Name))
+	sub, err := stream.Init(dbt, client)
+	if err != nil {
+		return nil, err
+	}
+	sub.AddDefaultHanler(sub.LoadThoughtHandler)
+	return sub, nil
+}
+
+// newPublisher connects to the node at rpcUrl and signs with TW_ORACLE_KEY
+func newPublisher(ctx context.Context, rpcUrl string, contractAddress string) (*chain.Publisher, error) {
+	if !ethcommon.IsHexAddress(contractAddress) {
+		return nil, fmt.Errorf("invalid oracle contract address %q", contractAddress)
+	}
+	key, err := crypto.HexToECDSA(strings.TrimPrefix(os.Getenv("TW_ORACLE_KEY"), "0x"))
+	if err != nil {
+		return nil, fmt.Errorf("TW_ORACLE_KEY: %v", err)
+	}
+	backend, err := ethclient.DialContext(ctx, rpcUrl)
+	if err != nil {
+		return nil, err
+	}
+	chainId, err := backend.ChainID(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return chain.NewPublisher(backend, ethcommon.HexToAddress(contractAddress), key, chainId)
+}
+
+// signerLoader opens the oracle signer configured by the start flags, nil if none is
+func signerLoader(ctx *cli.Context) signer.Loader {
+	if endpoint := ctx.String(signerExternalFlag.Name); endpoint != "" {
+		address := ctx.String(signerAddressFlag.Name)
+		return func(ctx context.Context) (signer.Signer, error) {
+			if !ethcommon.IsHexAddress(address) {
+				return nil, fmt.Errorf("invalid signer address %q", address)
+			}
+			return signer.NewExternalSigner(ctx, endpoint, ethcommon.HexToAddress(address))
+		}
+	}
+	if keyFile := ctx.String(signerKeyFileFlag.Name); keyFile != "" {
+		return func(ctx context.Context) (signer.Signer, error) {
+			return signer.LoadKeyFile(keyFile, os.Getenv("TW_SIGNER_PASSWORD"))
+		}
+	}
+	return nil
+}
 
-	//restS := restful.InitRestService(port, dbt)
-	//err = restS.Start()
-	//if err != nil {
-	//	panic(err)
-	//}
-	//log.Info("rest api started")
-	waitToExit()
+// setTipsLen applies --tips-len for the commands declaring it
+func setTipsLen(ctx *cli.Context) {
+	if tipsLen := ctx.Int(tipsLenFlag.Name); tipsLen > 0 {
+		stream.MAX_TIPS_LEN = tipsLen
+	}
+}
+
+func ListDeadLetters(ctx *cli.Context) error {
+	sub, err := initSubscriber(ctx)
+	if err != nil {
+		return err
+	}
+	letters, err := sub.ListDeadLetters()
+	if err != nil {
+		return err
+	}
+	for _, letter := range letters {
+		fmt.Printf("%v\ttweet:%v\thandler:%v\tattempts:%v\tnext retry:%v\terror:%v\n", letter.Id, letter.TweetId,
+			letter.HandlerName, letter.Attempts, letter.NextRetryAt.Format(time.RFC3339), letter.Error)
+	}
+	return nil
 }
 
-func waitToExit() {
-	exit := make(chan bool, 0)
+func DeadLetterAction(ctx *cli.Context) error {
+	id, err := strconv.ParseInt(ctx.Args().First(), 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid dead letter id %q", ctx.Args().First())
+	}
+	sub, err := initSubscriber(ctx)
+	if err != nil {
+		return err
+	}
+	switch ctx.Command.Name {
+	case "replay":
+		return sub.ReplayDeadLetter(context.Background(), id)
+	case "discard":
+		return sub.DiscardDeadLetter(id)
+	}
+	letter, err := sub.GetDeadLetter(id)
+	if err != nil {
+		return err
+	}
+	enc, _ := json.MarshalIndent(letter, "", "    ")
+	fmt.Println(string(enc))
+	return nil
+}
+
+func Replay(ctx *cli.Context) error {
+	if !ctx.Args().Present() {
+		return errors.New("missing recording files")
+	}
+	files, err := stream.RecordingFiles(ctx.Args())
+	if err != nil {
+		return err
+	}
+	sub, err := initSubscriber(ctx)
+	if err != nil {
+		return err
+	}
+	replayed, err := sub.Replay(context.Background(), files, ctx.Float64(speedFlag.Name))
+	log.Info("replayed", replayed, "tweets from", len(files), "files")
+	return err
+}
+
+// exitContext is cancelled on the first exit signal
+func exitContext() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
 	sc := make(chan os.Signal, 1)
 	if !signal.Ignored(syscall.SIGHUP) {
 		signal.Notify(sc, syscall.SIGHUP)
 	}
 	signal.Notify(sc, syscall.SIGINT, syscall.SIGTERM)
 	go func() {
-		for sig := range sc {
-			fmt.Printf("received exit signal:%v", sig.String())
-			close(exit)
-			break
-		}
+		sig := <-sc
+		fmt.Printf("received exit signal:%v\n", sig.String())
+		cancel()
 	}()
-	<-exit
+	return ctx
 }
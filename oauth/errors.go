@@ -0,0 +1,12 @@
+package oauth
+
+import "errors"
+
+var (
+	InvalidAddressError      = errors.New("invalid ethereum address")
+	SessionExpiredError      = errors.New("oauth session unknown or expired")
+	SessionNotVerifiedError  = errors.New("oauth session address signature not verified")
+	TokenExchangeError       = errors.New("oauth code exchange failed")
+	UserLookupError          = errors.New("oauth users/me failed")
+	AuthorizationDeniedError = errors.New("oauth authorization denied")
+)
@@ -0,0 +1,273 @@
+package oauth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+	"twitter_oracle/common"
+	"twitter_oracle/log"
+	"twitter_oracle/stream"
+	"twitter_oracle/twclient"
+)
+
+var (
+	DefaultAuthorizeURL = "https://twitter.com/i/oauth2/authorize"
+	DefaultScopes       = []string{"users.read", "tweet.read"}
+	//SessionTTL is how long a login may take from /oauth/login to the callback
+	SessionTTL = time.Minute * 10
+)
+
+var address = regexp.MustCompile(`^0x[0-9a-fA-F]{40}$`)
+
+// Config of the twitter app, APIHost serves the token and users/me endpoints
+type Config struct {
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	AuthorizeURL string
+	APIHost      string
+	Scopes       []string
+}
+
+// NewConfig points the flow at apiHost, a host other than twitter's also serves authorize
+func NewConfig(clientID, clientSecret, redirectURL, apiHost string) Config {
+	authorizeURL := DefaultAuthorizeURL
+	if apiHost != twclient.DefaultHost {
+		authorizeURL = apiHost + "/i/oauth2/authorize"
+	}
+	return Config{
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		RedirectURL:  redirectURL,
+		AuthorizeURL: authorizeURL,
+		APIHost:      apiHost,
+		Scopes:       DefaultScopes,
+	}
+}
+
+// SessionStore keeps logins in progress with their pkce verifier, implemented by db.DBService
+type SessionStore interface {
+	PutOAuthSession(session common.OAuthSessionInfo) error
+	GetOAuthSession(state string) (common.OAuthSessionInfo, error)
+	VerifyOAuthSession(state string) error
+	TakeOAuthSession(state string) (common.OAuthSessionInfo, error)
+}
+
+// Linker binds a twitter account to an address, the state of the login is its link nonce
+type Linker interface {
+	PutLinkNonce(link common.WalletLinkInfo) error
+	LinkWallet(link common.WalletLinkInfo) error
+}
+
+// Challenge is the message the wallet signs before the user is sent to twitter
+type Challenge struct {
+	State     string    `json:"state"`
+	Message   string    `json:"message"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// Flow links a twitter account to a wallet with the authorization code flow with PKCE: the
+// wallet signs the login state, twitter vouches for the account and the two are linked
+type Flow struct {
+	Config
+	sessions SessionStore
+	links    Linker
+	client   *http.Client
+}
+
+func NewFlow(config Config, sessions SessionStore, links Linker, client *http.Client) *Flow {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &Flow{
+		Config:   config,
+		sessions: sessions,
+		links:    links,
+		client:   client,
+	}
+}
+
+// LoginMessage is the text the wallet signs to prove it starts the login of state
+func LoginMessage(state string) string {
+	return fmt.Sprintf("Link this wallet to the twitter account I authorize on twitter oracle. State: %s", state)
+}
+
+func randomString(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func codeChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// Login starts linking walletAddress, the wallet signs the returned message
+func (f *Flow) Login(walletAddress string) (Challenge, error) {
+	if !address.MatchString(walletAddress) {
+		return Challenge{}, fmt.Errorf("%w: %q", InvalidAddressError, walletAddress)
+	}
+	state, err := randomString(16)
+	if err != nil {
+		return Challenge{}, err
+	}
+	//43 to 128 characters of the unreserved set
+	verifier, err := randomString(32)
+	if err != nil {
+		return Challenge{}, err
+	}
+	session := common.OAuthSessionInfo{
+		State:     state,
+		Verifier:  verifier,
+		Address:   walletAddress,
+		ExpiresAt: time.Now().Add(SessionTTL),
+	}
+	if err := f.sessions.PutOAuthSession(session); err != nil {
+		return Challenge{}, err
+	}
+	return Challenge{State: state, Message: LoginMessage(state), ExpiresAt: session.ExpiresAt}, nil
+}
+
+// Authorize checks the wallet signature of the login and returns the twitter url to send the user to
+func (f *Flow) Authorize(state string, signature string) (string, error) {
+	session, err := f.sessions.GetOAuthSession(state)
+	if err != nil || time.Now().After(session.ExpiresAt) {
+		return "", SessionExpiredError
+	}
+	if err := stream.VerifyLinkSignature(LoginMessage(state), session.Address, signature); err != nil {
+		return "", err
+	}
+	if err := f.sessions.VerifyOAuthSession(state); err != nil {
+		return "", err
+	}
+	q := url.Values{}
+	q.Set("response_type", "code")
+	q.Set("client_id", f.ClientID)
+	q.Set("redirect_uri", f.RedirectURL)
+	q.Set("scope", strings.Join(f.Scopes, " "))
+	q.Set("state", state)
+	q.Set("code_challenge", codeChallenge(session.Verifier))
+	q.Set("code_challenge_method", "S256")
+	return f.AuthorizeURL + "?" + q.Encode(), nil
+}
+
+// Callback exchanges the code twitter redirected back with and links the account it belongs to.
+// The session is consumed first so a state can not be replayed
+func (f *Flow) Callback(ctx context.Context, state string, code string) (common.WalletLinkInfo, error) {
+	session, err := f.sessions.TakeOAuthSession(state)
+	if err != nil || time.Now().After(session.ExpiresAt) {
+		return common.WalletLinkInfo{}, SessionExpiredError
+	}
+	if !session.Verified {
+		return common.WalletLinkInfo{}, SessionNotVerifiedError
+	}
+	token, err := f.exchange(ctx, code, session.Verifier)
+	if err != nil {
+		return common.WalletLinkInfo{}, err
+	}
+	user, err := f.me(ctx, token)
+	if err != nil {
+		return common.WalletLinkInfo{}, err
+	}
+	link := common.WalletLinkInfo{
+		Nonce:     state,
+		Twitter:   strings.ToLower(user.UserName),
+		Status:    stream.LinkIssued,
+		ExpiresAt: session.ExpiresAt,
+	}
+	if err := f.links.PutLinkNonce(link); err != nil {
+		return common.WalletLinkInfo{}, err
+	}
+	link.Twitter, link.TwitterId, link.Address = user.UserName, user.ID, session.Address
+	if err := f.links.LinkWallet(link); err != nil {
+		return common.WalletLinkInfo{}, err
+	}
+	link.Status = stream.LinkLinked
+	log.Info("wallet linked by oauth", user.UserName, "address", session.Address, "authorId", user.ID)
+	return link, nil
+}
+
+type tokenResponse struct {
+	TokenType   string `json:"token_type"`
+	AccessToken string `json:"access_token"`
+}
+
+func (f *Flow) exchange(ctx context.Context, code string, verifier string) (string, error) {
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", f.RedirectURL)
+	form.Set("code_verifier", verifier)
+	form.Set("client_id", f.ClientID)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, f.APIHost+"/2/oauth2/token", strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	//confidential clients authenticate, public ones only send client_id
+	if f.ClientSecret != "" {
+		req.SetBasicAuth(f.ClientID, f.ClientSecret)
+	}
+	token := tokenResponse{}
+	if err := f.do(req, &token); err != nil {
+		return "", fmt.Errorf("%w: %v", TokenExchangeError, err)
+	}
+	if token.AccessToken == "" {
+		return "", fmt.Errorf("%w: no access token", TokenExchangeError)
+	}
+	return token.AccessToken, nil
+}
+
+type user struct {
+	ID       string `json:"id"`
+	UserName string `json:"username"`
+}
+
+type meResponse struct {
+	Data user `json:"data"`
+}
+
+func (f *Flow) me(ctx context.Context, token string) (user, error) {
+	me := meResponse{}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, f.APIHost+"/2/users/me", nil)
+	if err != nil {
+		return me.Data, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	if err := f.do(req, &me); err != nil {
+		return me.Data, fmt.Errorf("%w: %v", UserLookupError, err)
+	}
+	if me.Data.ID == "" || me.Data.UserName == "" {
+		return me.Data, fmt.Errorf("%w: no user in response", UserLookupError)
+	}
+	return me.Data, nil
+}
+
+func (f *Flow) do(req *http.Request, v interface{}) error {
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1024*1024))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%v: %s", resp.Status, body)
+	}
+	return json.Unmarshal(body, v)
+}
@@ -0,0 +1,230 @@
+package oauth
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+	"twitter_oracle/common"
+	"twitter_oracle/faketwitter"
+	"twitter_oracle/stream"
+
+	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+	twitter "github.com/g8rswimmer/go-twitter/v2"
+)
+
+type memSessionStore struct {
+	mutex    sync.Mutex
+	sessions map[string]common.OAuthSessionInfo
+}
+
+func (m *memSessionStore) PutOAuthSession(session common.OAuthSessionInfo) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.sessions[session.State] = session
+	return nil
+}
+
+func (m *memSessionStore) GetOAuthSession(state string) (common.OAuthSessionInfo, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	session, ok := m.sessions[state]
+	if !ok {
+		return session, errors.New("no rows")
+	}
+	return session, nil
+}
+
+func (m *memSessionStore) VerifyOAuthSession(state string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	session := m.sessions[state]
+	session.Verified = true
+	m.sessions[state] = session
+	return nil
+}
+
+func (m *memSessionStore) TakeOAuthSession(state string) (common.OAuthSessionInfo, error) {
+	session, err := m.GetOAuthSession(state)
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	delete(m.sessions, state)
+	return session, err
+}
+
+type memLinker struct {
+	nonces []common.WalletLinkInfo
+	linked []common.WalletLinkInfo
+}
+
+func (m *memLinker) PutLinkNonce(link common.WalletLinkInfo) error {
+	m.nonces = append(m.nonces, link)
+	return nil
+}
+
+func (m *memLinker) LinkWallet(link common.WalletLinkInfo) error {
+	m.linked = append(m.linked, link)
+	return nil
+}
+
+type flowTest struct {
+	flow     *Flow
+	ts       *faketwitter.TestServer
+	sessions *memSessionStore
+	links    *memLinker
+	//browser stops at redirects so the test plays the user agent
+	browser *http.Client
+}
+
+func newFlowTest(t *testing.T) *flowTest {
+	ts := faketwitter.NewTestServer(&faketwitter.Fixture{
+		Users: []*twitter.UserObj{{ID: "100", Name: "Ninox", UserName: "Ninox2022"}},
+	})
+	t.Cleanup(ts.Close)
+	ft := &flowTest{
+		ts:       ts,
+		sessions: &memSessionStore{sessions: make(map[string]common.OAuthSessionInfo)},
+		links:    &memLinker{},
+		browser: &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		}},
+	}
+	config := NewConfig("client", "", "http://oracle.local/oauth/callback", ts.URL())
+	ft.flow = NewFlow(config, ft.sessions, ft.links, nil)
+	return ft
+}
+
+func sign(t *testing.T, message string) (string, string) {
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig, err := crypto.Sign(accounts.TextHash([]byte(message)), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig[crypto.RecoveryIDOffset] += 27
+	return crypto.PubkeyToAddress(key.PublicKey).Hex(), hexutil.Encode(sig)
+}
+
+// authorize sends the user to the fake twitter and returns the code it redirected back with
+func (ft *flowTest) authorize(t *testing.T, authorizeURL string) string {
+	resp, err := ft.browser.Get(authorizeURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("authorize status %v", resp.Status)
+	}
+	back, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if back.Host != "oracle.local" || back.Query().Get("code") == "" {
+		t.Fatalf("redirected to %v", back)
+	}
+	return back.Query().Get("code")
+}
+
+// login starts a session for a fresh key and returns its state and signature
+func (ft *flowTest) login(t *testing.T) (string, string, string) {
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := crypto.PubkeyToAddress(key.PublicKey).Hex()
+	challenge, err := ft.flow.Login(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if challenge.Message != LoginMessage(challenge.State) {
+		t.Fatalf("message %q", challenge.Message)
+	}
+	sig, err := crypto.Sign(accounts.TextHash([]byte(challenge.Message)), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig[crypto.RecoveryIDOffset] += 27
+	return challenge.State, address, hexutil.Encode(sig)
+}
+
+func TestFlow(t *testing.T) {
+	ft := newFlowTest(t)
+	state, address, signature := ft.login(t)
+	authorizeURL, err := ft.flow.Authorize(state, signature)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code := ft.authorize(t, authorizeURL)
+
+	link, err := ft.flow.Callback(context.Background(), state, code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if link.TwitterId != "100" || link.Address != address || link.Status != stream.LinkLinked {
+		t.Fatalf("link %+v", link)
+	}
+	if len(ft.links.nonces) != 1 || ft.links.nonces[0].Nonce != state || ft.links.nonces[0].Twitter != "ninox2022" {
+		t.Fatalf("nonces %+v", ft.links.nonces)
+	}
+	if len(ft.links.linked) != 1 || ft.links.linked[0].TwitterId != "100" {
+		t.Fatalf("linked %+v", ft.links.linked)
+	}
+
+	//the state is consumed by the callback
+	_, err = ft.flow.Callback(context.Background(), state, code)
+	if !errors.Is(err, SessionExpiredError) {
+		t.Fatalf("replay err %v", err)
+	}
+}
+
+func TestFlowRejects(t *testing.T) {
+	ft := newFlowTest(t)
+
+	if _, err := ft.flow.Login("0x1234"); !errors.Is(err, InvalidAddressError) {
+		t.Fatalf("address err %v", err)
+	}
+
+	//signed by another wallet
+	state, _, _ := ft.login(t)
+	_, otherSignature := sign(t, LoginMessage(state))
+	if _, err := ft.flow.Authorize(state, otherSignature); !errors.Is(err, stream.LinkSignatureError) {
+		t.Fatalf("signature err %v", err)
+	}
+	//a callback for a login whose wallet never signed
+	if _, err := ft.flow.Callback(context.Background(), state, "code"); !errors.Is(err, SessionNotVerifiedError) {
+		t.Fatalf("unverified err %v", err)
+	}
+
+	//the verifier of another session does not match the challenge twitter holds
+	state, _, signature := ft.login(t)
+	authorizeURL, err := ft.flow.Authorize(state, signature)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code := ft.authorize(t, authorizeURL)
+	session := ft.sessions.sessions[state]
+	session.Verifier += "x"
+	ft.sessions.sessions[state] = session
+	if _, err = ft.flow.Callback(context.Background(), state, code); !errors.Is(err, TokenExchangeError) {
+		t.Fatalf("pkce err %v", err)
+	}
+
+	//expired sessions can not be authorized
+	state, _, signature = ft.login(t)
+	session = ft.sessions.sessions[state]
+	session.ExpiresAt = time.Now().Add(-time.Second)
+	ft.sessions.sessions[state] = session
+	if _, err = ft.flow.Authorize(state, signature); !errors.Is(err, SessionExpiredError) {
+		t.Fatalf("expired err %v", err)
+	}
+	if len(ft.links.linked) != 0 {
+		t.Fatalf("linked %+v", ft.links.linked)
+	}
+}
@@ -0,0 +1,8 @@
+package oracle
+
+import "errors"
+
+var (
+	InvalidTweetError  = errors.New("tweet can not be stated as a fact")
+	TweetNotFoundError = errors.New("tweet not found")
+)
@@ -0,0 +1,183 @@
+package oracle
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"strconv"
+	"time"
+	"twitter_oracle/signer"
+	"twitter_oracle/twclient"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/common/math"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/signer/core/apitypes"
+	twitter "github.com/g8rswimmer/go-twitter/v2"
+)
+
+const (
+	TweetFactType   = "TweetFact"
+	MetricsFactType = "MetricsFact"
+)
+
+var (
+	DomainName    = "twitter oracle"
+	DomainVersion = "1"
+)
+
+var factTypes = apitypes.Types{
+	TweetFactType: {
+		{Name: "tweetId", Type: "uint256"},
+		{Name: "authorId", Type: "uint256"},
+		{Name: "textHash", Type: "bytes32"},
+		{Name: "createdAt", Type: "uint256"},
+	},
+	MetricsFactType: {
+		{Name: "tweetId", Type: "uint256"},
+		{Name: "likes", Type: "uint256"},
+		{Name: "retweets", Type: "uint256"},
+		{Name: "quotes", Type: "uint256"},
+		{Name: "replies", Type: "uint256"},
+		{Name: "observedAt", Type: "uint256"},
+	},
+}
+
+// SignedFact is a claim about a tweet with the oracle signature over its EIP-712 typed data.
+// TypedData is complete so a client can hash it and submit message and signature to a contract
+type SignedFact struct {
+	TypedData apitypes.TypedData `json:"typed_data"`
+	Digest    string             `json:"digest"`
+	Signer    string             `json:"signer"`
+	Signature string             `json:"signature"`
+}
+
+// Oracle answers pull requests for tweet facts: it looks the tweet up when asked and signs what
+// it observed, a contract checks the signature against the oracle keys it trusts
+type Oracle struct {
+	client twclient.Client
+	keys   *signer.KeyRing
+	Domain apitypes.TypedDataDomain
+}
+
+// NewOracle signs in the domain of chainId, verifyingContract may be empty
+func NewOracle(client twclient.Client, keys *signer.KeyRing, chainId int64, verifyingContract string) *Oracle {
+	return &Oracle{
+		client: client,
+		keys:   keys,
+		Domain: apitypes.TypedDataDomain{
+			Name:              DomainName,
+			Version:           DomainVersion,
+			ChainId:           math.NewHexOrDecimal256(chainId),
+			VerifyingContract: verifyingContract,
+		},
+	}
+}
+
+func (o *Oracle) Keys() *signer.KeyRing {
+	return o.keys
+}
+
+// TweetFact signs that authorId posted the text hashing to textHash at createdAt
+func (o *Oracle) TweetFact(ctx context.Context, tweetId string) (SignedFact, error) {
+	tweet, err := o.lookup(ctx, tweetId)
+	if err != nil {
+		return SignedFact{}, err
+	}
+	createdAt, err := time.Parse(time.RFC3339, tweet.CreatedAt)
+	if err != nil {
+		return SignedFact{}, fmt.Errorf("%w: created_at %q", InvalidTweetError, tweet.CreatedAt)
+	}
+	if _, err := strconv.ParseUint(tweet.AuthorID, 10, 64); err != nil {
+		return SignedFact{}, fmt.Errorf("%w: author %q", InvalidTweetError, tweet.AuthorID)
+	}
+	return o.sign(ctx, TweetFactType, apitypes.TypedDataMessage{
+		"tweetId":   tweet.ID,
+		"authorId":  tweet.AuthorID,
+		"textHash":  crypto.Keccak256Hash([]byte(tweet.Text)).Hex(),
+		"createdAt": strconv.FormatInt(createdAt.Unix(), 10),
+	})
+}
+
+// MetricsFact signs the public metrics of the tweet as observed now
+func (o *Oracle) MetricsFact(ctx context.Context, tweetId string) (SignedFact, error) {
+	tweet, err := o.lookup(ctx, tweetId)
+	if err != nil {
+		return SignedFact{}, err
+	}
+	if tweet.PublicMetrics == nil {
+		return SignedFact{}, fmt.Errorf("%w: no public metrics", InvalidTweetError)
+	}
+	m := tweet.PublicMetrics
+	return o.sign(ctx, MetricsFactType, apitypes.TypedDataMessage{
+		"tweetId":    tweet.ID,
+		"likes":      strconv.Itoa(m.Likes),
+		"retweets":   strconv.Itoa(m.Retweets),
+		"quotes":     strconv.Itoa(m.Quotes),
+		"replies":    strconv.Itoa(m.Replies),
+		"observedAt": strconv.FormatInt(time.Now().Unix(), 10),
+	})
+}
+
+func (o *Oracle) lookup(ctx context.Context, tweetId string) (*twitter.TweetObj, error) {
+	if _, ok := new(big.Int).SetString(tweetId, 10); !ok {
+		return nil, fmt.Errorf("%w: id %q", InvalidTweetError, tweetId)
+	}
+	opts := twitter.TweetLookupOpts{
+		TweetFields: []twitter.TweetField{twitter.TweetFieldAuthorID, twitter.TweetFieldCreatedAt, twitter.TweetFieldPublicMetrics},
+	}
+	tweetResponse, err := o.client.TweetLookup(ctx, []string{tweetId}, opts)
+	if err != nil {
+		return nil, err
+	}
+	for _, tweet := range tweetResponse.Raw.Tweets {
+		if tweet != nil && tweet.ID == tweetId {
+			return tweet, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %v", TweetNotFoundError, tweetId)
+}
+
+// TypedData wraps message of primaryType in the oracle domain
+func (o *Oracle) TypedData(primaryType string, message apitypes.TypedDataMessage) apitypes.TypedData {
+	types := apitypes.Types{
+		"EIP712Domain": domainType(o.Domain),
+		primaryType:    factTypes[primaryType],
+	}
+	return apitypes.TypedData{
+		Types:       types,
+		PrimaryType: primaryType,
+		Domain:      o.Domain,
+		Message:     message,
+	}
+}
+
+func (o *Oracle) sign(ctx context.Context, primaryType string, message apitypes.TypedDataMessage) (SignedFact, error) {
+	data := o.TypedData(primaryType, message)
+	digest, err := signer.TypedDataHash(data)
+	if err != nil {
+		return SignedFact{}, err
+	}
+	signature, address, err := o.keys.Sign(ctx, data)
+	if err != nil {
+		return SignedFact{}, err
+	}
+	return SignedFact{
+		TypedData: data,
+		Digest:    hexutil.Encode(digest),
+		Signer:    address.Hex(),
+		Signature: hexutil.Encode(signature),
+	}, nil
+}
+
+// domainType lists the fields the domain sets, the EIP712Domain type must match Domain.Map
+func domainType(domain apitypes.TypedDataDomain) []apitypes.Type {
+	fields := []apitypes.Type{{Name: "name", Type: "string"}, {Name: "version", Type: "string"}}
+	if domain.ChainId != nil {
+		fields = append(fields, apitypes.Type{Name: "chainId", Type: "uint256"})
+	}
+	if domain.VerifyingContract != "" {
+		fields = append(fields, apitypes.Type{Name: "verifyingContract", Type: "address"})
+	}
+	return fields
+}
@@ -0,0 +1,116 @@
+package oracle
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"testing"
+	"twitter_oracle/signer"
+	"twitter_oracle/twclient"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+	twitter "github.com/g8rswimmer/go-twitter/v2"
+)
+
+func newTestOracle(t *testing.T) (*Oracle, *signer.KeySigner) {
+	fake := twclient.NewFake()
+	fake.AddUser(&twitter.UserObj{ID: "100", Name: "Ninox", UserName: "ninox2022"})
+	fake.AddTweet(&twitter.TweetObj{
+		ID:            "1593857112829136897",
+		AuthorID:      "100",
+		Text:          "#HugMe gm",
+		CreatedAt:     "2022-11-15T08:00:00.000Z",
+		PublicMetrics: &twitter.TweetMetricsObj{Likes: 7, Retweets: 3, Quotes: 5, Replies: 1},
+	})
+	key, _ := crypto.GenerateKey()
+	s := signer.NewKeySigner(key)
+	keys := signer.NewKeyRing(nil, nil)
+	keys.Rotate(s)
+	return NewOracle(fake, keys, 1, "0x000000000000000000000000000000000000dEaD"), s
+}
+
+// recoverFact checks the fact as a client does after receiving it as json
+func recoverFact(t *testing.T, fact SignedFact) SignedFact {
+	b, err := json.Marshal(fact)
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := SignedFact{}
+	if err = json.Unmarshal(b, &received); err != nil {
+		t.Fatal(err)
+	}
+	address, err := signer.Recover(received.TypedData, hexutil.MustDecode(received.Signature))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if address.Hex() != fact.Signer {
+		t.Fatalf("recovered %v, signer %v", address, fact.Signer)
+	}
+	return received
+}
+
+func TestTweetFact(t *testing.T) {
+	o, s := newTestOracle(t)
+	fact, err := o.TweetFact(context.Background(), "1593857112829136897")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fact.Signer != s.Address().Hex() {
+		t.Fatalf("signer %v", fact.Signer)
+	}
+	recoverFact(t, fact)
+
+	//the digest as a contract computes it
+	domainSeparator := crypto.Keccak256(
+		crypto.Keccak256([]byte("EIP712Domain(string name,string version,uint256 chainId,address verifyingContract)")),
+		crypto.Keccak256([]byte(DomainName)),
+		crypto.Keccak256([]byte(DomainVersion)),
+		word(big.NewInt(1)),
+		word(new(big.Int).SetBytes(hexutil.MustDecode("0x000000000000000000000000000000000000dEaD"))),
+	)
+	tweetId, _ := new(big.Int).SetString("1593857112829136897", 10)
+	structHash := crypto.Keccak256(
+		crypto.Keccak256([]byte("TweetFact(uint256 tweetId,uint256 authorId,bytes32 textHash,uint256 createdAt)")),
+		word(tweetId),
+		word(big.NewInt(100)),
+		crypto.Keccak256([]byte("#HugMe gm")),
+		word(big.NewInt(1668499200)),
+	)
+	digest := crypto.Keccak256([]byte{0x19, 0x01}, domainSeparator, structHash)
+	if fact.Digest != hexutil.Encode(digest) {
+		t.Fatalf("digest %v, want %x", fact.Digest, digest)
+	}
+}
+
+func word(n *big.Int) []byte {
+	return n.FillBytes(make([]byte, 32))
+}
+
+func TestMetricsFact(t *testing.T) {
+	o, _ := newTestOracle(t)
+	fact, err := o.MetricsFact(context.Background(), "1593857112829136897")
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := recoverFact(t, fact)
+	message := received.TypedData.Message
+	if received.TypedData.PrimaryType != MetricsFactType || message["likes"] != "7" || message["replies"] != "1" || message["observedAt"] == "" {
+		t.Fatalf("message %+v", message)
+	}
+
+	//a client changing the claim no longer recovers the oracle
+	message["likes"] = "700"
+	address, err := signer.Recover(received.TypedData, hexutil.MustDecode(received.Signature))
+	if err == nil && address.Hex() == fact.Signer {
+		t.Fatal("tampered fact still verifies")
+	}
+
+	if _, err = o.MetricsFact(context.Background(), "42"); !errors.Is(err, TweetNotFoundError) {
+		t.Fatalf("missing err %v", err)
+	}
+	if _, err = o.TweetFact(context.Background(), "@ninox"); !errors.Is(err, InvalidTweetError) {
+		t.Fatalf("invalid err %v", err)
+	}
+}
@@ -4,4 +4,6 @@ import "errors"
 
 var (
 	EventTweetNotFoundError = errors.New("event tweet not found")
+	TweetNotFoundError      = errors.New("tweet not found")
+	NoEventStoreError       = errors.New("polling events needs a db")
 )
@@ -4,56 +4,83 @@ import (
 	"context"
 	"fmt"
 	twitter "github.com/g8rswimmer/go-twitter/v2"
-	"net/http"
+	"strings"
 	"time"
+	"twitter_oracle/attest"
 	"twitter_oracle/common"
 	"twitter_oracle/db"
 	"twitter_oracle/log"
+	"twitter_oracle/twclient"
 )
 
 var QueryContextTimeout = time.Minute * 5
 
+// EnrollBuffer is how many enrolled events wait for Start, more are polled at the next tick
+var EnrollBuffer = 64
+
+// Attester records quotes and metrics for the next attestation epoch, implemented by attest.Attester
+type Attester interface {
+	Record(record common.AttestationRecord) error
+}
+
+// MetricsPublisher takes the polled metrics of event tweets to an oracle feed, implemented by chain.Publisher
+type MetricsPublisher interface {
+	Queue(tweetId string, metric common.TweetPublicMetricInfo)
+}
+
+// EventStore keeps the polled metrics and quotes of registered events, implemented by db.DBService
+type EventStore interface {
+	GetEventTweetIdList() ([]string, error)
+	PutEventPublicMetric(tweetId string, metric common.TweetPublicMetricInfo) error
+	PutQuotes(tweetId string, quoteList []common.QuoteInfo) error
+	GetLastQuoteId(tweetId string) (string, error)
+}
+
 type Querier struct {
-	BeaverToken            string
 	HUGTwitterName         string
 	AddEventTwitterHashtag string
-	client                 *twitter.Client
+	client                 twclient.Client
 	PollDur                time.Duration
 	db                     *db.DBService
+	events                 EventStore
+	enroll                 chan string
+	//Publisher gets every polled metric when set
+	Publisher MetricsPublisher
+	//Attester gets every polled metric and quote when set
+	Attester Attester
 }
 
-func Init(db *db.DBService, duration time.Duration) *Querier {
+func Init(db *db.DBService, duration time.Duration, client twclient.Client) *Querier {
 	q := Querier{
-		BeaverToken:            common.BeaverToken,
 		HUGTwitterName:         common.HugTwitterName,
 		AddEventTwitterHashtag: common.AddEventTwitterHashtag,
+		client:                 client,
 		PollDur:                duration,
 		db:                     db,
+		enroll:                 make(chan string, EnrollBuffer),
+	}
+	if db != nil {
+		q.events = db
 	}
-	q.newClient()
 	return &q
 }
 
-func (q *Querier) newClient() {
-	q.client = &twitter.Client{
-		Authorizer: authorize{
-			Token: q.BeaverToken,
-		},
-		Client: http.DefaultClient,
-		Host:   "https://api.twitter.com",
+// Start polls the event tweets every PollDur, the first poll runs right away
+func (q *Querier) Start(ctx context.Context) error {
+	if q.events == nil {
+		return NoEventStoreError
 	}
-}
-
-func (q *Querier) Start() {
 	ticker := time.NewTicker(q.PollDur)
-	start := make(chan struct{})
-	start <- struct{}{}
+	defer ticker.Stop()
 	job := func() error {
-		tweetIdList, err := q.db.GetEventTweetIdList()
+		tweetIdList, err := q.events.GetEventTweetIdList()
 		if err != nil {
 			return err
 		}
 		for _, tweetId := range tweetIdList {
+			if ctx.Err() != nil {
+				return nil
+			}
 			//get public metric
 			q.updatePublicMetric(tweetId)
 			//poll quotes
@@ -61,16 +88,22 @@ func (q *Querier) Start() {
 		}
 		return nil
 	}
+	err := job()
+	if err != nil {
+		return err
+	}
 	for {
 		select {
-		case <-start:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
 			err := job()
 			if err != nil {
-				panic(err)
+				log.Error(err)
 			}
-		case <-ticker.C:
-			err := job()
-			log.Error(err)
+		case tweetId := <-q.enroll:
+			q.updatePublicMetric(tweetId)
+			q.pollTweetQuotes(tweetId)
 		}
 	}
 }
@@ -84,15 +117,30 @@ func (q *Querier) updatePublicMetric(tweetId string) {
 		return
 	}
 	metricCancel()
-	e = q.db.PutEventPublicMetric(tweetId, metric)
-	if e != nil {
-		log.Warn("PutEventPublicMetric error", e, "tweetId", tweetId)
-		return
+	if q.events != nil {
+		e = q.events.PutEventPublicMetric(tweetId, metric)
+		if e != nil {
+			log.Warn("PutEventPublicMetric error", e, "tweetId", tweetId)
+			return
+		}
+	}
+	if q.Publisher != nil {
+		q.Publisher.Queue(tweetId, metric)
 	}
+	q.attest(common.AttestationRecord{
+		Kind:       attest.MetricsRecord,
+		TweetId:    tweetId,
+		Metrics:    metric,
+		RecordedAt: time.Now(),
+	})
 }
 
+// pollTweetQuotes saves the quotes since the newest saved one, it needs the store to know where to stop
 func (q *Querier) pollTweetQuotes(tweetId string) {
-	lastQuoteId, e := q.db.GetLastQuoteId(tweetId)
+	if q.events == nil {
+		return
+	}
+	lastQuoteId, e := q.events.GetLastQuoteId(tweetId)
 	if e != nil {
 		log.Warn("GetLastQuoteId error", e, "tweetId", tweetId)
 		return
@@ -104,9 +152,39 @@ func (q *Querier) pollTweetQuotes(tweetId string) {
 		log.Warn("PollQuotes error", e, "tweetId", tweetId, "last quote id", lastQuoteId)
 		return
 	}
-	e = q.db.PutQuotes(tweetId, quotes)
+	e = q.events.PutQuotes(tweetId, quotes)
 	if e != nil {
 		log.Warn("PutQuotes error", e, "tweetId", tweetId)
+		return
+	}
+	for _, quote := range quotes {
+		q.attest(common.AttestationRecord{
+			Kind:       attest.QuoteRecord,
+			TweetId:    quote.TweetId,
+			AuthorId:   quote.AuthorId,
+			AuthorName: quote.AuthorName,
+			Text:       quote.Text,
+			RecordedAt: quote.CreatedAt,
+		})
+	}
+}
+
+// Enroll hands a newly registered event to Start so it is polled right away instead of at the
+// next tick, it never blocks the caller and leaves the event to the tick when Start is behind
+func (q *Querier) Enroll(tweetId string) {
+	select {
+	case q.enroll <- tweetId:
+	default:
+		log.Warn("enroll queue full, polling at the next tick", "tweetId", tweetId)
+	}
+}
+
+func (q *Querier) attest(record common.AttestationRecord) {
+	if q.Attester == nil {
+		return
+	}
+	if e := q.Attester.Record(record); e != nil {
+		log.Warn("attestation record error", e, "kind", record.Kind, "tweetId", record.TweetId)
 	}
 }
 
@@ -136,7 +214,7 @@ func (q *Querier) GetEventTwitterId(ctx context.Context, eventName string, from
 		info = common.EventTweetInfo{
 			TweetId:    dic.Tweet.ID,
 			AuthorId:   dic.Author.ID,
-			AuthorName: dic.Author.Name,
+			AuthorName: dic.Author.UserName,
 			Text:       dic.Tweet.Text,
 			CreatedAt:  createTime,
 			EventName:  eventName,
@@ -148,6 +226,8 @@ func (q *Querier) GetEventTwitterId(ctx context.Context, eventName string, from
 	return info, nil
 }
 
+// GetTweetPublicMetric returns the public metrics of tweetId, TweetNotFoundError if the tweet is
+// gone or came back without metrics so no zeros are stored, published or attested for it
 func (q *Querier) GetTweetPublicMetric(ctx context.Context, tweetId string) (common.TweetPublicMetricInfo, error) {
 	opts := twitter.TweetLookupOpts{
 		TweetFields: []twitter.TweetField{twitter.TweetFieldPublicMetrics},
@@ -156,20 +236,19 @@ func (q *Querier) GetTweetPublicMetric(ctx context.Context, tweetId string) (com
 	if err != nil {
 		return common.TweetPublicMetricInfo{}, err
 	}
-
-	dictionaries := tweetResponse.Raw.TweetDictionaries()
-	info := common.TweetPublicMetricInfo{}
-
-	for _, dic := range dictionaries {
-		info = common.TweetPublicMetricInfo{
-			RetweetCount: dic.Tweet.PublicMetrics.Retweets,
-			ReplyCount:   dic.Tweet.PublicMetrics.Replies,
-			LikeCount:    dic.Tweet.PublicMetrics.Likes,
-			QuoteCount:   dic.Tweet.PublicMetrics.Quotes,
-		}
-		break
+	if tweetResponse.Raw == nil {
+		return common.TweetPublicMetricInfo{}, fmt.Errorf("%w: %v", TweetNotFoundError, tweetId)
 	}
-	return info, nil
+	dic, ok := tweetResponse.Raw.TweetDictionaries()[tweetId]
+	if !ok || dic.Tweet.PublicMetrics == nil {
+		return common.TweetPublicMetricInfo{}, fmt.Errorf("%w: %v", TweetNotFoundError, tweetId)
+	}
+	return common.TweetPublicMetricInfo{
+		RetweetCount: dic.Tweet.PublicMetrics.Retweets,
+		ReplyCount:   dic.Tweet.PublicMetrics.Replies,
+		LikeCount:    dic.Tweet.PublicMetrics.Likes,
+		QuoteCount:   dic.Tweet.PublicMetrics.Quotes,
+	}, nil
 }
 
 func (q *Querier) PollQuotes(ctx context.Context, lastQuoteId string, tweetId string) ([]common.QuoteInfo, error) {
@@ -187,10 +266,15 @@ func (q *Querier) PollQuotes(ctx context.Context, lastQuoteId string, tweetId st
 		}
 		dictionaries := tweetResponse.Raw.TweetDictionaries()
 
-		for id, dic := range dictionaries {
-			if id == lastQuoteId {
+		//quotes come newest first, walk them in response order until the last seen one
+		for _, tweet := range tweetResponse.Raw.Tweets {
+			if tweet.ID == lastQuoteId {
 				return infoList, nil
 			}
+			dic := dictionaries[tweet.ID]
+			if dic.Tweet.PublicMetrics == nil || dic.Author == nil {
+				continue
+			}
 			createTime, e := time.Parse(time.RFC3339, dic.Tweet.CreatedAt)
 			if e != nil {
 				createTime = time.Now()
@@ -217,3 +301,99 @@ func (q *Querier) PollQuotes(ctx context.Context, lastQuoteId string, tweetId st
 		opts.PaginationToken = tweetResponse.Meta.NextToken
 	}
 }
+
+// GetTweet looks one tweet up with its author, TweetNotFoundError if it does not exist or is not visible
+func (q *Querier) GetTweet(ctx context.Context, tweetId string) (common.TweetInfo, error) {
+	opts := twitter.TweetLookupOpts{
+		Expansions:  []twitter.Expansion{twitter.ExpansionAuthorID},
+		TweetFields: []twitter.TweetField{twitter.TweetFieldAuthorID, twitter.TweetFieldCreatedAt, twitter.TweetFieldPublicMetrics},
+	}
+	tweetResponse, err := q.client.TweetLookup(ctx, []string{tweetId}, opts)
+	if err != nil {
+		return common.TweetInfo{}, err
+	}
+	//a missing tweet is reported in the errors of a successful response
+	dic, ok := tweetResponse.Raw.TweetDictionaries()[tweetId]
+	if !ok {
+		return common.TweetInfo{}, fmt.Errorf("%w: %v", TweetNotFoundError, tweetId)
+	}
+	info := common.TweetInfo{
+		TweetId:  dic.Tweet.ID,
+		AuthorId: dic.Tweet.AuthorID,
+		Text:     dic.Tweet.Text,
+	}
+	if dic.Author != nil {
+		info.AuthorUsername = dic.Author.UserName
+	}
+	if createTime, e := time.Parse(time.RFC3339, dic.Tweet.CreatedAt); e == nil {
+		info.CreatedAt = createTime
+	}
+	if dic.Tweet.PublicMetrics != nil {
+		info.PublicMetric = common.TweetPublicMetricInfo{
+			RetweetCount: dic.Tweet.PublicMetrics.Retweets,
+			ReplyCount:   dic.Tweet.PublicMetrics.Replies,
+			LikeCount:    dic.Tweet.PublicMetrics.Likes,
+			QuoteCount:   dic.Tweet.PublicMetrics.Quotes,
+		}
+	}
+	return info, nil
+}
+
+// CountQuotesSince counts the quotes of tweetId created after since, quotes come newest first so
+// paging stops at the first older one
+func (q *Querier) CountQuotesSince(ctx context.Context, tweetId string, since time.Time) (int, error) {
+	count := 0
+	err := q.walkQuotes(ctx, tweetId, func(quote *twitter.TweetDictionary) bool {
+		createTime, e := time.Parse(time.RFC3339, quote.Tweet.CreatedAt)
+		if e != nil || !createTime.After(since) {
+			return false
+		}
+		count++
+		return true
+	})
+	return count, err
+}
+
+// FindQuoteBy returns the id of a quote of tweetId by the user with authorId, or by username
+// when authorId is empty, and "" if they did not quote it
+func (q *Querier) FindQuoteBy(ctx context.Context, tweetId string, authorId string, username string) (string, error) {
+	found := ""
+	err := q.walkQuotes(ctx, tweetId, func(quote *twitter.TweetDictionary) bool {
+		if authorId != "" && quote.Tweet.AuthorID == authorId ||
+			authorId == "" && quote.Author != nil && strings.EqualFold(quote.Author.UserName, username) {
+			found = quote.Tweet.ID
+			return false
+		}
+		return true
+	})
+	return found, err
+}
+
+// walkQuotes visits the quotes of tweetId newest first until visit returns false
+func (q *Querier) walkQuotes(ctx context.Context, tweetId string, visit func(quote *twitter.TweetDictionary) bool) error {
+	opts := twitter.QuoteTweetsLookupOpts{
+		MaxResults:  100,
+		Expansions:  []twitter.Expansion{twitter.ExpansionAuthorID},
+		TweetFields: []twitter.TweetField{twitter.TweetFieldAuthorID, twitter.TweetFieldCreatedAt},
+	}
+	for {
+		tweetResponse, err := q.client.QuoteTweetsLookup(ctx, tweetId, opts)
+		if err != nil {
+			return err
+		}
+		dictionaries := tweetResponse.Raw.TweetDictionaries()
+		for _, tweet := range tweetResponse.Raw.Tweets {
+			dic := dictionaries[tweet.ID]
+			if dic == nil {
+				continue
+			}
+			if !visit(dic) {
+				return nil
+			}
+		}
+		if tweetResponse.Meta == nil || tweetResponse.Meta.NextToken == "" {
+			return nil
+		}
+		opts.PaginationToken = tweetResponse.Meta.NextToken
+	}
+}
@@ -2,21 +2,33 @@ package query
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	twitter "github.com/g8rswimmer/go-twitter/v2"
 	"os"
 	"testing"
 	"time"
+	"twitter_oracle/common"
+	"twitter_oracle/faketwitter"
+	"twitter_oracle/twclient"
 )
 
 var tokenStr = os.Getenv("TW_BEAVER")
 
-func TestQuerier_GetEventTwitterId(t *testing.T) {
-	querier := Querier{
-		BeaverToken:            tokenStr,
+// liveQuerier talks to the real twitter api, tests using it are skipped without TW_BEAVER
+func liveQuerier(t *testing.T) *Querier {
+	if tokenStr == "" {
+		t.Skip("TW_BEAVER not set")
+	}
+	return &Querier{
 		HUGTwitterName:         "HUG",
 		AddEventTwitterHashtag: "NEWEVENT",
+		client:                 twclient.New(tokenStr, twclient.DefaultHost),
 	}
-	querier.newClient()
+}
+
+func TestQuerier_GetEventTwitterId(t *testing.T) {
+	querier := liveQuerier(t)
 	_, err := querier.GetEventTwitterId(context.Background(), "", "")
 	if err != nil {
 		t.Fatal(err)
@@ -24,13 +36,8 @@ func TestQuerier_GetEventTwitterId(t *testing.T) {
 }
 
 func TestGetPublicMetric(t *testing.T) {
-	querier := Querier{
-		BeaverToken:            tokenStr,
-		HUGTwitterName:         "HUG",
-		AddEventTwitterHashtag: "NEWEVENT",
-	}
-	querier.newClient()
-	_, err := querier.GetTweetPublicMetric(context.Background(), []string{"1496269563708665857"})
+	querier := liveQuerier(t)
+	_, err := querier.GetTweetPublicMetric(context.Background(), "1496269563708665857")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -43,3 +50,212 @@ func TestParseTime(t *testing.T) {
 	}
 	fmt.Println(ti.String())
 }
+
+func fakeQuerier() (*Querier, *twclient.Fake) {
+	fake := twclient.NewFake()
+	fake.AddUser(&twitter.UserObj{ID: "100", Name: "Ninox", UserName: "ninox2022"})
+	fake.AddTweet(&twitter.TweetObj{
+		ID:            "1000",
+		AuthorID:      "100",
+		Text:          "#HugMe event",
+		PublicMetrics: &twitter.TweetMetricsObj{Likes: 7, Retweets: 3, Quotes: 5, Replies: 1},
+	})
+	for i := 1; i <= 5; i++ {
+		id := fmt.Sprintf("100%d", i)
+		fake.AddTweet(&twitter.TweetObj{
+			ID:            id,
+			AuthorID:      "100",
+			Text:          "quote " + id,
+			CreatedAt:     "2022-11-15T08:00:00.000Z",
+			PublicMetrics: &twitter.TweetMetricsObj{},
+		})
+		fake.AddQuote("1000", id)
+	}
+	return &Querier{
+		HUGTwitterName:         "HUGGLE",
+		AddEventTwitterHashtag: "HugMe",
+		client:                 fake,
+		enroll:                 make(chan string, EnrollBuffer),
+	}, fake
+}
+
+func TestGetPublicMetricFake(t *testing.T) {
+	querier, _ := fakeQuerier()
+	metric, err := querier.GetTweetPublicMetric(context.Background(), "1000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := common.TweetPublicMetricInfo{RetweetCount: 3, ReplyCount: 1, LikeCount: 7, QuoteCount: 5}
+	if metric != want {
+		t.Fatalf("metric = %+v, want %+v", metric, want)
+	}
+}
+
+type queuedMetrics map[string]common.TweetPublicMetricInfo
+
+func (q queuedMetrics) Queue(tweetId string, metric common.TweetPublicMetricInfo) {
+	q[tweetId] = metric
+}
+
+func TestUpdatePublicMetricQueues(t *testing.T) {
+	querier, _ := fakeQuerier()
+	queued := queuedMetrics{}
+	querier.Publisher = queued
+	querier.updatePublicMetric("1000")
+	want := common.TweetPublicMetricInfo{RetweetCount: 3, ReplyCount: 1, LikeCount: 7, QuoteCount: 5}
+	if len(queued) != 1 || queued["1000"] != want {
+		t.Fatalf("queued %+v", queued)
+	}
+}
+
+func TestMissingMetricsNotQueued(t *testing.T) {
+	querier, fake := fakeQuerier()
+	fake.AddTweet(&twitter.TweetObj{ID: "2000", AuthorID: "100"})
+	queued := queuedMetrics{}
+	querier.Publisher = queued
+	for _, id := range []string{"2000", "404"} {
+		if _, err := querier.GetTweetPublicMetric(context.Background(), id); !errors.Is(err, TweetNotFoundError) {
+			t.Fatalf("%v: expected TweetNotFoundError, got %v", id, err)
+		}
+		querier.updatePublicMetric(id)
+	}
+	if len(queued) != 0 {
+		t.Fatalf("queued %+v", queued)
+	}
+}
+
+func TestPollQuotesFake(t *testing.T) {
+	querier, fake := fakeQuerier()
+	quotes, err := querier.PollQuotes(context.Background(), "1002", "1000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(quotes) != 3 || quotes[0].TweetId != "1005" || quotes[2].TweetId != "1003" {
+		t.Fatalf("unexpected quotes %+v", quotes)
+	}
+	if fake.CallCount("QuoteTweetsLookup") != 1 {
+		t.Fatalf("QuoteTweetsLookup called %v times", fake.CallCount("QuoteTweetsLookup"))
+	}
+
+	for i := 6; i <= 12; i++ {
+		id := fmt.Sprintf("10%02d", i)
+		fake.AddTweet(&twitter.TweetObj{ID: id, AuthorID: "100", PublicMetrics: &twitter.TweetMetricsObj{}})
+		fake.AddQuote("1000", id)
+	}
+	quotes, err = querier.PollQuotes(context.Background(), "", "1000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(quotes) != 12 {
+		t.Fatalf("got %v quotes across pages, want 12", len(quotes))
+	}
+	if fake.CallCount("QuoteTweetsLookup") != 3 {
+		t.Fatalf("QuoteTweetsLookup called %v times", fake.CallCount("QuoteTweetsLookup"))
+	}
+}
+
+func TestPollQuotesFakeServer(t *testing.T) {
+	ts := faketwitter.NewTestServer(&faketwitter.Fixture{
+		Users: []*twitter.UserObj{{ID: "100", Name: "Ninox", UserName: "ninox2022"}},
+		Tweets: []*twitter.TweetObj{
+			{ID: "1001", AuthorID: "100", Text: "first quote", CreatedAt: "2022-11-15T08:00:00.000Z", PublicMetrics: &twitter.TweetMetricsObj{Likes: 2}},
+			{ID: "1002", AuthorID: "100", Text: "second quote", CreatedAt: "2022-11-15T09:00:00.000Z", PublicMetrics: &twitter.TweetMetricsObj{}},
+		},
+		Quotes: map[string][]string{"1000": {"1001", "1002"}},
+	})
+	defer ts.Close()
+	querier := &Querier{client: ts.Client()}
+	quotes, err := querier.PollQuotes(context.Background(), "", "1000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(quotes) != 2 || quotes[0].TweetId != "1002" || quotes[1].PublicMetic.LikeCount != 2 {
+		t.Fatalf("unexpected quotes %+v", quotes)
+	}
+}
+
+// memEventStore keeps the newest quote first as PollQuotes returns them
+type memEventStore struct {
+	metrics map[string]common.TweetPublicMetricInfo
+	quotes  map[string][]common.QuoteInfo
+}
+
+func (m *memEventStore) GetEventTweetIdList() ([]string, error) {
+	return []string{"1000"}, nil
+}
+
+func (m *memEventStore) PutEventPublicMetric(tweetId string, metric common.TweetPublicMetricInfo) error {
+	m.metrics[tweetId] = metric
+	return nil
+}
+
+func (m *memEventStore) PutQuotes(tweetId string, quoteList []common.QuoteInfo) error {
+	m.quotes[tweetId] = append(quoteList, m.quotes[tweetId]...)
+	return nil
+}
+
+func (m *memEventStore) GetLastQuoteId(tweetId string) (string, error) {
+	if len(m.quotes[tweetId]) == 0 {
+		return "", nil
+	}
+	return m.quotes[tweetId][0].TweetId, nil
+}
+
+func TestPollEventFake(t *testing.T) {
+	querier, fake := fakeQuerier()
+	store := &memEventStore{metrics: make(map[string]common.TweetPublicMetricInfo), quotes: make(map[string][]common.QuoteInfo)}
+	querier.events = store
+	querier.updatePublicMetric("1000")
+	querier.pollTweetQuotes("1000")
+	if store.metrics["1000"].LikeCount != 7 || len(store.quotes["1000"]) != 5 {
+		t.Fatalf("metrics %+v, quotes %v", store.metrics, len(store.quotes["1000"]))
+	}
+	//the next poll only saves the quotes since the newest saved one
+	fake.AddTweet(&twitter.TweetObj{ID: "1006", AuthorID: "100", PublicMetrics: &twitter.TweetMetricsObj{}})
+	fake.AddQuote("1000", "1006")
+	querier.pollTweetQuotes("1000")
+	if quotes := store.quotes["1000"]; len(quotes) != 6 || quotes[0].TweetId != "1006" {
+		t.Fatalf("quotes after second poll %+v", quotes)
+	}
+}
+
+type notifiedMetrics chan string
+
+func (n notifiedMetrics) Queue(tweetId string, metric common.TweetPublicMetricInfo) {
+	n <- tweetId
+}
+
+func TestEnrollPolledByStart(t *testing.T) {
+	querier, _ := fakeQuerier()
+	querier.events = &memEventStore{metrics: make(map[string]common.TweetPublicMetricInfo), quotes: make(map[string][]common.QuoteInfo)}
+	querier.PollDur = time.Hour
+	queued := make(notifiedMetrics, 4)
+	querier.Publisher = queued
+	querier.Enroll("1001")
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- querier.Start(ctx)
+	}()
+	for _, want := range []string{"1000", "1001"} {
+		select {
+		case got := <-queued:
+			if got != want {
+				t.Fatalf("polled %v, want %v", got, want)
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatalf("%v was not polled", want)
+		}
+	}
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Fatalf("Start returned %v", err)
+	}
+}
+
+func TestStartNeedsEventStore(t *testing.T) {
+	querier, _ := fakeQuerier()
+	if err := querier.Start(context.Background()); err != NoEventStoreError {
+		t.Fatalf("expected NoEventStoreError, got %v", err)
+	}
+}
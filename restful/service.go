@@ -1,14 +1,27 @@
 package restful
 
 import (
+	"context"
+	"crypto/subtle"
 	"encoding/json"
 	"errors"
-	"github.com/ethereum/go-ethereum/cmd/utils"
+	"fmt"
+	"github.com/ethereum/go-ethereum/metrics"
+	"github.com/ethereum/go-ethereum/metrics/prometheus"
 	"github.com/gorilla/mux"
+	"net"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
+	"twitter_oracle/adapter"
+	"twitter_oracle/attest"
+	"twitter_oracle/common"
 	"twitter_oracle/db"
 	"twitter_oracle/log"
+	"twitter_oracle/oauth"
+	"twitter_oracle/oracle"
+	"twitter_oracle/query"
 	"twitter_oracle/stream"
 )
 
@@ -16,16 +29,45 @@ var (
 	WriteResponseErr = errors.New("write response error")
 )
 
+var ShutdownTimeout = time.Second * 10
+
 const (
-	DefaultRespStatus     = 100
-	Success               = 200
-	ConversationIdInvalid = 24
+	DefaultRespStatus        = 100
+	Success                  = 200
+	ConversationIdInvalid    = 24
+	ConversationUpdateFailed = 25
+	RuleSyncFailed           = 26
+	DeadLetterIdInvalid      = 27
+	DeadLetterFailed         = 28
+	PendingThoughtFailed     = 29
+	UsernameHistoryFailed    = 30
+	WalletLinkFailed         = 31
+	OAuthFailed              = 32
+	AttestationFailed        = 33
+	OracleFactFailed         = 34
+	EventFailed              = 35
+	Unauthorized             = 36
 )
 
 type Service struct {
 	port       string
 	db         *db.DBService
 	Subscriber *stream.Subscriber
+	//RulesFile is the stream rules manifest synced by /sync_rules
+	RulesFile string
+	//AdminToken guards the routes changing state, sent as "Authorization: Bearer <token>". Without
+	//it those routes only answer loopback requests
+	AdminToken string
+	//OAuth links wallets through a twitter login, the /oauth endpoints are off while nil
+	OAuth *oauth.Flow
+	//Attester serves /attestation_proof, off while nil
+	Attester *attest.Attester
+	//Oracle signs tweet facts on demand for /fact, off while nil
+	Oracle *oracle.Oracle
+	//Adapter answers chainlink external adapter requests at /adapter
+	Adapter *adapter.Adapter
+	//Querier searches the registration tweets the stream missed for /register_event, off while nil
+	Querier *query.Querier
 }
 
 func InitRestService(port string, db *db.DBService) *Service {
@@ -56,7 +98,30 @@ func AutoResponse(writer http.ResponseWriter, resp Resp) {
 	}
 }
 
-func (c *Service) Start() error {
+// admin lets a request through with the admin token, or from loopback when no token is set
+func (c *Service) admin(handler http.HandlerFunc) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		if c.AdminToken != "" {
+			token := strings.TrimPrefix(request.Header.Get("Authorization"), "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(token), []byte(c.AdminToken)) == 1 {
+				handler(writer, request)
+				return
+			}
+		} else if host, _, err := net.SplitHostPort(request.RemoteAddr); err == nil && net.ParseIP(host).IsLoopback() {
+			handler(writer, request)
+			return
+		}
+		log.Warn("admin request refused", request.URL.Path, "remote", request.RemoteAddr)
+		writer.WriteHeader(http.StatusUnauthorized)
+		resp := NewResp()
+		resp.Status = Unauthorized
+		resp.Value = "admin token required"
+		AutoResponse(writer, resp)
+	}
+}
+
+// Start serves the rest api until ctx is done, requests in flight get ShutdownTimeout to finish
+func (c *Service) Start(ctx context.Context) error {
 	log.Info("start queryer rpc port:" + c.port)
 	address := "0.0.0.0:" + c.port
 	r := mux.NewRouter()
@@ -65,9 +130,386 @@ func (c *Service) Start() error {
 
 	})
 
-	r.HandleFunc("/add_conversation/{conversation}", func(writer http.ResponseWriter, request *http.Request) {
+	r.Handle("/debug/metrics/prometheus", prometheus.Handler(metrics.DefaultRegistry))
+
+	r.HandleFunc("/stream_state", func(writer http.ResponseWriter, request *http.Request) {
+		resp := NewResp()
+		resp.Status = Success
+		resp.Value = string(c.Subscriber.State())
+		AutoResponse(writer, resp)
+	})
+
+	r.HandleFunc("/sync_rules", c.admin(func(writer http.ResponseWriter, request *http.Request) {
+		resp := NewResp()
+		defer func() { AutoResponse(writer, resp) }()
+		if c.RulesFile == "" {
+			resp.Status = RuleSyncFailed
+			resp.Value = "no rules manifest configured"
+			return
+		}
+		dryRun := request.URL.Query().Get("dry_run") == "true"
+		report, err := c.Subscriber.SyncRulesFile(request.Context(), c.RulesFile, dryRun)
+		if err != nil {
+			log.Warn("sync rules error", err)
+			resp.Status = RuleSyncFailed
+			resp.Value = err.Error()
+			return
+		}
+		b, _ := json.Marshal(report)
+		resp.Status = Success
+		resp.Value = string(b)
+	})).Methods(http.MethodPost)
+
+	r.HandleFunc("/dead_letters", func(writer http.ResponseWriter, request *http.Request) {
+		resp := NewResp()
+		defer func() { AutoResponse(writer, resp) }()
+		letters, err := c.Subscriber.ListDeadLetters()
+		if err != nil {
+			resp.Status = DeadLetterFailed
+			resp.Value = err.Error()
+			return
+		}
+		b, _ := json.Marshal(letters)
+		resp.Status = Success
+		resp.Value = string(b)
+	})
+
+	//without an action the letter is returned for inspection, replay and discard are admin posts
+	deadLetter := func(writer http.ResponseWriter, request *http.Request) {
+		resp := NewResp()
+		defer func() { AutoResponse(writer, resp) }()
+		vars := mux.Vars(request)
+		id, err := strconv.ParseInt(vars["id"], 10, 64)
+		if err != nil {
+			resp.Status = DeadLetterIdInvalid
+			return
+		}
+		switch vars["action"] {
+		case "replay":
+			err = c.Subscriber.ReplayDeadLetter(request.Context(), id)
+		case "discard":
+			err = c.Subscriber.DiscardDeadLetter(id)
+		default:
+			var letter common.DeadLetterInfo
+			letter, err = c.Subscriber.GetDeadLetter(id)
+			if err == nil {
+				b, _ := json.Marshal(letter)
+				resp.Value = string(b)
+			}
+		}
+		if err != nil {
+			log.Warn("dead letter error", err, "id", id, "action", vars["action"])
+			resp.Status = DeadLetterFailed
+			resp.Value = err.Error()
+			return
+		}
+		resp.Status = Success
+	}
+	r.HandleFunc("/dead_letters/{id}", deadLetter)
+	r.HandleFunc("/dead_letters/{id}/{action:replay|discard}", c.admin(deadLetter)).Methods(http.MethodPost)
+
+	//pending thoughts grouped by author handle, of one author with the handle in the path
+	pendingThoughts := func(writer http.ResponseWriter, request *http.Request) {
+		resp := NewResp()
+		defer func() { AutoResponse(writer, resp) }()
+		thoughts, err := c.Subscriber.ListPendingThoughts(mux.Vars(request)["author"])
+		if err != nil {
+			log.Warn("pending thoughts error", err)
+			resp.Status = PendingThoughtFailed
+			resp.Value = err.Error()
+			return
+		}
+		b, _ := json.Marshal(thoughts)
+		resp.Status = Success
+		resp.Value = string(b)
+	}
+	r.HandleFunc("/pending_thoughts", pendingThoughts)
+	r.HandleFunc("/pending_thoughts/{author}", pendingThoughts)
+
+	r.HandleFunc("/username_history/{author_id}", func(writer http.ResponseWriter, request *http.Request) {
+		resp := NewResp()
+		defer func() { AutoResponse(writer, resp) }()
+		names, err := c.db.GetTwitterUsernameHistory(mux.Vars(request)["author_id"])
+		if err != nil {
+			log.Warn("username history error", err)
+			resp.Status = UsernameHistoryFailed
+			resp.Value = err.Error()
+			return
+		}
+		b, _ := json.Marshal(names)
+		resp.Status = Success
+		resp.Value = string(b)
+	})
+
+	//the message to sign and tweet with the nonce to link a wallet to the twitter account
+	r.HandleFunc("/link_nonce/{twitter}", func(writer http.ResponseWriter, request *http.Request) {
+		resp := NewResp()
+		defer func() { AutoResponse(writer, resp) }()
+		twitter := mux.Vars(request)["twitter"]
+		challenge, err := c.Subscriber.IssueLinkNonce(twitter)
+		if err != nil {
+			log.Warn("issue link nonce error", err, "twitter", twitter)
+			resp.Status = WalletLinkFailed
+			resp.Value = err.Error()
+			return
+		}
+		b, _ := json.Marshal(challenge)
+		resp.Status = Success
+		resp.Value = string(b)
+	})
+
+	r.HandleFunc("/link_status/{twitter}", func(writer http.ResponseWriter, request *http.Request) {
+		resp := NewResp()
+		defer func() { AutoResponse(writer, resp) }()
+		link, err := c.Subscriber.GetWalletLinkStatus(mux.Vars(request)["twitter"])
+		if err != nil {
+			resp.Status = WalletLinkFailed
+			resp.Value = err.Error()
+			return
+		}
+		b, _ := json.Marshal(link)
+		resp.Status = Success
+		resp.Value = string(b)
+	})
+
+	r.HandleFunc("/events", func(writer http.ResponseWriter, request *http.Request) {
+		resp := NewResp()
+		defer func() { AutoResponse(writer, resp) }()
+		events, err := c.Subscriber.GetEventList()
+		if err != nil {
+			resp.Status = EventFailed
+			resp.Value = err.Error()
+			return
+		}
+		b, _ := json.Marshal(events)
+		resp.Status = Success
+		resp.Value = string(b)
+	})
+
+	//whether a #HugMe tweet registered its event, or why it was rejected
+	r.HandleFunc("/events/{tweet_id}", func(writer http.ResponseWriter, request *http.Request) {
+		resp := NewResp()
+		defer func() { AutoResponse(writer, resp) }()
+		event, err := c.Subscriber.GetEvent(mux.Vars(request)["tweet_id"])
+		if err != nil {
+			resp.Status = EventFailed
+			resp.Value = err.Error()
+			return
+		}
+		b, _ := json.Marshal(event)
+		resp.Status = Success
+		resp.Value = string(b)
+	})
+
+	//registers an event from the latest "#event #HugMe @HUGGLE" tweet of an organizer, for tweets the stream missed
+	r.HandleFunc("/register_event/{event}/{from}", c.admin(func(writer http.ResponseWriter, request *http.Request) {
+		resp := NewResp()
+		defer func() { AutoResponse(writer, resp) }()
+		if c.Querier == nil {
+			resp.Status = EventFailed
+			resp.Value = "event search not configured"
+			return
+		}
+		vars := mux.Vars(request)
+		info, err := c.Querier.GetEventTwitterId(request.Context(), vars["event"], vars["from"])
+		if err == nil {
+			err = c.Subscriber.RegisterEvent(info)
+		}
+		if err != nil {
+			log.Warn("register event error", err, "event", vars["event"], "from", vars["from"])
+			resp.Status = EventFailed
+			resp.Value = err.Error()
+			return
+		}
+		event, err := c.Subscriber.GetEvent(info.TweetId)
+		if err != nil {
+			resp.Status = EventFailed
+			resp.Value = err.Error()
+			return
+		}
+		b, _ := json.Marshal(event)
+		resp.Status = Success
+		resp.Value = string(b)
+	})).Methods(http.MethodPost)
+
+	//the oauth2 login links a wallet without a tweet: login returns the message to sign,
+	//authorize checks the signature and redirects to twitter which redirects back to callback
+	r.HandleFunc("/oauth/login", func(writer http.ResponseWriter, request *http.Request) {
+		resp := NewResp()
+		defer func() { AutoResponse(writer, resp) }()
+		if c.OAuth == nil {
+			resp.Status = OAuthFailed
+			resp.Value = "oauth not configured"
+			return
+		}
+		challenge, err := c.OAuth.Login(request.URL.Query().Get("address"))
+		if err != nil {
+			resp.Status = OAuthFailed
+			resp.Value = err.Error()
+			return
+		}
+		b, _ := json.Marshal(challenge)
+		resp.Status = Success
+		resp.Value = string(b)
+	})
+
+	r.HandleFunc("/oauth/authorize/{state}", func(writer http.ResponseWriter, request *http.Request) {
+		resp := NewResp()
+		if c.OAuth == nil {
+			resp.Status = OAuthFailed
+			resp.Value = "oauth not configured"
+			AutoResponse(writer, resp)
+			return
+		}
+		authorizeURL, err := c.OAuth.Authorize(mux.Vars(request)["state"], request.URL.Query().Get("signature"))
+		if err != nil {
+			resp.Status = OAuthFailed
+			resp.Value = err.Error()
+			AutoResponse(writer, resp)
+			return
+		}
+		http.Redirect(writer, request, authorizeURL, http.StatusFound)
+	})
+
+	r.HandleFunc("/oauth/callback", func(writer http.ResponseWriter, request *http.Request) {
+		resp := NewResp()
+		defer func() { AutoResponse(writer, resp) }()
+		if c.OAuth == nil {
+			resp.Status = OAuthFailed
+			resp.Value = "oauth not configured"
+			return
+		}
+		query := request.URL.Query()
+		if denied := query.Get("error"); denied != "" {
+			resp.Status = OAuthFailed
+			resp.Value = fmt.Sprintf("%v: %v", oauth.AuthorizationDeniedError, denied)
+			return
+		}
+		link, err := c.OAuth.Callback(request.Context(), query.Get("state"), query.Get("code"))
+		if err != nil {
+			log.Warn("oauth callback error", err, "state", query.Get("state"))
+			resp.Status = OAuthFailed
+			resp.Value = err.Error()
+			return
+		}
+		b, _ := json.Marshal(link)
+		resp.Status = Success
+		resp.Value = string(b)
+	})
+
+	//the sealed records of a tweet with their merkle proof and the signed epoch root
+	r.HandleFunc("/attestation_proof/{tweet_id}", func(writer http.ResponseWriter, request *http.Request) {
+		resp := NewResp()
+		defer func() { AutoResponse(writer, resp) }()
+		if c.Attester == nil {
+			resp.Status = AttestationFailed
+			resp.Value = "attestation not configured"
+			return
+		}
+		proofs, err := c.Attester.Proofs(mux.Vars(request)["tweet_id"])
+		if err != nil {
+			resp.Status = AttestationFailed
+			resp.Value = err.Error()
+			return
+		}
+		b, _ := json.Marshal(proofs)
+		resp.Status = Success
+		resp.Value = string(b)
+	})
+
+	//EIP-712 signed facts about a tweet, looked up when asked
+	r.HandleFunc("/fact/{kind:tweet|metrics}/{tweet_id}", func(writer http.ResponseWriter, request *http.Request) {
+		resp := NewResp()
+		defer func() { AutoResponse(writer, resp) }()
+		if c.Oracle == nil {
+			resp.Status = OracleFactFailed
+			resp.Value = "oracle signer not configured"
+			return
+		}
+		vars := mux.Vars(request)
+		var fact oracle.SignedFact
+		var err error
+		if vars["kind"] == "tweet" {
+			fact, err = c.Oracle.TweetFact(request.Context(), vars["tweet_id"])
+		} else {
+			fact, err = c.Oracle.MetricsFact(request.Context(), vars["tweet_id"])
+		}
+		if err != nil {
+			log.Warn("sign fact error", err, "kind", vars["kind"], "tweetId", vars["tweet_id"])
+			resp.Status = OracleFactFailed
+			resp.Value = err.Error()
+			return
+		}
+		b, _ := json.Marshal(fact)
+		resp.Status = Success
+		resp.Value = string(b)
+	})
+
+	//the current and retired oracle keys, rotate reloads the configured key file or external signer
+	r.HandleFunc("/oracle_keys", func(writer http.ResponseWriter, request *http.Request) {
+		resp := NewResp()
+		defer func() { AutoResponse(writer, resp) }()
+		if c.Oracle == nil {
+			resp.Status = OracleFactFailed
+			resp.Value = "oracle signer not configured"
+			return
+		}
+		b, _ := json.Marshal(c.Oracle.Keys().Keys())
+		resp.Status = Success
+		resp.Value = string(b)
+	})
+
+	r.HandleFunc("/oracle_keys/rotate", c.admin(func(writer http.ResponseWriter, request *http.Request) {
+		resp := NewResp()
+		defer func() { AutoResponse(writer, resp) }()
+		if c.Oracle == nil {
+			resp.Status = OracleFactFailed
+			resp.Value = "oracle signer not configured"
+			return
+		}
+		key, err := c.Oracle.Keys().Reload(request.Context())
+		if err != nil {
+			log.Warn("rotate oracle key error", err)
+			resp.Status = OracleFactFailed
+			resp.Value = err.Error()
+			return
+		}
+		b, _ := json.Marshal(key)
+		resp.Status = Success
+		resp.Value = string(b)
+	})).Methods(http.MethodPost)
+
+	//chainlink bridges post here, the adapter writes its own request/response format
+	if c.Adapter != nil {
+		r.Handle("/adapter", c.Adapter).Methods(http.MethodPost)
+	}
+
+	r.HandleFunc("/tag_routes", func(writer http.ResponseWriter, request *http.Request) {
 		resp := NewResp()
-		defer AutoResponse(writer, resp)
+		b, _ := json.Marshal(c.Subscriber.GetTagRoutes())
+		resp.Status = Success
+		resp.Value = string(b)
+		AutoResponse(writer, resp)
+	})
+
+	//without handler the route of tag is removed
+	r.HandleFunc("/route_tag/{tag}", c.admin(func(writer http.ResponseWriter, request *http.Request) {
+		resp := NewResp()
+		defer func() { AutoResponse(writer, resp) }()
+		tag := mux.Vars(request)["tag"]
+		err := c.Subscriber.RouteTag(tag, request.URL.Query().Get("handler"))
+		if err != nil {
+			log.Warn("route tag error", err, "tag", tag)
+			resp.Status = ConversationUpdateFailed
+			resp.Value = err.Error()
+			return
+		}
+		resp.Status = Success
+	})).Methods(http.MethodPost)
+
+	r.HandleFunc("/add_conversation/{conversation}", c.admin(func(writer http.ResponseWriter, request *http.Request) {
+		resp := NewResp()
+		defer func() { AutoResponse(writer, resp) }()
 		vars := mux.Vars(request)
 		conv := vars["conversation"]
 		//verify
@@ -75,18 +517,48 @@ func (c *Service) Start() error {
 			resp.Status = ConversationIdInvalid
 			return
 		}
-		c.Subscriber.AddConversation(conv, stream.DefaultHandler)
+		handlerName := request.URL.Query().Get("handler")
+		if handlerName == "" {
+			handlerName = stream.DefaultHandlerName
+		}
+		err := c.Subscriber.AddConversation(conv, handlerName)
+		if err != nil {
+			log.Warn("add conversation error", err, "conversation", conv)
+			resp.Status = ConversationUpdateFailed
+			resp.Value = err.Error()
+			return
+		}
 		resp.Status = Success
 		return
-	})
+	})).Methods(http.MethodPost)
 
-	go func() {
-		err := http.ListenAndServe(address, r)
+	r.HandleFunc("/remove_conversation/{conversation}", c.admin(func(writer http.ResponseWriter, request *http.Request) {
+		resp := NewResp()
+		defer func() { AutoResponse(writer, resp) }()
+		conv := mux.Vars(request)["conversation"]
+		err := c.Subscriber.RemoveConversation(conv)
 		if err != nil {
-			utils.Fatalf("http listen error", err)
+			log.Warn("remove conversation error", err, "conversation", conv)
+			resp.Status = ConversationUpdateFailed
+			resp.Value = err.Error()
+			return
 		}
+		resp.Status = Success
+	})).Methods(http.MethodPost)
+
+	server := &http.Server{Addr: address, Handler: r}
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- server.ListenAndServe()
 	}()
-	return nil
+	select {
+	case err := <-errCh:
+		return fmt.Errorf("http listen error: %w", err)
+	case <-ctx.Done():
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), ShutdownTimeout)
+	defer cancel()
+	return server.Shutdown(shutdownCtx)
 }
 
 func PrintErrorStr(prefix string, detail string) string {
@@ -0,0 +1,9 @@
+package signer
+
+import "errors"
+
+var (
+	NoSignerError        = errors.New("no oracle signer configured")
+	KeyFileError         = errors.New("oracle key file unreadable")
+	SignatureLengthError = errors.New("signer returned a malformed signature")
+)
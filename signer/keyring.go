@@ -0,0 +1,137 @@
+package signer
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+	"twitter_oracle/common"
+	"twitter_oracle/log"
+
+	ethcommon "github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/signer/core/apitypes"
+)
+
+// Key is a signer address and when it signed for the oracle, RetiredAt is nil for the current key
+type Key = common.OracleKeyInfo
+
+// KeyStore keeps the key history across restarts, implemented by db.DBService
+type KeyStore interface {
+	GetOracleKeys() ([]common.OracleKeyInfo, error)
+	// PutOracleKey retires the current key at key.ActiveFrom and makes key the current one
+	PutOracleKey(key common.OracleKeyInfo) error
+}
+
+// Loader opens the configured signer, a key file is read again so replacing it rotates the key
+type Loader func(ctx context.Context) (Signer, error)
+
+// leasedSigner counts the signs still running on a signer so a rotated one is closed after them
+type leasedSigner struct {
+	Signer
+	inFlight sync.WaitGroup
+}
+
+// KeyRing signs with its current signer and keeps the history of rotated keys, so a verifier
+// can accept a signature of a retired key made while it was active. Without a store the
+// history only lives as long as the process
+type KeyRing struct {
+	mutex    sync.RWMutex
+	load     Loader
+	store    KeyStore
+	restored bool
+	current  *leasedSigner
+	keys     []Key
+}
+
+func NewKeyRing(load Loader, store KeyStore) *KeyRing {
+	return &KeyRing{load: load, store: store}
+}
+
+// Reload opens the signer again and rotates to it when its address changed
+func (k *KeyRing) Reload(ctx context.Context) (Key, error) {
+	if k.load == nil {
+		return Key{}, NoSignerError
+	}
+	s, err := k.load(ctx)
+	if err != nil {
+		return Key{}, err
+	}
+	return k.Rotate(s)
+}
+
+// restoreLocked reads the stored history once, must be called with mutex held
+func (k *KeyRing) restoreLocked() error {
+	if k.restored || k.store == nil {
+		return nil
+	}
+	keys, err := k.store.GetOracleKeys()
+	if err != nil {
+		return err
+	}
+	k.keys, k.restored = keys, true
+	return nil
+}
+
+// Rotate makes s the current signer and retires the previous key, a signer with the current
+// address only replaces the connection. The previous signer is closed once its signs finish
+func (k *KeyRing) Rotate(s Signer) (Key, error) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	if err := k.restoreLocked(); err != nil {
+		return Key{}, err
+	}
+	address := s.Address().Hex()
+	var key Key
+	if n := len(k.keys); n > 0 && k.keys[n-1].Address == address {
+		key = k.keys[n-1]
+	} else {
+		key = Key{Address: address, ActiveFrom: time.Now()}
+		//stored first so a key never signs without verifiers being able to learn of it
+		if k.store != nil {
+			if err := k.store.PutOracleKey(key); err != nil {
+				return Key{}, err
+			}
+		}
+		if n > 0 {
+			retiredAt := key.ActiveFrom
+			k.keys[n-1].RetiredAt = &retiredAt
+			log.Info("oracle signer rotated", k.keys[n-1].Address, "to", address)
+		}
+		k.keys = append(k.keys, key)
+	}
+	previous := k.current
+	k.current = &leasedSigner{Signer: s}
+	if previous != nil && previous.Signer != s {
+		if closer, ok := previous.Signer.(io.Closer); ok {
+			//no sign can lease previous any more, it is out of current under the lock
+			go func() {
+				previous.inFlight.Wait()
+				closer.Close()
+			}()
+		}
+	}
+	return key, nil
+}
+
+// Keys returns the current and retired keys, oldest first
+func (k *KeyRing) Keys() []Key {
+	k.mutex.RLock()
+	defer k.mutex.RUnlock()
+	return append([]Key(nil), k.keys...)
+}
+
+// Sign signs data with the current signer and returns which address signed
+func (k *KeyRing) Sign(ctx context.Context, data apitypes.TypedData) ([]byte, ethcommon.Address, error) {
+	k.mutex.RLock()
+	s := k.current
+	if s != nil {
+		s.inFlight.Add(1)
+	}
+	k.mutex.RUnlock()
+	if s == nil {
+		return nil, ethcommon.Address{}, NoSignerError
+	}
+	defer s.inFlight.Done()
+	signature, err := s.SignTypedData(ctx, data)
+	return signature, s.Address(), err
+}
@@ -0,0 +1,148 @@
+package signer
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts/keystore"
+	ethcommon "github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/ethereum/go-ethereum/signer/core/apitypes"
+)
+
+// Signer signs EIP-712 typed data. It gets the whole typed data and not only the digest so an
+// external signer can show and check what it signs. Signatures end with v as 27 or 28
+type Signer interface {
+	Address() ethcommon.Address
+	SignTypedData(ctx context.Context, data apitypes.TypedData) ([]byte, error)
+}
+
+// TypedDataHash is the EIP-712 digest keccak256("\x19\x01" ‖ domainSeparator ‖ hashStruct(message))
+func TypedDataHash(data apitypes.TypedData) ([]byte, error) {
+	domainSeparator, err := data.HashStruct("EIP712Domain", data.Domain.Map())
+	if err != nil {
+		return nil, err
+	}
+	messageHash, err := data.HashStruct(data.PrimaryType, data.Message)
+	if err != nil {
+		return nil, err
+	}
+	return crypto.Keccak256([]byte{0x19, 0x01}, domainSeparator, messageHash), nil
+}
+
+// Recover returns the address that signed data
+func Recover(data apitypes.TypedData, signature []byte) (ethcommon.Address, error) {
+	hash, err := TypedDataHash(data)
+	if err != nil {
+		return ethcommon.Address{}, err
+	}
+	if len(signature) != crypto.SignatureLength || signature[crypto.RecoveryIDOffset] < 27 {
+		return ethcommon.Address{}, SignatureLengthError
+	}
+	sig := append([]byte(nil), signature...)
+	sig[crypto.RecoveryIDOffset] -= 27
+	pub, err := crypto.SigToPub(hash, sig)
+	if err != nil {
+		return ethcommon.Address{}, err
+	}
+	return crypto.PubkeyToAddress(*pub), nil
+}
+
+// KeySigner signs with a private key held in memory
+type KeySigner struct {
+	key     *ecdsa.PrivateKey
+	address ethcommon.Address
+}
+
+func NewKeySigner(key *ecdsa.PrivateKey) *KeySigner {
+	return &KeySigner{key: key, address: crypto.PubkeyToAddress(key.PublicKey)}
+}
+
+func (s *KeySigner) Address() ethcommon.Address {
+	return s.address
+}
+
+func (s *KeySigner) SignTypedData(ctx context.Context, data apitypes.TypedData) ([]byte, error) {
+	hash, err := TypedDataHash(data)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := crypto.Sign(hash, s.key)
+	if err != nil {
+		return nil, err
+	}
+	signature[crypto.RecoveryIDOffset] += 27
+	return signature, nil
+}
+
+// LoadKeyFile reads a geth keystore file decrypted with password, or a file holding the hex private key
+func LoadKeyFile(path string, password string) (*KeySigner, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", KeyFileError, err)
+	}
+	if json.Valid(content) {
+		key, err := keystore.DecryptKey(content, password)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v: %v", KeyFileError, path, err)
+		}
+		return NewKeySigner(key.PrivateKey), nil
+	}
+	key, err := crypto.HexToECDSA(strings.TrimPrefix(strings.TrimSpace(string(content)), "0x"))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v: %v", KeyFileError, path, err)
+	}
+	return NewKeySigner(key), nil
+}
+
+// ExternalSignTimeout bounds a signing request, an external signer may wait for a human to approve
+var ExternalSignTimeout = time.Second * 30
+
+// ExternalSigner asks a clef compatible signer over JSON-RPC with account_signTypedData, the key
+// never enters the oracle process
+type ExternalSigner struct {
+	client  *rpc.Client
+	address ethcommon.Address
+}
+
+func NewExternalSigner(ctx context.Context, endpoint string, address ethcommon.Address) (*ExternalSigner, error) {
+	client, err := rpc.DialContext(ctx, endpoint)
+	if err != nil {
+		return nil, err
+	}
+	return &ExternalSigner{client: client, address: address}, nil
+}
+
+func (s *ExternalSigner) Address() ethcommon.Address {
+	return s.address
+}
+
+func (s *ExternalSigner) SignTypedData(ctx context.Context, data apitypes.TypedData) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, ExternalSignTimeout)
+	defer cancel()
+	var signature hexutil.Bytes
+	err := s.client.CallContext(ctx, &signature, "account_signTypedData", s.address.Hex(), data)
+	if err != nil {
+		return nil, err
+	}
+	if len(signature) != crypto.SignatureLength {
+		return nil, SignatureLengthError
+	}
+	//some signers return v as 0 or 1
+	if signature[crypto.RecoveryIDOffset] < 27 {
+		signature[crypto.RecoveryIDOffset] += 27
+	}
+	return signature, nil
+}
+
+func (s *ExternalSigner) Close() error {
+	s.client.Close()
+	return nil
+}
@@ -0,0 +1,263 @@
+package signer
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"errors"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+	"twitter_oracle/common"
+
+	"github.com/ethereum/go-ethereum/accounts/keystore"
+	ethcommon "github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/common/math"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/ethereum/go-ethereum/signer/core/apitypes"
+)
+
+func testTypedData() apitypes.TypedData {
+	return apitypes.TypedData{
+		Types: apitypes.Types{
+			"EIP712Domain": {{Name: "name", Type: "string"}, {Name: "version", Type: "string"}, {Name: "chainId", Type: "uint256"}},
+			"Fact":         {{Name: "tweetId", Type: "uint256"}, {Name: "textHash", Type: "bytes32"}},
+		},
+		PrimaryType: "Fact",
+		Domain:      apitypes.TypedDataDomain{Name: "test", Version: "1", ChainId: math.NewHexOrDecimal256(1)},
+		Message: apitypes.TypedDataMessage{
+			"tweetId":  "1593857112829136897",
+			"textHash": crypto.Keccak256Hash([]byte("gm")).Hex(),
+		},
+	}
+}
+
+func checkSigner(t *testing.T, s Signer) {
+	data := testTypedData()
+	signature, err := s.SignTypedData(context.Background(), data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := signature[crypto.RecoveryIDOffset]; v != 27 && v != 28 {
+		t.Fatalf("v = %d", v)
+	}
+	address, err := Recover(data, signature)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if address != s.Address() {
+		t.Fatalf("recovered %v, signer %v", address, s.Address())
+	}
+}
+
+func TestKeyFile(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	dir := t.TempDir()
+
+	hexFile := filepath.Join(dir, "oracle.key")
+	if err := os.WriteFile(hexFile, []byte(hexutil.Encode(crypto.FromECDSA(key))+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	s, err := LoadKeyFile(hexFile, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSigner(t, s)
+
+	ks := keystore.NewKeyStore(filepath.Join(dir, "keystore"), keystore.LightScryptN, keystore.LightScryptP)
+	account, err := ks.ImportECDSA(key, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	jsonFile := account.URL.Path
+	if _, err = LoadKeyFile(jsonFile, "wrong"); err == nil {
+		t.Fatal("wrong password accepted")
+	}
+	s, err = LoadKeyFile(jsonFile, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Address() != crypto.PubkeyToAddress(key.PublicKey) {
+		t.Fatalf("address %v", s.Address())
+	}
+	checkSigner(t, s)
+}
+
+// clef answers account_signTypedData, with v as 0 or 1 like some signers do
+type clef struct {
+	key *ecdsa.PrivateKey
+}
+
+func (c *clef) SignTypedData(ctx context.Context, addr ethcommon.MixedcaseAddress, data apitypes.TypedData) (hexutil.Bytes, error) {
+	if addr.Address() != crypto.PubkeyToAddress(c.key.PublicKey) {
+		return nil, keystore.ErrNoMatch
+	}
+	hash, err := TypedDataHash(data)
+	if err != nil {
+		return nil, err
+	}
+	return crypto.Sign(hash, c.key)
+}
+
+func TestExternalSigner(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	server := rpc.NewServer()
+	if err := server.RegisterName("account", &clef{key: key}); err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	s, err := NewExternalSigner(context.Background(), ts.URL, crypto.PubkeyToAddress(key.PublicKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	checkSigner(t, s)
+
+	other, _ := crypto.GenerateKey()
+	s, err = NewExternalSigner(context.Background(), ts.URL, crypto.PubkeyToAddress(other.PublicKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if _, err = s.SignTypedData(context.Background(), testTypedData()); err == nil {
+		t.Fatal("unknown account signed")
+	}
+}
+
+func TestKeyRingRotation(t *testing.T) {
+	first, _ := crypto.GenerateKey()
+	second, _ := crypto.GenerateKey()
+	current := first
+	ring := NewKeyRing(func(ctx context.Context) (Signer, error) {
+		return NewKeySigner(current), nil
+	}, nil)
+	if _, _, err := ring.Sign(context.Background(), testTypedData()); err != NoSignerError {
+		t.Fatalf("err %v", err)
+	}
+	if _, err := ring.Reload(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	//the same key again is no rotation
+	if _, err := ring.Reload(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if keys := ring.Keys(); len(keys) != 1 || keys[0].RetiredAt != nil {
+		t.Fatalf("keys %+v", keys)
+	}
+
+	current = second
+	key, err := ring.Reload(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := ring.Keys()
+	if len(keys) != 2 || keys[0].RetiredAt == nil || keys[1] != key || key.Address != crypto.PubkeyToAddress(second.PublicKey).Hex() {
+		t.Fatalf("keys %+v", keys)
+	}
+	signature, address, err := ring.Sign(context.Background(), testTypedData())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if recovered, _ := Recover(testTypedData(), signature); recovered != address || address.Hex() != key.Address {
+		t.Fatalf("signed by %v, recovered %v", address, recovered)
+	}
+}
+
+// memKeyStore follows the retire-on-put rule of the db implementation
+type memKeyStore struct {
+	keys []common.OracleKeyInfo
+}
+
+func (m *memKeyStore) GetOracleKeys() ([]common.OracleKeyInfo, error) {
+	return append([]common.OracleKeyInfo(nil), m.keys...), nil
+}
+
+func (m *memKeyStore) PutOracleKey(key common.OracleKeyInfo) error {
+	for i := range m.keys {
+		if m.keys[i].RetiredAt == nil {
+			retiredAt := key.ActiveFrom
+			m.keys[i].RetiredAt = &retiredAt
+		}
+	}
+	m.keys = append(m.keys, key)
+	return nil
+}
+
+func TestKeyRingHistory(t *testing.T) {
+	first, _ := crypto.GenerateKey()
+	second, _ := crypto.GenerateKey()
+	store := &memKeyStore{}
+	ring := NewKeyRing(nil, store)
+	ring.Rotate(NewKeySigner(first))
+	ring.Rotate(NewKeySigner(second))
+
+	//a restarted oracle still knows when the first key was valid
+	restarted := NewKeyRing(nil, store)
+	if _, err := restarted.Rotate(NewKeySigner(second)); err != nil {
+		t.Fatal(err)
+	}
+	keys := restarted.Keys()
+	if len(keys) != 2 || keys[0].Address != crypto.PubkeyToAddress(first.PublicKey).Hex() || keys[0].RetiredAt == nil || keys[1].RetiredAt != nil {
+		t.Fatalf("keys %+v", keys)
+	}
+	if len(store.keys) != 2 {
+		t.Fatalf("restart with the current key stored %+v", store.keys)
+	}
+}
+
+// slowSigner holds its sign until release and records when it is closed
+type slowSigner struct {
+	Signer
+	release chan struct{}
+	closed  chan struct{}
+}
+
+func (s *slowSigner) SignTypedData(ctx context.Context, data apitypes.TypedData) ([]byte, error) {
+	<-s.release
+	select {
+	case <-s.closed:
+		return nil, errors.New("signed on a closed signer")
+	default:
+	}
+	return s.Signer.SignTypedData(ctx, data)
+}
+
+func (s *slowSigner) Close() error {
+	close(s.closed)
+	return nil
+}
+
+func TestKeyRingCloseAfterSign(t *testing.T) {
+	first, _ := crypto.GenerateKey()
+	second, _ := crypto.GenerateKey()
+	slow := &slowSigner{Signer: NewKeySigner(first), release: make(chan struct{}), closed: make(chan struct{})}
+	ring := NewKeyRing(nil, nil)
+	ring.Rotate(slow)
+	signed := make(chan error)
+	go func() {
+		_, _, err := ring.Sign(context.Background(), testTypedData())
+		signed <- err
+	}()
+	//the sign holds slow when it is rotated out
+	time.Sleep(time.Millisecond * 20)
+	ring.Rotate(NewKeySigner(second))
+	select {
+	case <-slow.closed:
+		t.Fatal("closed with a sign in flight")
+	case <-time.After(time.Millisecond * 20):
+	}
+	close(slow.release)
+	if err := <-signed; err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-slow.closed:
+	case <-time.After(time.Second):
+		t.Fatal("rotated signer never closed")
+	}
+}
@@ -1,15 +0,0 @@
-package stream
-
-import (
-	"fmt"
-	"net/http"
-)
-
-type authorize struct {
-	Token string
-}
-
-func (a authorize) Add(req *http.Request) {
-	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", a.Token))
-}
-
@@ -0,0 +1,246 @@
+package stream
+
+import (
+	"context"
+	"github.com/g8rswimmer/go-twitter/v2"
+	"sort"
+	"sync"
+	"twitter_oracle/log"
+	"twitter_oracle/twclient"
+)
+
+var (
+	//BackfillPageSize is max_results of each recent search page, 100 is the api maximum
+	BackfillPageSize = 100
+	//DedupWindow is how many recent tweet ids are remembered to drop live and backfilled overlaps
+	DedupWindow = 10000
+)
+
+// CheckpointStore persists the last tweet id handled for each stream rule, implemented by db.DBService
+type CheckpointStore interface {
+	GetStreamCheckpoints() (map[string]string, error)
+	PutStreamCheckpoint(ruleId string, tweetId string) error
+}
+
+// tweetIdAfter reports whether a is newer than b, ids are snowflakes so a longer id is newer
+func tweetIdAfter(a, b string) bool {
+	if len(a) != len(b) {
+		return len(a) > len(b)
+	}
+	return a > b
+}
+
+type checkpointTracker struct {
+	mutex sync.Mutex
+	store CheckpointStore
+	last  map[string]string
+}
+
+func newCheckpointTracker(store CheckpointStore) *checkpointTracker {
+	return &checkpointTracker{
+		store: store,
+		last:  make(map[string]string),
+	}
+}
+
+func (c *checkpointTracker) load() error {
+	if c.store == nil {
+		return nil
+	}
+	last, err := c.store.GetStreamCheckpoints()
+	if err != nil {
+		return err
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.last = last
+	return nil
+}
+
+func (c *checkpointTracker) get(ruleId string) (string, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	tweetId, ok := c.last[ruleId]
+	return tweetId, ok
+}
+
+// advance moves the checkpoint of every rule forward to tweetId, older ids are ignored
+func (c *checkpointTracker) advance(rules []twclient.MatchingRule, tweetId string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, rule := range rules {
+		if last, ok := c.last[rule.ID]; ok && !tweetIdAfter(tweetId, last) {
+			continue
+		}
+		c.last[rule.ID] = tweetId
+		if c.store == nil {
+			continue
+		}
+		if err := c.store.PutStreamCheckpoint(rule.ID, tweetId); err != nil {
+			log.Warn("PutStreamCheckpoint error", err, "rule", rule.ID, "tweetId", tweetId)
+		}
+	}
+}
+
+// seenTweets remembers the last size tweet ids
+type seenTweets struct {
+	mutex sync.Mutex
+	size  int
+	ids   map[string]struct{}
+	order []string
+}
+
+func newSeenTweets(size int) *seenTweets {
+	return &seenTweets{
+		size: size,
+		ids:  make(map[string]struct{}),
+	}
+}
+
+func (s *seenTweets) contains(id string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	_, ok := s.ids[id]
+	return ok
+}
+
+// markSeen records id and reports whether it had been seen before
+func (s *seenTweets) markSeen(id string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.ids[id]; ok {
+		return true
+	}
+	s.ids[id] = struct{}{}
+	s.order = append(s.order, id)
+	if len(s.order) > s.size {
+		delete(s.ids, s.order[0])
+		s.order = s.order[1:]
+	}
+	return false
+}
+
+// forget drops id so it is handled when it comes again, the id is searched from the newest end
+func (s *seenTweets) forget(id string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.ids[id]; !ok {
+		return
+	}
+	delete(s.ids, id)
+	for i := len(s.order) - 1; i >= 0; i-- {
+		if s.order[i] == id {
+			s.order = append(s.order[:i], s.order[i+1:]...)
+			break
+		}
+	}
+}
+
+// SearchRecentSince pages through recent search for query after sinceId
+func (s *Subscriber) SearchRecentSince(ctx context.Context, query string, sinceId string) (*twitter.TweetRaw, error) {
+	opts := twitter.TweetRecentSearchOpts{
+		Expansions:  []twitter.Expansion{twitter.ExpansionAuthorID},
+		TweetFields: []twitter.TweetField{twitter.TweetFieldCreatedAt, twitter.TweetFieldConversationID},
+		SinceID:     sinceId,
+		MaxResults:  BackfillPageSize,
+	}
+	raw := &twitter.TweetRaw{Includes: &twitter.TweetRawIncludes{}}
+	for {
+		tweetResponse, err := s.client.TweetRecentSearch(ctx, query, opts)
+		if err != nil {
+			return raw, err
+		}
+		if tweetResponse.Raw != nil {
+			raw.Tweets = append(raw.Tweets, tweetResponse.Raw.Tweets...)
+			if tweetResponse.Raw.Includes != nil {
+				raw.Includes.Users = append(raw.Includes.Users, tweetResponse.Raw.Includes.Users...)
+			}
+		}
+		if tweetResponse.Meta == nil || tweetResponse.Meta.NextToken == "" {
+			return raw, nil
+		}
+		opts.NextToken = tweetResponse.Meta.NextToken
+	}
+}
+
+// backfill replays tweets each rule matched after its checkpoint, oldest first, so tweets
+// missed while disconnected reach the handlers before live processing resumes
+func (s *Subscriber) backfill(ctx context.Context) {
+	rulesResp, err := s.client.TweetSearchStreamRules(ctx, nil)
+	if err != nil {
+		log.Warn("backfill get rules error", err)
+		return
+	}
+	for _, rule := range rulesResp.Rules {
+		sinceId, ok := s.checkpoints.get(string(rule.ID))
+		if !ok {
+			continue
+		}
+		raw, err := s.SearchRecentSince(ctx, rule.Value, sinceId)
+		if err != nil {
+			//pages come newest first, replaying a partial search would move the checkpoint past
+			//the older tweets it never fetched, so the rule waits for the next backfill
+			log.Warn("backfill search error", err, "rule", rule.Value, "since", sinceId)
+			continue
+		}
+		if raw == nil || len(raw.Tweets) == 0 {
+			continue
+		}
+		sort.Slice(raw.Tweets, func(i, j int) bool {
+			return tweetIdAfter(raw.Tweets[j].ID, raw.Tweets[i].ID)
+		})
+		log.Info("backfill", len(raw.Tweets), "tweets for rule", rule.Value, "since", sinceId)
+		matching := []twclient.MatchingRule{{ID: string(rule.ID), Tag: rule.Tag}}
+		for _, tweet := range raw.Tweets {
+			s.processTweetMessage(ctx, &twclient.TweetMessage{
+				Raw: &twitter.TweetRaw{
+					Tweets:   []*twitter.TweetObj{tweet},
+					Includes: raw.Includes,
+				},
+				MatchingRules: matching,
+			})
+		}
+	}
+}
+
+// processTweetMessage queues a live or backfilled message once, the rule checkpoints move when
+// it and every message before it are handled, those of a duplicate too
+func (s *Subscriber) processTweetMessage(ctx context.Context, tweetMsg *twclient.TweetMessage) {
+	if tweetMsg == nil || tweetMsg.Raw == nil || len(tweetMsg.Raw.Tweets) == 0 || tweetMsg.Raw.Tweets[0] == nil {
+		log.Warn("tweet message response miss content")
+		return
+	}
+	tweetId := tweetMsg.Raw.Tweets[0].ID
+	if s.seen.markSeen(tweetId) {
+		//a tweet several rules matched is backfilled once per rule, the rules of this delivery
+		//still move past it once everything before it is handled
+		if s.pool == nil {
+			s.advanceCheckpoints(tweetMsg)
+		} else {
+			s.pool.skip(tweetMsg)
+		}
+		return
+	}
+	if s.pool == nil {
+		s.handleQueued(ctx, tweetMsg)
+		s.advanceCheckpoints(tweetMsg)
+		return
+	}
+	if err := s.pool.submit(ctx, tweetMsg); err != nil {
+		//never queued, a backfill or redelivery must still get it through
+		s.seen.forget(tweetId)
+		log.Warn("tweet not queued", err, "tweetId", tweetId)
+	}
+}
+
+func (s *Subscriber) handleQueued(ctx context.Context, tweetMsg *twclient.TweetMessage) {
+	err := s.handleTweetMessage(ctx, tweetMsg)
+	if err != nil {
+		//todo:handle tweet message handle error
+		log.Warn("handle tweet message error", err, "tweetId", tweetMsg.Raw.Tweets[0].ID)
+	}
+}
+
+func (s *Subscriber) advanceCheckpoints(tweetMsg *twclient.TweetMessage) {
+	s.checkpoints.advance(tweetMsg.MatchingRules, tweetMsg.Raw.Tweets[0].ID)
+}
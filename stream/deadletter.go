@@ -0,0 +1,173 @@
+package stream
+
+import (
+	"context"
+	"fmt"
+	"github.com/ethereum/go-ethereum/metrics"
+	"time"
+	"twitter_oracle/common"
+	"twitter_oracle/log"
+)
+
+// FallbackHandlerName names the handler set by AddDefaultHanler in dead letters
+const FallbackHandlerName = "fallback"
+
+var (
+	deadLetterCounter   = metrics.NewRegisteredCounter("stream/deadletter/stored", nil)
+	deadLetterRecovered = metrics.NewRegisteredCounter("stream/deadletter/recovered", nil)
+)
+
+// DeadLetterStore keeps tweets whose handler failed, implemented by db.DBService
+type DeadLetterStore interface {
+	PutDeadLetter(letter common.DeadLetterInfo) error
+	GetDeadLetterList() ([]common.DeadLetterInfo, error)
+	GetDueDeadLetters(now time.Time, maxAttempts int) ([]common.DeadLetterInfo, error)
+	GetDeadLetter(id int64) (common.DeadLetterInfo, error)
+	UpdateDeadLetterAttempt(id int64, attempts int, errMsg string, nextRetryAt time.Time) error
+	DeleteDeadLetter(id int64) error
+}
+
+// DeadLetterPolicy controls the retry worker, a letter is retried with exponential backoff
+// until MaxAttempts and then only replayed by hand
+type DeadLetterPolicy struct {
+	Initial      time.Duration
+	Max          time.Duration
+	MaxAttempts  int
+	PollInterval time.Duration
+}
+
+var DefaultDeadLetterPolicy = DeadLetterPolicy{
+	Initial:      time.Minute,
+	Max:          time.Hour,
+	MaxAttempts:  8,
+	PollInterval: time.Second * 30,
+}
+
+func (p DeadLetterPolicy) nextRetry(attempts int) time.Time {
+	return time.Now().Add(exponential(p.Initial, attempts, p.Max))
+}
+
+// deadLetter stores the event with its author so it can be replayed without twitter
+func (s *Subscriber) deadLetter(event *TweetEvent, handlerErr error) {
+	if s.deadLetters == nil {
+		return
+	}
+	payload, err := event.payload()
+	if err != nil {
+		log.Error("marshal dead letter error", err, "tweetId", event.TweetId)
+		return
+	}
+	err = s.deadLetters.PutDeadLetter(common.DeadLetterInfo{
+		TweetId:     event.TweetId,
+		HandlerName: event.HandlerName,
+		Payload:     payload,
+		Error:       handlerErr.Error(),
+		Attempts:    1,
+		NextRetryAt: s.Retry.nextRetry(1),
+	})
+	if err != nil {
+		log.Error("put dead letter error", err, "tweetId", event.TweetId, "handler", event.HandlerName)
+		return
+	}
+	deadLetterCounter.Inc(1)
+}
+
+func (s *Subscriber) namedHandler(name string) (Handler, bool) {
+	if name == FallbackHandlerName {
+		return s.defaultHandler, s.defaultHandler != nil
+	}
+	return s.conversations.handler(name)
+}
+
+func (s *Subscriber) ListDeadLetters() ([]common.DeadLetterInfo, error) {
+	if s.deadLetters == nil {
+		return nil, NoDeadLetterStoreError
+	}
+	return s.deadLetters.GetDeadLetterList()
+}
+
+func (s *Subscriber) GetDeadLetter(id int64) (common.DeadLetterInfo, error) {
+	if s.deadLetters == nil {
+		return common.DeadLetterInfo{}, NoDeadLetterStoreError
+	}
+	return s.deadLetters.GetDeadLetter(id)
+}
+
+// DiscardDeadLetter drops a letter without handling it
+func (s *Subscriber) DiscardDeadLetter(id int64) error {
+	if s.deadLetters == nil {
+		return NoDeadLetterStoreError
+	}
+	if _, err := s.deadLetters.GetDeadLetter(id); err != nil {
+		return err
+	}
+	return s.deadLetters.DeleteDeadLetter(id)
+}
+
+// ReplayDeadLetter runs the letter's handler again regardless of its attempts, the letter
+// is removed on success and rescheduled on failure
+func (s *Subscriber) ReplayDeadLetter(ctx context.Context, id int64) error {
+	if s.deadLetters == nil {
+		return NoDeadLetterStoreError
+	}
+	letter, err := s.deadLetters.GetDeadLetter(id)
+	if err != nil {
+		return err
+	}
+	return s.replay(ctx, letter)
+}
+
+func (s *Subscriber) replay(ctx context.Context, letter common.DeadLetterInfo) error {
+	handler, ok := s.namedHandler(letter.HandlerName)
+	if !ok {
+		return fmt.Errorf("%w: %v", UnknownHandlerError, letter.HandlerName)
+	}
+	event, err := decodeTweetEvent(letter.Payload)
+	if err != nil {
+		return fmt.Errorf("dead letter %v payload: %w", letter.Id, err)
+	}
+	event.HandlerName = letter.HandlerName
+	handlerErr := Chain(handler, s.middleware...)(ctx, event)
+	if handlerErr != nil {
+		attempts := letter.Attempts + 1
+		err = s.deadLetters.UpdateDeadLetterAttempt(letter.Id, attempts, handlerErr.Error(), s.Retry.nextRetry(attempts))
+		if err != nil {
+			log.Error("update dead letter error", err, "id", letter.Id)
+		}
+		return handlerErr
+	}
+	deadLetterRecovered.Inc(1)
+	log.Info("dead letter recovered", "id", letter.Id, "tweetId", event.TweetId, "handler", letter.HandlerName)
+	return s.deadLetters.DeleteDeadLetter(letter.Id)
+}
+
+// RetryDeadLetters replays due letters every Retry.PollInterval until ctx is done
+func (s *Subscriber) RetryDeadLetters(ctx context.Context) {
+	if s.deadLetters == nil {
+		return
+	}
+	ticker := time.NewTicker(s.Retry.PollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.retryDue(ctx)
+		}
+	}
+}
+
+func (s *Subscriber) retryDue(ctx context.Context) {
+	letters, err := s.deadLetters.GetDueDeadLetters(time.Now(), s.Retry.MaxAttempts)
+	if err != nil {
+		log.Warn("get due dead letters error", err)
+		return
+	}
+	for _, letter := range letters {
+		err = s.replay(ctx, letter)
+		if err != nil {
+			log.Warn("dead letter retry failed", err, "id", letter.Id, "attempts", letter.Attempts+1)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package stream
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+	"twitter_oracle/common"
+	"twitter_oracle/twclient"
+)
+
+type memDeadLetterStore struct {
+	mutex   sync.Mutex
+	nextId  int64
+	letters map[int64]common.DeadLetterInfo
+}
+
+func newMemDeadLetterStore() *memDeadLetterStore {
+	return &memDeadLetterStore{nextId: 1, letters: make(map[int64]common.DeadLetterInfo)}
+}
+
+func (m *memDeadLetterStore) PutDeadLetter(letter common.DeadLetterInfo) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for id, old := range m.letters {
+		if old.TweetId == letter.TweetId && old.HandlerName == letter.HandlerName {
+			old.Attempts++
+			old.Error = letter.Error
+			old.NextRetryAt = letter.NextRetryAt
+			m.letters[id] = old
+			return nil
+		}
+	}
+	letter.Id = m.nextId
+	m.nextId++
+	m.letters[letter.Id] = letter
+	return nil
+}
+
+func (m *memDeadLetterStore) GetDeadLetterList() ([]common.DeadLetterInfo, error) {
+	return m.GetDueDeadLetters(time.Now().Add(time.Hour*24*365), 1<<30)
+}
+
+func (m *memDeadLetterStore) GetDueDeadLetters(now time.Time, maxAttempts int) ([]common.DeadLetterInfo, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	letters := make([]common.DeadLetterInfo, 0)
+	for _, letter := range m.letters {
+		if !letter.NextRetryAt.After(now) && letter.Attempts < maxAttempts {
+			letters = append(letters, letter)
+		}
+	}
+	sort.Slice(letters, func(i, j int) bool { return letters[i].Id < letters[j].Id })
+	return letters, nil
+}
+
+func (m *memDeadLetterStore) GetDeadLetter(id int64) (common.DeadLetterInfo, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	letter, ok := m.letters[id]
+	if !ok {
+		return letter, errors.New("no rows in result set")
+	}
+	return letter, nil
+}
+
+func (m *memDeadLetterStore) UpdateDeadLetterAttempt(id int64, attempts int, errMsg string, nextRetryAt time.Time) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	letter := m.letters[id]
+	letter.Attempts, letter.Error, letter.NextRetryAt = attempts, errMsg, nextRetryAt
+	m.letters[id] = letter
+	return nil
+}
+
+func (m *memDeadLetterStore) DeleteDeadLetter(id int64) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	delete(m.letters, id)
+	return nil
+}
+
+// flakyHandler fails until healed
+type flakyHandler struct {
+	recordingHandler
+	healed bool
+}
+
+func (f *flakyHandler) handle(ctx context.Context, event *TweetEvent) error {
+	f.mutex.Lock()
+	healed := f.healed
+	f.mutex.Unlock()
+	if !healed {
+		return errors.New("connection refused")
+	}
+	return f.recordingHandler.handle(ctx, event)
+}
+
+func (f *flakyHandler) heal() {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.healed = true
+}
+
+func TestDeadLetterRetry(t *testing.T) {
+	store := newMemDeadLetterStore()
+	flaky := &flakyHandler{}
+	sub := newSubscriber(nil, twclient.NewFake())
+	sub.deadLetters = store
+	sub.defaultHandler = flaky.handle
+	sub.Retry = DeadLetterPolicy{Initial: time.Millisecond, Max: time.Millisecond * 5, MaxAttempts: 3, PollInterval: time.Millisecond * 10}
+
+	fs := twclient.NewFakeStream()
+	fs.SendTweet(fakeTweet("11", "10", "a thought"), fakeAuthor)
+	if err := sub.handleTweetMessage(context.Background(), <-fs.Tweets()); err != nil {
+		t.Fatal(err)
+	}
+	letters, _ := sub.ListDeadLetters()
+	if len(letters) != 1 || letters[0].HandlerName != FallbackHandlerName || letters[0].Attempts != 1 || letters[0].Error != "connection refused" {
+		t.Fatalf("unexpected dead letters %+v", letters)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go sub.RetryDeadLetters(ctx)
+	//attempts stop at MaxAttempts while the handler keeps failing
+	waitFor(t, func() bool {
+		letter, _ := store.GetDeadLetter(letters[0].Id)
+		return letter.Attempts == 3
+	})
+	time.Sleep(time.Millisecond * 50)
+	if letter, _ := store.GetDeadLetter(letters[0].Id); letter.Attempts != 3 {
+		t.Fatalf("retried past MaxAttempts: %v", letter.Attempts)
+	}
+
+	flaky.heal()
+	if err := sub.ReplayDeadLetter(context.Background(), letters[0].Id); err != nil {
+		t.Fatal(err)
+	}
+	if got := flaky.recorded(); len(got) != 1 || got[0].id != "11" || got[0].authorName != fakeAuthor.UserName {
+		t.Fatalf("replayed %+v", got)
+	}
+	if letters, _ = sub.ListDeadLetters(); len(letters) != 0 {
+		t.Fatalf("replayed letter not removed %+v", letters)
+	}
+}
+
+func TestDeadLetterConversationHandler(t *testing.T) {
+	flaky := &flakyHandler{}
+	sub := newSubscriber(nil, twclient.NewFake())
+	sub.deadLetters = newMemDeadLetterStore()
+	sub.RegisterHandler("flaky", flaky.handle)
+	if err := sub.AddConversation("10", "flaky"); err != nil {
+		t.Fatal(err)
+	}
+	fs := twclient.NewFakeStream()
+	fs.SendTweet(fakeTweet("11", "10", "reply"), fakeAuthor)
+	fs.SendTweet(fakeTweet("12", "10", "another reply"), fakeAuthor)
+	for i := 0; i < 2; i++ {
+		if err := sub.handleTweetMessage(context.Background(), <-fs.Tweets()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	letters, _ := sub.ListDeadLetters()
+	if len(letters) != 2 || letters[0].HandlerName != "flaky" {
+		t.Fatalf("unexpected dead letters %+v", letters)
+	}
+	if err := sub.DiscardDeadLetter(letters[0].Id); err != nil {
+		t.Fatal(err)
+	}
+	flaky.heal()
+	sub.retryDue(context.Background())
+	if got := flaky.recorded(); len(got) != 0 {
+		t.Fatalf("letter retried before its backoff %+v", got)
+	}
+	if err := sub.ReplayDeadLetter(context.Background(), letters[1].Id); err != nil {
+		t.Fatal(err)
+	}
+	if got := flaky.recorded(); len(got) != 1 || got[0].id != "12" {
+		t.Fatalf("replayed %+v", got)
+	}
+	if err := sub.DiscardDeadLetter(letters[0].Id); err == nil {
+		t.Fatal("discarding a missing letter should fail")
+	}
+}
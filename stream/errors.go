@@ -0,0 +1,25 @@
+package stream
+
+import "errors"
+
+var (
+	UnknownHandlerError        = errors.New("unknown handler name")
+	ConversationNotFoundError  = errors.New("conversation not registered")
+	InvalidRuleError           = errors.New("invalid stream rule")
+	NoDeadLetterStoreError     = errors.New("dead letters need a db")
+	NoThoughtStoreError        = errors.New("thoughts need a db")
+	HandlerPanicError          = errors.New("handler panic")
+	HandlerTimeoutError        = errors.New("handler timeout")
+	StreamClosedError          = errors.New("stream connection closed")
+	StreamStalledError         = errors.New("no data or heartbeat on stream")
+	OperationalDisconnectError = errors.New("stream disconnected by twitter for operational reasons")
+	TooManyConnectionsError    = errors.New("stream connection limit reached")
+	TweetNotFoundError         = errors.New("tweet not found")
+	NoWalletLinkStoreError     = errors.New("wallet links need a db")
+	InvalidLinkTweetError      = errors.New("link tweet needs an address, a nonce and a signature")
+	LinkNonceInvalidError      = errors.New("link nonce unknown, expired or issued to another account")
+	LinkSignatureError         = errors.New("signature does not match the address")
+	NoEventStoreError          = errors.New("events need a db")
+	InvalidEventTweetError     = errors.New("invalid event registration tweet")
+	InvalidEventNameError      = errors.New("event name must be 3 to 32 letters, digits or underscores and not only digits")
+)
@@ -0,0 +1,119 @@
+package stream
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/g8rswimmer/go-twitter/v2"
+	"time"
+	"twitter_oracle/twclient"
+)
+
+// TweetEvent is one tweet as delivered to a handler, with everything the stream sent along
+type TweetEvent struct {
+	TweetId        string
+	ConversationId string
+	AuthorId       string
+	AuthorName     string
+	CreatedAt      time.Time
+	Text           string
+	//HandlerName is the name the event is dispatched under, set for each handler
+	HandlerName   string
+	MatchingRules []twclient.MatchingRule
+	//Tweet carries entities, referenced tweets and the other requested fields
+	Tweet    *twitter.TweetObj
+	Author   *twitter.UserObj
+	Includes *twitter.TweetRawIncludes
+	//Raw is the stream line the tweet arrived in, nil for backfilled tweets
+	Raw json.RawMessage
+}
+
+// Handler handles one tweet, handlers needing the db close over it. Delivery is at least once:
+// a tweet comes again after a reconnect backfill, a dead letter retry or a replay, so a handler
+// must be idempotent, keyed by TweetId, and not only rely on the Dedup middleware
+type Handler func(ctx context.Context, event *TweetEvent) error
+
+// newTweetEvents resolves the author and created time of every tweet in msg, tweets whose
+// author is not included are returned in skipped
+func newTweetEvents(msg *twclient.TweetMessage) (events []*TweetEvent, skipped []*twitter.TweetObj) {
+	users := make(map[string]*twitter.UserObj)
+	if msg.Raw.Includes != nil {
+		for _, user := range msg.Raw.Includes.Users {
+			if user == nil {
+				continue
+			}
+			users[user.ID] = user
+		}
+	}
+	for _, tweet := range msg.Raw.Tweets {
+		if tweet == nil {
+			continue
+		}
+		author, ok := users[tweet.AuthorID]
+		if !ok {
+			skipped = append(skipped, tweet)
+			continue
+		}
+		createTime, err := time.Parse(time.RFC3339, tweet.CreatedAt)
+		if err != nil {
+			createTime = time.Now()
+		}
+		event := &TweetEvent{
+			TweetId:        tweet.ID,
+			ConversationId: tweet.ConversationID,
+			AuthorId:       author.ID,
+			AuthorName:     author.UserName,
+			CreatedAt:      createTime,
+			Text:           tweet.Text,
+			MatchingRules:  msg.MatchingRules,
+			Tweet:          tweet,
+			Author:         author,
+			Includes:       msg.Raw.Includes,
+		}
+		if len(msg.Raw.Tweets) == 1 {
+			event.Raw = msg.Data
+		}
+		events = append(events, event)
+	}
+	return events, skipped
+}
+
+// decodeTweetEvent is the inverse of payload
+func decodeTweetEvent(payload []byte) (*TweetEvent, error) {
+	msg, err := twclient.DecodeTweetMessage(payload)
+	if err != nil {
+		return nil, err
+	}
+	events, _ := newTweetEvents(msg)
+	if len(events) == 0 {
+		return nil, fmt.Errorf("payload of tweet %v miss author", msg.Raw.Tweets[0].ID)
+	}
+	return events[0], nil
+}
+
+// payload encodes the event as a stream line carrying only its author so it can be replayed
+func (e *TweetEvent) payload() ([]byte, error) {
+	return twclient.EncodeTweetMessage(e.Tweet, &twitter.TweetRawIncludes{Users: []*twitter.UserObj{e.Author}}, e.MatchingRules)
+}
+
+// ReferencedTweetId returns the id of the tweet this one replied_to, quoted or retweeted
+func (e *TweetEvent) ReferencedTweetId(refType string) string {
+	if e.Tweet == nil {
+		return ""
+	}
+	for _, ref := range e.Tweet.ReferencedTweets {
+		if ref != nil && ref.Type == refType {
+			return ref.ID
+		}
+	}
+	return ""
+}
+
+// RuleTags returns the tags of the stream rules the tweet matched
+func (e *TweetEvent) RuleTags() []string {
+	tags := make([]string, 0, len(e.MatchingRules))
+	for _, rule := range e.MatchingRules {
+		tags = append(tags, rule.Tag)
+	}
+	return tags
+}
@@ -0,0 +1,192 @@
+package stream
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/metrics"
+	"regexp"
+	"strings"
+	"time"
+	"twitter_oracle/common"
+	"twitter_oracle/db"
+	"twitter_oracle/log"
+)
+
+const (
+	LinkIssued   = "issued"
+	LinkLinked   = "linked"
+	LinkRejected = "rejected"
+	//LinkReplaced is a link the account or the address moved on from
+	LinkReplaced = "replaced"
+)
+
+var (
+	//LinkNonceTTL is how long a user has to tweet the signature of an issued nonce
+	LinkNonceTTL = time.Hour
+	//LinkHashtag marks a link tweet, the rule matching it should carry the "link" tag
+	LinkHashtag = "#HugLink"
+)
+
+var (
+	linkAddress   = regexp.MustCompile(`^0x[0-9a-fA-F]{40}$`)
+	linkSignature = regexp.MustCompile(`^0x[0-9a-fA-F]{130}$`)
+	linkNonce     = regexp.MustCompile(`^[0-9a-f]{32}$`)
+)
+
+var (
+	walletLinkedCounter   = metrics.NewRegisteredCounter("stream/link/linked", nil)
+	walletRejectedCounter = metrics.NewRegisteredCounter("stream/link/rejected", nil)
+)
+
+// WalletLinkStore keeps issued nonces and binds twitter accounts to addresses, implemented by db.DBService
+type WalletLinkStore interface {
+	PutLinkNonce(link common.WalletLinkInfo) error
+	// GetLinkNonce returns db.LinkNonceNotFoundError for a nonce that was never issued
+	GetLinkNonce(nonce string) (common.WalletLinkInfo, error)
+	// LinkWallet consumes the nonce of link and links the account to the address, a nonce is only accepted once
+	// unless it comes again with the same tweet
+	LinkWallet(link common.WalletLinkInfo) error
+	RejectWalletLink(nonce string, tweetId string, errMsg string) error
+	GetWalletLinkStatus(twitter string) (common.WalletLinkInfo, error)
+}
+
+// LinkChallenge is what a user signs with personal_sign and tweets as
+// "#HugLink <address> <nonce> <signature>"
+type LinkChallenge struct {
+	Nonce     string    `json:"nonce"`
+	Message   string    `json:"message"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// LinkMessage is the text signed to link twitter to the signing address
+func LinkMessage(twitter string, nonce string) string {
+	return fmt.Sprintf("Link twitter account @%s to this wallet on twitter oracle. Nonce: %s", strings.ToLower(twitter), nonce)
+}
+
+// VerifyLinkSignature checks that signature is an EIP-191 personal_sign of message by address
+func VerifyLinkSignature(message string, address string, signature string) error {
+	sig, err := hexutil.Decode(signature)
+	if err != nil || len(sig) != crypto.SignatureLength {
+		return fmt.Errorf("%w: malformed signature", LinkSignatureError)
+	}
+	//wallets sign with v as 27 or 28
+	if sig[crypto.RecoveryIDOffset] >= 27 {
+		sig[crypto.RecoveryIDOffset] -= 27
+	}
+	pub, err := crypto.SigToPub(accounts.TextHash([]byte(message)), sig)
+	if err != nil {
+		return fmt.Errorf("%w: %v", LinkSignatureError, err)
+	}
+	if signer := crypto.PubkeyToAddress(*pub); !strings.EqualFold(signer.Hex(), address) {
+		return fmt.Errorf("%w: signed by %v", LinkSignatureError, signer.Hex())
+	}
+	return nil
+}
+
+// parseLinkTweet finds the address, nonce and signature among the words of a link tweet
+func parseLinkTweet(text string) (address, nonce, signature string, err error) {
+	for _, word := range strings.Fields(text) {
+		switch {
+		case linkAddress.MatchString(word):
+			address = word
+		case linkSignature.MatchString(word):
+			signature = word
+		case linkNonce.MatchString(word):
+			nonce = word
+		}
+	}
+	if address == "" || nonce == "" || signature == "" {
+		return "", "", "", InvalidLinkTweetError
+	}
+	return address, nonce, signature, nil
+}
+
+// IssueLinkNonce starts linking twitter to a wallet, the user signs the returned message
+func (s *Subscriber) IssueLinkNonce(twitter string) (LinkChallenge, error) {
+	if s.links == nil {
+		return LinkChallenge{}, NoWalletLinkStoreError
+	}
+	twitter = strings.ToLower(strings.TrimPrefix(twitter, "@"))
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return LinkChallenge{}, err
+	}
+	link := common.WalletLinkInfo{
+		Nonce:     hex.EncodeToString(b),
+		Twitter:   twitter,
+		Status:    LinkIssued,
+		ExpiresAt: time.Now().Add(LinkNonceTTL),
+	}
+	if err := s.links.PutLinkNonce(link); err != nil {
+		return LinkChallenge{}, err
+	}
+	return LinkChallenge{Nonce: link.Nonce, Message: LinkMessage(twitter, link.Nonce), ExpiresAt: link.ExpiresAt}, nil
+}
+
+func (s *Subscriber) GetWalletLinkStatus(twitter string) (common.WalletLinkInfo, error) {
+	if s.links == nil {
+		return common.WalletLinkInfo{}, NoWalletLinkStoreError
+	}
+	return s.links.GetWalletLinkStatus(strings.ToLower(strings.TrimPrefix(twitter, "@")))
+}
+
+// LinkHandler binds the author of a link tweet to the address that signed their nonce. A rejected
+// link is recorded on the nonce for the user to see and not retried, a store error is returned
+// so the tweet is dead lettered and can be replayed
+func (s *Subscriber) LinkHandler(ctx context.Context, event *TweetEvent) error {
+	if s.links == nil {
+		return NoWalletLinkStoreError
+	}
+	address, nonce, signature, err := parseLinkTweet(event.Text)
+	if err != nil {
+		walletRejectedCounter.Inc(1)
+		log.Info("wallet link rejected", err, "author", event.AuthorName, "tweetId", event.TweetId)
+		return nil
+	}
+	link, err := s.links.GetLinkNonce(nonce)
+	if err != nil && !errors.Is(err, db.LinkNonceNotFoundError) {
+		return err
+	}
+	if err != nil {
+		walletRejectedCounter.Inc(1)
+		log.Info("wallet link rejected", err, "nonce", nonce, "author", event.AuthorName, "tweetId", event.TweetId)
+		return nil
+	}
+	err = s.verifyLink(link, event, address, signature)
+	if err != nil {
+		walletRejectedCounter.Inc(1)
+		log.Info("wallet link rejected", err, "nonce", nonce, "author", event.AuthorName, "tweetId", event.TweetId)
+		return s.links.RejectWalletLink(nonce, event.TweetId, err.Error())
+	}
+	link.TwitterId, link.Twitter, link.Address, link.TweetId = event.AuthorId, event.AuthorName, address, event.TweetId
+	err = s.links.LinkWallet(link)
+	if errors.Is(err, db.LinkNonceUsedError) {
+		walletRejectedCounter.Inc(1)
+		log.Info("wallet link rejected", err, "nonce", nonce, "author", event.AuthorName, "tweetId", event.TweetId)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	walletLinkedCounter.Inc(1)
+	log.Info("wallet linked", event.AuthorName, "address", address, "authorId", event.AuthorId)
+	return nil
+}
+
+func (s *Subscriber) verifyLink(link common.WalletLinkInfo, event *TweetEvent, address string, signature string) error {
+	switch {
+	case !strings.EqualFold(link.Twitter, event.AuthorName):
+		return fmt.Errorf("%w: issued to @%v", LinkNonceInvalidError, link.Twitter)
+	case link.Status == LinkLinked && link.TweetId != event.TweetId:
+		return fmt.Errorf("%w: already used by tweet %v", LinkNonceInvalidError, link.TweetId)
+	case time.Now().After(link.ExpiresAt) && link.Status != LinkLinked:
+		return fmt.Errorf("%w: expired at %v", LinkNonceInvalidError, link.ExpiresAt.Format(time.RFC3339))
+	}
+	return VerifyLinkSignature(LinkMessage(link.Twitter, link.Nonce), address, signature)
+}
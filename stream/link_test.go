@@ -0,0 +1,221 @@
+package stream
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"errors"
+	"fmt"
+	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/g8rswimmer/go-twitter/v2"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"twitter_oracle/common"
+	"twitter_oracle/db"
+	"twitter_oracle/twclient"
+)
+
+// memWalletLinkStore follows the nonce rules of the db implementation
+type memWalletLinkStore struct {
+	mutex sync.Mutex
+	links map[string]common.WalletLinkInfo
+	users map[string]string
+	//getErr fails GetLinkNonce when set
+	getErr error
+}
+
+func newMemWalletLinkStore() *memWalletLinkStore {
+	return &memWalletLinkStore{links: make(map[string]common.WalletLinkInfo), users: make(map[string]string)}
+}
+
+func (m *memWalletLinkStore) PutLinkNonce(link common.WalletLinkInfo) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	link.UpdatedAt = time.Now()
+	m.links[link.Nonce] = link
+	return nil
+}
+
+func (m *memWalletLinkStore) GetLinkNonce(nonce string) (common.WalletLinkInfo, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.getErr != nil {
+		return common.WalletLinkInfo{}, m.getErr
+	}
+	link, ok := m.links[nonce]
+	if !ok {
+		return link, db.LinkNonceNotFoundError
+	}
+	return link, nil
+}
+
+func (m *memWalletLinkStore) LinkWallet(link common.WalletLinkInfo) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	stored := m.links[link.Nonce]
+	usable := stored.Status != LinkLinked && time.Now().Before(stored.ExpiresAt)
+	if !usable && !(stored.Status == LinkLinked && stored.TweetId == link.TweetId) {
+		return db.LinkNonceUsedError
+	}
+	link.Status, link.Error, link.UpdatedAt = LinkLinked, "", time.Now()
+	m.links[link.Nonce] = link
+	m.users[link.TwitterId] = link.Address
+	return nil
+}
+
+func (m *memWalletLinkStore) RejectWalletLink(nonce string, tweetId string, errMsg string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	link := m.links[nonce]
+	if link.Status == LinkLinked {
+		return nil
+	}
+	link.Status, link.TweetId, link.Error, link.UpdatedAt = LinkRejected, tweetId, errMsg, time.Now()
+	m.links[nonce] = link
+	return nil
+}
+
+func (m *memWalletLinkStore) GetWalletLinkStatus(twitter string) (common.WalletLinkInfo, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	var latest common.WalletLinkInfo
+	for _, link := range m.links {
+		if link.Twitter == twitter && link.UpdatedAt.After(latest.UpdatedAt) {
+			latest = link
+		}
+	}
+	return latest, nil
+}
+
+func signLink(t *testing.T, key *ecdsa.PrivateKey, message string) string {
+	sig, err := crypto.Sign(accounts.TextHash([]byte(message)), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//as wallets return it
+	sig[crypto.RecoveryIDOffset] += 27
+	return hexutil.Encode(sig)
+}
+
+func linkEvent(id string, author *twitter.UserObj, text string) *TweetEvent {
+	tweet := fakeTweet(id, id, text)
+	tweet.AuthorID = author.ID
+	return &TweetEvent{TweetId: id, ConversationId: id, AuthorId: author.ID, AuthorName: author.UserName, Text: text, Tweet: tweet, Author: author}
+}
+
+func TestVerifyLinkSignature(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	other, _ := crypto.GenerateKey()
+	address := crypto.PubkeyToAddress(key.PublicKey).Hex()
+	message := LinkMessage("NinoX2022", "0123456789abcdef0123456789abcdef")
+	if err := VerifyLinkSignature(message, strings.ToLower(address), signLink(t, key, message)); err != nil {
+		t.Fatal(err)
+	}
+	cases := map[string]string{
+		"other signer":  signLink(t, other, message),
+		"other message": signLink(t, key, message+"!"),
+		"malformed":     "0x1234",
+	}
+	for name, sig := range cases {
+		if err := VerifyLinkSignature(message, address, sig); !errors.Is(err, LinkSignatureError) {
+			t.Fatalf("%v: expected LinkSignatureError, got %v", name, err)
+		}
+	}
+}
+
+func TestLinkHandler(t *testing.T) {
+	store := newMemWalletLinkStore()
+	sub := newSubscriber(nil, twclient.NewFake())
+	sub.links = store
+	key, _ := crypto.GenerateKey()
+	address := crypto.PubkeyToAddress(key.PublicKey).Hex()
+	ctx := context.Background()
+	link := func(id string, author *twitter.UserObj, nonce string, sig string) {
+		text := fmt.Sprintf("%v %v %v %v", LinkHashtag, address, nonce, sig)
+		if err := sub.dispatch(ctx, LinkHandlerName, sub.LinkHandler, linkEvent(id, author, text)); err != nil {
+			t.Fatalf("link tweet %v: %v", id, err)
+		}
+	}
+
+	challenge, err := sub.IssueLinkNonce("@NinoX2022")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig := signLink(t, key, challenge.Message)
+	//signed for ninox2022 but tweeted by someone else
+	link("1", &twitter.UserObj{ID: "300", UserName: "impostor"}, challenge.Nonce, sig)
+	if status, _ := sub.GetWalletLinkStatus("ninox2022"); status.Status != LinkRejected || !strings.Contains(status.Error, "issued to") {
+		t.Fatalf("impostor link status %+v", status)
+	}
+	link("2", fakeAuthor, challenge.Nonce, sig)
+	status, err := sub.GetWalletLinkStatus("NinoX2022")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Status != LinkLinked || status.TwitterId != fakeAuthor.ID || store.users[fakeAuthor.ID] != address {
+		t.Fatalf("link status %+v, users %v", status, store.users)
+	}
+	//delivered again the same tweet still links
+	link("2", fakeAuthor, challenge.Nonce, sig)
+	//a replayed signature in a new tweet is rejected
+	link("3", fakeAuthor, challenge.Nonce, sig)
+	if status, _ := sub.GetWalletLinkStatus("ninox2022"); status.TweetId != "2" || status.Status != LinkLinked {
+		t.Fatalf("replayed link changed status %+v", status)
+	}
+
+	//a signature of another nonce does not match
+	second, _ := sub.IssueLinkNonce("ninox2022")
+	link("4", fakeAuthor, second.Nonce, sig)
+	status, _ = sub.GetWalletLinkStatus("ninox2022")
+	if status.Nonce != second.Nonce || status.Status != LinkRejected || !strings.Contains(status.Error, LinkSignatureError.Error()) {
+		t.Fatalf("mismatched signature status %+v", status)
+	}
+	//the rejected nonce can still be used before it expires
+	link("5", fakeAuthor, second.Nonce, signLink(t, key, second.Message))
+	if status, _ := sub.GetWalletLinkStatus("ninox2022"); status.Status != LinkLinked || status.TweetId != "5" {
+		t.Fatalf("retried link status %+v", status)
+	}
+
+	expired, _ := sub.IssueLinkNonce("ninox2022")
+	store.links[expired.Nonce] = func(l common.WalletLinkInfo) common.WalletLinkInfo {
+		l.ExpiresAt = time.Now().Add(-time.Second)
+		return l
+	}(store.links[expired.Nonce])
+	link("6", fakeAuthor, expired.Nonce, signLink(t, key, expired.Message))
+	if status, _ := sub.GetWalletLinkStatus("ninox2022"); status.Status != LinkRejected || !strings.Contains(status.Error, "expired") {
+		t.Fatalf("expired link status %+v", status)
+	}
+}
+
+func TestLinkHandlerStoreError(t *testing.T) {
+	store := newMemWalletLinkStore()
+	sub := newSubscriber(nil, twclient.NewFake())
+	sub.links = store
+	key, _ := crypto.GenerateKey()
+	address := crypto.PubkeyToAddress(key.PublicKey).Hex()
+	challenge, err := sub.IssueLinkNonce("ninox2022")
+	if err != nil {
+		t.Fatal(err)
+	}
+	text := fmt.Sprintf("%v %v %v %v", LinkHashtag, address, challenge.Nonce, signLink(t, key, challenge.Message))
+	//an unknown nonce is the user's mistake
+	unknown := fmt.Sprintf("%v %v %v %v", LinkHashtag, address, strings.Repeat("0", 32), signLink(t, key, challenge.Message))
+	if err := sub.LinkHandler(context.Background(), linkEvent("1", fakeAuthor, unknown)); err != nil {
+		t.Fatalf("unknown nonce: %v", err)
+	}
+	//a store that is down must not drop the tweet
+	store.getErr = errors.New("connection refused")
+	if err := sub.LinkHandler(context.Background(), linkEvent("2", fakeAuthor, text)); !errors.Is(err, store.getErr) {
+		t.Fatalf("expected the store error, got %v", err)
+	}
+	store.getErr = nil
+	if err := sub.LinkHandler(context.Background(), linkEvent("2", fakeAuthor, text)); err != nil {
+		t.Fatal(err)
+	}
+	if store.users[fakeAuthor.ID] != address {
+		t.Fatalf("replayed link tweet not linked, users %v", store.users)
+	}
+}
@@ -0,0 +1,182 @@
+package stream
+
+import (
+	"context"
+	"fmt"
+	"github.com/ethereum/go-ethereum/metrics"
+	"runtime/debug"
+	"sync"
+	"time"
+	"twitter_oracle/log"
+)
+
+// Middleware wraps a handler with cross-cutting behavior. State a middleware keeps is shared by
+// every handler it wraps, so it is keyed by TweetEvent.HandlerName where that matters
+type Middleware func(next Handler) Handler
+
+// Chain wraps handler so that the first middleware runs outermost
+func Chain(handler Handler, middleware ...Middleware) Handler {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		handler = middleware[i](handler)
+	}
+	return handler
+}
+
+// Recover turns a handler panic into HandlerPanicError so one bad tweet can not stop the stream
+func Recover() Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, event *TweetEvent) (err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					log.Error("handler panic", r, "handler", event.HandlerName, "tweetId", event.TweetId, "stack", string(debug.Stack()))
+					err = fmt.Errorf("%w: %v", HandlerPanicError, r)
+				}
+			}()
+			return next(ctx, event)
+		}
+	}
+}
+
+// Logging logs every failed handler call
+func Logging() Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, event *TweetEvent) error {
+			err := next(ctx, event)
+			if err != nil {
+				log.Warn("handler error", err, "handler", event.HandlerName, "tweetId", event.TweetId, "author", event.AuthorName)
+			}
+			return err
+		}
+	}
+}
+
+// Timing records the duration of each handler in the stream/handler/<name> timer
+func Timing() Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, event *TweetEvent) error {
+			start := time.Now()
+			err := next(ctx, event)
+			metrics.GetOrRegisterTimer("stream/handler/"+event.HandlerName, nil).UpdateSince(start)
+			return err
+		}
+	}
+}
+
+var abandonedGauge = metrics.NewRegisteredGauge("stream/handler/abandoned", nil)
+
+// Timeout cancels the handler context after d and returns HandlerTimeoutError if the handler
+// has not returned by then. A handler can not be stopped from outside, one that ignores its
+// context keeps running in the background until it returns; stream/handler/abandoned counts
+// those still running so a handler that leaks them shows up
+func Timeout(d time.Duration) Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, event *TweetEvent) error {
+			ctx, cancel := context.WithTimeout(ctx, d)
+			defer cancel()
+			var mutex sync.Mutex
+			finished, abandoned := false, false
+			done := make(chan error, 1)
+			go func() {
+				err := next(ctx, event)
+				mutex.Lock()
+				if abandoned {
+					abandonedGauge.Dec(1)
+				}
+				finished = true
+				mutex.Unlock()
+				done <- err
+			}()
+			select {
+			case err := <-done:
+				return err
+			case <-ctx.Done():
+				mutex.Lock()
+				defer mutex.Unlock()
+				if finished {
+					return <-done
+				}
+				abandoned = true
+				abandonedGauge.Inc(1)
+				return fmt.Errorf("%w: %v after %v", HandlerTimeoutError, event.HandlerName, d)
+			}
+		}
+	}
+}
+
+// Dedup skips tweets a handler already handled successfully, the last size per handler are remembered
+func Dedup(size int) Middleware {
+	var mutex sync.Mutex
+	seen := make(map[string]*seenTweets)
+	return func(next Handler) Handler {
+		return func(ctx context.Context, event *TweetEvent) error {
+			mutex.Lock()
+			handled, ok := seen[event.HandlerName]
+			if !ok {
+				handled = newSeenTweets(size)
+				seen[event.HandlerName] = handled
+			}
+			mutex.Unlock()
+			if handled.contains(event.TweetId) {
+				return nil
+			}
+			err := next(ctx, event)
+			if err == nil {
+				handled.markSeen(event.TweetId)
+			}
+			return err
+		}
+	}
+}
+
+// authorLimiter keeps the recent handled times of each handler/author key, keys whose times all
+// fell out of the window are swept at most once per window so one-off authors do not pile up
+type authorLimiter struct {
+	mutex     sync.Mutex
+	limit     int
+	window    time.Duration
+	recent    map[string][]time.Time
+	lastSweep time.Time
+}
+
+func (a *authorLimiter) allow(key string) bool {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	now := time.Now()
+	if now.Sub(a.lastSweep) >= a.window {
+		for k, times := range a.recent {
+			if now.Sub(times[len(times)-1]) >= a.window {
+				delete(a.recent, k)
+			}
+		}
+		a.lastSweep = now
+	}
+	times := a.recent[key]
+	kept := times[:0]
+	for _, t := range times {
+		if now.Sub(t) < a.window {
+			kept = append(kept, t)
+		}
+	}
+	if len(kept) >= a.limit {
+		a.recent[key] = kept
+		return false
+	}
+	a.recent[key] = append(kept, now)
+	return true
+}
+
+// RateLimitPerAuthor lets each author through a handler at most limit times per window,
+// tweets over the limit are dropped
+func RateLimitPerAuthor(limit int, window time.Duration) Middleware {
+	limiter := &authorLimiter{limit: limit, window: window, recent: make(map[string][]time.Time), lastSweep: time.Now()}
+	return func(next Handler) Handler {
+		return func(ctx context.Context, event *TweetEvent) error {
+			if !limiter.allow(event.HandlerName + "/" + event.AuthorId) {
+				metrics.GetOrRegisterCounter("stream/handler/ratelimited", nil).Inc(1)
+				log.Warn("author rate limited", event.AuthorName, "handler", event.HandlerName, "tweetId", event.TweetId)
+				return nil
+			}
+			return next(ctx, event)
+		}
+	}
+}
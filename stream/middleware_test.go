@@ -0,0 +1,162 @@
+package stream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+	"twitter_oracle/twclient"
+)
+
+func TestChainOrder(t *testing.T) {
+	var order []string
+	mark := func(name string) Middleware {
+		return func(next Handler) Handler {
+			return func(ctx context.Context, event *TweetEvent) error {
+				order = append(order, name)
+				return next(ctx, event)
+			}
+		}
+	}
+	handler := Chain(func(ctx context.Context, event *TweetEvent) error {
+		order = append(order, "handler")
+		return nil
+	}, mark("outer"), mark("inner"))
+	if err := handler(context.Background(), &TweetEvent{}); err != nil {
+		t.Fatal(err)
+	}
+	if len(order) != 3 || order[0] != "outer" || order[1] != "inner" || order[2] != "handler" {
+		t.Fatalf("order = %v", order)
+	}
+}
+
+func TestRecoverAndTimeout(t *testing.T) {
+	panicking := Chain(func(ctx context.Context, event *TweetEvent) error {
+		panic("nil author")
+	}, Recover())
+	if err := panicking(context.Background(), &TweetEvent{}); !errors.Is(err, HandlerPanicError) {
+		t.Fatalf("got %v, want HandlerPanicError", err)
+	}
+	slow := Chain(func(ctx context.Context, event *TweetEvent) error {
+		time.Sleep(time.Second)
+		return nil
+	}, Timeout(time.Millisecond*10))
+	if err := slow(context.Background(), &TweetEvent{}); !errors.Is(err, HandlerTimeoutError) {
+		t.Fatalf("got %v, want HandlerTimeoutError", err)
+	}
+}
+
+func TestDedupAndRateLimit(t *testing.T) {
+	calls := 0
+	fail := true
+	handler := Chain(func(ctx context.Context, event *TweetEvent) error {
+		calls++
+		if fail {
+			return errors.New("db down")
+		}
+		return nil
+	}, Dedup(10))
+	event := &TweetEvent{TweetId: "1", HandlerName: "thought"}
+	handler(context.Background(), event)
+	fail = false
+	//a failed call is not remembered so the retry gets through
+	handler(context.Background(), event)
+	handler(context.Background(), event)
+	handler(context.Background(), &TweetEvent{TweetId: "1", HandlerName: "default"})
+	if calls != 3 {
+		t.Fatalf("calls = %v, want 3", calls)
+	}
+
+	calls = 0
+	limited := Chain(func(ctx context.Context, event *TweetEvent) error {
+		calls++
+		return nil
+	}, RateLimitPerAuthor(2, time.Hour))
+	for i := 0; i < 5; i++ {
+		limited(context.Background(), &TweetEvent{AuthorId: "100", HandlerName: "thought"})
+	}
+	limited(context.Background(), &TweetEvent{AuthorId: "200", HandlerName: "thought"})
+	if calls != 3 {
+		t.Fatalf("calls = %v, want 3", calls)
+	}
+}
+
+func TestTweetEventPayload(t *testing.T) {
+	rules := []twclient.MatchingRule{{ID: "7", Tag: "thought"}}
+	fs := twclient.NewFakeStream()
+	fs.SendMatching(fakeTweet("11", "10", "a thought"), rules, fakeAuthor)
+	events, skipped := newTweetEvents(<-fs.Tweets())
+	if len(events) != 1 || len(skipped) != 0 {
+		t.Fatalf("events %v skipped %v", events, skipped)
+	}
+	event := events[0]
+	if event.AuthorName != fakeAuthor.UserName || event.CreatedAt.IsZero() || len(event.Raw) == 0 || event.RuleTags()[0] != "thought" {
+		t.Fatalf("unexpected event %+v", event)
+	}
+	payload, err := event.payload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := decodeTweetEvent(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.TweetId != "11" || decoded.AuthorId != fakeAuthor.ID || !decoded.CreatedAt.Equal(event.CreatedAt) || decoded.MatchingRules[0] != rules[0] {
+		t.Fatalf("decoded %+v, want %+v", decoded, event)
+	}
+}
+
+func TestDispatchPanicIsDeadLettered(t *testing.T) {
+	sub := newSubscriber(nil, twclient.NewFake())
+	sub.deadLetters = newMemDeadLetterStore()
+	sub.defaultHandler = func(ctx context.Context, event *TweetEvent) error {
+		panic("boom")
+	}
+	fs := twclient.NewFakeStream()
+	fs.SendTweet(fakeTweet("11", "10", "a thought"), fakeAuthor)
+	if err := sub.handleTweetMessage(context.Background(), <-fs.Tweets()); err != nil {
+		t.Fatal(err)
+	}
+	letters, _ := sub.ListDeadLetters()
+	if len(letters) != 1 || letters[0].HandlerName != FallbackHandlerName {
+		t.Fatalf("unexpected dead letters %+v", letters)
+	}
+}
+
+func TestTimeoutAbandoned(t *testing.T) {
+	release := make(chan struct{})
+	finished := make(chan struct{})
+	stuck := Chain(func(ctx context.Context, event *TweetEvent) error {
+		<-release
+		close(finished)
+		return nil
+	}, Timeout(time.Millisecond*10))
+	if err := stuck(context.Background(), &TweetEvent{}); !errors.Is(err, HandlerTimeoutError) {
+		t.Fatalf("got %v, want HandlerTimeoutError", err)
+	}
+	//the abandoned handler still runs to its end
+	close(release)
+	select {
+	case <-finished:
+	case <-time.After(time.Second):
+		t.Fatal("abandoned handler never finished")
+	}
+}
+
+func TestRateLimitSweep(t *testing.T) {
+	limiter := &authorLimiter{limit: 1, window: time.Millisecond * 20, recent: make(map[string][]time.Time), lastSweep: time.Now()}
+	for i := 0; i < 100; i++ {
+		limiter.allow(fmt.Sprint("thought/", i))
+	}
+	if limiter.allow("thought/0") {
+		t.Fatal("author let through twice in a window")
+	}
+	time.Sleep(time.Millisecond * 30)
+	if !limiter.allow("thought/0") {
+		t.Fatal("author still limited after the window")
+	}
+	if len(limiter.recent) != 1 {
+		t.Fatalf("%v keys left after the window, want 1", len(limiter.recent))
+	}
+}
@@ -0,0 +1,107 @@
+package stream
+
+import (
+	"context"
+	"github.com/ethereum/go-ethereum/metrics"
+	"time"
+	"twitter_oracle/common"
+	"twitter_oracle/log"
+)
+
+var (
+	pendingThoughtCounter  = metrics.NewRegisteredCounter("stream/pending/stored", nil)
+	pendingPromotedCounter = metrics.NewRegisteredCounter("stream/pending/promoted", nil)
+	pendingExpiredCounter  = metrics.NewRegisteredCounter("stream/pending/expired", nil)
+)
+
+// PendingThoughtStore keeps thoughts of authors without a linked address, implemented by db.DBService
+type PendingThoughtStore interface {
+	PutPendingThought(thought common.PendingThoughtInfo) error
+	GetPendingThoughtList(authorName string) ([]common.PendingThoughtInfo, error)
+	PromotePendingThoughts() (int64, error)
+	DeleteExpiredPendingThoughts(now time.Time) (int64, error)
+}
+
+// PendingPolicy controls how long thoughts wait for their author and how often they are promoted
+type PendingPolicy struct {
+	TTL          time.Duration
+	PollInterval time.Duration
+}
+
+var DefaultPendingPolicy = PendingPolicy{
+	TTL:          time.Hour * 24 * 30,
+	PollInterval: time.Minute,
+}
+
+// putPending keeps the thought of event until its author links an address
+func (s *Subscriber) putPending(event *TweetEvent, content, sourceUrl, tips string) error {
+	if s.pending == nil {
+		return NoThoughtStoreError
+	}
+	err := s.pending.PutPendingThought(common.PendingThoughtInfo{
+		TweetId:    event.TweetId,
+		AuthorId:   event.AuthorId,
+		AuthorName: event.AuthorName,
+		Content:    content,
+		SourceUrl:  sourceUrl,
+		Tips:       tips,
+		ExpiresAt:  time.Now().Add(s.Pending.TTL),
+	})
+	if err != nil {
+		return err
+	}
+	pendingThoughtCounter.Inc(1)
+	log.Info("thought pending until author links an address", event.AuthorName, "tweetId", event.TweetId)
+	return nil
+}
+
+// ListPendingThoughts returns the pending thoughts grouped by author handle, of one author if authorName is set
+func (s *Subscriber) ListPendingThoughts(authorName string) (map[string][]common.PendingThoughtInfo, error) {
+	if s.pending == nil {
+		return nil, NoThoughtStoreError
+	}
+	thoughts, err := s.pending.GetPendingThoughtList(authorName)
+	if err != nil {
+		return nil, err
+	}
+	byAuthor := make(map[string][]common.PendingThoughtInfo)
+	for _, thought := range thoughts {
+		byAuthor[thought.AuthorName] = append(byAuthor[thought.AuthorName], thought)
+	}
+	return byAuthor, nil
+}
+
+// PromotePendingThoughts promotes the thoughts of authors who linked an address and drops expired
+// ones every Pending.PollInterval until ctx is done
+func (s *Subscriber) PromotePendingThoughts(ctx context.Context) {
+	if s.pending == nil {
+		return
+	}
+	ticker := time.NewTicker(s.Pending.PollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.promotePending()
+		}
+	}
+}
+
+func (s *Subscriber) promotePending() {
+	promoted, err := s.pending.PromotePendingThoughts()
+	if err != nil {
+		log.Warn("promote pending thoughts error", err)
+	} else if promoted > 0 {
+		pendingPromotedCounter.Inc(promoted)
+		log.Info("pending thoughts promoted", promoted)
+	}
+	expired, err := s.pending.DeleteExpiredPendingThoughts(time.Now())
+	if err != nil {
+		log.Warn("delete expired pending thoughts error", err)
+	} else if expired > 0 {
+		pendingExpiredCounter.Inc(expired)
+		log.Info("pending thoughts expired", expired)
+	}
+}
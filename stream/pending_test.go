@@ -0,0 +1,97 @@
+package stream
+
+import (
+	"context"
+	"github.com/g8rswimmer/go-twitter/v2"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"twitter_oracle/common"
+	"twitter_oracle/twclient"
+)
+
+type memPendingStore struct {
+	mutex    sync.Mutex
+	thoughts map[string]common.PendingThoughtInfo
+	promotes int
+}
+
+func (m *memPendingStore) PutPendingThought(thought common.PendingThoughtInfo) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.thoughts[thought.TweetId] = thought
+	return nil
+}
+
+func (m *memPendingStore) GetPendingThoughtList(authorName string) ([]common.PendingThoughtInfo, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	thoughts := make([]common.PendingThoughtInfo, 0)
+	for _, thought := range m.thoughts {
+		if authorName == "" || strings.EqualFold(authorName, thought.AuthorName) {
+			thoughts = append(thoughts, thought)
+		}
+	}
+	return thoughts, nil
+}
+
+func (m *memPendingStore) PromotePendingThoughts() (int64, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.promotes++
+	return 0, nil
+}
+
+func (m *memPendingStore) DeleteExpiredPendingThoughts(now time.Time) (int64, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	expired := int64(0)
+	for id, thought := range m.thoughts {
+		if !thought.ExpiresAt.After(now) {
+			delete(m.thoughts, id)
+			expired++
+		}
+	}
+	return expired, nil
+}
+
+func TestPendingThought(t *testing.T) {
+	newcomer := &twitter.UserObj{ID: "200", UserName: "newcomer"}
+	thoughts := &memThoughtStore{thoughts: make(map[string][]string), unregistered: map[string]bool{"200": true}}
+	pending := &memPendingStore{thoughts: make(map[string]common.PendingThoughtInfo)}
+	sub := newSubscriber(nil, twclient.NewFake())
+	sub.thoughts, sub.pending = thoughts, pending
+	sub.Pending = PendingPolicy{TTL: time.Millisecond * 50, PollInterval: time.Millisecond * 10}
+
+	tweet := fakeTweet("1", "1", "@ninox2022 #thought first words")
+	tweet.AuthorID = newcomer.ID
+	event := &TweetEvent{TweetId: "1", ConversationId: "1", AuthorId: newcomer.ID, AuthorName: newcomer.UserName, Text: tweet.Text, Tweet: tweet, Author: newcomer}
+	if err := sub.dispatch(context.Background(), ThoughtHandlerName, sub.LoadThoughtHandler, event); err != nil {
+		t.Fatalf("unregistered author must not fail the handler: %v", err)
+	}
+	byAuthor, err := sub.ListPendingThoughts("NEWCOMER")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := byAuthor["newcomer"]
+	if len(byAuthor) != 1 || len(got) != 1 || got[0].AuthorId != "200" || got[0].Tips != "first words" {
+		t.Fatalf("pending thoughts %+v", byAuthor)
+	}
+	if ttl := time.Until(got[0].ExpiresAt); ttl <= 0 || ttl > sub.Pending.TTL {
+		t.Fatalf("pending thought expires in %v", ttl)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go sub.PromotePendingThoughts(ctx)
+	waitFor(t, func() bool {
+		thoughts, _ := pending.GetPendingThoughtList("")
+		return len(thoughts) == 0
+	})
+	pending.mutex.Lock()
+	defer pending.mutex.Unlock()
+	if pending.promotes == 0 {
+		t.Fatal("pending thoughts never promoted")
+	}
+}
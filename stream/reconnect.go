@@ -0,0 +1,226 @@
+package stream
+
+import (
+	"context"
+	"errors"
+	"github.com/ethereum/go-ethereum/metrics"
+	"github.com/g8rswimmer/go-twitter/v2"
+	"math/rand"
+	"net/http"
+	"time"
+	"twitter_oracle/log"
+)
+
+type ConnectionState string
+
+const (
+	StateConnecting   ConnectionState = "connecting"
+	StateConnected    ConnectionState = "connected"
+	StateDisconnected ConnectionState = "disconnected"
+	StateBackoff      ConnectionState = "backoff"
+	StateStopped      ConnectionState = "stopped"
+)
+
+type ErrorKind string
+
+const (
+	NetworkErrorKind   ErrorKind = "network"
+	HTTPErrorKind      ErrorKind = "http"
+	RateLimitErrorKind ErrorKind = "ratelimit"
+)
+
+var (
+	reconnectAttemptCounter = metrics.NewRegisteredCounter("stream/reconnect/attempts", nil)
+	reconnectSuccessCounter = metrics.NewRegisteredCounter("stream/reconnect/success", nil)
+	connectedGauge          = metrics.NewRegisteredGauge("stream/connected", nil)
+)
+
+// ConnectionEvent is emitted on every connect attempt and state transition of the filtered stream
+type ConnectionEvent struct {
+	State   ConnectionState
+	Attempt int
+	Kind    ErrorKind
+	Delay   time.Duration
+	Err     error
+	Time    time.Time
+}
+
+// BackoffPolicy follows twitter's reconnect guidance: linear for network errors,
+// exponential for http errors and a longer exponential for 429
+type BackoffPolicy struct {
+	NetworkStep      time.Duration
+	NetworkMax       time.Duration
+	HTTPInitial      time.Duration
+	HTTPMax          time.Duration
+	RateLimitInitial time.Duration
+	RateLimitMax     time.Duration
+	//Jitter spreads each delay uniformly by +/- this fraction
+	Jitter float64
+}
+
+var DefaultBackoffPolicy = BackoffPolicy{
+	NetworkStep:      time.Millisecond * 250,
+	NetworkMax:       time.Second * 16,
+	HTTPInitial:      time.Second * 5,
+	HTTPMax:          time.Second * 320,
+	RateLimitInitial: time.Minute,
+	RateLimitMax:     time.Minute * 15,
+	Jitter:           0.2,
+}
+
+func classifyError(err error) ErrorKind {
+	statusCode := 0
+	errResp := &twitter.ErrorResponse{}
+	httpErr := &twitter.HTTPError{}
+	switch {
+	case errors.As(err, &errResp):
+		statusCode = errResp.StatusCode
+	case errors.As(err, &httpErr):
+		statusCode = httpErr.StatusCode
+	default:
+		return NetworkErrorKind
+	}
+	if statusCode == http.StatusTooManyRequests {
+		return RateLimitErrorKind
+	}
+	return HTTPErrorKind
+}
+
+// Delay returns how long to wait before retry number attempt (starting at 1) after err
+func (p BackoffPolicy) Delay(kind ErrorKind, attempt int, err error) time.Duration {
+	if attempt < 1 {
+		attempt = 1
+	}
+	var delay time.Duration
+	switch kind {
+	case NetworkErrorKind:
+		delay = capDuration(p.NetworkStep*time.Duration(attempt), p.NetworkMax)
+	case HTTPErrorKind:
+		delay = exponential(p.HTTPInitial, attempt, p.HTTPMax)
+	case RateLimitErrorKind:
+		delay = exponential(p.RateLimitInitial, attempt, p.RateLimitMax)
+	}
+	delay = p.jitter(delay)
+	//never retry before the rate limit window resets
+	if rl, ok := twitter.RateLimitFromError(err); ok && rl.Remaining == 0 {
+		if untilReset := time.Until(rl.Reset.Time()); untilReset > delay {
+			delay = untilReset
+		}
+	}
+	return delay
+}
+
+func (p BackoffPolicy) jitter(delay time.Duration) time.Duration {
+	if p.Jitter <= 0 || delay <= 0 {
+		return delay
+	}
+	spread := float64(delay) * p.Jitter
+	return time.Duration(float64(delay) - spread + rand.Float64()*2*spread)
+}
+
+func exponential(initial time.Duration, attempt int, max time.Duration) time.Duration {
+	delay := initial
+	for i := 1; i < attempt && delay < max; i++ {
+		delay *= 2
+	}
+	return capDuration(delay, max)
+}
+
+func capDuration(d time.Duration, max time.Duration) time.Duration {
+	if max > 0 && d > max {
+		return max
+	}
+	return d
+}
+
+// OnConnectionEvent registers fn to observe connection attempts and state changes
+func (s *Subscriber) OnConnectionEvent(fn func(ConnectionEvent)) {
+	s.stateMutex.Lock()
+	defer s.stateMutex.Unlock()
+	s.observers = append(s.observers, fn)
+}
+
+func (s *Subscriber) State() ConnectionState {
+	s.stateMutex.RLock()
+	defer s.stateMutex.RUnlock()
+	return s.state
+}
+
+func (s *Subscriber) emit(event ConnectionEvent) {
+	event.Time = time.Now()
+	s.stateMutex.Lock()
+	s.state = event.State
+	observers := append([]func(ConnectionEvent){}, s.observers...)
+	s.stateMutex.Unlock()
+
+	switch event.State {
+	case StateConnected:
+		connectedGauge.Update(1)
+		log.Info("stream connected", "attempt", event.Attempt)
+	case StateBackoff:
+		log.Warn("stream connect failed", event.Err, "kind", event.Kind, "attempt", event.Attempt, "retry in", event.Delay)
+	case StateDisconnected, StateStopped:
+		connectedGauge.Update(0)
+		log.Warn("stream", event.State, "cause", event.Err)
+	}
+	for _, fn := range observers {
+		fn(event)
+	}
+}
+
+// connect opens the filtered stream, retrying with backoff until it succeeds or ctx is done
+func (s *Subscriber) connect(ctx context.Context) error {
+	attempts := make(map[ErrorKind]int)
+	for attempt := 1; ; attempt++ {
+		s.emit(ConnectionEvent{State: StateConnecting, Attempt: attempt})
+		reconnectAttemptCounter.Inc(1)
+		stream, err := s.client.TweetSearchStream(ctx, streamOpts)
+		if err == nil {
+			s.stream = stream
+			reconnectSuccessCounter.Inc(1)
+			s.emit(ConnectionEvent{State: StateConnected, Attempt: attempt})
+			return nil
+		}
+		if ctx.Err() != nil {
+			s.emit(ConnectionEvent{State: StateStopped, Attempt: attempt, Err: ctx.Err()})
+			return ctx.Err()
+		}
+		kind := classifyError(err)
+		attempts[kind]++
+		delay := s.Backoff.Delay(kind, attempts[kind], err)
+		metrics.GetOrRegisterCounter("stream/reconnect/failures/"+string(kind), nil).Inc(1)
+		s.emit(ConnectionEvent{State: StateBackoff, Attempt: attempt, Kind: kind, Delay: delay, Err: err})
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			s.emit(ConnectionEvent{State: StateStopped, Attempt: attempt, Err: ctx.Err()})
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// reconnect closes the current stream and opens a new one, tweets missed meanwhile are backfilled.
+// Twitter wants a client over the connection limit to wait before it tries again
+func (s *Subscriber) reconnect(ctx context.Context, cause error) error {
+	s.emit(ConnectionEvent{State: StateDisconnected, Err: cause})
+	s.stream.Close()
+	if errors.Is(cause, TooManyConnectionsError) {
+		delay := s.Backoff.Delay(RateLimitErrorKind, 1, nil)
+		s.emit(ConnectionEvent{State: StateBackoff, Kind: RateLimitErrorKind, Delay: delay, Err: cause})
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			s.emit(ConnectionEvent{State: StateStopped, Err: ctx.Err()})
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+	if err := s.connect(ctx); err != nil {
+		return err
+	}
+	s.backfill(ctx)
+	return nil
+}
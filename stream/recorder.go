@@ -0,0 +1,237 @@
+package stream
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/g8rswimmer/go-twitter/v2"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+	"twitter_oracle/log"
+	"twitter_oracle/twclient"
+)
+
+const (
+	RecordedTweet  = "tweet"
+	RecordedSystem = "system"
+
+	recordFileLayout = "20060102T150405.000"
+	recordExt        = ".ndjson"
+)
+
+var (
+	//DefaultRecordInterval starts a new recording file every hour
+	DefaultRecordInterval = time.Hour
+	//DefaultRecordMaxBytes starts a new recording file once one grows past 64MB
+	DefaultRecordMaxBytes int64 = 64 * 1024 * 1024
+)
+
+// RecordedMessage is one line of a recording, Data is the stream line of a tweet or the system message
+type RecordedMessage struct {
+	Time time.Time       `json:"time"`
+	Type string          `json:"type"`
+	Data json.RawMessage `json:"data"`
+}
+
+// Recorder writes what the stream delivers to NDJSON files in dir, rotated by age and size
+type Recorder struct {
+	mutex    sync.Mutex
+	dir      string
+	interval time.Duration
+	maxBytes int64
+	file     *os.File
+	writer   *bufio.Writer
+	opened   time.Time
+	size     int64
+	seq      int
+}
+
+func NewRecorder(dir string, interval time.Duration, maxBytes int64) (*Recorder, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &Recorder{
+		dir:      dir,
+		interval: interval,
+		maxBytes: maxBytes,
+	}, nil
+}
+
+func (r *Recorder) RecordTweet(msg *twclient.TweetMessage) error {
+	data := []byte(msg.Data)
+	if len(data) == 0 && msg.Raw != nil && len(msg.Raw.Tweets) > 0 {
+		var err error
+		data, err = twclient.EncodeTweetMessage(msg.Raw.Tweets[0], msg.Raw.Includes, msg.MatchingRules)
+		if err != nil {
+			return err
+		}
+	}
+	return r.write(RecordedTweet, data)
+}
+
+func (r *Recorder) RecordSystem(msg map[twitter.SystemMessageType]twitter.SystemMessage) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return r.write(RecordedSystem, data)
+}
+
+func (r *Recorder) write(msgType string, data []byte) error {
+	line, err := json.Marshal(RecordedMessage{Time: time.Now().UTC(), Type: msgType, Data: data})
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.file == nil || (r.interval > 0 && time.Since(r.opened) >= r.interval) ||
+		(r.maxBytes > 0 && r.size > 0 && r.size+int64(len(line)) > r.maxBytes) {
+		if err := r.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := r.writer.Write(line)
+	r.size += int64(n)
+	if err != nil {
+		return err
+	}
+	//flush per line so a crash loses nothing already received
+	return r.writer.Flush()
+}
+
+func (r *Recorder) rotate() error {
+	if err := r.closeFile(); err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	//seq keeps files apart when the size limit rotates twice within a millisecond
+	r.seq++
+	path := filepath.Join(r.dir, fmt.Sprintf("stream-%v-%04d%v", now.Format(recordFileLayout), r.seq%10000, recordExt))
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	log.Info("recording stream to", path)
+	r.file = file
+	r.writer = bufio.NewWriter(file)
+	r.opened = now
+	r.size = 0
+	return nil
+}
+
+func (r *Recorder) closeFile() error {
+	if r.file == nil {
+		return nil
+	}
+	err := r.writer.Flush()
+	if closeErr := r.file.Close(); err == nil {
+		err = closeErr
+	}
+	r.file, r.writer = nil, nil
+	return err
+}
+
+func (r *Recorder) Close() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.closeFile()
+}
+
+// SetRecorder records every message Start receives from the stream, call it before Start
+func (s *Subscriber) SetRecorder(recorder *Recorder) {
+	s.recorder = recorder
+}
+
+// RecordingFiles expands directories in paths to the recordings they hold, oldest first
+func RecordingFiles(paths []string) ([]string, error) {
+	var files []string
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			files = append(files, path)
+			continue
+		}
+		matches, err := filepath.Glob(filepath.Join(path, "*"+recordExt))
+		if err != nil {
+			return nil, err
+		}
+		sort.Strings(matches)
+		files = append(files, matches...)
+	}
+	return files, nil
+}
+
+// Replay feeds the tweets of recordings through the handlers in order. speed 1 keeps the recorded
+// pace, 10 replays ten times faster and 0 as fast as possible. It returns how many tweets were replayed.
+func (s *Subscriber) Replay(ctx context.Context, files []string, speed float64) (int, error) {
+	replayed := 0
+	var last time.Time
+	for _, path := range files {
+		n, err := s.replayFile(ctx, path, speed, &last)
+		replayed += n
+		if err != nil {
+			return replayed, err
+		}
+	}
+	return replayed, nil
+}
+
+func (s *Subscriber) replayFile(ctx context.Context, path string, speed float64, last *time.Time) (int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	replayed := 0
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		recorded := RecordedMessage{}
+		if err := json.Unmarshal(scanner.Bytes(), &recorded); err != nil {
+			return replayed, fmt.Errorf("%v:%v: %w", path, lineNo, err)
+		}
+		if speed > 0 && !last.IsZero() && recorded.Time.After(*last) {
+			timer := time.NewTimer(time.Duration(float64(recorded.Time.Sub(*last)) / speed))
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return replayed, ctx.Err()
+			case <-timer.C:
+			}
+		}
+		*last = recorded.Time
+		if recorded.Type != RecordedTweet {
+			sysMsg := map[twitter.SystemMessageType]twitter.SystemMessage{}
+			if err := json.Unmarshal(recorded.Data, &sysMsg); err != nil {
+				return replayed, fmt.Errorf("%v:%v: %w", path, lineNo, err)
+			}
+			//only logged, there is no stream to reopen
+			for _, event := range ParseSystemMessage(sysMsg) {
+				event.log()
+			}
+			continue
+		}
+		msg, err := twclient.DecodeTweetMessage(recorded.Data)
+		if err != nil {
+			return replayed, fmt.Errorf("%v:%v: %w", path, lineNo, err)
+		}
+		if err := s.handleTweetMessage(ctx, msg); err != nil {
+			log.Warn("replay tweet error", err, "file", path, "line", lineNo)
+			continue
+		}
+		replayed++
+	}
+	return replayed, scanner.Err()
+}
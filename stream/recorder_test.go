@@ -0,0 +1,88 @@
+package stream
+
+import (
+	"context"
+	"fmt"
+	"github.com/g8rswimmer/go-twitter/v2"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+	"twitter_oracle/twclient"
+)
+
+func TestRecordAndReplay(t *testing.T) {
+	dir := t.TempDir()
+	recorder, err := NewRecorder(dir, time.Hour, 600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs := twclient.NewFakeStream()
+	rules := []twclient.MatchingRule{{ID: "1", Tag: "unrouted"}}
+	for i := 1; i <= 4; i++ {
+		fs.SendMatching(fakeTweet(fmt.Sprint(i), "1", fmt.Sprintf("tweet %v", i)), rules, fakeAuthor)
+		if err := recorder.RecordTweet(<-fs.Tweets()); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond * 5)
+	}
+	//backfilled messages have no raw line and are encoded
+	if err := recorder.RecordTweet(&twclient.TweetMessage{Raw: &twitter.TweetRaw{
+		Tweets:   []*twitter.TweetObj{fakeTweet("5", "1", "tweet 5")},
+		Includes: &twitter.TweetRawIncludes{Users: []*twitter.UserObj{fakeAuthor}},
+	}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := recorder.RecordSystem(map[twitter.SystemMessageType]twitter.SystemMessage{
+		twitter.InfoMessageType: {Message: "keep alive"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := recorder.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := RecordingFiles([]string{dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) < 2 {
+		t.Fatalf("recording not rotated by size: %v", files)
+	}
+	def := &recordingHandler{}
+	sub := newSubscriber(nil, twclient.NewFake())
+	sub.defaultHandler = def.handle
+	start := time.Now()
+	replayed, err := sub.Replay(context.Background(), files, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replayed != 5 || time.Since(start) > time.Millisecond*15 {
+		t.Fatalf("replayed %v in %v", replayed, time.Since(start))
+	}
+	for i, tweet := range def.recorded() {
+		if tweet.id != fmt.Sprint(i+1) || tweet.authorName != fakeAuthor.UserName {
+			t.Fatalf("replayed out of order %+v", def.recorded())
+		}
+	}
+
+	//at the original pace the 5ms gaps are kept
+	start = time.Now()
+	if _, err := sub.Replay(context.Background(), files, 1); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < time.Millisecond*15 {
+		t.Fatalf("replay at speed 1 took %v", elapsed)
+	}
+}
+
+func TestReplayBadLine(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bad.ndjson")
+	if err := os.WriteFile(path, []byte("{\"type\":\"tweet\",\"data\":{}}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	sub := newSubscriber(nil, twclient.NewFake())
+	if _, err := sub.Replay(context.Background(), []string{path}, 0); err == nil {
+		t.Fatal("expected error for a tweet line without data")
+	}
+}
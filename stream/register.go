@@ -0,0 +1,153 @@
+package stream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/ethereum/go-ethereum/metrics"
+	"regexp"
+	"strings"
+	"twitter_oracle/common"
+	"twitter_oracle/db"
+	"twitter_oracle/log"
+)
+
+const (
+	EventRegistered = "registered"
+	EventRejected   = "rejected"
+)
+
+var (
+	eventHashtag = regexp.MustCompile(`#([\p{L}\p{N}_]+)`)
+	eventMention = regexp.MustCompile(`@(\w+)`)
+	//eventName keeps names usable as hashtags and as on-chain keys, twitter does not link a hashtag of digits only
+	eventName       = regexp.MustCompile(`^[A-Za-z0-9_]{3,32}$`)
+	eventNameDigits = regexp.MustCompile(`^[0-9_]+$`)
+	eventRegistered = metrics.NewRegisteredCounter("stream/event/registered", nil)
+	eventRejected   = metrics.NewRegisteredCounter("stream/event/rejected", nil)
+)
+
+// EventStore keeps registered events and why refused registrations were rejected, implemented by db.DBService
+type EventStore interface {
+	// RegisterEvent returns db.EventNameTakenError when another tweet registered the name
+	RegisterEvent(event common.EventTweetInfo) error
+	RejectEvent(event common.EventTweetInfo, errMsg string) error
+	GetEvent(tweetId string) (common.EventInfo, error)
+	GetEventList() ([]common.EventInfo, error)
+}
+
+// EventEnroller starts tracking the metrics and quotes of a registered event, implemented by query.Querier
+type EventEnroller interface {
+	Enroll(tweetId string)
+}
+
+// ParseEventName finds the event a "#<event> #HugMe @HUGGLE" tweet registers, the name is
+// returned with InvalidEventNameError so the rejection can show it
+func ParseEventName(text string) (string, error) {
+	mentioned := false
+	for _, match := range eventMention.FindAllStringSubmatch(text, -1) {
+		if strings.EqualFold(match[1], common.HugTwitterName) {
+			mentioned = true
+		}
+	}
+	if !mentioned {
+		return "", fmt.Errorf("%w: missing @%v", InvalidEventTweetError, common.HugTwitterName)
+	}
+	tagged := false
+	var names []string
+	for _, match := range eventHashtag.FindAllStringSubmatch(text, -1) {
+		name := match[1]
+		if strings.EqualFold(name, common.AddEventTwitterHashtag) {
+			tagged = true
+			continue
+		}
+		duplicate := false
+		for _, seen := range names {
+			duplicate = duplicate || strings.EqualFold(seen, name)
+		}
+		if !duplicate {
+			names = append(names, name)
+		}
+	}
+	switch {
+	case !tagged:
+		return "", fmt.Errorf("%w: missing #%v", InvalidEventTweetError, common.AddEventTwitterHashtag)
+	case len(names) == 0:
+		return "", fmt.Errorf("%w: no event hashtag", InvalidEventTweetError)
+	case len(names) > 1:
+		return "", fmt.Errorf("%w: one event per tweet, got #%v", InvalidEventTweetError, strings.Join(names, " #"))
+	}
+	name := names[0]
+	if !eventName.MatchString(name) || eventNameDigits.MatchString(name) {
+		return name, fmt.Errorf("%w: #%v", InvalidEventNameError, name)
+	}
+	return name, nil
+}
+
+// isEventRejection tells a registration refused for its tweet from a store failure worth retrying
+func isEventRejection(err error) bool {
+	return errors.Is(err, InvalidEventTweetError) || errors.Is(err, InvalidEventNameError) || errors.Is(err, db.EventNameTakenError)
+}
+
+// RegisterEvent stores the event named in the text of a registration tweet and enrolls it in
+// metrics and quote polling. A refused registration is recorded for the organizer and returned
+func (s *Subscriber) RegisterEvent(event common.EventTweetInfo) error {
+	if s.events == nil {
+		return NoEventStoreError
+	}
+	name, err := ParseEventName(event.Text)
+	event.EventName = name
+	if err == nil {
+		err = s.events.RegisterEvent(event)
+	}
+	if isEventRejection(err) {
+		eventRejected.Inc(1)
+		log.Info("event registration rejected", err, "author", event.AuthorName, "tweetId", event.TweetId)
+		if e := s.events.RejectEvent(event, err.Error()); e != nil {
+			return e
+		}
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	eventRegistered.Inc(1)
+	log.Info("event registered", name, "author", event.AuthorName, "tweetId", event.TweetId)
+	if s.Enroller != nil {
+		s.Enroller.Enroll(event.TweetId)
+	}
+	return nil
+}
+
+func (s *Subscriber) GetEvent(tweetId string) (common.EventInfo, error) {
+	if s.events == nil {
+		return common.EventInfo{}, NoEventStoreError
+	}
+	return s.events.GetEvent(tweetId)
+}
+
+func (s *Subscriber) GetEventList() ([]common.EventInfo, error) {
+	if s.events == nil {
+		return nil, NoEventStoreError
+	}
+	return s.events.GetEventList()
+}
+
+// EventHandler registers the events of #HugMe tweets, retweets of a registration are ignored
+// and a rejected registration is not retried
+func (s *Subscriber) EventHandler(ctx context.Context, event *TweetEvent) error {
+	if event.ReferencedTweetId("retweeted") != "" {
+		return nil
+	}
+	err := s.RegisterEvent(common.EventTweetInfo{
+		TweetId:    event.TweetId,
+		AuthorId:   event.AuthorId,
+		AuthorName: event.AuthorName,
+		Text:       event.Text,
+		CreatedAt:  event.CreatedAt,
+	})
+	if isEventRejection(err) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,179 @@
+package stream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/g8rswimmer/go-twitter/v2"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"twitter_oracle/common"
+	"twitter_oracle/db"
+	"twitter_oracle/twclient"
+)
+
+// memEventStore follows the name rules of the db implementation
+type memEventStore struct {
+	mutex  sync.Mutex
+	events map[string]common.EventInfo
+	err    error
+}
+
+func newMemEventStore() *memEventStore {
+	return &memEventStore{events: make(map[string]common.EventInfo)}
+}
+
+func (m *memEventStore) RegisterEvent(event common.EventTweetInfo) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.err != nil {
+		return m.err
+	}
+	for _, stored := range m.events {
+		if stored.Status == EventRegistered && strings.EqualFold(stored.EventName, event.EventName) && stored.TweetId != event.TweetId {
+			return fmt.Errorf("%w: #%v by tweet %v", db.EventNameTakenError, event.EventName, stored.TweetId)
+		}
+	}
+	if m.events[event.TweetId].Status == EventRegistered {
+		return nil
+	}
+	m.events[event.TweetId] = common.EventInfo{EventTweetInfo: event, Status: EventRegistered, UpdatedAt: time.Now()}
+	return nil
+}
+
+func (m *memEventStore) RejectEvent(event common.EventTweetInfo, errMsg string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.events[event.TweetId].Status == EventRegistered {
+		return nil
+	}
+	m.events[event.TweetId] = common.EventInfo{EventTweetInfo: event, Status: EventRejected, Error: errMsg, UpdatedAt: time.Now()}
+	return nil
+}
+
+func (m *memEventStore) GetEvent(tweetId string) (common.EventInfo, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	event, ok := m.events[tweetId]
+	if !ok {
+		return event, errors.New("no rows in result set")
+	}
+	return event, nil
+}
+
+func (m *memEventStore) GetEventList() ([]common.EventInfo, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	eventList := make([]common.EventInfo, 0)
+	for _, event := range m.events {
+		if event.Status == EventRegistered {
+			eventList = append(eventList, event)
+		}
+	}
+	return eventList, nil
+}
+
+type enrolled []string
+
+func (e *enrolled) Enroll(tweetId string) {
+	*e = append(*e, tweetId)
+}
+
+func TestParseEventName(t *testing.T) {
+	valid := map[string]string{
+		"#DevCon #HugMe @HUGGLE":                        "DevCon",
+		"join us! #hugme @huggle #Dev_Con_2022.":        "Dev_Con_2022",
+		"@HUGGLE #HugMe #devcon see you at #DEVCON":     "devcon",
+		"#HugMe #ETH2022\n@HUGGLE https://t.co/abcdefg": "ETH2022",
+	}
+	for text, want := range valid {
+		name, err := ParseEventName(text)
+		if err != nil || name != want {
+			t.Fatalf("%q: got %q %v, want %q", text, name, err, want)
+		}
+	}
+	invalid := map[string]error{
+		"#DevCon #HugMe":                                  InvalidEventTweetError,
+		"#DevCon @HUGGLE":                                 InvalidEventTweetError,
+		"#HugMe @HUGGLE":                                  InvalidEventTweetError,
+		"#DevCon #EthCon #HugMe @HUGGLE":                  InvalidEventTweetError,
+		"#DevCon #HugMe @HUGGLE_fan":                      InvalidEventTweetError,
+		"#Dc #HugMe @HUGGLE":                              InvalidEventNameError,
+		"#2022 #HugMe @HUGGLE":                            InvalidEventNameError,
+		"#Café #HugMe @HUGGLE":                            InvalidEventNameError,
+		"#" + strings.Repeat("a", 33) + " #HugMe @HUGGLE": InvalidEventNameError,
+	}
+	for text, want := range invalid {
+		if _, err := ParseEventName(text); !errors.Is(err, want) {
+			t.Fatalf("%q: expected %v, got %v", text, want, err)
+		}
+	}
+}
+
+func TestEventHandler(t *testing.T) {
+	store := newMemEventStore()
+	sub := newSubscriber(nil, twclient.NewFake())
+	sub.events = store
+	enroller := &enrolled{}
+	sub.Enroller = enroller
+	ctx := context.Background()
+	register := func(id string, author *twitter.UserObj, text string) error {
+		return sub.dispatch(ctx, EventHandlerName, sub.EventHandler, linkEvent(id, author, text))
+	}
+	organizer := &twitter.UserObj{ID: "300", UserName: "organizer"}
+
+	if err := register("1", fakeAuthor, "#DevCon #HugMe @HUGGLE"); err != nil {
+		t.Fatal(err)
+	}
+	//delivered again the same tweet stays registered
+	if err := register("1", fakeAuthor, "#DevCon #HugMe @HUGGLE"); err != nil {
+		t.Fatal(err)
+	}
+	event, err := sub.GetEvent("1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event.Status != EventRegistered || event.EventName != "DevCon" || event.AuthorId != fakeAuthor.ID || len(*enroller) != 2 {
+		t.Fatalf("registered event %+v, enrolled %v", event, *enroller)
+	}
+
+	//rejections are recorded for the organizer and not dead-lettered
+	if err := register("2", organizer, "#devcon #HugMe @HUGGLE"); err != nil {
+		t.Fatal(err)
+	}
+	if event, _ := sub.GetEvent("2"); event.Status != EventRejected || !strings.Contains(event.Error, "tweet 1") {
+		t.Fatalf("duplicate event %+v", event)
+	}
+	if err := register("3", organizer, "#2022 #HugMe @HUGGLE"); err != nil {
+		t.Fatal(err)
+	}
+	if event, _ := sub.GetEvent("3"); event.Status != EventRejected || event.EventName != "2022" || !strings.Contains(event.Error, "#2022") {
+		t.Fatalf("invalid event %+v", event)
+	}
+
+	//a retweet of a registration is not one
+	retweet := linkEvent("4", organizer, "RT @ninox2022: #EthCon #HugMe @HUGGLE")
+	retweet.Tweet.ReferencedTweets = []*twitter.TweetReferencedTweetObj{{Type: "retweeted", ID: "1"}}
+	if err := sub.dispatch(ctx, EventHandlerName, sub.EventHandler, retweet); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sub.GetEvent("4"); err == nil {
+		t.Fatal("retweet registered an event")
+	}
+
+	//a store failure is returned to be retried
+	store.err = errors.New("connection refused")
+	if err := register("5", organizer, "#EthCon #HugMe @HUGGLE"); err == nil {
+		t.Fatal("expected the store error")
+	}
+	store.err = nil
+	if err := register("5", organizer, "#EthCon #HugMe @HUGGLE"); err != nil {
+		t.Fatal(err)
+	}
+	eventList, _ := sub.GetEventList()
+	if len(eventList) != 2 || len(*enroller) != 3 || (*enroller)[2] != "5" {
+		t.Fatalf("events %+v, enrolled %v", eventList, *enroller)
+	}
+}
@@ -0,0 +1,221 @@
+package stream
+
+import (
+	"fmt"
+	"sync"
+	"time"
+	"twitter_oracle/common"
+	"twitter_oracle/log"
+)
+
+const (
+	DefaultHandlerName = "default"
+	ThoughtHandlerName = "thought"
+	LinkHandlerName    = "link"
+	EventHandlerName   = "event"
+)
+
+// DefaultTagRoutes maps stream rule tags to the handler their tweets go to
+var DefaultTagRoutes = map[string]string{
+	"thought": ThoughtHandlerName,
+	"replies": DefaultHandlerName,
+	"link":    LinkHandlerName,
+	"event":   EventHandlerName,
+}
+
+// ConversationStore persists registered conversations, implemented by db.DBService
+type ConversationStore interface {
+	GetConversationList() ([]common.ConversationInfo, error)
+	PutConversation(conversationId string, handlerName string) error
+	DeleteConversation(conversationId string) error
+}
+
+type conversationHandler struct {
+	info    common.ConversationInfo
+	handler Handler
+}
+
+type tagRoute struct {
+	handlerName string
+	handler     Handler
+}
+
+// conversationRegistry maps conversation ids and rule tags to handlers, it is written by the rest
+// service and read by the stream goroutine so every access goes through the lock
+type conversationRegistry struct {
+	mutex         sync.RWMutex
+	store         ConversationStore
+	named         map[string]Handler
+	conversations map[string]conversationHandler
+	//deferred are stored conversations whose handler is not registered yet, kept until it is
+	deferred map[string]common.ConversationInfo
+	routes   map[string]string
+}
+
+func newConversationRegistry(store ConversationStore) *conversationRegistry {
+	r := &conversationRegistry{
+		store:         store,
+		named:         make(map[string]Handler),
+		conversations: make(map[string]conversationHandler),
+		deferred:      make(map[string]common.ConversationInfo),
+		routes:        make(map[string]string),
+	}
+	r.named[DefaultHandlerName] = DefaultHandler
+	return r
+}
+
+// registerHandler names handler, conversations loaded before it was registered start using it
+func (r *conversationRegistry) registerHandler(name string, handler Handler) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.named[name] = handler
+	for id, info := range r.deferred {
+		if info.HandlerName == name {
+			r.conversations[id] = conversationHandler{info: info, handler: handler}
+			delete(r.deferred, id)
+		}
+	}
+}
+
+// load replaces the in-memory conversations with the ones in the store, a conversation whose
+// handler is not registered yet is deferred until registerHandler names it
+func (r *conversationRegistry) load() error {
+	if r.store == nil {
+		return nil
+	}
+	convList, err := r.store.GetConversationList()
+	if err != nil {
+		return err
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.conversations = make(map[string]conversationHandler)
+	r.deferred = make(map[string]common.ConversationInfo)
+	for _, conv := range convList {
+		handler, ok := r.named[conv.HandlerName]
+		if !ok {
+			log.Warn("defer conversation until its handler is registered", conv.ConversationId, conv.HandlerName)
+			r.deferred[conv.ConversationId] = conv
+			continue
+		}
+		r.conversations[conv.ConversationId] = conversationHandler{info: conv, handler: handler}
+	}
+	return nil
+}
+
+// put persists before updating memory so a failed write leaves both unchanged
+func (r *conversationRegistry) put(conversationId string, handlerName string) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	handler, ok := r.named[handlerName]
+	if !ok {
+		return fmt.Errorf("%w: %v", UnknownHandlerError, handlerName)
+	}
+	if r.store != nil {
+		if err := r.store.PutConversation(conversationId, handlerName); err != nil {
+			return err
+		}
+	}
+	info := common.ConversationInfo{
+		ConversationId: conversationId,
+		HandlerName:    handlerName,
+		CreatedAt:      time.Now(),
+	}
+	if old, ok := r.conversations[conversationId]; ok {
+		info.CreatedAt = old.info.CreatedAt
+	}
+	if old, ok := r.deferred[conversationId]; ok {
+		info.CreatedAt = old.CreatedAt
+		delete(r.deferred, conversationId)
+	}
+	r.conversations[conversationId] = conversationHandler{info: info, handler: handler}
+	return nil
+}
+
+func (r *conversationRegistry) remove(conversationId string) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	_, ok := r.conversations[conversationId]
+	_, deferred := r.deferred[conversationId]
+	if !ok && !deferred {
+		return ConversationNotFoundError
+	}
+	if r.store != nil {
+		if err := r.store.DeleteConversation(conversationId); err != nil {
+			return err
+		}
+	}
+	delete(r.conversations, conversationId)
+	delete(r.deferred, conversationId)
+	return nil
+}
+
+func (r *conversationRegistry) get(conversationId string) (conversationHandler, bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	conv, ok := r.conversations[conversationId]
+	return conv, ok
+}
+
+func (r *conversationRegistry) handler(name string) (Handler, bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	handler, ok := r.named[name]
+	return handler, ok
+}
+
+// list returns the registered conversations, deferred ones included
+func (r *conversationRegistry) list() []common.ConversationInfo {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	convList := make([]common.ConversationInfo, 0, len(r.conversations)+len(r.deferred))
+	for _, conv := range r.conversations {
+		convList = append(convList, conv.info)
+	}
+	for _, info := range r.deferred {
+		convList = append(convList, info)
+	}
+	return convList
+}
+
+// route sends tweets matching a rule tagged tag to the named handler, an empty name removes the route
+func (r *conversationRegistry) route(tag string, handlerName string) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if handlerName == "" {
+		delete(r.routes, tag)
+		return nil
+	}
+	if _, ok := r.named[handlerName]; !ok {
+		return fmt.Errorf("%w: %v", UnknownHandlerError, handlerName)
+	}
+	r.routes[tag] = handlerName
+	return nil
+}
+
+// routed returns the handlers for tags, each handler once even if several tags route to it
+func (r *conversationRegistry) routed(tags []string) []tagRoute {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	var routes []tagRoute
+	added := make(map[string]bool)
+	for _, tag := range tags {
+		name, ok := r.routes[tag]
+		if !ok || added[name] {
+			continue
+		}
+		added[name] = true
+		routes = append(routes, tagRoute{handlerName: name, handler: r.named[name]})
+	}
+	return routes
+}
+
+func (r *conversationRegistry) routeList() map[string]string {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	routes := make(map[string]string, len(r.routes))
+	for tag, name := range r.routes {
+		routes[tag] = name
+	}
+	return routes
+}
@@ -0,0 +1,215 @@
+package stream
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"github.com/ethereum/go-ethereum/metrics"
+	"github.com/g8rswimmer/go-twitter/v2"
+	"sync"
+	"time"
+	"twitter_oracle/log"
+	"twitter_oracle/twclient"
+)
+
+// maxLookupIds is the most ids twitter accepts in one tweet lookup
+const maxLookupIds = 100
+
+var (
+	//RootAuthorCacheSize is how many conversation roots keep their author
+	RootAuthorCacheSize = 10000
+	//RootAuthorTTL is how long a cached author is trusted, a renamed account is picked up after it
+	RootAuthorTTL = time.Hour
+	//RootLookupWindow is how long a lookup waits for others to share its batch
+	RootLookupWindow = time.Millisecond * 50
+	//RootLookupTimeout bounds one batched lookup, it serves every waiting handler so none of their contexts is used
+	RootLookupTimeout = time.Second * 30
+)
+
+var (
+	rootAuthorHit     = metrics.NewRegisteredCounter("stream/rootauthor/hit", nil)
+	rootAuthorMiss    = metrics.NewRegisteredCounter("stream/rootauthor/miss", nil)
+	rootAuthorLookups = metrics.NewRegisteredCounter("stream/rootauthor/lookups", nil)
+)
+
+// rootAuthor is who wrote a conversation root, the id stays when the username changes
+type rootAuthor struct {
+	id       string
+	username string
+}
+
+type cachedAuthor struct {
+	conversationId string
+	author         rootAuthor
+	expires        time.Time
+}
+
+// rootLookup is one conversation root waiting in or for a batch, done is closed once author or err is set
+type rootLookup struct {
+	author rootAuthor
+	err    error
+	done   chan struct{}
+}
+
+// rootAuthors resolves the author of a conversation's root tweet. Answers are kept in an LRU
+// cache with a TTL and misses from concurrent handlers are coalesced into batched lookups.
+type rootAuthors struct {
+	client twclient.Client
+	size   int
+	ttl    time.Duration
+	window time.Duration
+
+	mutex   sync.Mutex
+	cache   map[string]*list.Element
+	order   *list.List
+	pending map[string]*rootLookup
+	batch   []string
+	timer   *time.Timer
+}
+
+func newRootAuthors(client twclient.Client, size int, ttl time.Duration, window time.Duration) *rootAuthors {
+	return &rootAuthors{
+		client:  client,
+		size:    size,
+		ttl:     ttl,
+		window:  window,
+		cache:   make(map[string]*list.Element),
+		order:   list.New(),
+		pending: make(map[string]*rootLookup),
+	}
+}
+
+// get returns the author of conversationId's root tweet
+func (r *rootAuthors) get(ctx context.Context, conversationId string) (rootAuthor, error) {
+	r.mutex.Lock()
+	if author, ok := r.cached(conversationId); ok {
+		r.mutex.Unlock()
+		rootAuthorHit.Inc(1)
+		return author, nil
+	}
+	rootAuthorMiss.Inc(1)
+	lookup, ok := r.pending[conversationId]
+	if !ok {
+		lookup = &rootLookup{done: make(chan struct{})}
+		r.pending[conversationId] = lookup
+		r.batch = append(r.batch, conversationId)
+		if len(r.batch) >= maxLookupIds {
+			r.flushLocked()
+		} else if r.timer == nil {
+			r.timer = time.AfterFunc(r.window, r.flush)
+		}
+	}
+	r.mutex.Unlock()
+
+	select {
+	case <-ctx.Done():
+		return rootAuthor{}, ctx.Err()
+	case <-lookup.done:
+		return lookup.author, lookup.err
+	}
+}
+
+// cached must be called with mutex held
+func (r *rootAuthors) cached(conversationId string) (rootAuthor, bool) {
+	elem, ok := r.cache[conversationId]
+	if !ok {
+		return rootAuthor{}, false
+	}
+	entry := elem.Value.(*cachedAuthor)
+	if time.Now().After(entry.expires) {
+		r.order.Remove(elem)
+		delete(r.cache, conversationId)
+		return rootAuthor{}, false
+	}
+	r.order.MoveToFront(elem)
+	return entry.author, true
+}
+
+// put must be called with mutex held
+func (r *rootAuthors) put(conversationId string, author rootAuthor) {
+	if elem, ok := r.cache[conversationId]; ok {
+		entry := elem.Value.(*cachedAuthor)
+		entry.author, entry.expires = author, time.Now().Add(r.ttl)
+		r.order.MoveToFront(elem)
+		return
+	}
+	r.cache[conversationId] = r.order.PushFront(&cachedAuthor{
+		conversationId: conversationId,
+		author:         author,
+		expires:        time.Now().Add(r.ttl),
+	})
+	for r.size > 0 && r.order.Len() > r.size {
+		oldest := r.order.Back()
+		r.order.Remove(oldest)
+		delete(r.cache, oldest.Value.(*cachedAuthor).conversationId)
+	}
+}
+
+func (r *rootAuthors) flush() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.flushLocked()
+}
+
+// flushLocked sends the current batch, must be called with mutex held
+func (r *rootAuthors) flushLocked() {
+	if r.timer != nil {
+		r.timer.Stop()
+		r.timer = nil
+	}
+	if len(r.batch) == 0 {
+		return
+	}
+	ids := r.batch
+	r.batch = nil
+	go r.lookup(ids)
+}
+
+func (r *rootAuthors) lookup(ids []string) {
+	rootAuthorLookups.Inc(1)
+	ctx, cancel := context.WithTimeout(context.Background(), RootLookupTimeout)
+	defer cancel()
+	opts := twitter.TweetLookupOpts{
+		Expansions:  []twitter.Expansion{twitter.ExpansionAuthorID},
+		TweetFields: []twitter.TweetField{twitter.TweetFieldConversationID},
+	}
+	authors := make(map[string]rootAuthor)
+	resp, err := r.client.TweetLookup(ctx, ids, opts)
+	if err == nil && resp.Raw == nil {
+		err = fmt.Errorf("lookup %v conversation roots: response tweet raw nil", len(ids))
+	}
+	if err != nil {
+		log.Warn("conversation root lookup error", err, "ids", len(ids))
+	} else {
+		names := make(map[string]string)
+		if resp.Raw.Includes != nil {
+			for _, user := range resp.Raw.Includes.Users {
+				if user != nil {
+					names[user.ID] = user.UserName
+				}
+			}
+		}
+		for _, tweet := range resp.Raw.Tweets {
+			if tweet != nil && names[tweet.AuthorID] != "" {
+				authors[tweet.ID] = rootAuthor{id: tweet.AuthorID, username: names[tweet.AuthorID]}
+			}
+		}
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for _, id := range ids {
+		lookup := r.pending[id]
+		delete(r.pending, id)
+		if author, ok := authors[id]; ok {
+			r.put(id, author)
+			lookup.author = author
+		} else if err != nil {
+			lookup.err = err
+		} else {
+			//failures are not cached, a deleted root may be a transient lookup gap
+			lookup.err = fmt.Errorf("%w: conversation root %v", TweetNotFoundError, id)
+		}
+		close(lookup.done)
+	}
+}
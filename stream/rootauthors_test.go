@@ -0,0 +1,114 @@
+package stream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/g8rswimmer/go-twitter/v2"
+	"sync"
+	"testing"
+	"time"
+	"twitter_oracle/twclient"
+)
+
+func rootAuthorsFake(roots int) *twclient.Fake {
+	fake := twclient.NewFake()
+	fake.AddUser(fakeAuthor)
+	for i := 0; i < roots; i++ {
+		id := fmt.Sprint(2000 + i)
+		fake.AddTweet(fakeTweet(id, id, "root "+id))
+	}
+	return fake
+}
+
+func TestRootAuthorsBatch(t *testing.T) {
+	fake := rootAuthorsFake(150)
+	authors := newRootAuthors(fake, 1000, time.Hour, time.Millisecond*20)
+	var wg sync.WaitGroup
+	errs := make(chan error, 300)
+	//every root twice, the second ask shares the first one's lookup
+	for i := 0; i < 300; i++ {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			author, err := authors.get(context.Background(), id)
+			if err == nil && (author.id != fakeAuthor.ID || author.username != fakeAuthor.UserName) {
+				err = fmt.Errorf("root %v author %v", id, author)
+			}
+			errs <- err
+		}(fmt.Sprint(2000 + i%150))
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	calls := fake.Calls()
+	if len(calls) != 2 {
+		t.Fatalf("got %v lookups, want 2", len(calls))
+	}
+	for _, call := range calls {
+		if ids := call.Args[0].([]string); len(ids) > maxLookupIds {
+			t.Fatalf("lookup of %v ids", len(ids))
+		}
+	}
+	if _, err := authors.get(context.Background(), "2042"); err != nil {
+		t.Fatal(err)
+	}
+	if fake.CallCount("TweetLookup") != 2 {
+		t.Fatal("cached root looked up again")
+	}
+}
+
+func TestRootAuthorsExpiry(t *testing.T) {
+	fake := rootAuthorsFake(3)
+	authors := newRootAuthors(fake, 2, time.Millisecond*50, time.Millisecond)
+	ctx := context.Background()
+	for _, id := range []string{"2000", "2001", "2000", "2002"} {
+		if _, err := authors.get(ctx, id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	//2001 was least recently used when 2002 came in
+	lookups := fake.CallCount("TweetLookup")
+	authors.get(ctx, "2000")
+	if fake.CallCount("TweetLookup") != lookups {
+		t.Fatal("recently used root evicted")
+	}
+	authors.get(ctx, "2001")
+	if fake.CallCount("TweetLookup") != lookups+1 {
+		t.Fatal("least recently used root not evicted")
+	}
+	time.Sleep(time.Millisecond * 60)
+	authors.get(ctx, "2001")
+	if fake.CallCount("TweetLookup") != lookups+2 {
+		t.Fatal("expired root not looked up again")
+	}
+}
+
+func TestRootAuthorsFailures(t *testing.T) {
+	fake := rootAuthorsFake(1)
+	authors := newRootAuthors(fake, 10, time.Hour, time.Millisecond)
+	ctx := context.Background()
+	if _, err := authors.get(ctx, "9999"); !errors.Is(err, TweetNotFoundError) {
+		t.Fatalf("expected TweetNotFoundError, got %v", err)
+	}
+	fake.FailNext("TweetLookup", &twitter.ErrorResponse{StatusCode: 429})
+	if _, err := authors.get(ctx, "2000"); err == nil {
+		t.Fatal("lookup error not returned")
+	}
+	//neither failure is cached
+	if author, err := authors.get(ctx, "2000"); err != nil || author.username != fakeAuthor.UserName {
+		t.Fatalf("got %v %v after a failed lookup", author, err)
+	}
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := authors.get(cancelled, "2000"); err != nil {
+		t.Fatalf("cached root needs no context, got %v", err)
+	}
+	if _, err := authors.get(cancelled, "9999"); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+}
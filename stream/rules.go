@@ -0,0 +1,205 @@
+package stream
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/g8rswimmer/go-twitter/v2"
+	"os"
+	"sort"
+	"twitter_oracle/log"
+)
+
+// RuleSpec is one filtered stream rule of the manifest, Handler optionally routes the tag
+type RuleSpec struct {
+	Value   string `json:"value"`
+	Tag     string `json:"tag"`
+	Handler string `json:"handler,omitempty"`
+}
+
+// RulesManifest is the declared set of stream rules, reconciled against twitter by SyncRules
+type RulesManifest struct {
+	Rules []RuleSpec `json:"rules"`
+}
+
+// LiveRule is a rule as it exists on twitter
+type LiveRule struct {
+	ID    string `json:"id"`
+	Value string `json:"value"`
+	Tag   string `json:"tag"`
+}
+
+// RuleDrift is a live rule whose value is in the manifest under another tag
+type RuleDrift struct {
+	Live LiveRule `json:"live"`
+	Want RuleSpec `json:"want"`
+}
+
+// RuleSyncReport describes what SyncRules changed, or would change on a dry run
+type RuleSyncReport struct {
+	DryRun    bool        `json:"dry_run"`
+	Added     []LiveRule  `json:"added"`
+	Deleted   []LiveRule  `json:"deleted"`
+	Unchanged []LiveRule  `json:"unchanged"`
+	Drift     []RuleDrift `json:"drift"`
+}
+
+func (r *RuleSyncReport) Changed() bool {
+	return len(r.Added) > 0 || len(r.Deleted) > 0
+}
+
+func LoadRulesManifest(path string) (*RulesManifest, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	manifest := &RulesManifest{}
+	if err := json.Unmarshal(b, manifest); err != nil {
+		return nil, fmt.Errorf("parse rules manifest %v: %w", path, err)
+	}
+	return manifest, manifest.validate()
+}
+
+func (m *RulesManifest) validate() error {
+	values := make(map[string]bool)
+	routes := make(map[string]string)
+	for _, rule := range m.Rules {
+		if rule.Handler != "" {
+			if other, ok := routes[rule.Tag]; ok && other != rule.Handler {
+				return fmt.Errorf("%w: tag %q routed to %v and %v", InvalidRuleError, rule.Tag, other, rule.Handler)
+			}
+			routes[rule.Tag] = rule.Handler
+		}
+		if rule.Value == "" {
+			return fmt.Errorf("%w: empty value", InvalidRuleError)
+		}
+		if values[rule.Value] {
+			return fmt.Errorf("%w: duplicate value %q", InvalidRuleError, rule.Value)
+		}
+		values[rule.Value] = true
+	}
+	return nil
+}
+
+// SyncRules reconciles the live stream rules with manifest: missing rules are added, rules not in
+// the manifest are deleted and a tag change replaces the rule since twitter rules are immutable.
+// New rules are always validated with the api dry_run flag first, with dryRun nothing is changed.
+// Tags of rules naming a handler are routed to it once the sync succeeded.
+func (s *Subscriber) SyncRules(ctx context.Context, manifest *RulesManifest, dryRun bool) (*RuleSyncReport, error) {
+	if err := manifest.validate(); err != nil {
+		return nil, err
+	}
+	for _, spec := range manifest.Rules {
+		if _, ok := s.conversations.handler(spec.Handler); spec.Handler != "" && !ok {
+			return nil, fmt.Errorf("%w: %v for rule %q", UnknownHandlerError, spec.Handler, spec.Value)
+		}
+	}
+	rulesResp, err := s.client.TweetSearchStreamRules(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	report := &RuleSyncReport{DryRun: dryRun}
+	live := make(map[string]LiveRule)
+	for _, rule := range rulesResp.Rules {
+		live[rule.Value] = LiveRule{ID: string(rule.ID), Value: rule.Value, Tag: rule.Tag}
+	}
+
+	//newRules have a value twitter has not seen, replaced are drifted rules added back with the manifest tag
+	var newRules, replaced []twitter.TweetSearchStreamRule
+	var toDelete []twitter.TweetSearchStreamRuleID
+	wanted := make(map[string]bool)
+	for _, spec := range manifest.Rules {
+		wanted[spec.Value] = true
+		rule, ok := live[spec.Value]
+		switch {
+		case !ok:
+			newRules = append(newRules, twitter.TweetSearchStreamRule{Value: spec.Value, Tag: spec.Tag})
+		case rule.Tag != spec.Tag:
+			report.Drift = append(report.Drift, RuleDrift{Live: rule, Want: spec})
+			toDelete = append(toDelete, twitter.TweetSearchStreamRuleID(rule.ID))
+			report.Deleted = append(report.Deleted, rule)
+			replaced = append(replaced, twitter.TweetSearchStreamRule{Value: spec.Value, Tag: spec.Tag})
+		default:
+			report.Unchanged = append(report.Unchanged, rule)
+		}
+	}
+	for _, rule := range live {
+		if !wanted[rule.Value] {
+			toDelete = append(toDelete, twitter.TweetSearchStreamRuleID(rule.ID))
+			report.Deleted = append(report.Deleted, rule)
+		}
+	}
+	sort.Slice(report.Deleted, func(i, j int) bool { return report.Deleted[i].ID < report.Deleted[j].ID })
+	for _, drift := range report.Drift {
+		log.Warn("stream rule drift", "value", drift.Live.Value, "live tag", drift.Live.Tag, "manifest tag", drift.Want.Tag)
+	}
+
+	//validate everything before changing anything, the drifted values still exist on twitter
+	//and would be rejected as duplicates so only new values go through dry_run
+	if len(toDelete) > 0 {
+		if _, err := s.client.TweetSearchStreamDeleteRuleByID(ctx, toDelete, true); err != nil {
+			return report, err
+		}
+	}
+	if len(newRules) > 0 {
+		validated, err := s.addRules(ctx, newRules, true)
+		if err != nil {
+			return report, err
+		}
+		if dryRun {
+			report.Added = validated
+		}
+	}
+	if dryRun {
+		for _, rule := range replaced {
+			report.Added = append(report.Added, LiveRule{Value: rule.Value, Tag: rule.Tag})
+		}
+		return report, nil
+	}
+
+	//delete first, a drifted rule has to go before its value can be added again
+	toAdd := append(newRules, replaced...)
+	if len(toDelete) > 0 {
+		if _, err := s.client.TweetSearchStreamDeleteRuleByID(ctx, toDelete, false); err != nil {
+			return report, err
+		}
+	}
+	if len(toAdd) > 0 {
+		added, err := s.addRules(ctx, toAdd, false)
+		report.Added = added
+		if err != nil {
+			return report, err
+		}
+	}
+	for _, spec := range manifest.Rules {
+		if spec.Handler != "" {
+			s.conversations.route(spec.Tag, spec.Handler)
+		}
+	}
+	log.Info("stream rules synced", "added", len(report.Added), "deleted", len(report.Deleted), "unchanged", len(report.Unchanged))
+	return report, nil
+}
+
+// SyncRulesFile loads the manifest at path and syncs it
+func (s *Subscriber) SyncRulesFile(ctx context.Context, path string, dryRun bool) (*RuleSyncReport, error) {
+	manifest, err := LoadRulesManifest(path)
+	if err != nil {
+		return nil, err
+	}
+	return s.SyncRules(ctx, manifest, dryRun)
+}
+
+func (s *Subscriber) addRules(ctx context.Context, rules []twitter.TweetSearchStreamRule, dryRun bool) ([]LiveRule, error) {
+	resp, err := s.client.TweetSearchStreamAddRule(ctx, rules, dryRun)
+	if err != nil {
+		return nil, err
+	}
+	var added []LiveRule
+	for _, rule := range resp.Rules {
+		added = append(added, LiveRule{ID: string(rule.ID), Value: rule.Value, Tag: rule.Tag})
+	}
+	if len(resp.Errors) > 0 {
+		return added, fmt.Errorf("%w: %v %v", InvalidRuleError, resp.Errors[0].Title, resp.Errors[0].Detail)
+	}
+	return added, nil
+}
@@ -0,0 +1,101 @@
+package stream
+
+import (
+	"context"
+	"errors"
+	"github.com/g8rswimmer/go-twitter/v2"
+	"testing"
+	"twitter_oracle/twclient"
+)
+
+func liveRuleTags(fake *twclient.Fake) map[string]string {
+	tags := make(map[string]string)
+	for _, rule := range fake.Rules() {
+		tags[rule.Value] = rule.Tag
+	}
+	return tags
+}
+
+func TestSyncRules(t *testing.T) {
+	fake := twclient.NewFake()
+	_, err := fake.TweetSearchStreamAddRule(context.Background(), []twitter.TweetSearchStreamRule{
+		{Value: "#HugReply @metauce", Tag: "replies"},
+		{Value: "#HugThought", Tag: "thoughts"},
+		{Value: "#stale", Tag: "old"},
+	}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub := newSubscriber(nil, fake)
+	sub.RouteTag("replies", "")
+
+	report, err := sub.SyncRulesFile(context.Background(), "testdata/rules.json", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Added) != 2 || len(report.Deleted) != 2 || len(report.Unchanged) != 1 || len(report.Drift) != 1 {
+		t.Fatalf("unexpected dry run report %+v", report)
+	}
+	if report.Drift[0].Live.Tag != "thoughts" || report.Drift[0].Want.Tag != "thought" {
+		t.Fatalf("unexpected drift %+v", report.Drift[0])
+	}
+	if tags := liveRuleTags(fake); len(tags) != 3 || tags["#stale"] != "old" {
+		t.Fatalf("dry run changed rules %v", tags)
+	}
+	if routes := sub.GetTagRoutes(); routes["replies"] != "" {
+		t.Fatalf("dry run changed routes %v", routes)
+	}
+
+	report, err = sub.SyncRulesFile(context.Background(), "testdata/rules.json", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"#HugReply @metauce": "replies", "#HugThought": "thought", "#HugMe": "event"}
+	tags := liveRuleTags(fake)
+	if len(tags) != len(want) {
+		t.Fatalf("live rules %v, want %v", tags, want)
+	}
+	for value, tag := range want {
+		if tags[value] != tag {
+			t.Fatalf("live rules %v, want %v", tags, want)
+		}
+	}
+
+	if routes := sub.GetTagRoutes(); routes["replies"] != DefaultHandlerName || routes["thought"] != ThoughtHandlerName {
+		t.Fatalf("manifest routes not applied %v", routes)
+	}
+
+	report, err = sub.SyncRulesFile(context.Background(), "testdata/rules.json", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Changed() || len(report.Drift) != 0 {
+		t.Fatalf("second sync not a no-op %+v", report)
+	}
+}
+
+func TestSyncRulesInvalid(t *testing.T) {
+	fake := twclient.NewFake()
+	sub := newSubscriber(nil, fake)
+	_, err := sub.SyncRules(context.Background(), &RulesManifest{Rules: []RuleSpec{{Value: "a"}, {Value: "a"}}}, false)
+	if !errors.Is(err, InvalidRuleError) {
+		t.Fatalf("got %v, want InvalidRuleError", err)
+	}
+	_, err = sub.SyncRules(context.Background(), &RulesManifest{Rules: []RuleSpec{{Value: "a", Tag: "a", Handler: "missing"}}}, false)
+	if !errors.Is(err, UnknownHandlerError) {
+		t.Fatalf("got %v, want UnknownHandlerError", err)
+	}
+	//a rule the api rejects on dry_run must leave the live rules untouched
+	_, err = fake.TweetSearchStreamAddRule(context.Background(), []twitter.TweetSearchStreamRule{{Value: "#keep"}}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake.FailNext("TweetSearchStreamAddRule", errors.New("invalid rule syntax"))
+	_, err = sub.SyncRules(context.Background(), &RulesManifest{Rules: []RuleSpec{{Value: "#new ("}}}, false)
+	if err == nil {
+		t.Fatal("expected validation error")
+	}
+	if tags := liveRuleTags(fake); len(tags) != 1 || fake.CallCount("TweetSearchStreamAddRule") != 2 {
+		t.Fatalf("rules changed after failed validation %v", tags)
+	}
+}
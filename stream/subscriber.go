@@ -6,77 +6,185 @@ import (
 	"errors"
 	"fmt"
 	"github.com/g8rswimmer/go-twitter/v2"
-	"net/http"
-	"strings"
+	"sync"
 	"time"
+	"twitter_oracle/attest"
 	"twitter_oracle/common"
 	"twitter_oracle/db"
+	"twitter_oracle/log"
+	"twitter_oracle/twclient"
 )
 
+// MAX_TIPS_LEN is how many characters, as a reader counts them, the tips of a thought keep
 var MAX_TIPS_LEN = 50
 
-var EventFilter = "@ninox2022 #thought"
+var DefaultDrainTimeout = time.Second * 20
+
+// DefaultKeepAlive is how long the stream may stay silent before it is reopened, twitter sends
+// a heartbeat every 20 seconds
+var DefaultKeepAlive = time.Second * 30
 
-type Handler func(db *db.DBService, id string, conversation string, authorId string, authorName string, createTime time.Time, text string) error
+var streamOpts = twitter.TweetSearchStreamOpts{
+	Expansions:  []twitter.Expansion{twitter.ExpansionAuthorID},
+	TweetFields: []twitter.TweetField{twitter.TweetFieldCreatedAt, twitter.TweetFieldConversationID},
+}
+
+var EventFilter = "@ninox2022 #thought"
 
 //By Default add text as reply to conversation in db
-func DefaultHandler(db *db.DBService, id string, conversation string, authorId string, authorName string, createTime time.Time, text string) error {
+func DefaultHandler(ctx context.Context, event *TweetEvent) error {
 	//todo:add as reply in db
 	return nil
 }
 
+// StatusUrl links a tweet without its author's handle, for when the author is not known
+func StatusUrl(tweetId string) string {
+	return fmt.Sprintf("https://twitter.com/i/web/status/%s", tweetId)
+}
+
+// AuthorStatusUrl links a tweet under its author's handle. Twitter resolves status links by id,
+// the handle only helps readers, so a link made before a rename still opens
+func AuthorStatusUrl(username string, tweetId string) string {
+	return fmt.Sprintf("https://twitter.com/%s/status/%s", username, tweetId)
+}
+
+// ThoughtStore saves thoughts keyed by their tweet, implemented by db.DBService
+type ThoughtStore interface {
+	PutThought(tweetId, authorId, authorName, content, sourceUrl, tips string) error
+}
+
+// Attester records thoughts for the next attestation epoch, implemented by attest.Attester
+type Attester interface {
+	Record(record common.AttestationRecord) error
+}
+
 type Subscriber struct {
-	conversationHandler map[string]Handler
-	BeaverToken         string
-	client              *twitter.Client
-	stream              *twitter.TweetStream
-	db                  *db.DBService
-	defaultHandler      Handler
+	conversations  *conversationRegistry
+	checkpoints    *checkpointTracker
+	deadLetters    DeadLetterStore
+	thoughts       ThoughtStore
+	pending        PendingThoughtStore
+	links          WalletLinkStore
+	events         EventStore
+	seen           *seenTweets
+	client         twclient.Client
+	stream         twclient.TweetStream
+	db             *db.DBService
+	defaultHandler Handler
+	middleware     []Middleware
+	pool           *workerPool
+	recorder       *Recorder
+	rootAuthors    *rootAuthors
+	users          *userTracker
+	Backoff        BackoffPolicy
+	Retry          DeadLetterPolicy
+	Pending        PendingPolicy
+	Workers        WorkerPoolConfig
+	//DrainTimeout is how long queued tweets are still handled after Start is cancelled
+	DrainTimeout time.Duration
+	//Summarizer makes the tips of thoughts
+	Summarizer Summarizer
+	//Attester gets every loaded thought when set
+	Attester Attester
+	//Enroller starts polling an event as soon as it is registered when set
+	Enroller EventEnroller
+	//RulesFile is the rules manifest resynced when the stream reports a rule change, off while empty
+	RulesFile string
+	//KeepAlive is how long the stream may go without data or heartbeat before it is reopened, 0 disables the watchdog
+	KeepAlive  time.Duration
+	stateMutex sync.RWMutex
+	state      ConnectionState
+	observers  []func(ConnectionEvent)
 }
 
-func Init(db *db.DBService) (*Subscriber, error) {
-	s := Subscriber{
-		conversationHandler: make(map[string]Handler),
-		BeaverToken:         common.BeaverToken,
-		db:                  db,
+func newSubscriber(db *db.DBService, client twclient.Client) *Subscriber {
+	s := &Subscriber{
+		conversations: newConversationRegistry(nil),
+		checkpoints:   newCheckpointTracker(nil),
+		seen:          newSeenTweets(DedupWindow),
+		client:        client,
+		db:            db,
+		Backoff:       DefaultBackoffPolicy,
+		Retry:         DefaultDeadLetterPolicy,
+		Pending:       DefaultPendingPolicy,
+		Workers:       DefaultWorkerPoolConfig,
+		DrainTimeout:  DefaultDrainTimeout,
+		KeepAlive:     DefaultKeepAlive,
+		Summarizer:    NewTipsSummarizer(),
+		middleware:    []Middleware{Recover(), Logging(), Timing()},
+		rootAuthors:   newRootAuthors(client, RootAuthorCacheSize, RootAuthorTTL, RootLookupWindow),
+		users:         newUserTracker(nil, KnownUsersSize),
 	}
-	convList, err := db.GetConversationList()
-	if err != nil {
-		return nil, err
+	if db != nil {
+		s.conversations.store = db
+		s.checkpoints.store = db
+		s.deadLetters = db
+		s.thoughts = db
+		s.pending = db
+		s.links = db
+		s.events = db
+		s.users.store = db
 	}
-	for _, conv := range convList {
-		s.conversationHandler[conv] = DefaultHandler
+	s.conversations.registerHandler(ThoughtHandlerName, s.LoadThoughtHandler)
+	s.conversations.registerHandler(LinkHandlerName, s.LinkHandler)
+	s.conversations.registerHandler(EventHandlerName, s.EventHandler)
+	for tag, handlerName := range DefaultTagRoutes {
+		s.conversations.route(tag, handlerName)
 	}
-	s.newClient()
-	return &s, nil
+	return s
 }
 
-func (s *Subscriber) newClient() {
-	s.client = &twitter.Client{
-		Authorizer: authorize{
-			Token: s.BeaverToken,
-		},
-		Client: http.DefaultClient,
-		Host:   "https://api.twitter.com",
+func Init(db *db.DBService, client twclient.Client) (*Subscriber, error) {
+	s := newSubscriber(db, client)
+	err := s.conversations.load()
+	if err != nil {
+		return nil, err
+	}
+	err = s.checkpoints.load()
+	if err != nil {
+		return nil, err
 	}
+	return s, nil
 }
 
 func (s *Subscriber) AddDefaultHanler(handler Handler) {
 	s.defaultHandler = handler
 }
 
-func (s *Subscriber) AddConversation(conversationFilter string, handler Handler) {
-	s.conversationHandler[conversationFilter] = handler
+// Use appends middleware wrapping every handler after the default Recover, Logging and Timing,
+// call it before Start
+func (s *Subscriber) Use(middleware ...Middleware) {
+	s.middleware = append(s.middleware, middleware...)
 }
 
-func (s *Subscriber) RemoveConversation(conversationFilter string) {
-	if _, ok := s.conversationHandler[conversationFilter]; ok {
-		delete(s.conversationHandler, conversationFilter)
-	}
+// RegisterHandler makes handler available to conversations by name, register before they are added
+func (s *Subscriber) RegisterHandler(name string, handler Handler) {
+	s.conversations.registerHandler(name, handler)
+}
+
+// RouteTag sends tweets matching a rule tagged tag to the named handler, an empty name removes the route
+func (s *Subscriber) RouteTag(tag string, handlerName string) error {
+	return s.conversations.route(tag, handlerName)
+}
+
+func (s *Subscriber) GetTagRoutes() map[string]string {
+	return s.conversations.routeList()
+}
+
+func (s *Subscriber) AddConversation(conversationFilter string, handlerName string) error {
+	return s.conversations.put(conversationFilter, handlerName)
+}
+
+func (s *Subscriber) RemoveConversation(conversationFilter string) error {
+	return s.conversations.remove(conversationFilter)
+}
+
+func (s *Subscriber) UpdateConversationHandler(conversationFilter string, handlerName string) error {
+	return s.conversations.put(conversationFilter, handlerName)
 }
 
-func (s *Subscriber) UpdateConversationHandler(conversationFilter string, handler Handler) {
-	s.conversationHandler[conversationFilter] = handler
+func (s *Subscriber) GetConversationList() []common.ConversationInfo {
+	return s.conversations.list()
 }
 
 func (s *Subscriber) GetRules(ctx context.Context) (string, error) {
@@ -111,7 +219,7 @@ func (s *Subscriber) DeleteRules(ctx context.Context, ids []string) error {
 	for _, id := range ids {
 		ruleIDs = append(ruleIDs, twitter.TweetSearchStreamRuleID(id))
 	}
-	_, err := s.client.TweetSearchStreamDeleteRuleByID(ctx, ruleIDs, true)
+	_, err := s.client.TweetSearchStreamDeleteRuleByID(ctx, ruleIDs, false)
 	return err
 }
 
@@ -121,7 +229,7 @@ func (s *Subscriber) GetTweetById(ctx context.Context, id string) (*twitter.Twee
 		TweetFields: []twitter.TweetField{twitter.TweetFieldCreatedAt, twitter.TweetFieldConversationID},
 	}
 	ids := []string{id}
-	tweetResponse, err := s.client.TweetLookup(context.Background(), ids, opts)
+	tweetResponse, err := s.client.TweetLookup(ctx, ids, opts)
 	if err != nil {
 		return nil, err
 	}
@@ -131,177 +239,156 @@ func (s *Subscriber) GetTweetById(ctx context.Context, id string) (*twitter.Twee
 	return tweetResponse.Raw, nil
 }
 
-func (s *Subscriber) reconnect(ctx context.Context) error {
-	ticker := time.NewTicker(time.Minute * 5)
-	timeout := time.NewTimer(time.Minute * 60)
-	var err error
-	for {
-		select {
-		case <-ticker.C:
-			opts := twitter.TweetSearchStreamOpts{
-				Expansions:  []twitter.Expansion{twitter.ExpansionAuthorID},
-				TweetFields: []twitter.TweetField{twitter.TweetFieldCreatedAt, twitter.TweetFieldConversationID},
-			}
-			s.stream, err = s.client.TweetSearchStream(ctx, opts)
-			if err != nil {
-				fmt.Printf("tweet sample callout error: %v\n", err)
-				continue
-			} else {
-				fmt.Println("reconnect success")
-				return nil
-			}
-		case <-timeout.C:
-			return errors.New("reconnect timeout")
-		}
-	}
-}
-
+// Start streams until ctx is done, lost connections are reopened under the Backoff policy.
+// Tweets are handled on the Workers pool so a slow handler does not stall the stream. Once ctx
+// is done the stream is closed and queued tweets get DrainTimeout to be handled.
 func (s *Subscriber) Start(ctx context.Context) error {
-	opts := twitter.TweetSearchStreamOpts{
-		Expansions:  []twitter.Expansion{twitter.ExpansionAuthorID},
-		TweetFields: []twitter.TweetField{twitter.TweetFieldCreatedAt, twitter.TweetFieldConversationID},
-	}
-	var err error
-	s.stream, err = s.client.TweetSearchStream(ctx, opts)
+	//handlers outlive ctx while draining, their context is cancelled when the drain times out
+	handleCtx, cancelHandle := context.WithCancel(context.Background())
+	defer cancelHandle()
+	s.pool = newWorkerPool(s.Workers, s.handleQueued, s.advanceCheckpoints)
+	s.pool.start(handleCtx)
+	defer func() {
+		if !s.pool.stop(s.DrainTimeout) {
+			log.Warn("tweet handlers still running after", s.DrainTimeout, "cancelling them")
+			cancelHandle()
+		}
+	}()
+	err := s.connect(ctx)
 	if err != nil {
 		return err
 	}
+	s.backfill(ctx)
 	fmt.Println("start streaming")
-	defer s.stream.Close()
-	ticker := time.NewTicker(time.Second)
+	//close whichever stream is current on return, connect replaces s.stream
+	defer func() {
+		s.stream.Close()
+	}()
+	ticker := time.NewTicker(s.watchdogInterval())
+	defer ticker.Stop()
 	for {
+		var cause error
 		select {
+		case <-ctx.Done():
+			s.emit(ConnectionEvent{State: StateStopped, Err: ctx.Err()})
+			return ctx.Err()
 		case tm := <-s.stream.Tweets():
-			tmb, err := json.Marshal(tm)
-			if err != nil {
-				fmt.Printf("error decoding tweet message %v", err)
+			if s.recorder != nil {
+				if err := s.recorder.RecordTweet(tm); err != nil {
+					log.Warn("record tweet error", err)
+				}
 			}
-			fmt.Printf("tweet: %s\n\n", string(tmb))
 
-			e := s.handleTweetMessage(tm)
-			if e != nil {
-				//todo:handle tweet message handle error
-				fmt.Println(e)
-			}
+			s.processTweetMessage(ctx, tm)
 
 		case sm := <-s.stream.SystemMessages():
-			smb, err := json.Marshal(sm)
-			if err != nil {
-				fmt.Printf("error decoding system message %v", err)
+			if s.recorder != nil {
+				if err := s.recorder.RecordSystem(sm); err != nil {
+					log.Warn("record system message error", err)
+				}
 			}
-			fmt.Printf("system: %s\n\n", string(smb))
+			cause = s.handleSystemMessage(ctx, sm)
 		case strErr := <-s.stream.Err():
-			fmt.Printf("error: %v\n\n", strErr)
+			log.Warn("stream error", strErr)
 		case <-ticker.C:
-			if s.stream.Connection() == false {
-				fmt.Printf("connection lost %v\n", time.Now())
-				s.stream.Close()
-				reconnectErr := s.reconnect(ctx)
-				if reconnectErr != nil {
-					return reconnectErr
-				}
-				fmt.Println("reconnected", time.Now())
+			if !s.stream.Connection() {
+				cause = StreamClosedError
+			} else if s.stalled() {
+				stallCounter.Inc(1)
+				cause = StreamStalledError
+			}
+		}
+		if cause != nil {
+			if err := s.reconnect(ctx, cause); err != nil {
+				return err
 			}
 		}
 	}
 }
 
-func (s *Subscriber) handleTweetMessage(tweetMsg *twitter.TweetMessage) error {
+func (s *Subscriber) handleTweetMessage(ctx context.Context, tweetMsg *twclient.TweetMessage) error {
 	if tweetMsg == nil || tweetMsg.Raw == nil || tweetMsg.Raw.Tweets == nil || tweetMsg.Raw.Includes == nil || tweetMsg.Raw.Includes.Users == nil {
 		return errors.New("tweet message response miss content")
 	}
-	userIdNameMap := make(map[string]string)
-	for _, user := range tweetMsg.Raw.Includes.Users {
-		if user == nil {
-			continue
-		}
-		userIdNameMap[user.ID] = user.UserName
+	s.users.observe(tweetMsg.Raw.Includes.Users)
+	events, skipped := newTweetEvents(tweetMsg)
+	for _, tweet := range skipped {
+		//todo:handle stream message without author name
+		fmt.Println("failed to get author name, author id:", tweet.AuthorID)
 	}
-	for _, tweet := range tweetMsg.Raw.Tweets {
-		if tweet == nil {
-			continue
-		}
+	for _, event := range events {
+		handled := false
 		//handle certain conversation
-		for conversation, handler := range s.conversationHandler {
-			if tweet.ConversationID == conversation {
-				authorId := tweet.AuthorID
-				authorName, ok := userIdNameMap[authorId]
-				if !ok {
-					//todo:handle stream message without author name
-					fmt.Println("failed to get author name, author id:", authorId)
-					continue
-				}
-				createTime, err := time.Parse(time.RFC3339, tweet.CreatedAt)
-				if err != nil {
-					createTime = time.Now()
-				}
-				e := handler(s.db, tweet.ID, conversation, authorId, authorName, createTime, tweet.Text)
-				if e != nil {
-					//todo:handle handler error
-					continue
-				}
-			}
+		if conv, ok := s.conversations.get(event.ConversationId); ok {
+			s.dispatch(ctx, conv.info.HandlerName, conv.handler, event)
+			handled = true
 		}
-
-		if s.defaultHandler != nil {
-			authorId := tweet.AuthorID
-			authorName, ok := userIdNameMap[authorId]
-			if !ok {
-				//todo:handle stream message without author name
-				fmt.Println("failed to get author name, author id:", authorId)
-				continue
-			}
-			createTime, err := time.Parse(time.RFC3339, tweet.CreatedAt)
-			if err != nil {
-				createTime = time.Now()
-			}
-			e := s.defaultHandler(s.db, tweet.ID, tweet.ConversationID, authorId, authorName, createTime, tweet.Text)
-			if e != nil {
-				//todo:handle handler error
-				fmt.Println("default handle error", e, tweet)
-				continue
-			}
+		//then by the tags of the rules it matched, the default handler only gets unrouted tweets
+		for _, route := range s.conversations.routed(event.RuleTags()) {
+			s.dispatch(ctx, route.handlerName, route.handler, event)
+			handled = true
+		}
+		if !handled && s.defaultHandler != nil {
+			s.dispatch(ctx, FallbackHandlerName, s.defaultHandler, event)
 		}
 	}
 	return nil
 }
 
-func (s *Subscriber) LoadThoughtHandler(db *db.DBService, id string, conversation string, authorId string, authorName string, createTime time.Time, text string) error {
-	fmt.Println("load thought", authorName, createTime)
-	sourceUrl := ""
-	tips := text
-	if len(text) > MAX_TIPS_LEN {
-		sepList := strings.Split(text, " ")
-		summary := ""
-		for _, sep := range sepList {
-			summary = summary + sep
-			if len(summary) > MAX_TIPS_LEN {
-				summary = summary + " ..."
-				break
-			}
-		}
+// dispatch runs handler through the middleware chain and dead-letters the event if it fails
+func (s *Subscriber) dispatch(ctx context.Context, handlerName string, handler Handler, event *TweetEvent) error {
+	named := *event
+	named.HandlerName = handlerName
+	err := Chain(handler, s.middleware...)(ctx, &named)
+	if err != nil {
+		s.deadLetter(&named, err)
 	}
-	if id == conversation {
-		sourceUrl = fmt.Sprintf("https://twitter.com/%s/status/%s", authorName, conversation)
-	} else {
-		raw, err := s.GetTweetById(context.Background(), conversation)
-		if err != nil {
-			return err
-		}
-		userIdNameMap := make(map[string]string)
-		for _, user := range raw.Includes.Users {
-			if user == nil {
-				continue
-			}
-			userIdNameMap[user.ID] = user.UserName
-		}
-		if len(raw.Tweets) == 0 {
-			return errors.New("conversation tweet not found" + conversation)
-		}
-		conversationAuthor := userIdNameMap[raw.Tweets[0].AuthorID]
-		sourceUrl = fmt.Sprintf("https://twitter.com/%s/status/%s", conversationAuthor, conversation)
+	return err
+}
+
+// sourceUrl links the conversation root under the latest username of its author, a root whose
+// author can not be looked up is linked without a handle rather than dropping the thought
+func (s *Subscriber) sourceUrl(ctx context.Context, event *TweetEvent) string {
+	conversation := event.ConversationId
+	if event.TweetId == conversation {
+		return AuthorStatusUrl(event.AuthorName, conversation)
+	}
+	author, err := s.rootAuthors.get(ctx, conversation)
+	if err != nil {
+		log.Warn("conversation root author error", err, "conversation", conversation)
+		return StatusUrl(conversation)
+	}
+	//a rename seen in the stream is newer than the cached lookup
+	if username, ok := s.users.username(author.id); ok {
+		return AuthorStatusUrl(username, conversation)
+	}
+	return AuthorStatusUrl(author.username, conversation)
+}
+
+func (s *Subscriber) LoadThoughtHandler(ctx context.Context, event *TweetEvent) error {
+	fmt.Println("load thought", event.AuthorName, event.CreatedAt)
+	text := event.Text
+	tips := s.Summarizer.Summarize(text)
+	sourceUrl := s.sourceUrl(ctx, event)
+	if s.thoughts == nil {
+		return NoThoughtStoreError
+	}
+	err := s.thoughts.PutThought(event.TweetId, event.AuthorId, event.AuthorName, text, sourceUrl, tips)
+	if errors.Is(err, db.UserNotRegisteredError) {
+		err = s.putPending(event, text, sourceUrl, tips)
+	}
+	if err != nil || s.Attester == nil {
+		return err
 	}
-	return db.PutThought(authorName, text, sourceUrl, tips)
+	//recorded once per tweet, a redelivery only retries a failed record
+	return s.Attester.Record(common.AttestationRecord{
+		Kind:       attest.ThoughtRecord,
+		TweetId:    event.TweetId,
+		AuthorId:   event.AuthorId,
+		AuthorName: event.AuthorName,
+		Text:       text,
+		RecordedAt: event.CreatedAt,
+	})
 }
 
 func (q *Subscriber) GetEventTwitterId(ctx context.Context, sinceId string) (*twitter.TweetRaw, error) {
@@ -3,24 +3,32 @@ package stream
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/g8rswimmer/go-twitter/v2"
+	"net/http"
 	"os"
+	"sync"
 	"testing"
 	"time"
+	"twitter_oracle/common"
 	"twitter_oracle/db"
+	"twitter_oracle/faketwitter"
+	"twitter_oracle/twclient"
 )
 
 var tokenStr = os.Getenv("TW_BEAVER")
 
-func TestGetRule(t *testing.T) {
-	sub := Subscriber{
-		conversationHandler: make(map[string]Handler),
-		BeaverToken:         tokenStr,
-		client:              nil,
-		stream:              nil,
+// liveSubscriber talks to the real twitter api, tests using it are skipped without TW_BEAVER
+func liveSubscriber(t *testing.T) *Subscriber {
+	if tokenStr == "" {
+		t.Skip("TW_BEAVER not set")
 	}
-	sub.newClient()
+	return newSubscriber(nil, twclient.New(tokenStr, twclient.DefaultHost))
+}
+
+func TestGetRule(t *testing.T) {
+	sub := liveSubscriber(t)
 	rules, err := sub.GetRules(context.Background())
 	if err != nil {
 		t.Fatal(err)
@@ -29,13 +37,7 @@ func TestGetRule(t *testing.T) {
 }
 
 func TestDeleteRule(t *testing.T) {
-	sub := Subscriber{
-		conversationHandler: make(map[string]Handler),
-		BeaverToken:         tokenStr,
-		client:              nil,
-		stream:              nil,
-	}
-	sub.newClient()
+	sub := liveSubscriber(t)
 	err := sub.DeleteRules(context.Background(), []string{"1545290390944722945", "1546429906975727617"})
 	if err != nil {
 		t.Fatal(err)
@@ -43,13 +45,7 @@ func TestDeleteRule(t *testing.T) {
 }
 
 func TestAddRule(t *testing.T) {
-	sub := Subscriber{
-		conversationHandler: make(map[string]Handler),
-		BeaverToken:         tokenStr,
-		client:              nil,
-		stream:              nil,
-	}
-	sub.newClient()
+	sub := liveSubscriber(t)
 	rule := "#HugReply @metauce"
 	tag := "replies"
 	rules, err := sub.AddRule(context.Background(), rule, tag)
@@ -59,21 +55,15 @@ func TestAddRule(t *testing.T) {
 	fmt.Println(rules)
 }
 
-func DummyHandler(db *db.DBService, id string, conversation string, authorId string, authorName string, createTime time.Time, text string) error {
+func DummyHandler(ctx context.Context, event *TweetEvent) error {
 	fmt.Printf("id:%v\nconversation:%v\nauthor id:%v\nauthor name:%v\ncreate time:%v\ntext:%v\n",
-		id, conversation, authorId, authorName, createTime.String(), text)
+		event.TweetId, event.ConversationId, event.AuthorId, event.AuthorName, event.CreatedAt.String(), event.Text)
 	return nil
 }
 
 func TestStartStream(t *testing.T) {
-	sub := Subscriber{
-		conversationHandler: make(map[string]Handler),
-		BeaverToken:         tokenStr,
-		client:              nil,
-		stream:              nil,
-		defaultHandler:      DummyHandler,
-	}
-	sub.newClient()
+	sub := liveSubscriber(t)
+	sub.defaultHandler = DummyHandler
 	ctx, cancel := context.WithTimeout(context.Background(), time.Minute*10)
 	defer cancel()
 	err := sub.Start(ctx)
@@ -83,14 +73,8 @@ func TestStartStream(t *testing.T) {
 }
 
 func TestGetTweetConversation(t *testing.T) {
-	sub := Subscriber{
-		conversationHandler: make(map[string]Handler),
-		BeaverToken:         tokenStr,
-		client:              nil,
-		stream:              nil,
-		defaultHandler:      DummyHandler,
-	}
-	sub.newClient()
+	sub := liveSubscriber(t)
+	sub.defaultHandler = DummyHandler
 	opts := twitter.TweetLookupOpts{
 		Expansions:  []twitter.Expansion{twitter.ExpansionAuthorID},
 		TweetFields: []twitter.TweetField{twitter.TweetFieldCreatedAt, twitter.TweetFieldConversationID},
@@ -109,31 +93,599 @@ func TestGetTweetConversation(t *testing.T) {
 	fmt.Println(string(enc))
 
 	tweet := tweetResponse.Raw.Tweets[0]
-	DummyHandler(nil, tweet.ID, tweet.ConversationID, tweet.AuthorID, "mask", time.Now(), tweet.Text)
+	DummyHandler(context.Background(), &TweetEvent{TweetId: tweet.ID, ConversationId: tweet.ConversationID, AuthorId: tweet.AuthorID,
+		AuthorName: "mask", CreatedAt: time.Now(), Text: tweet.Text, Tweet: tweet})
 }
 
 func TestEventTweet(t *testing.T) {
-	sub := Subscriber{
-		conversationHandler: make(map[string]Handler),
-		BeaverToken:         tokenStr,
-		client:              nil,
-		stream:              nil,
-		defaultHandler:      DummyHandler,
-	}
-	sub.newClient()
+	sub := liveSubscriber(t)
+	sub.defaultHandler = DummyHandler
 	raw, err := sub.GetEventTwitterId(context.Background(), "1592355565187235840")
 	if err != nil {
 		t.Fatal(err)
 	}
 	fmt.Printf("load %v tweets\n", len(raw.Tweets))
-	for _, tweet := range raw.Tweets {
-		createTime, err := time.Parse(time.RFC3339, tweet.CreatedAt)
+	events, _ := newTweetEvents(&twclient.TweetMessage{Raw: raw})
+	for _, event := range events {
+		err = DummyHandler(context.Background(), event)
 		if err != nil {
-			createTime = time.Now()
+			t.Fatal(err)
 		}
-		err = DummyHandler(nil, tweet.ID, tweet.ConversationID, tweet.AuthorID, "mask", createTime, tweet.Text)
-		if err != nil {
+	}
+}
+
+type recordedTweet struct {
+	id           string
+	conversation string
+	authorName   string
+	text         string
+}
+
+type recordingHandler struct {
+	mutex  sync.Mutex
+	tweets []recordedTweet
+}
+
+func (r *recordingHandler) handle(ctx context.Context, event *TweetEvent) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.tweets = append(r.tweets, recordedTweet{id: event.TweetId, conversation: event.ConversationId, authorName: event.AuthorName, text: event.Text})
+	return nil
+}
+
+func (r *recordingHandler) recorded() []recordedTweet {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return append([]recordedTweet(nil), r.tweets...)
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met before deadline")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+var fakeAuthor = &twitter.UserObj{ID: "100", Name: "Ninox", UserName: "ninox2022"}
+
+func fakeTweet(id string, conversation string, text string) *twitter.TweetObj {
+	return &twitter.TweetObj{
+		ID:             id,
+		Text:           text,
+		AuthorID:       fakeAuthor.ID,
+		ConversationID: conversation,
+		CreatedAt:      "2022-11-15T08:00:00.000Z",
+	}
+}
+
+func TestHandleTweetMessageDispatch(t *testing.T) {
+	conv := &recordingHandler{}
+	def := &recordingHandler{}
+	sub := newSubscriber(nil, twclient.NewFake())
+	sub.defaultHandler = def.handle
+	sub.RegisterHandler("recording", conv.handle)
+	if err := sub.AddConversation("10", "recording"); err != nil {
+		t.Fatal(err)
+	}
+	fs := twclient.NewFakeStream()
+	fs.SendTweet(fakeTweet("11", "10", "reply in conversation"), fakeAuthor)
+	fs.SendTweet(fakeTweet("21", "20", "unrelated tweet"), fakeAuthor)
+	for i := 0; i < 2; i++ {
+		if err := sub.handleTweetMessage(context.Background(), <-fs.Tweets()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := conv.recorded(); len(got) != 1 || got[0].id != "11" || got[0].authorName != "ninox2022" {
+		t.Fatalf("conversation handler got %+v", got)
+	}
+	//the default handler only gets tweets no conversation or tag routed
+	if got := def.recorded(); len(got) != 1 || got[0].id != "21" {
+		t.Fatalf("default handler got %+v", got)
+	}
+	if err := sub.handleTweetMessage(context.Background(), &twclient.TweetMessage{}); err == nil {
+		t.Fatal("expected error for empty message")
+	}
+}
+
+func TestHandleTweetMessageRouteByTag(t *testing.T) {
+	thought, replies, conv, def := &recordingHandler{}, &recordingHandler{}, &recordingHandler{}, &recordingHandler{}
+	sub := newSubscriber(nil, twclient.NewFake())
+	sub.defaultHandler = def.handle
+	sub.RegisterHandler("thoughts", thought.handle)
+	sub.RegisterHandler("replies", replies.handle)
+	sub.RegisterHandler("conv", conv.handle)
+	if err := sub.RouteTag("thought", "thoughts"); err != nil {
+		t.Fatal(err)
+	}
+	if err := sub.RouteTag("replies", "replies"); err != nil {
+		t.Fatal(err)
+	}
+	if err := sub.RouteTag("event", "missing"); !errors.Is(err, UnknownHandlerError) {
+		t.Fatalf("got %v, want UnknownHandlerError", err)
+	}
+	if err := sub.AddConversation("10", "conv"); err != nil {
+		t.Fatal(err)
+	}
+	fs := twclient.NewFakeStream()
+	fs.SendMatching(fakeTweet("1", "1", "#thought"), []twclient.MatchingRule{{ID: "1", Tag: "thought"}}, fakeAuthor)
+	//matching two rules routed to the same handler runs it once
+	fs.SendMatching(fakeTweet("2", "2", "#thought #HugReply"), []twclient.MatchingRule{{ID: "1", Tag: "thought"}, {ID: "3", Tag: "thought"}, {ID: "2", Tag: "replies"}}, fakeAuthor)
+	fs.SendMatching(fakeTweet("3", "10", "#HugReply in conversation"), []twclient.MatchingRule{{ID: "2", Tag: "replies"}}, fakeAuthor)
+	fs.SendMatching(fakeTweet("4", "4", "untagged"), []twclient.MatchingRule{{ID: "4"}}, fakeAuthor)
+	for i := 0; i < 4; i++ {
+		if err := sub.handleTweetMessage(context.Background(), <-fs.Tweets()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ids := func(h *recordingHandler) (ids []string) {
+		for _, tweet := range h.recorded() {
+			ids = append(ids, tweet.id)
+		}
+		return ids
+	}
+	for _, c := range []struct {
+		name    string
+		handler *recordingHandler
+		want    string
+	}{{"thought", thought, "[1 2]"}, {"replies", replies, "[2 3]"}, {"conversation", conv, "[3]"}, {"default", def, "[4]"}} {
+		if got := fmt.Sprint(ids(c.handler)); got != c.want {
+			t.Fatalf("%v handler got %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestStartReconnect(t *testing.T) {
+	fake := twclient.NewFake()
+	first, second := twclient.NewFakeStream(), twclient.NewFakeStream()
+	fake.QueueStream(first)
+	fake.QueueStream(second)
+	def := &recordingHandler{}
+	sub := newSubscriber(nil, fake)
+	sub.defaultHandler = def.handle
+	sub.Backoff = BackoffPolicy{NetworkStep: time.Millisecond, NetworkMax: time.Millisecond * 10}
+	var eventMutex sync.Mutex
+	var events []ConnectionEvent
+	sub.OnConnectionEvent(func(event ConnectionEvent) {
+		eventMutex.Lock()
+		defer eventMutex.Unlock()
+		events = append(events, event)
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go sub.Start(ctx)
+
+	first.SendTweet(fakeTweet("1", "1", "before disconnect"), fakeAuthor)
+	waitFor(t, func() bool { return len(def.recorded()) == 1 })
+	fake.FailNext("TweetSearchStream", errors.New("connection reset by peer"))
+	first.Disconnect()
+	waitFor(t, func() bool { return fake.CallCount("TweetSearchStream") == 3 })
+	if !first.Closed() {
+		t.Fatal("lost stream was not closed")
+	}
+	second.SendTweet(fakeTweet("2", "2", "after reconnect"), fakeAuthor)
+	waitFor(t, func() bool { return len(def.recorded()) == 2 })
+	if sub.State() != StateConnected {
+		t.Fatalf("state = %v, want connected", sub.State())
+	}
+
+	eventMutex.Lock()
+	defer eventMutex.Unlock()
+	backoffs := 0
+	for _, event := range events {
+		if event.State == StateBackoff {
+			backoffs++
+			if event.Kind != NetworkErrorKind {
+				t.Fatalf("backoff kind = %v, want network", event.Kind)
+			}
+		}
+	}
+	if backoffs != 1 {
+		t.Fatalf("got %v backoff events, want 1", backoffs)
+	}
+}
+
+func TestStartBackfill(t *testing.T) {
+	fake := twclient.NewFake()
+	resp, err := fake.TweetSearchStreamAddRule(context.Background(), []twitter.TweetSearchStreamRule{{Value: "#HugReply", Tag: "unrouted"}}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules := []twclient.MatchingRule{{ID: string(resp.Rules[0].ID), Tag: "unrouted"}}
+	fake.AddUser(fakeAuthor)
+	for _, id := range []string{"1001", "1002", "1003"} {
+		fake.AddTweet(fakeTweet(id, "1000", "#HugReply "+id))
+		fake.AddSearchResult("#HugReply", id)
+	}
+	first, second := twclient.NewFakeStream(), twclient.NewFakeStream()
+	fake.QueueStream(first)
+	fake.QueueStream(second)
+	def := &recordingHandler{}
+	//one conversation so the worker pool keeps the order
+	sub := newSubscriber(nil, fake)
+	sub.defaultHandler = def.handle
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go sub.Start(ctx)
+
+	first.SendMatching(fakeTweet("1001", "1000", "#HugReply 1001"), rules, fakeAuthor)
+	waitFor(t, func() bool { return len(def.recorded()) == 1 })
+	first.Disconnect()
+	waitFor(t, func() bool { return len(def.recorded()) == 3 })
+	//1003 was already backfilled and must not be handled again
+	second.SendMatching(fakeTweet("1003", "1000", "#HugReply 1003"), rules, fakeAuthor)
+	second.SendMatching(fakeTweet("1004", "1000", "#HugReply 1004"), rules, fakeAuthor)
+	waitFor(t, func() bool { return len(def.recorded()) >= 4 })
+
+	got := def.recorded()
+	want := []string{"1001", "1002", "1003", "1004"}
+	if len(got) != len(want) {
+		t.Fatalf("handled %+v, want %v", got, want)
+	}
+	for i, id := range want {
+		if got[i].id != id {
+			t.Fatalf("handled %+v, want %v", got, want)
+		}
+	}
+	waitFor(t, func() bool {
+		last, _ := sub.checkpoints.get(rules[0].ID)
+		return last == "1004"
+	})
+}
+
+func TestSeenTweets(t *testing.T) {
+	seen := newSeenTweets(2)
+	for _, id := range []string{"1", "2", "3"} {
+		if seen.markSeen(id) {
+			t.Fatalf("%v reported as seen", id)
+		}
+	}
+	if !seen.markSeen("3") {
+		t.Fatal("3 not reported as seen")
+	}
+	if seen.markSeen("1") {
+		t.Fatal("1 should have left the window")
+	}
+	if !tweetIdAfter("1000", "999") || tweetIdAfter("999", "1000") {
+		t.Fatal("tweetIdAfter compares snowflakes by value")
+	}
+}
+
+func TestBackoffPolicyDelay(t *testing.T) {
+	policy := DefaultBackoffPolicy
+	policy.Jitter = 0
+	if d := policy.Delay(NetworkErrorKind, 3, errors.New("reset")); d != time.Millisecond*750 {
+		t.Fatalf("network delay = %v", d)
+	}
+	if d := policy.Delay(NetworkErrorKind, 1000, errors.New("reset")); d != policy.NetworkMax {
+		t.Fatalf("network delay must cap at %v, got %v", policy.NetworkMax, d)
+	}
+	httpErr := &twitter.ErrorResponse{StatusCode: http.StatusServiceUnavailable}
+	if kind := classifyError(httpErr); kind != HTTPErrorKind {
+		t.Fatalf("kind = %v, want http", kind)
+	}
+	if d := policy.Delay(HTTPErrorKind, 3, httpErr); d != time.Second*20 {
+		t.Fatalf("http delay = %v", d)
+	}
+	if d := policy.Delay(HTTPErrorKind, 100, httpErr); d != policy.HTTPMax {
+		t.Fatalf("http delay must cap at %v, got %v", policy.HTTPMax, d)
+	}
+	reset := time.Now().Add(time.Minute * 10)
+	limited := &twitter.ErrorResponse{
+		StatusCode: http.StatusTooManyRequests,
+		RateLimit:  &twitter.RateLimit{Limit: 50, Remaining: 0, Reset: twitter.Epoch(reset.Unix())},
+	}
+	if kind := classifyError(limited); kind != RateLimitErrorKind {
+		t.Fatalf("kind = %v, want ratelimit", kind)
+	}
+	if d := policy.Delay(RateLimitErrorKind, 1, limited); d < time.Minute*9 {
+		t.Fatalf("429 delay %v must wait for the rate limit reset", d)
+	}
+
+	policy.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		d := policy.Delay(HTTPErrorKind, 1, httpErr)
+		if d < time.Millisecond*2500 || d > time.Millisecond*7500 {
+			t.Fatalf("jittered delay %v out of range", d)
+		}
+	}
+}
+
+func TestStartFakeServer(t *testing.T) {
+	ts := faketwitter.NewTestServer(&faketwitter.Fixture{
+		Users: []*twitter.UserObj{fakeAuthor},
+		Tweets: []*twitter.TweetObj{
+			fakeTweet("1001", "1000", "a good day @ninox2022 #thought"),
+		},
+		Stream: []faketwitter.StreamEvent{{TweetId: "1001"}},
+	})
+	ts.Heartbeat = 50 * time.Millisecond
+	defer ts.Close()
+
+	def := &recordingHandler{}
+	sub := newSubscriber(nil, ts.Client())
+	sub.defaultHandler = def.handle
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- sub.Start(ctx)
+	}()
+	waitFor(t, func() bool { return len(def.recorded()) == 1 })
+	if got := def.recorded()[0]; got.id != "1001" || got.authorName != "ninox2022" {
+		t.Fatalf("unexpected tweet %+v", got)
+	}
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Fatalf("Start returned %v, want context.Canceled", err)
+	}
+}
+
+type memConversationStore struct {
+	mutex sync.Mutex
+	convs map[string]string
+}
+
+func (m *memConversationStore) GetConversationList() ([]common.ConversationInfo, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	convList := make([]common.ConversationInfo, 0)
+	for conv, name := range m.convs {
+		convList = append(convList, common.ConversationInfo{ConversationId: conv, HandlerName: name})
+	}
+	return convList, nil
+}
+
+func (m *memConversationStore) PutConversation(conversationId string, handlerName string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.convs[conversationId] = handlerName
+	return nil
+}
+
+func (m *memConversationStore) DeleteConversation(conversationId string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	delete(m.convs, conversationId)
+	return nil
+}
+
+func TestConversationRegistryPersist(t *testing.T) {
+	store := &memConversationStore{convs: make(map[string]string)}
+	registry := newConversationRegistry(store)
+	if err := registry.put("10", "missing"); !errors.Is(err, UnknownHandlerError) {
+		t.Fatalf("expected UnknownHandlerError, got %v", err)
+	}
+	if err := registry.put("10", DefaultHandlerName); err != nil {
+		t.Fatal(err)
+	}
+	if err := registry.put("20", DefaultHandlerName); err != nil {
+		t.Fatal(err)
+	}
+	if err := registry.remove("20"); err != nil {
+		t.Fatal(err)
+	}
+	if err := registry.remove("20"); err != ConversationNotFoundError {
+		t.Fatalf("expected ConversationNotFoundError, got %v", err)
+	}
+
+	//a restarted subscriber reloads what was registered at runtime
+	reloaded := newConversationRegistry(store)
+	if err := reloaded.load(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := reloaded.get("10"); !ok {
+		t.Fatal("conversation 10 not reloaded")
+	}
+	if _, ok := reloaded.get("20"); ok {
+		t.Fatal("removed conversation 20 reloaded")
+	}
+
+	//a conversation of a handler registered after load waits for it instead of being dropped
+	reloaded.registerHandler("late", DefaultHandler)
+	if err := reloaded.put("30", "late"); err != nil {
+		t.Fatal(err)
+	}
+	restarted := newConversationRegistry(store)
+	if err := restarted.load(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := restarted.get("30"); ok || len(restarted.list()) != 2 {
+		t.Fatalf("conversation 30 resolved before its handler, list %+v", restarted.list())
+	}
+	restarted.registerHandler("late", DefaultHandler)
+	if conv, ok := restarted.get("30"); !ok || conv.info.HandlerName != "late" {
+		t.Fatalf("conversation 30 not resolved, got %+v", conv)
+	}
+	if _, ok := store.convs["30"]; !ok {
+		t.Fatal("deferred conversation deleted from the store")
+	}
+}
+
+func TestConversationRegistryConcurrent(t *testing.T) {
+	sub := newSubscriber(nil, twclient.NewFake())
+	sub.RegisterHandler("recording", (&recordingHandler{}).handle)
+	fs := twclient.NewFakeStream()
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 200; i++ {
+			conv := fmt.Sprint(i % 10)
+			sub.AddConversation(conv, "recording")
+			sub.RemoveConversation(conv)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 200; i++ {
+			fs.SendTweet(fakeTweet(fmt.Sprint(i), fmt.Sprint(i%10), "concurrent"), fakeAuthor)
+			sub.handleTweetMessage(context.Background(), <-fs.Tweets())
+		}
+	}()
+	wg.Wait()
+}
+
+// memThoughtStore keeps the last thought per tweet as the db upsert does
+type memThoughtStore struct {
+	mutex    sync.Mutex
+	thoughts map[string][]string
+	puts     int
+	//unregistered author ids have no linked address
+	unregistered map[string]bool
+}
+
+func (m *memThoughtStore) PutThought(tweetId, authorId, authorName, content, sourceUrl, tips string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.unregistered[authorId] {
+		return fmt.Errorf("%w: %v", db.UserNotRegisteredError, authorName)
+	}
+	m.puts++
+	m.thoughts[tweetId] = []string{authorId, content, sourceUrl, tips}
+	return nil
+}
+
+func TestThoughtRedelivery(t *testing.T) {
+	store := &memThoughtStore{thoughts: make(map[string][]string)}
+	sub := newSubscriber(nil, twclient.NewFake())
+	sub.thoughts = store
+	msg := &twclient.TweetMessage{
+		Raw: &twitter.TweetRaw{
+			Tweets:   []*twitter.TweetObj{fakeTweet("1", "1", "a good day #thought")},
+			Includes: &twitter.TweetRawIncludes{Users: []*twitter.UserObj{fakeAuthor}},
+		},
+		MatchingRules: []twclient.MatchingRule{{ID: "9", Tag: "thought"}},
+	}
+	//a backfill or replay hands the same tweet over again
+	for i := 0; i < 2; i++ {
+		if err := sub.handleTweetMessage(context.Background(), msg); err != nil {
 			t.Fatal(err)
 		}
 	}
+	if store.puts != 2 || len(store.thoughts) != 1 {
+		t.Fatalf("got %v puts for %v tweets, want 2 for 1", store.puts, len(store.thoughts))
+	}
+	if got := store.thoughts["1"]; got[0] != fakeAuthor.ID || got[2] != "https://twitter.com/ninox2022/status/1" {
+		t.Fatalf("unexpected thought %v", got)
+	}
+}
+
+type memUserStore struct {
+	mutex sync.Mutex
+	names [][2]string
+}
+
+func (m *memUserStore) PutTwitterUsername(authorId string, username string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.names = append(m.names, [2]string{authorId, username})
+	return nil
+}
+
+func TestUserRename(t *testing.T) {
+	fake := twclient.NewFake()
+	fake.AddUser(fakeAuthor)
+	fake.AddTweet(fakeTweet("10", "10", "root"))
+	users := &memUserStore{}
+	thoughts := &memThoughtStore{thoughts: make(map[string][]string)}
+	sub := newSubscriber(nil, fake)
+	sub.thoughts = thoughts
+	sub.users.store = users
+	renamed := &twitter.UserObj{ID: fakeAuthor.ID, UserName: "ninox_renamed"}
+	fs := twclient.NewFakeStream()
+	rules := []twclient.MatchingRule{{ID: "9", Tag: "thought"}}
+	fs.SendMatching(fakeTweet("11", "10", "#thought before"), rules, fakeAuthor)
+	fs.SendMatching(fakeTweet("12", "10", "#thought again"), rules, fakeAuthor)
+	fs.SendMatching(fakeTweet("13", "10", "#thought after"), rules, renamed)
+	for i := 0; i < 3; i++ {
+		if err := sub.handleTweetMessage(context.Background(), <-fs.Tweets()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if fmt.Sprint(users.names) != "[[100 ninox2022] [100 ninox_renamed]]" {
+		t.Fatalf("username writes %v", users.names)
+	}
+	//the thoughts of both names belong to the same author, the cached root takes the new name
+	want := map[string]string{"11": "https://twitter.com/ninox2022/status/10", "13": "https://twitter.com/ninox_renamed/status/10"}
+	for id, url := range want {
+		if got := thoughts.thoughts[id]; got[0] != fakeAuthor.ID || got[2] != url {
+			t.Fatalf("thought %v = %v", id, got)
+		}
+	}
+	if fake.CallCount("TweetLookup") != 1 {
+		t.Fatalf("root looked up %v times, want 1", fake.CallCount("TweetLookup"))
+	}
+}
+
+func TestBackfillSearchError(t *testing.T) {
+	fake := twclient.NewFake()
+	resp, err := fake.TweetSearchStreamAddRule(context.Background(), []twitter.TweetSearchStreamRule{{Value: "#HugReply", Tag: "unrouted"}}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ruleId := string(resp.Rules[0].ID)
+	fake.AddUser(fakeAuthor)
+	for _, id := range []string{"1001", "1002", "1003"} {
+		fake.AddTweet(fakeTweet(id, "1000", "#HugReply "+id))
+		fake.AddSearchResult("#HugReply", id)
+	}
+	def := &recordingHandler{}
+	sub := newSubscriber(nil, fake)
+	sub.defaultHandler = def.handle
+	sub.checkpoints.last[ruleId] = "1000"
+	pageSize := BackfillPageSize
+	BackfillPageSize = 2
+	defer func() { BackfillPageSize = pageSize }()
+	//the first page of the newest tweets arrives, the older page fails
+	fake.FailNext("TweetRecentSearch", nil)
+	fake.FailNext("TweetRecentSearch", &twitter.ErrorResponse{StatusCode: 503})
+	sub.backfill(context.Background())
+	if got := def.recorded(); len(got) != 0 {
+		t.Fatalf("partial backfill handled %+v", got)
+	}
+	if last, _ := sub.checkpoints.get(ruleId); last != "1000" {
+		t.Fatalf("checkpoint moved to %v", last)
+	}
+	sub.backfill(context.Background())
+	if got := def.recorded(); len(got) != 3 || got[0].id != "1001" {
+		t.Fatalf("backfill handled %+v", got)
+	}
+	if last, _ := sub.checkpoints.get(ruleId); last != "1003" {
+		t.Fatalf("checkpoint at %v, want 1003", last)
+	}
+}
+
+func TestBackfillSharedTweetCheckpoints(t *testing.T) {
+	fake := twclient.NewFake()
+	resp, err := fake.TweetSearchStreamAddRule(context.Background(), []twitter.TweetSearchStreamRule{
+		{Value: "#HugReply", Tag: "unrouted"},
+		{Value: "#HugAlso", Tag: "unrouted"},
+	}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake.AddUser(fakeAuthor)
+	for _, id := range []string{"1001", "1002"} {
+		fake.AddTweet(fakeTweet(id, "1000", "#HugReply #HugAlso "+id))
+		fake.AddSearchResult("#HugReply", id)
+		fake.AddSearchResult("#HugAlso", id)
+	}
+	def := &recordingHandler{}
+	sub := newSubscriber(nil, fake)
+	sub.defaultHandler = def.handle
+	for _, rule := range resp.Rules {
+		sub.checkpoints.last[string(rule.ID)] = "1000"
+	}
+	sub.backfill(context.Background())
+	if got := def.recorded(); len(got) != 2 {
+		t.Fatalf("backfill handled %+v", got)
+	}
+	//the second rule found only tweets the first already handled, it must not fetch them again
+	for _, rule := range resp.Rules {
+		if last, _ := sub.checkpoints.get(string(rule.ID)); last != "1002" {
+			t.Fatalf("checkpoint of %v at %v, want 1002", rule.Value, last)
+		}
+	}
 }
@@ -0,0 +1,149 @@
+package stream
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+const (
+	linkPlaceholder = "[link]"
+	ellipsis        = "…"
+)
+
+var tcoLink = regexp.MustCompile(`^https?://t\.co/\S+$`)
+
+// Summarizer turns the text of a thought tweet into its tips
+type Summarizer interface {
+	Summarize(text string) string
+}
+
+// TipsSummarizer drops the trigger words, collapses t.co links and truncates on a word boundary
+// to MaxLen characters as a reader counts them, so CJK and emoji are not cut apart
+type TipsSummarizer struct {
+	//Triggers are removed wherever they appear, case insensitive
+	Triggers []string
+	//MaxLen in grapheme clusters with the ellipsis, 0 uses MAX_TIPS_LEN
+	MaxLen int
+}
+
+// NewTipsSummarizer strips the words of the EventFilter rule
+func NewTipsSummarizer() *TipsSummarizer {
+	return &TipsSummarizer{Triggers: strings.Fields(EventFilter)}
+}
+
+func (t *TipsSummarizer) Summarize(text string) string {
+	maxLen := t.MaxLen
+	if maxLen <= 0 {
+		maxLen = MAX_TIPS_LEN
+	}
+	var words []string
+	for _, word := range strings.Fields(text) {
+		if t.isTrigger(word) {
+			continue
+		}
+		if tcoLink.MatchString(word) {
+			if len(words) > 0 && words[len(words)-1] == linkPlaceholder {
+				continue
+			}
+			word = linkPlaceholder
+		}
+		words = append(words, word)
+	}
+	return truncateGraphemes(strings.Join(words, " "), maxLen)
+}
+
+func (t *TipsSummarizer) isTrigger(word string) bool {
+	//"#thought," and "@ninox2022:" are still triggers
+	trimmed := strings.TrimRightFunc(word, unicode.IsPunct)
+	for _, trigger := range t.Triggers {
+		if strings.EqualFold(word, trigger) || strings.EqualFold(trimmed, trigger) {
+			return true
+		}
+	}
+	return false
+}
+
+// truncateGraphemes cuts text to at most maxLen grapheme clusters ending in an ellipsis. It cuts
+// at the last space if that keeps at least half of the text, text without spaces such as CJK is
+// cut between clusters
+func truncateGraphemes(text string, maxLen int) string {
+	clusters := graphemes(text)
+	if len(clusters) <= maxLen {
+		return text
+	}
+	if maxLen <= 1 {
+		return strings.Join(clusters[:maxLen], "")
+	}
+	keep := maxLen - 1
+	for i := keep; i >= keep/2 && i > 0; i-- {
+		if clusters[i] == " " {
+			keep = i
+			break
+		}
+	}
+	return strings.TrimRightFunc(strings.Join(clusters[:keep], ""), unicode.IsSpace) + ellipsis
+}
+
+// graphemes splits text into user perceived characters: a base with its combining marks, variation
+// selectors and skin tones, emoji joined by ZWJ, flag pairs and tag sequences. It is an approximation
+// of UAX #29 good enough for counting and never splits inside a sequence
+func graphemes(text string) []string {
+	var clusters []string
+	start := 0
+	var prev rune
+	regional := 0
+	for i, r := range text {
+		if i > start && !extendsCluster(prev, r, regional) {
+			clusters = append(clusters, text[start:i])
+			start = i
+			regional = 0
+		}
+		if isRegionalIndicator(r) {
+			regional++
+		}
+		prev = r
+	}
+	if start < len(text) {
+		clusters = append(clusters, text[start:])
+	}
+	return clusters
+}
+
+func extendsCluster(prev rune, r rune, regional int) bool {
+	switch {
+	case prev == '\r' && r == '\n':
+		return true
+	case prev == '\u200d', r == '\u200d':
+		//zero width joiner glues the next emoji on
+		return true
+	case unicode.In(r, unicode.Mn, unicode.Me, unicode.Mc):
+		return true
+	case r >= 0xfe00 && r <= 0xfe0f, r >= 0xe0100 && r <= 0xe01ef:
+		//variation selectors
+		return true
+	case r >= 0x1f3fb && r <= 0x1f3ff:
+		//skin tone modifiers
+		return true
+	case r >= 0xe0020 && r <= 0xe007f:
+		//tag sequences of subdivision flags
+		return true
+	case isRegionalIndicator(prev) && isRegionalIndicator(r):
+		//flags are pairs of regional indicators
+		return regional%2 == 1
+	case isHangulJamo(prev, r):
+		return true
+	}
+	return false
+}
+
+func isRegionalIndicator(r rune) bool {
+	return r >= 0x1f1e6 && r <= 0x1f1ff
+}
+
+// isHangulJamo keeps conjoining jamo, which decomposed Korean syllables are written in, together
+func isHangulJamo(prev rune, r rune) bool {
+	leading := prev >= 0x1100 && prev <= 0x115f
+	vowel := prev >= 0x1160 && prev <= 0x11a7
+	return (leading && r >= 0x1100 && r <= 0x11a7) || (vowel && r >= 0x1160 && r <= 0x11ff)
+}
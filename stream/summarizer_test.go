@@ -0,0 +1,64 @@
+package stream
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+)
+
+type tipsCase struct {
+	Name string `json:"name"`
+	Max  int    `json:"max"`
+	Text string `json:"text"`
+	Want string `json:"want"`
+}
+
+func TestTipsSummarizer(t *testing.T) {
+	b, err := os.ReadFile("testdata/tips.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cases []tipsCase
+	if err := json.Unmarshal(b, &cases); err != nil {
+		t.Fatal(err)
+	}
+	summarizer := NewTipsSummarizer()
+	for _, c := range cases {
+		summarizer.MaxLen = c.Max
+		got := summarizer.Summarize(c.Text)
+		if got != c.Want {
+			t.Errorf("%v: got %q, want %q", c.Name, got, c.Want)
+		}
+		if n := len(graphemes(got)); n > c.Max {
+			t.Errorf("%v: %v characters over %v", c.Name, n, c.Max)
+		}
+	}
+}
+
+func TestTipsSummarizerMaxTipsLen(t *testing.T) {
+	defer func(maxLen int) { MAX_TIPS_LEN = maxLen }(MAX_TIPS_LEN)
+	MAX_TIPS_LEN = 8
+	if got := NewTipsSummarizer().Summarize("#thought 一二三四五六七八九十"); got != "一二三四五六七…" {
+		t.Fatalf("got %q", got)
+	}
+}
+
+func TestGraphemes(t *testing.T) {
+	cases := map[string]int{
+		"":                         0,
+		"abc":                      3,
+		"e\u0301":                  1,
+		"👍🏽":                       1,
+		"🇯🇵🇺🇸":                     2,
+		"🇯🇵🇺":                      2,
+		"👩‍💻 ok":                   4,
+		"한국":                       2,
+		"\u1100\u1161\u11a8\u1100": 2,
+		"\r\n":                     1,
+	}
+	for text, want := range cases {
+		if got := len(graphemes(text)); got != want {
+			t.Errorf("%q: got %v clusters, want %v", text, got, want)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package stream
+
+import (
+	"context"
+	"github.com/ethereum/go-ethereum/metrics"
+	"github.com/g8rswimmer/go-twitter/v2"
+	"sort"
+	"strings"
+	"time"
+	"twitter_oracle/log"
+)
+
+type SystemEventType string
+
+const (
+	OperationalDisconnectEvent SystemEventType = "operational_disconnect"
+	TooManyConnectionsEvent    SystemEventType = "too_many_connections"
+	RuleChangeEvent            SystemEventType = "rule_change"
+	//NoticeEvent is any other system message, handled by its level only
+	NoticeEvent SystemEventType = "notice"
+)
+
+var (
+	stallCounter = metrics.NewRegisteredCounter("stream/watchdog/stalls", nil)
+	//RuleResyncTimeout bounds the rule sync a rule change triggers, the stream is not read meanwhile
+	RuleResyncTimeout = time.Second * 30
+)
+
+// SystemMessageCodes maps the type or code a system message starts with, as in
+// "operational-disconnect (UpstreamOperationalDisconnect): ...", to the event it is. Anything
+// else is a NoticeEvent whatever its text says
+var SystemMessageCodes = map[string]SystemEventType{
+	"operational-disconnect":        OperationalDisconnectEvent,
+	"UpstreamOperationalDisconnect": OperationalDisconnectEvent,
+	"ConnectionException":           TooManyConnectionsEvent,
+	"TooManyConnections":            TooManyConnectionsEvent,
+	"rules-updated":                 RuleChangeEvent,
+	"RulesUpdated":                  RuleChangeEvent,
+}
+
+// SystemEvent is a system message of the stream classified by what it asks of the subscriber
+type SystemEvent struct {
+	Type    SystemEventType
+	Level   twitter.SystemMessageType
+	Message string
+	Sent    time.Time
+}
+
+// ParseSystemMessage classifies every message of a system line, errors first
+func ParseSystemMessage(msg map[twitter.SystemMessageType]twitter.SystemMessage) []SystemEvent {
+	var events []SystemEvent
+	for level, message := range msg {
+		events = append(events, SystemEvent{
+			Type:    classifySystemMessage(message.Message),
+			Level:   level,
+			Message: message.Message,
+			Sent:    message.Sent,
+		})
+	}
+	sort.Slice(events, func(i, j int) bool {
+		return levelOrder(events[i].Level) < levelOrder(events[j].Level)
+	})
+	return events
+}
+
+func levelOrder(level twitter.SystemMessageType) int {
+	switch level {
+	case twitter.ErrorMessageType:
+		return 0
+	case twitter.WarnMessageType:
+		return 1
+	case twitter.InfoMessageType:
+		return 2
+	}
+	return 3
+}
+
+// classifySystemMessage looks up the code in parentheses first, then the type before it
+func classifySystemMessage(message string) SystemEventType {
+	prefix, _, found := strings.Cut(message, ":")
+	if !found {
+		return NoticeEvent
+	}
+	fields := strings.Fields(prefix)
+	for i := len(fields) - 1; i >= 0; i-- {
+		code := strings.TrimSuffix(strings.TrimPrefix(fields[i], "("), ")")
+		if t, ok := SystemMessageCodes[code]; ok {
+			return t
+		}
+	}
+	return NoticeEvent
+}
+
+// reconnectCause is the error a system event reports when the stream has to be reopened, nil if it does not
+func (e SystemEvent) reconnectCause() error {
+	switch e.Type {
+	case OperationalDisconnectEvent:
+		return OperationalDisconnectError
+	case TooManyConnectionsEvent:
+		return TooManyConnectionsError
+	}
+	return nil
+}
+
+func (e SystemEvent) log() {
+	metrics.GetOrRegisterCounter("stream/system/"+string(e.Type), nil).Inc(1)
+	switch {
+	case e.Type == RuleChangeEvent:
+		//rules changed outside sync-rules, resyncRules puts the manifest back
+		log.Warn("stream rules changed", e.Message, "sent", e.Sent)
+	case e.Type != NoticeEvent, e.Level == twitter.ErrorMessageType:
+		log.Error("stream system", e.Type, e.Message, "sent", e.Sent)
+	case e.Level == twitter.WarnMessageType:
+		log.Warn("stream system", e.Message, "sent", e.Sent)
+	default:
+		log.Info("stream system", e.Message, "sent", e.Sent)
+	}
+}
+
+// handleSystemMessage logs and counts the events of msg and resyncs the rules when they changed,
+// it returns why the stream has to be reopened or nil to keep reading
+func (s *Subscriber) handleSystemMessage(ctx context.Context, msg map[twitter.SystemMessageType]twitter.SystemMessage) error {
+	var cause error
+	for _, event := range ParseSystemMessage(msg) {
+		event.log()
+		if event.Type == RuleChangeEvent {
+			s.resyncRules(ctx)
+		}
+		if c := event.reconnectCause(); c != nil && cause == nil {
+			cause = c
+		}
+	}
+	return cause
+}
+
+// resyncRules reconciles the live rules with RulesFile after they changed outside SyncRules, so
+// the tags the stream delivers match the routes again
+func (s *Subscriber) resyncRules(ctx context.Context) {
+	if s.RulesFile == "" {
+		log.Warn("stream rules changed without a rules manifest to resync, tag routes may not match")
+		return
+	}
+	syncCtx, cancel := context.WithTimeout(ctx, RuleResyncTimeout)
+	defer cancel()
+	report, err := s.SyncRulesFile(syncCtx, s.RulesFile, false)
+	if err != nil {
+		log.Error("stream rules resync error", err, "manifest", s.RulesFile)
+		return
+	}
+	log.Info("stream rules resynced", "added", len(report.Added), "deleted", len(report.Deleted))
+}
+
+// stalled reports whether the stream was silent, heartbeats included, for longer than KeepAlive
+func (s *Subscriber) stalled() bool {
+	return s.KeepAlive > 0 && time.Since(s.stream.LastActivity()) > s.KeepAlive
+}
+
+// watchdogInterval is how often Start checks the connection, often enough to notice a stall
+// within a fraction of KeepAlive
+func (s *Subscriber) watchdogInterval() time.Duration {
+	interval := time.Second
+	if s.KeepAlive > 0 && s.KeepAlive/4 < interval {
+		interval = s.KeepAlive / 4
+	}
+	return interval
+}
@@ -0,0 +1,133 @@
+package stream
+
+import (
+	"context"
+	"errors"
+	"github.com/g8rswimmer/go-twitter/v2"
+	"sync"
+	"testing"
+	"time"
+	"twitter_oracle/twclient"
+)
+
+func TestParseSystemMessage(t *testing.T) {
+	cases := []struct {
+		level   twitter.SystemMessageType
+		message string
+		want    SystemEventType
+	}{
+		{twitter.ErrorMessageType, "operational-disconnect (UpstreamOperationalDisconnect): This stream has been disconnected upstream for operational reasons.", OperationalDisconnectEvent},
+		{twitter.ErrorMessageType, "ConnectionException: This stream is currently at the maximum allowed connection limit.", TooManyConnectionsEvent},
+		{twitter.InfoMessageType, "rules-updated (RulesUpdated): Rules were updated for this stream.", RuleChangeEvent},
+		{twitter.WarnMessageType, "Stream slowing down", NoticeEvent},
+		//only the type and code count, not what the text mentions
+		{twitter.InfoMessageType, "Tip: review your rules and reduce operational disconnect risk", NoticeEvent},
+		{twitter.InfoMessageType, "Rules were updated for this stream", NoticeEvent},
+	}
+	for _, c := range cases {
+		events := ParseSystemMessage(map[twitter.SystemMessageType]twitter.SystemMessage{c.level: {Message: c.message}})
+		if len(events) != 1 || events[0].Type != c.want || events[0].Level != c.level {
+			t.Fatalf("%q parsed to %+v, want %v", c.message, events, c.want)
+		}
+	}
+	events := ParseSystemMessage(map[twitter.SystemMessageType]twitter.SystemMessage{
+		twitter.InfoMessageType:  {Message: "hello"},
+		twitter.ErrorMessageType: {Message: "operational-disconnect (UpstreamOperationalDisconnect): gone"},
+	})
+	if len(events) != 2 || events[0].Type != OperationalDisconnectEvent {
+		t.Fatalf("errors must come first, got %+v", events)
+	}
+}
+
+// startReconnecting starts sub on first and returns the disconnect causes it reports
+func startReconnecting(t *testing.T, sub *Subscriber) func() []error {
+	var mutex sync.Mutex
+	var causes []error
+	sub.OnConnectionEvent(func(event ConnectionEvent) {
+		if event.State != StateDisconnected {
+			return
+		}
+		mutex.Lock()
+		defer mutex.Unlock()
+		causes = append(causes, event.Err)
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go sub.Start(ctx)
+	return func() []error {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return append([]error{}, causes...)
+	}
+}
+
+func TestStartWatchdogStall(t *testing.T) {
+	fake := twclient.NewFake()
+	first, second := twclient.NewFakeStream(), twclient.NewFakeStream()
+	fake.QueueStream(first)
+	fake.QueueStream(second)
+	sub := newSubscriber(nil, fake)
+	sub.KeepAlive = time.Millisecond * 100
+	def := &recordingHandler{}
+	sub.defaultHandler = def.handle
+	causes := startReconnecting(t, sub)
+
+	//heartbeats keep a quiet stream open
+	for i := 0; i < 6; i++ {
+		time.Sleep(time.Millisecond * 40)
+		first.Heartbeat()
+	}
+	if first.Closed() {
+		t.Fatal("stream with heartbeats reopened")
+	}
+	waitFor(t, func() bool { return first.Closed() && fake.CallCount("TweetSearchStream") == 2 })
+	if got := causes(); len(got) != 1 || !errors.Is(got[0], StreamStalledError) {
+		t.Fatalf("disconnect causes %v, want stall", got)
+	}
+	second.SendTweet(fakeTweet("1", "1", "after stall"), fakeAuthor)
+	waitFor(t, func() bool { return len(def.recorded()) == 1 })
+}
+
+func TestRuleChangeResyncs(t *testing.T) {
+	fake := twclient.NewFake()
+	live := twclient.NewFakeStream()
+	fake.QueueStream(live)
+	sub := newSubscriber(nil, fake)
+	sub.RulesFile = "testdata/rules.json"
+	startReconnecting(t, sub)
+	waitFor(t, func() bool { return fake.CallCount("TweetSearchStream") == 1 })
+	//someone deleted the rules outside sync-rules
+	live.SendSystem(twitter.InfoMessageType, "rules-updated (RulesUpdated): Rules were updated for this stream.")
+	waitFor(t, func() bool { return len(fake.Rules()) == 3 })
+	if tags := liveRuleTags(fake); tags["#HugThought"] != "thought" {
+		t.Fatalf("live rules after resync %v", tags)
+	}
+}
+
+func TestStartSystemMessageReconnect(t *testing.T) {
+	fake := twclient.NewFake()
+	streams := []*twclient.FakeStream{twclient.NewFakeStream(), twclient.NewFakeStream(), twclient.NewFakeStream()}
+	for _, fs := range streams {
+		fake.QueueStream(fs)
+	}
+	sub := newSubscriber(nil, fake)
+	sub.Backoff.RateLimitInitial = time.Millisecond * 200
+	sub.Backoff.Jitter = 0
+	causes := startReconnecting(t, sub)
+
+	streams[0].SendSystem(twitter.InfoMessageType, "Rules were updated for this stream")
+	streams[0].SendSystem(twitter.ErrorMessageType, "operational-disconnect: This stream has been disconnected upstream for operational reasons.")
+	waitFor(t, func() bool { return fake.CallCount("TweetSearchStream") == 2 })
+
+	streams[1].SendSystem(twitter.ErrorMessageType, "ConnectionException: This stream is currently at the maximum allowed connection limit.")
+	waitFor(t, func() bool { return streams[1].Closed() })
+	disconnected := time.Now()
+	waitFor(t, func() bool { return fake.CallCount("TweetSearchStream") == 3 })
+	if waited := time.Since(disconnected); waited < time.Millisecond*100 {
+		t.Fatalf("reconnected after %v over the connection limit", waited)
+	}
+	got := causes()
+	if len(got) != 2 || !errors.Is(got[0], OperationalDisconnectError) || !errors.Is(got[1], TooManyConnectionsError) {
+		t.Fatalf("disconnect causes %v", got)
+	}
+}
@@ -0,0 +1,74 @@
+package stream
+
+import (
+	"github.com/ethereum/go-ethereum/metrics"
+	"github.com/g8rswimmer/go-twitter/v2"
+	"sync"
+	"twitter_oracle/log"
+)
+
+// KnownUsersSize bounds how many author ids keep their last seen username in memory
+var KnownUsersSize = 100000
+
+var renameCounter = metrics.NewRegisteredCounter("stream/users/renamed", nil)
+
+// UserStore keeps the username history of twitter users, implemented by db.DBService
+type UserStore interface {
+	PutTwitterUsername(authorId string, username string) error
+}
+
+// userTracker records the usernames authors appear under in the stream, the store is only
+// written when an author is new to this process or was renamed
+type userTracker struct {
+	store UserStore
+	size  int
+	mutex sync.Mutex
+	known map[string]string
+}
+
+func newUserTracker(store UserStore, size int) *userTracker {
+	return &userTracker{
+		store: store,
+		size:  size,
+		known: make(map[string]string),
+	}
+}
+
+func (u *userTracker) observe(users []*twitter.UserObj) {
+	for _, user := range users {
+		if user == nil || user.ID == "" || user.UserName == "" {
+			continue
+		}
+		u.mutex.Lock()
+		last, ok := u.known[user.ID]
+		u.mutex.Unlock()
+		if ok && last == user.UserName {
+			continue
+		}
+		if u.store != nil {
+			if err := u.store.PutTwitterUsername(user.ID, user.UserName); err != nil {
+				log.Warn("put twitter username error", err, "authorId", user.ID, "username", user.UserName)
+				continue
+			}
+		}
+		if ok {
+			renameCounter.Inc(1)
+			log.Info("twitter user renamed", last, "to", user.UserName, "authorId", user.ID)
+		}
+		u.mutex.Lock()
+		if len(u.known) >= u.size {
+			//forgetting only costs another write for the next tweet of each author
+			u.known = make(map[string]string)
+		}
+		u.known[user.ID] = user.UserName
+		u.mutex.Unlock()
+	}
+}
+
+// username is the last name authorId was seen under in the stream
+func (u *userTracker) username(authorId string) (string, bool) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	name, ok := u.known[authorId]
+	return name, ok
+}
@@ -0,0 +1,172 @@
+package stream
+
+import (
+	"context"
+	"github.com/ethereum/go-ethereum/metrics"
+	"hash/fnv"
+	"sync"
+	"time"
+	"twitter_oracle/log"
+	"twitter_oracle/twclient"
+)
+
+var (
+	queuedGauge         = metrics.NewRegisteredGauge("stream/workers/queued", nil)
+	backpressureCounter = metrics.NewRegisteredCounter("stream/workers/backpressure", nil)
+	blockedTimer        = metrics.NewRegisteredTimer("stream/workers/blocked", nil)
+)
+
+// WorkerPoolConfig sizes the pool handling tweets off the stream reader
+type WorkerPoolConfig struct {
+	Workers int
+	//QueueSize is how many messages each worker buffers before the stream reader blocks
+	QueueSize int
+}
+
+var DefaultWorkerPoolConfig = WorkerPoolConfig{
+	Workers:   4,
+	QueueSize: 64,
+}
+
+type work struct {
+	seq uint64
+	msg *twclient.TweetMessage
+}
+
+// workerPool handles messages on a fixed set of workers. A conversation always goes to the same
+// worker so its tweets are handled in order, and a full queue blocks submit instead of dropping.
+// done is called for every message in submission order once it and all before it are handled,
+// so a checkpoint never moves past a tweet still in flight.
+type workerPool struct {
+	queues []chan work
+	wg     sync.WaitGroup
+	handle func(ctx context.Context, msg *twclient.TweetMessage)
+	done   func(msg *twclient.TweetMessage)
+
+	mutex     sync.Mutex
+	nextSeq   uint64
+	headSeq   uint64
+	completed map[uint64]*twclient.TweetMessage
+}
+
+func newWorkerPool(config WorkerPoolConfig, handle func(ctx context.Context, msg *twclient.TweetMessage), done func(msg *twclient.TweetMessage)) *workerPool {
+	if config.Workers < 1 {
+		config.Workers = 1
+	}
+	p := &workerPool{
+		queues:    make([]chan work, config.Workers),
+		handle:    handle,
+		done:      done,
+		completed: make(map[uint64]*twclient.TweetMessage),
+	}
+	for i := range p.queues {
+		p.queues[i] = make(chan work, config.QueueSize)
+	}
+	return p
+}
+
+func (p *workerPool) start(ctx context.Context) {
+	for _, queue := range p.queues {
+		p.wg.Add(1)
+		go func(queue chan work) {
+			defer p.wg.Done()
+			for w := range queue {
+				queuedGauge.Dec(1)
+				p.handle(ctx, w.msg)
+				p.complete(w)
+			}
+		}(queue)
+	}
+}
+
+// stop lets the workers drain what is queued and waits up to timeout for them, it reports whether
+// they finished. submit must not be called after
+func (p *workerPool) stop(timeout time.Duration) bool {
+	for _, queue := range p.queues {
+		close(queue)
+	}
+	drained := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(drained)
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-drained:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+func (p *workerPool) shard(msg *twclient.TweetMessage) chan work {
+	tweet := msg.Raw.Tweets[0]
+	key := tweet.ConversationID
+	if key == "" {
+		key = tweet.ID
+	}
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return p.queues[h.Sum32()%uint32(len(p.queues))]
+}
+
+func (p *workerPool) sequence(msg *twclient.TweetMessage) work {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	w := work{seq: p.nextSeq, msg: msg}
+	p.nextSeq++
+	return w
+}
+
+// skip passes msg to done in submission order without handling it
+func (p *workerPool) skip(msg *twclient.TweetMessage) {
+	p.complete(p.sequence(msg))
+}
+
+// submit queues msg, blocking while its worker's queue is full or until ctx is done
+func (p *workerPool) submit(ctx context.Context, msg *twclient.TweetMessage) error {
+	queue := p.shard(msg)
+	w := p.sequence(msg)
+
+	select {
+	case queue <- w:
+		queuedGauge.Inc(1)
+		return nil
+	default:
+	}
+	backpressureCounter.Inc(1)
+	log.Warn("tweet queue full, stream reading paused", "tweetId", msg.Raw.Tweets[0].ID)
+	start := time.Now()
+	select {
+	case queue <- w:
+		blockedTimer.UpdateSince(start)
+		queuedGauge.Inc(1)
+		return nil
+	case <-ctx.Done():
+		//never handled, keep later messages from waiting on it
+		p.complete(work{seq: w.seq})
+		return ctx.Err()
+	}
+}
+
+func (p *workerPool) complete(w work) {
+	p.mutex.Lock()
+	p.completed[w.seq] = w.msg
+	var ready []*twclient.TweetMessage
+	for {
+		msg, ok := p.completed[p.headSeq]
+		if !ok {
+			break
+		}
+		delete(p.completed, p.headSeq)
+		p.headSeq++
+		if msg != nil {
+			ready = append(ready, msg)
+		}
+	}
+	p.mutex.Unlock()
+	for _, msg := range ready {
+		p.done(msg)
+	}
+}
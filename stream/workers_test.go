@@ -0,0 +1,220 @@
+package stream
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+	"twitter_oracle/twclient"
+)
+
+func queuedMessage(id string, conversation string) *twclient.TweetMessage {
+	fs := twclient.NewFakeStream()
+	fs.SendTweet(fakeTweet(id, conversation, "text"), fakeAuthor)
+	return <-fs.Tweets()
+}
+
+func TestWorkerPoolOrdering(t *testing.T) {
+	var mutex sync.Mutex
+	handled := make(map[string][]string)
+	var done []string
+	pool := newWorkerPool(WorkerPoolConfig{Workers: 4, QueueSize: 8}, func(ctx context.Context, msg *twclient.TweetMessage) {
+		time.Sleep(time.Duration(rand.Intn(500)) * time.Microsecond)
+		tweet := msg.Raw.Tweets[0]
+		mutex.Lock()
+		defer mutex.Unlock()
+		handled[tweet.ConversationID] = append(handled[tweet.ConversationID], tweet.ID)
+	}, func(msg *twclient.TweetMessage) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		done = append(done, msg.Raw.Tweets[0].ID)
+	})
+	pool.start(context.Background())
+	var want []string
+	for i := 0; i < 200; i++ {
+		id := fmt.Sprintf("%04d", i)
+		want = append(want, id)
+		if err := pool.submit(context.Background(), queuedMessage(id, fmt.Sprint(i%7))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pool.stop(time.Second)
+
+	for conversation, ids := range handled {
+		for i := 1; i < len(ids); i++ {
+			if ids[i] < ids[i-1] {
+				t.Fatalf("conversation %v handled out of order %v", conversation, ids)
+			}
+		}
+	}
+	if fmt.Sprint(done) != fmt.Sprint(want) {
+		t.Fatalf("done out of submission order %v", done)
+	}
+}
+
+func TestWorkerPoolSkip(t *testing.T) {
+	release := make(chan struct{})
+	var mutex sync.Mutex
+	var done []string
+	pool := newWorkerPool(WorkerPoolConfig{Workers: 1, QueueSize: 4}, func(ctx context.Context, msg *twclient.TweetMessage) {
+		<-release
+	}, func(msg *twclient.TweetMessage) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		done = append(done, msg.Raw.Tweets[0].ID)
+	})
+	pool.start(context.Background())
+	if err := pool.submit(context.Background(), queuedMessage("1", "1")); err != nil {
+		t.Fatal(err)
+	}
+	//a skipped duplicate waits for what was submitted before it
+	pool.skip(queuedMessage("1", "1"))
+	mutex.Lock()
+	early := len(done)
+	mutex.Unlock()
+	if early != 0 {
+		t.Fatal("skipped message done before the one in flight")
+	}
+	close(release)
+	pool.stop(time.Second)
+	if fmt.Sprint(done) != "[1 1]" {
+		t.Fatalf("done %v", done)
+	}
+}
+
+func TestWorkerPoolBackpressure(t *testing.T) {
+	release := make(chan struct{})
+	pool := newWorkerPool(WorkerPoolConfig{Workers: 1, QueueSize: 1}, func(ctx context.Context, msg *twclient.TweetMessage) {
+		<-release
+	}, func(msg *twclient.TweetMessage) {})
+	pool.start(context.Background())
+
+	//the worker holds the first, the queue the second, the third has to wait
+	submitted := make(chan error, 3)
+	go func() {
+		for i := 0; i < 3; i++ {
+			submitted <- pool.submit(context.Background(), queuedMessage(fmt.Sprint(i), "1"))
+		}
+	}()
+	<-submitted
+	<-submitted
+	select {
+	case <-submitted:
+		t.Fatal("submit did not block on a full queue")
+	case <-time.After(time.Millisecond * 50):
+	}
+	close(release)
+	if err := <-submitted; err != nil {
+		t.Fatal(err)
+	}
+	pool.stop(time.Second)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	blocked := newWorkerPool(WorkerPoolConfig{Workers: 1}, func(ctx context.Context, msg *twclient.TweetMessage) {}, func(msg *twclient.TweetMessage) {})
+	cancel()
+	if err := blocked.submit(ctx, queuedMessage("1", "1")); err == nil {
+		t.Fatal("submit on a cancelled context should fail")
+	}
+}
+
+func TestStartDrainsOnCancel(t *testing.T) {
+	fake := twclient.NewFake()
+	fs := twclient.NewFakeStream()
+	fake.QueueStream(fs)
+	release := make(chan struct{})
+	var mutex sync.Mutex
+	var handled []string
+	var handlerErrs []error
+	sub := newSubscriber(nil, fake)
+	sub.Workers = WorkerPoolConfig{Workers: 1, QueueSize: 8}
+	sub.defaultHandler = func(ctx context.Context, event *TweetEvent) error {
+		<-release
+		mutex.Lock()
+		defer mutex.Unlock()
+		handled = append(handled, event.TweetId)
+		handlerErrs = append(handlerErrs, ctx.Err())
+		return nil
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- sub.Start(ctx)
+	}()
+	for i := 1; i <= 3; i++ {
+		fs.SendTweet(fakeTweet(fmt.Sprint(i), "1", "queued"), fakeAuthor)
+	}
+	waitFor(t, func() bool { return len(fs.Tweets()) == 0 })
+	time.Sleep(time.Millisecond * 20)
+	cancel()
+	select {
+	case <-stopped:
+		t.Fatal("Start returned before queued tweets were handled")
+	case <-time.After(time.Millisecond * 50):
+	}
+	close(release)
+	if err := <-stopped; err != context.Canceled {
+		t.Fatalf("Start returned %v", err)
+	}
+	if !fs.Closed() {
+		t.Fatal("stream not closed on shutdown")
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if fmt.Sprint(handled) != "[1 2 3]" {
+		t.Fatalf("handled %v", handled)
+	}
+	for _, err := range handlerErrs {
+		if err != nil {
+			t.Fatalf("handler context cancelled while draining: %v", err)
+		}
+	}
+}
+
+func TestStartDrainTimeout(t *testing.T) {
+	fake := twclient.NewFake()
+	fs := twclient.NewFakeStream()
+	fake.QueueStream(fs)
+	sub := newSubscriber(nil, fake)
+	sub.DrainTimeout = time.Millisecond * 20
+	cancelled := make(chan struct{})
+	sub.defaultHandler = func(ctx context.Context, event *TweetEvent) error {
+		<-ctx.Done()
+		close(cancelled)
+		return ctx.Err()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- sub.Start(ctx)
+	}()
+	fs.SendTweet(fakeTweet("1", "1", "never finishes"), fakeAuthor)
+	waitFor(t, func() bool { return len(fs.Tweets()) == 0 })
+	cancel()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("Start did not give up draining")
+	}
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Fatal("handler context not cancelled after the drain timeout")
+	}
+}
+
+func TestUnqueuedTweetNotSeen(t *testing.T) {
+	sub := newSubscriber(nil, twclient.NewFake())
+	//a queue of zero with no worker never takes the message
+	sub.pool = newWorkerPool(WorkerPoolConfig{Workers: 1}, func(ctx context.Context, msg *twclient.TweetMessage) {}, func(msg *twclient.TweetMessage) {})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	sub.processTweetMessage(ctx, queuedMessage("1", "1"))
+	if sub.seen.contains("1") {
+		t.Fatal("tweet that was not queued is marked seen")
+	}
+	if sub.seen.markSeen("1") {
+		t.Fatal("forgotten tweet reported as seen")
+	}
+}
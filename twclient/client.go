@@ -0,0 +1,53 @@
+package twclient
+
+import (
+	"context"
+	twitter "github.com/g8rswimmer/go-twitter/v2"
+	"net/http"
+	"time"
+)
+
+const DefaultHost = "https://api.twitter.com"
+
+// TweetStream is the filtered stream the subscriber consumes
+type TweetStream interface {
+	Tweets() <-chan *TweetMessage
+	SystemMessages() <-chan map[twitter.SystemMessageType]twitter.SystemMessage
+	Err() <-chan error
+	Connection() bool
+	//LastActivity is when anything, a heartbeat included, last arrived on the stream
+	LastActivity() time.Time
+	Close()
+}
+
+// Client covers the twitter v2 operations used by the oracle
+type Client interface {
+	TweetSearchStreamRules(ctx context.Context, ruleIDs []twitter.TweetSearchStreamRuleID) (*twitter.TweetSearchStreamRulesResponse, error)
+	TweetSearchStreamAddRule(ctx context.Context, rules []twitter.TweetSearchStreamRule, dryRun bool) (*twitter.TweetSearchStreamAddRuleResponse, error)
+	TweetSearchStreamDeleteRuleByID(ctx context.Context, ruleIDs []twitter.TweetSearchStreamRuleID, dryRun bool) (*twitter.TweetSearchStreamDeleteRuleResponse, error)
+	TweetSearchStream(ctx context.Context, opts twitter.TweetSearchStreamOpts) (TweetStream, error)
+	TweetLookup(ctx context.Context, ids []string, opts twitter.TweetLookupOpts) (*twitter.TweetLookupResponse, error)
+	TweetRecentSearch(ctx context.Context, query string, opts twitter.TweetRecentSearchOpts) (*twitter.TweetRecentSearchResponse, error)
+	QuoteTweetsLookup(ctx context.Context, tweetID string, opts twitter.QuoteTweetsLookupOpts) (*twitter.QuoteTweetsLookupResponse, error)
+}
+
+type apiClient struct {
+	*twitter.Client
+}
+
+// New returns a Client calling the twitter api at host with a bearer token
+func New(token string, host string) Client {
+	return NewWithHTTPClient(token, host, http.DefaultClient)
+}
+
+func NewWithHTTPClient(token string, host string, httpClient *http.Client) Client {
+	return &apiClient{
+		Client: &twitter.Client{
+			Authorizer: authorize{
+				Token: token,
+			},
+			Client: httpClient,
+			Host:   host,
+		},
+	}
+}
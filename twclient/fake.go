@@ -0,0 +1,474 @@
+package twclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	twitter "github.com/g8rswimmer/go-twitter/v2"
+	"math/big"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	NoFakeStreamError = errors.New("fake: no stream queued")
+)
+
+const fakeChanSize = 64
+
+// Call is one recorded invocation on Fake
+type Call struct {
+	Method string
+	Args   []interface{}
+}
+
+// Fake is an in-memory Client that records every call
+type Fake struct {
+	mutex      sync.Mutex
+	calls      []Call
+	errs       map[string][]error
+	rules      []*twitter.TweetSearchStreamRuleEntity
+	nextRuleId int
+	tweets     map[string]*twitter.TweetObj
+	users      map[string]*twitter.UserObj
+	search     map[string][]string
+	quotes     map[string][]string
+	streams    []*FakeStream
+}
+
+func NewFake() *Fake {
+	return &Fake{
+		errs:       make(map[string][]error),
+		nextRuleId: 1,
+		tweets:     make(map[string]*twitter.TweetObj),
+		users:      make(map[string]*twitter.UserObj),
+		search:     make(map[string][]string),
+		quotes:     make(map[string][]string),
+	}
+}
+
+// Calls returns a copy of the calls recorded so far
+func (f *Fake) Calls() []Call {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return append([]Call(nil), f.calls...)
+}
+
+// CallCount returns how many times method was called
+func (f *Fake) CallCount(method string) int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	count := 0
+	for _, c := range f.calls {
+		if c.Method == method {
+			count++
+		}
+	}
+	return count
+}
+
+// FailNext makes the next call to method return err, errors queue up in order
+func (f *Fake) FailNext(method string, err error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.errs[method] = append(f.errs[method], err)
+}
+
+func (f *Fake) AddUser(user *twitter.UserObj) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.users[user.ID] = user
+}
+
+func (f *Fake) User(id string) (*twitter.UserObj, bool) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	user, ok := f.users[id]
+	return user, ok
+}
+
+func (f *Fake) AddTweet(tweet *twitter.TweetObj) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.tweets[tweet.ID] = tweet
+}
+
+// AddSearchResult makes tweet a result of recent search for query, the tweet must be added with AddTweet
+func (f *Fake) AddSearchResult(query string, tweetId string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.search[query] = append(f.search[query], tweetId)
+}
+
+// AddQuote records quoteId as a quote tweet of tweetId, the quote must be added with AddTweet
+func (f *Fake) AddQuote(tweetId string, quoteId string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.quotes[tweetId] = append(f.quotes[tweetId], quoteId)
+}
+
+// QueueStream makes the next TweetSearchStream call return stream
+func (f *Fake) QueueStream(stream *FakeStream) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.streams = append(f.streams, stream)
+}
+
+func (f *Fake) Rules() []twitter.TweetSearchStreamRuleEntity {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	rules := make([]twitter.TweetSearchStreamRuleEntity, 0, len(f.rules))
+	for _, r := range f.rules {
+		rules = append(rules, *r)
+	}
+	return rules
+}
+
+func (f *Fake) record(method string, args ...interface{}) error {
+	f.calls = append(f.calls, Call{Method: method, Args: args})
+	if errs := f.errs[method]; len(errs) > 0 {
+		f.errs[method] = errs[1:]
+		return errs[0]
+	}
+	return nil
+}
+
+func (f *Fake) TweetSearchStreamRules(ctx context.Context, ruleIDs []twitter.TweetSearchStreamRuleID) (*twitter.TweetSearchStreamRulesResponse, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if err := f.record("TweetSearchStreamRules", ruleIDs); err != nil {
+		return nil, err
+	}
+	want := make(map[twitter.TweetSearchStreamRuleID]bool)
+	for _, id := range ruleIDs {
+		want[id] = true
+	}
+	resp := &twitter.TweetSearchStreamRulesResponse{
+		Meta: &twitter.TweetSearchStreamRuleMeta{Sent: time.Now()},
+	}
+	for _, r := range f.rules {
+		if len(want) == 0 || want[r.ID] {
+			rule := *r
+			resp.Rules = append(resp.Rules, &rule)
+		}
+	}
+	return resp, nil
+}
+
+func (f *Fake) TweetSearchStreamAddRule(ctx context.Context, rules []twitter.TweetSearchStreamRule, dryRun bool) (*twitter.TweetSearchStreamAddRuleResponse, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if err := f.record("TweetSearchStreamAddRule", rules, dryRun); err != nil {
+		return nil, err
+	}
+	resp := &twitter.TweetSearchStreamAddRuleResponse{
+		Meta: &twitter.TweetSearchStreamRuleMeta{Sent: time.Now()},
+	}
+	for _, rule := range rules {
+		if rule.Value == "" {
+			resp.Meta.Summary.NotCreated++
+			resp.Errors = append(resp.Errors, &twitter.ErrorObj{Title: "Invalid Rule", Detail: "empty rule value"})
+			continue
+		}
+		if f.hasRuleValue(rule.Value) {
+			resp.Meta.Summary.NotCreated++
+			resp.Errors = append(resp.Errors, &twitter.ErrorObj{Title: "DuplicateRule", Detail: "duplicate rule value " + rule.Value})
+			continue
+		}
+		entity := &twitter.TweetSearchStreamRuleEntity{
+			ID:                    twitter.TweetSearchStreamRuleID(strconv.Itoa(f.nextRuleId)),
+			TweetSearchStreamRule: rule,
+		}
+		f.nextRuleId++
+		if !dryRun {
+			f.rules = append(f.rules, entity)
+		}
+		resp.Rules = append(resp.Rules, entity)
+		resp.Meta.Summary.Created++
+	}
+	return resp, nil
+}
+
+func (f *Fake) hasRuleValue(value string) bool {
+	for _, r := range f.rules {
+		if r.Value == value {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *Fake) TweetSearchStreamDeleteRuleByID(ctx context.Context, ruleIDs []twitter.TweetSearchStreamRuleID, dryRun bool) (*twitter.TweetSearchStreamDeleteRuleResponse, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if err := f.record("TweetSearchStreamDeleteRuleByID", ruleIDs, dryRun); err != nil {
+		return nil, err
+	}
+	resp := &twitter.TweetSearchStreamDeleteRuleResponse{
+		Meta: &twitter.TweetSearchStreamRuleMeta{Sent: time.Now()},
+	}
+	del := make(map[twitter.TweetSearchStreamRuleID]bool)
+	for _, id := range ruleIDs {
+		del[id] = true
+	}
+	kept := make([]*twitter.TweetSearchStreamRuleEntity, 0, len(f.rules))
+	for _, r := range f.rules {
+		if del[r.ID] {
+			resp.Meta.Summary.Deleted++
+			delete(del, r.ID)
+			if dryRun {
+				kept = append(kept, r)
+			}
+			continue
+		}
+		kept = append(kept, r)
+	}
+	resp.Meta.Summary.NotDeleted = len(del)
+	f.rules = kept
+	return resp, nil
+}
+
+func (f *Fake) TweetSearchStream(ctx context.Context, opts twitter.TweetSearchStreamOpts) (TweetStream, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if err := f.record("TweetSearchStream", opts); err != nil {
+		return nil, err
+	}
+	if len(f.streams) == 0 {
+		return nil, NoFakeStreamError
+	}
+	stream := f.streams[0]
+	f.streams = f.streams[1:]
+	return stream, nil
+}
+
+func (f *Fake) TweetLookup(ctx context.Context, ids []string, opts twitter.TweetLookupOpts) (*twitter.TweetLookupResponse, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if err := f.record("TweetLookup", ids, opts); err != nil {
+		return nil, err
+	}
+	raw := f.raw(ids)
+	for _, id := range ids {
+		if _, ok := f.tweets[id]; !ok {
+			raw.Errors = append(raw.Errors, &twitter.ErrorObj{
+				Title:        "Not Found Error",
+				Detail:       fmt.Sprintf("Could not find tweet with ids: [%s].", id),
+				Type:         "https://api.twitter.com/2/problems/resource-not-found",
+				ResourceType: "tweet",
+				Parameter:    "ids",
+				Value:        id,
+			})
+		}
+	}
+	return &twitter.TweetLookupResponse{Raw: raw}, nil
+}
+
+func (f *Fake) TweetRecentSearch(ctx context.Context, query string, opts twitter.TweetRecentSearchOpts) (*twitter.TweetRecentSearchResponse, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if err := f.record("TweetRecentSearch", query, opts); err != nil {
+		return nil, err
+	}
+	ids := make([]string, 0)
+	for _, id := range newestFirst(f.search[query]) {
+		if opts.SinceID != "" && !idAfter(id, opts.SinceID) {
+			continue
+		}
+		if opts.UntilID != "" && !idAfter(opts.UntilID, id) {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	page, next, err := paginate(ids, opts.MaxResults, opts.NextToken)
+	if err != nil {
+		return nil, err
+	}
+	meta := &twitter.TweetRecentSearchMeta{ResultCount: len(page), NextToken: next}
+	if len(page) > 0 {
+		meta.NewestID = page[0]
+		meta.OldestID = page[len(page)-1]
+	}
+	return &twitter.TweetRecentSearchResponse{Raw: f.raw(page), Meta: meta}, nil
+}
+
+func (f *Fake) QuoteTweetsLookup(ctx context.Context, tweetID string, opts twitter.QuoteTweetsLookupOpts) (*twitter.QuoteTweetsLookupResponse, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if err := f.record("QuoteTweetsLookup", tweetID, opts); err != nil {
+		return nil, err
+	}
+	page, next, err := paginate(newestFirst(f.quotes[tweetID]), opts.MaxResults, opts.PaginationToken)
+	if err != nil {
+		return nil, err
+	}
+	return &twitter.QuoteTweetsLookupResponse{
+		Raw:  f.raw(page),
+		Meta: &twitter.QuoteTweetsLookupMeta{ResultCount: len(page), NextToken: next},
+	}, nil
+}
+
+// raw builds a response body for the known tweets in ids with their authors expanded
+func (f *Fake) raw(ids []string) *twitter.TweetRaw {
+	raw := &twitter.TweetRaw{
+		Tweets:   make([]*twitter.TweetObj, 0, len(ids)),
+		Includes: &twitter.TweetRawIncludes{},
+	}
+	seen := make(map[string]bool)
+	for _, id := range ids {
+		tweet, ok := f.tweets[id]
+		if !ok {
+			continue
+		}
+		raw.Tweets = append(raw.Tweets, tweet)
+		if user, ok := f.users[tweet.AuthorID]; ok && !seen[user.ID] {
+			seen[user.ID] = true
+			raw.Includes.Users = append(raw.Includes.Users, user)
+		}
+	}
+	return raw
+}
+
+func newestFirst(ids []string) []string {
+	sorted := append([]string(nil), ids...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return idAfter(sorted[i], sorted[j])
+	})
+	return sorted
+}
+
+// idAfter reports whether tweet id a is newer than b, ids are snowflakes so compare numerically
+func idAfter(a, b string) bool {
+	x, okX := new(big.Int).SetString(a, 10)
+	y, okY := new(big.Int).SetString(b, 10)
+	if !okX || !okY {
+		return a > b
+	}
+	return x.Cmp(y) > 0
+}
+
+func paginate(ids []string, maxResults int, token string) ([]string, string, error) {
+	if maxResults <= 0 {
+		maxResults = 10
+	}
+	offset := 0
+	if token != "" {
+		var err error
+		offset, err = strconv.Atoi(token)
+		if err != nil || offset < 0 || offset > len(ids) {
+			return nil, "", fmt.Errorf("fake: invalid pagination token %q", token)
+		}
+	}
+	end := offset + maxResults
+	if end >= len(ids) {
+		return ids[offset:], "", nil
+	}
+	return ids[offset:end], strconv.Itoa(end), nil
+}
+
+// FakeStream is a TweetStream whose messages and connection state are driven by the test
+type FakeStream struct {
+	tweets chan *TweetMessage
+	system chan map[twitter.SystemMessageType]twitter.SystemMessage
+	err    chan error
+	mutex  sync.RWMutex
+	alive  bool
+	closed bool
+	active time.Time
+}
+
+func NewFakeStream() *FakeStream {
+	return &FakeStream{
+		tweets: make(chan *TweetMessage, fakeChanSize),
+		system: make(chan map[twitter.SystemMessageType]twitter.SystemMessage, fakeChanSize),
+		err:    make(chan error, fakeChanSize),
+		alive:  true,
+		active: time.Now(),
+	}
+}
+
+// SendTweet delivers tweet with its included users as one stream message
+func (fs *FakeStream) SendTweet(tweet *twitter.TweetObj, users ...*twitter.UserObj) {
+	fs.SendMatching(tweet, nil, users...)
+}
+
+// SendMatching delivers tweet as matched by rules
+func (fs *FakeStream) SendMatching(tweet *twitter.TweetObj, rules []MatchingRule, users ...*twitter.UserObj) {
+	msg := &TweetMessage{
+		Raw: &twitter.TweetRaw{
+			Tweets:   []*twitter.TweetObj{tweet},
+			Includes: &twitter.TweetRawIncludes{Users: users},
+		},
+		MatchingRules: rules,
+	}
+	msg.Data, _ = EncodeTweetMessage(tweet, msg.Raw.Includes, rules)
+	fs.SendMessage(msg)
+}
+
+func (fs *FakeStream) SendMessage(msg *TweetMessage) {
+	fs.Heartbeat()
+	fs.tweets <- msg
+}
+
+func (fs *FakeStream) SendSystem(msgType twitter.SystemMessageType, message string) {
+	fs.Heartbeat()
+	fs.system <- map[twitter.SystemMessageType]twitter.SystemMessage{
+		msgType: {Message: message, Sent: time.Now()},
+	}
+}
+
+func (fs *FakeStream) SendErr(err error) {
+	fs.err <- err
+}
+
+// Heartbeat marks the stream active as a keep-alive line would, without delivering anything
+func (fs *FakeStream) Heartbeat() {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	fs.active = time.Now()
+}
+
+// Disconnect makes Connection report false as a lost keep-alive would
+func (fs *FakeStream) Disconnect() {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	fs.alive = false
+}
+
+func (fs *FakeStream) Closed() bool {
+	fs.mutex.RLock()
+	defer fs.mutex.RUnlock()
+	return fs.closed
+}
+
+func (fs *FakeStream) Tweets() <-chan *TweetMessage {
+	return fs.tweets
+}
+
+func (fs *FakeStream) SystemMessages() <-chan map[twitter.SystemMessageType]twitter.SystemMessage {
+	return fs.system
+}
+
+func (fs *FakeStream) Err() <-chan error {
+	return fs.err
+}
+
+func (fs *FakeStream) Connection() bool {
+	fs.mutex.RLock()
+	defer fs.mutex.RUnlock()
+	return fs.alive && !fs.closed
+}
+
+func (fs *FakeStream) LastActivity() time.Time {
+	fs.mutex.RLock()
+	defer fs.mutex.RUnlock()
+	return fs.active
+}
+
+func (fs *FakeStream) Close() {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	fs.closed = true
+}
@@ -0,0 +1,351 @@
+package twclient
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	twitter "github.com/g8rswimmer/go-twitter/v2"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	streamChanSize    = 64
+	maxStreamLineSize = 1024 * 1024
+)
+
+// MatchingRule is the filtered stream rule a tweet was delivered for
+type MatchingRule struct {
+	ID  string `json:"id"`
+	Tag string `json:"tag"`
+}
+
+// TweetMessage is one tweet of the filtered stream, unlike twitter.TweetMessage it keeps
+// the matching rules and the raw payload
+type TweetMessage struct {
+	Raw           *twitter.TweetRaw
+	MatchingRules []MatchingRule
+	Data          json.RawMessage
+}
+
+// streamProblem is an entry of a stream line carrying only errors, twitter v2 announces
+// operational disconnects and connection limits this way
+type streamProblem struct {
+	Title          string `json:"title"`
+	Detail         string `json:"detail"`
+	Type           string `json:"type"`
+	DisconnectType string `json:"disconnect_type"`
+}
+
+type streamLine struct {
+	Tweet         *twitter.TweetObj         `json:"data"`
+	Includes      *twitter.TweetRawIncludes `json:"includes,omitempty"`
+	Errors        []*twitter.ErrorObj       `json:"errors,omitempty"`
+	MatchingRules []MatchingRule            `json:"matching_rules,omitempty"`
+}
+
+// apiStream reads the filtered stream body, it never drops a tweet when the consumer is slow
+// and Close returns without waiting for the next heartbeat
+type apiStream struct {
+	tweets   chan *TweetMessage
+	system   chan map[twitter.SystemMessageType]twitter.SystemMessage
+	err      chan error
+	ctx      context.Context
+	cancel   context.CancelFunc
+	mutex    sync.RWMutex
+	alive    bool
+	lastData time.Time
+	//blocked is set while the consumer is too slow to take a message, the connection is not silent then
+	blocked bool
+}
+
+func (c *apiClient) TweetSearchStream(ctx context.Context, opts twitter.TweetSearchStreamOpts) (TweetStream, error) {
+	streamCtx, cancel := context.WithCancel(ctx)
+	req, err := http.NewRequestWithContext(streamCtx, http.MethodGet, c.Host+"/2/tweets/search/stream", nil)
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("tweet search stream request: %w", err)
+	}
+	req.Header.Add("Accept", "application/json")
+	c.Authorizer.Add(req)
+	req.URL.RawQuery = streamQuery(opts).Encode()
+
+	resp, err := c.Client.Client.Do(req)
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("tweet search stream response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer cancel()
+		defer resp.Body.Close()
+		rl := rateFromHeader(resp.Header)
+		e := &twitter.ErrorResponse{}
+		if err := json.NewDecoder(resp.Body).Decode(e); err != nil {
+			return nil, &twitter.HTTPError{
+				Status:     resp.Status,
+				StatusCode: resp.StatusCode,
+				URL:        resp.Request.URL.String(),
+				RateLimit:  rl,
+			}
+		}
+		e.StatusCode = resp.StatusCode
+		e.RateLimit = rl
+		return nil, e
+	}
+	return startStream(streamCtx, cancel, resp.Body), nil
+}
+
+func joinFields[T ~string](fields []T) string {
+	values := make([]string, len(fields))
+	for i, f := range fields {
+		values[i] = string(f)
+	}
+	return strings.Join(values, ",")
+}
+
+func streamQuery(opts twitter.TweetSearchStreamOpts) url.Values {
+	q := url.Values{}
+	fields := map[string]string{
+		"expansions":   joinFields(opts.Expansions),
+		"media.fields": joinFields(opts.MediaFields),
+		"place.fields": joinFields(opts.PlaceFields),
+		"poll.fields":  joinFields(opts.PollFields),
+		"tweet.fields": joinFields(opts.TweetFields),
+		"user.fields":  joinFields(opts.UserFields),
+	}
+	for key, value := range fields {
+		if value != "" {
+			q.Add(key, value)
+		}
+	}
+	if opts.BackfillMinutes > 0 {
+		q.Add("backfill_minutes", strconv.Itoa(opts.BackfillMinutes))
+	}
+	return q
+}
+
+func rateFromHeader(header http.Header) *twitter.RateLimit {
+	limit, err := strconv.Atoi(header.Get("x-rate-limit-limit"))
+	if err != nil {
+		return nil
+	}
+	remaining, err := strconv.Atoi(header.Get("x-rate-limit-remaining"))
+	if err != nil {
+		return nil
+	}
+	reset, err := strconv.Atoi(header.Get("x-rate-limit-reset"))
+	if err != nil {
+		return nil
+	}
+	return &twitter.RateLimit{Limit: limit, Remaining: remaining, Reset: twitter.Epoch(reset)}
+}
+
+func startStream(ctx context.Context, cancel context.CancelFunc, body io.ReadCloser) *apiStream {
+	s := &apiStream{
+		tweets:   make(chan *TweetMessage, streamChanSize),
+		system:   make(chan map[twitter.SystemMessageType]twitter.SystemMessage, streamChanSize),
+		err:      make(chan error, streamChanSize),
+		ctx:      ctx,
+		cancel:   cancel,
+		alive:    true,
+		lastData: time.Now(),
+	}
+	go s.read(body)
+	return s
+}
+
+func (s *apiStream) read(body io.ReadCloser) {
+	defer body.Close()
+	defer s.setAlive(false)
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxStreamLineSize)
+	scanner.Split(splitCRLF)
+	for scanner.Scan() {
+		s.mutex.Lock()
+		s.lastData = time.Now()
+		s.mutex.Unlock()
+
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			//heartbeat
+			continue
+		}
+		msg := make([]byte, len(line))
+		copy(msg, line)
+		s.decode(msg)
+	}
+	if err := scanner.Err(); err != nil && s.ctx.Err() == nil {
+		s.sendErr(&twitter.StreamError{Type: twitter.TweetErrorType, Msg: "read stream", Err: err})
+	}
+}
+
+func (s *apiStream) decode(msg []byte) {
+	keys := map[string]json.RawMessage{}
+	if err := json.Unmarshal(msg, &keys); err != nil {
+		s.sendErr(fmt.Errorf("stream error: unmarshal error %w", err))
+		return
+	}
+	if _, ok := keys["data"]; ok {
+		tweetMsg, err := DecodeTweetMessage(msg)
+		if err != nil {
+			s.sendErr(&twitter.StreamError{Type: twitter.TweetErrorType, Msg: "unmarshal tweet stream", Err: err})
+			return
+		}
+		select {
+		case s.tweets <- tweetMsg:
+			return
+		default:
+		}
+		s.setBlocked(true)
+		defer s.setBlocked(false)
+		select {
+		case s.tweets <- tweetMsg:
+		case <-s.ctx.Done():
+		}
+		return
+	}
+	var sysMsg map[twitter.SystemMessageType]twitter.SystemMessage
+	var err error
+	if problems, ok := keys["errors"]; ok {
+		sysMsg, err = problemMessage(problems)
+	} else {
+		err = json.Unmarshal(msg, &sysMsg)
+	}
+	if err != nil {
+		s.sendErr(&twitter.StreamError{Type: twitter.SystemErrorType, Msg: "unmarshal system stream", Err: err})
+		return
+	}
+	select {
+	case s.system <- sysMsg:
+		return
+	default:
+	}
+	s.setBlocked(true)
+	defer s.setBlocked(false)
+	select {
+	case s.system <- sysMsg:
+	case <-s.ctx.Done():
+	}
+}
+
+// setBlocked marks the reader waiting on the consumer, the stall timer restarts once it is taken
+func (s *apiStream) setBlocked(blocked bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.blocked = blocked
+	if !blocked {
+		s.lastData = time.Now()
+	}
+}
+
+// problemMessage turns an errors only line into an error system message "title: detail"
+func problemMessage(data json.RawMessage) (map[twitter.SystemMessageType]twitter.SystemMessage, error) {
+	var problems []streamProblem
+	if err := json.Unmarshal(data, &problems); err != nil {
+		return nil, err
+	}
+	var messages []string
+	for _, problem := range problems {
+		title := problem.Title
+		if problem.DisconnectType != "" {
+			title = title + " (" + problem.DisconnectType + ")"
+		}
+		messages = append(messages, title+": "+problem.Detail)
+	}
+	return map[twitter.SystemMessageType]twitter.SystemMessage{
+		twitter.ErrorMessageType: {Message: strings.Join(messages, "; "), Sent: time.Now().UTC()},
+	}, nil
+}
+
+// DecodeTweetMessage parses one filtered stream line
+func DecodeTweetMessage(msg []byte) (*TweetMessage, error) {
+	line := streamLine{}
+	if err := json.Unmarshal(msg, &line); err != nil {
+		return nil, err
+	}
+	if line.Tweet == nil {
+		return nil, errors.New("stream line without data")
+	}
+	return &TweetMessage{
+		Raw: &twitter.TweetRaw{
+			Tweets:   []*twitter.TweetObj{line.Tweet},
+			Includes: line.Includes,
+			Errors:   line.Errors,
+		},
+		MatchingRules: line.MatchingRules,
+		Data:          msg,
+	}, nil
+}
+
+// EncodeTweetMessage builds the filtered stream line of tweet, the inverse of DecodeTweetMessage
+func EncodeTweetMessage(tweet *twitter.TweetObj, includes *twitter.TweetRawIncludes, rules []MatchingRule) ([]byte, error) {
+	return json.Marshal(streamLine{Tweet: tweet, Includes: includes, MatchingRules: rules})
+}
+
+func (s *apiStream) sendErr(err error) {
+	select {
+	case s.err <- err:
+	default:
+	}
+}
+
+func (s *apiStream) setAlive(alive bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.alive = alive
+}
+
+func (s *apiStream) Tweets() <-chan *TweetMessage {
+	return s.tweets
+}
+
+func (s *apiStream) SystemMessages() <-chan map[twitter.SystemMessageType]twitter.SystemMessage {
+	return s.system
+}
+
+func (s *apiStream) Err() <-chan error {
+	return s.err
+}
+
+// Connection is false once the body ended, a silent stream is left to the caller's watchdog
+func (s *apiStream) Connection() bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.alive
+}
+
+// LastActivity is when the last line, heartbeats included, was read. While the consumer applies
+// backpressure the reader is not reading and it is now, a slow consumer is not a stalled stream
+func (s *apiStream) LastActivity() time.Time {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	if s.blocked {
+		return time.Now()
+	}
+	return s.lastData
+}
+
+func (s *apiStream) Close() {
+	s.cancel()
+}
+
+func splitCRLF(data []byte, atEOF bool) (int, []byte, error) {
+	if atEOF && len(data) == 0 {
+		return 0, nil, nil
+	}
+	if idx := bytes.Index(data, []byte("\r\n")); idx != -1 {
+		return idx + len("\r\n"), data[0:idx], nil
+	}
+	if atEOF {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}